@@ -0,0 +1,102 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errAMPDUConfig = errors.New("AMPDU window must be 1..64 and MPDUs 1..32")
+
+const (
+	defaultAMPDUMPDU = 4
+	maxAMPDUWsize    = 64
+	maxAMPDUMPDU     = 32
+)
+
+// AMPDUConfig configures 802.11n frame aggregation (AMPDU), see SetAMPDU.
+//
+// Aggregation trades chip RAM for throughput. Each frame in the receive
+// window occupies a firmware buffer until the window is complete, so large
+// windows suit streaming workloads (bulk TCP, audio) and small windows leave
+// RAM to the firmware and reduce reordering latency in request/response
+// workloads such as HTTP or MQTT. See PerformanceProfile for tuned presets.
+type AMPDUConfig struct {
+	// RxWindow is the receive block ack window size (ampdu_ba_wsize): how many
+	// frames the AP may send in an aggregate. Zero selects the default of 8.
+	RxWindow uint8
+	// TxMPDUs is the maximum amount of frames aggregated per transmitted AMPDU
+	// (ampdu_mpdu). Zero selects the default of 4.
+	TxMPDUs uint8
+	// Disable turns aggregation off in both directions (ampdu). Saves the most
+	// RAM at a severe throughput cost; some old APs misbehave with aggregation.
+	// The firmware only accepts the change while down so changing it takes
+	// the interface down and up, leaving the network joined, if any.
+	Disable bool
+}
+
+// SetAMPDU configures frame aggregation. The receive window is negotiated with
+// the AP when joining and takes effect on the next join.
+func (d *Device) SetAMPDU(cfg AMPDUConfig) error {
+	if cfg.RxWindow == 0 {
+		cfg.RxWindow = defaultAMPDUWsize
+	}
+	if cfg.TxMPDUs == 0 {
+		cfg.TxMPDUs = defaultAMPDUMPDU
+	}
+	if cfg.RxWindow > maxAMPDUWsize || cfg.TxMPDUs > maxAMPDUMPDU {
+		return errAMPDUConfig
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	return d.set_ampdu(cfg)
+}
+
+// AMPDU reads the aggregation configuration from the firmware.
+func (d *Device) AMPDU() (cfg AMPDUConfig, err error) {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return cfg, errDeviceNotInit
+	}
+	enabled, err := d.get_iovar("ampdu", whd.IF_STA)
+	if err != nil {
+		return cfg, err
+	}
+	mpdu, err := d.get_iovar("ampdu_mpdu", whd.IF_STA)
+	if err != nil {
+		return cfg, err
+	}
+	return AMPDUConfig{RxWindow: uint8(d.ampduWsize), TxMPDUs: uint8(mpdu), Disable: enabled == 0}, nil
+}
+
+func (d *Device) set_ampdu(cfg AMPDUConfig) error {
+	d.info("set_ampdu", slog.Int("wsize", int(cfg.RxWindow)), slog.Int("mpdu", int(cfg.TxMPDUs)), slog.Bool("disable", cfg.Disable))
+	err := d.set_iovar("ampdu_ba_wsize", whd.IF_STA, uint32(cfg.RxWindow))
+	if err != nil {
+		return err
+	}
+	err = d.set_iovar("ampdu_mpdu", whd.IF_STA, uint32(cfg.TxMPDUs))
+	if err != nil {
+		return err
+	}
+	d.ampduWsize = uint32(cfg.RxWindow)
+	if cfg.Disable == d.ampduDisabled {
+		return nil
+	}
+	// Setting ampdu while up fails with BCME_NOTDOWN.
+	err = d.doIoctlSet(whd.WLC_DOWN, whd.IF_STA, nil)
+	if err != nil {
+		return err
+	}
+	d.state = linkStateDown
+	err = d.set_iovar("ampdu", whd.IF_STA, b2u32(!cfg.Disable))
+	if err == nil {
+		d.ampduDisabled = cfg.Disable
+	}
+	return errjoin(err, d.doIoctlSet(whd.WLC_UP, whd.IF_STA, nil))
+}
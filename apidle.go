@@ -0,0 +1,66 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+var errAPIdleRange = errors.New("AP idle period out of range")
+
+// maxAPIdle is the longest idle period the firmware accepts, in seconds.
+const maxAPIdle = 1 << 16
+
+// APIdleConfig configures how the SoftAP ages out stations which stopped
+// communicating without disassociating, i.e: powered off or out of range,
+// see SetAPIdle. Stale stations take up a slot in the firmware's small
+// station table, limited further by APConfig.MaxClients, so a SoftAP used
+// for provisioning many devices in turn should age them out promptly.
+// Periods are rounded down to seconds. Zero fields keep the firmware's setting.
+type APIdleConfig struct {
+	// Timeout is the period of inactivity after which a station is
+	// disassociated. The firmware default is 60 seconds.
+	Timeout time.Duration
+	// ProbeAfter is the period of inactivity after which the AP starts
+	// probing the station with keepalive null data frames. A station
+	// answering probes is kept associated while idle.
+	ProbeAfter time.Duration
+	// MaxProbes is the amount of unanswered probes after which the station
+	// is disassociated.
+	MaxProbes uint8
+}
+
+// SetAPIdle sets the station inactivity timeout and keepalive probing of
+// the running SoftAP, see APIdleConfig. The settings are lost when the
+// SoftAP is stopped or the device reset.
+func (d *Device) SetAPIdle(cfg APIdleConfig) error {
+	if cfg.Timeout < 0 || cfg.Timeout >= maxAPIdle*time.Second ||
+		cfg.ProbeAfter < 0 || cfg.ProbeAfter >= maxAPIdle*time.Second {
+		return errAPIdleRange
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.apUp {
+		return errAPNotUp
+	}
+	// wl_scb_probe_t: scb_timeout, scb_activity_time and scb_max_probe.
+	var buf [12]byte
+	_, err := d.get_iovar_n("scb_probe", d.apIface, buf[:])
+	if err != nil {
+		return err
+	}
+	if cfg.Timeout != 0 {
+		_busOrder.PutUint32(buf[0:4], uint32(cfg.Timeout/time.Second))
+	}
+	if cfg.ProbeAfter != 0 {
+		_busOrder.PutUint32(buf[4:8], uint32(cfg.ProbeAfter/time.Second))
+	}
+	if cfg.MaxProbes != 0 {
+		_busOrder.PutUint32(buf[8:12], uint32(cfg.MaxProbes))
+	}
+	d.info("SetAPIdle", slog.Uint64("timeout", uint64(_busOrder.Uint32(buf[0:4]))),
+		slog.Uint64("activity", uint64(_busOrder.Uint32(buf[4:8]))),
+		slog.Uint64("maxprobe", uint64(_busOrder.Uint32(buf[8:12]))))
+	return d.set_iovar_n("scb_probe", d.apIface, buf[:])
+}
@@ -0,0 +1,244 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errIoctlBusy    = errors.New("async ioctl already in progress")
+	errIoctlPending = errors.New("async ioctl pending")
+	errIoctlTimeout = errors.New("async ioctl timeout")
+	errStaleHandle  = errors.New("stale async handle")
+	errScanPending  = errors.New("scan pending")
+)
+
+// IoctlRequest is an ioctl started with StartIoctl.
+type IoctlRequest struct {
+	Cmd   whd.SDPCMCommand
+	Iface whd.IoctlInterface
+	// Set selects a set ioctl, otherwise a get is sent.
+	Set bool
+	// Var is the name of the iovar of WLC_GET_VAR and WLC_SET_VAR requests.
+	Var string
+	// Data is the ioctl's data, sent after Var.
+	Data []byte
+	// Resp receives the response of get requests. The request is padded with
+	// zeros to the length of Resp to make room for the response, as the
+	// firmware responds in place. Resp must not be used until the ioctl completes.
+	Resp []byte
+}
+
+// asyncIoctl tracks the response of the ioctl started with StartIoctl.
+type asyncIoctl struct {
+	pending bool
+	// abandoned is set when the ioctl timed out; its response is discarded.
+	abandoned bool
+	id        uint16
+	seq       uint32
+	resp      []byte
+	n         int
+	err       error
+}
+
+// IoctlHandle is the completion handle of an ioctl started with StartIoctl.
+type IoctlHandle struct {
+	d   *Device
+	seq uint32
+}
+
+// StartIoctl sends an ioctl without waiting for its response so that long
+// running firmware operations do not hold the device lock: Poll, SendEth and
+// HCI traffic proceed while the firmware processes the request. The response is
+// received by Poll or any other device operation processing packets. Only one
+// async ioctl may be in progress; synchronous ioctls may be sent meanwhile.
+func (d *Device) StartIoctl(req IoctlRequest) (IoctlHandle, error) {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return IoctlHandle{}, errDeviceNotInit
+	} else if d.async.pending && !d.async.abandoned {
+		return IoctlHandle{}, errIoctlBusy
+	}
+	buf8 := u32AsU8(d._iovarBuf[:])
+	n := 0
+	if req.Var != "" {
+		if len(req.Var)+1 > len(buf8) {
+			return IoctlHandle{}, errIOVarTooLarge
+		}
+		n = copy(buf8, req.Var)
+		buf8[n] = 0
+		n++
+	}
+	length := max(n+len(req.Data), len(req.Resp))
+	if length > len(buf8) {
+		return IoctlHandle{}, errIOVarTooLarge
+	}
+	n += copy(buf8[n:], req.Data)
+	clear(buf8[n:length])
+
+	kind := uint8(ioctlGET)
+	if req.Set {
+		kind = ioctlSET
+	}
+	d.log_read()
+	err := d.waitForCredit(d._sendIoctlBuf[:])
+	if err != nil {
+		return IoctlHandle{}, err
+	}
+	err = d.sendIoctl(kind, req.Cmd, req.Iface, buf8[:length])
+	if err != nil {
+		return IoctlHandle{}, err
+	}
+	d.async = asyncIoctl{pending: true, id: d.ioctlID, seq: d.async.seq + 1, resp: req.Resp}
+	return IoctlHandle{d: d, seq: d.async.seq}, nil
+}
+
+// async_response handles the control packet payload if it is the response
+// of the async ioctl, returning true if so.
+func (d *Device) async_response(payload []byte) bool {
+	if !d.async.pending || len(payload) < whd.CDC_HEADER_LEN {
+		return false
+	}
+	hdr := whd.DecodeCDCHeader(_busOrder, payload)
+	if hdr.ID != d.async.id {
+		return false
+	}
+	d.async.pending = false
+	if hdr.Status != 0 {
+		d.logerr("async:ioctlerror", slog.Uint64("status", uint64(hdr.Status)))
+		d.async.err = errRxIoctlStatus
+	} else {
+		data := payload[whd.CDC_HEADER_LEN:]
+		d.async.n = copy(d.async.resp, data[:min(int(hdr.Length), len(data))])
+	}
+	d.async.resp = nil
+	return true
+}
+
+// Done returns true if the ioctl completed.
+func (h IoctlHandle) Done() bool {
+	_, err := h.Result()
+	return err != errIoctlPending
+}
+
+// Result returns the amount of response bytes written to the request's Resp
+// and the ioctl's error once the ioctl completes, errIoctlPending before.
+func (h IoctlHandle) Result() (int, error) {
+	h.d.lock()
+	defer h.d.unlock()
+	return h.result()
+}
+
+func (h IoctlHandle) result() (int, error) {
+	d := h.d
+	if d.async.seq != h.seq {
+		return 0, errStaleHandle
+	} else if d.async.abandoned {
+		return 0, errIoctlTimeout
+	} else if d.async.pending {
+		return 0, errIoctlPending
+	}
+	return d.async.n, d.async.err
+}
+
+// Wait polls the device until the ioctl completes or timeout elapses and
+// returns its result. The device lock is released between polls so other
+// users of the device proceed meanwhile. On timeout the ioctl is abandoned:
+// its late response is discarded and another async ioctl may be started.
+func (h IoctlHandle) Wait(timeout time.Duration) (int, error) {
+	d := h.d
+	d.lock()
+	defer d.unlock()
+	deadline := d.now().Add(timeout)
+	for {
+		n, err := h.result()
+		if err != errIoctlPending {
+			return n, err
+		} else if d.since(deadline) > 0 {
+			d.async.abandoned = true
+			d.async.resp = nil
+			return 0, errIoctlTimeout
+		}
+		err = d.check_status(d._sendIoctlBuf[:])
+		if err != nil {
+			return 0, err
+		}
+		d.unlock_sleep(time.Millisecond)
+	}
+}
+
+// ScanHandle is the completion handle of a scan started with StartScan.
+type ScanHandle struct {
+	d   *Device
+	seq uint32
+}
+
+// StartScan starts a scan without waiting for it to complete, unlike Scan.
+// fn is called for every BSS found as Poll, or any other device operation
+// processing packets, receives scan results.
+func (d *Device) StartScan(cfg ScanConfig, fn func(bss *whd.BSSInfo)) (ScanHandle, error) {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return ScanHandle{}, errDeviceNotInit
+	}
+	err := d.scan_start(cfg, fn)
+	if err != nil {
+		return ScanHandle{}, err
+	}
+	d.scanAsync = true
+	d.scanSeq++
+	return ScanHandle{d: d, seq: d.scanSeq}, nil
+}
+
+// Done returns true if the scan completed.
+func (h ScanHandle) Done() bool {
+	return h.Result() != errScanPending
+}
+
+// Result returns the result of the scan once completed, errScanPending before.
+func (h ScanHandle) Result() error {
+	h.d.lock()
+	defer h.d.unlock()
+	return h.result()
+}
+
+func (h ScanHandle) result() error {
+	d := h.d
+	if d.scanSeq != h.seq {
+		return errStaleHandle
+	} else if d.scanAsync {
+		return errScanPending
+	} else if !d.scanDone {
+		return errScanTimeout // Stopped by Wait.
+	}
+	return d.scan_result()
+}
+
+// Wait polls the device until the scan completes or timeout elapses and
+// returns its result. The device lock is released between polls. On timeout
+// no further results are passed to the callback.
+func (h ScanHandle) Wait(timeout time.Duration) error {
+	d := h.d
+	d.lock()
+	defer d.unlock()
+	deadline := d.now().Add(timeout)
+	for {
+		err := h.result()
+		if err != errScanPending {
+			return err
+		} else if d.since(deadline) > 0 {
+			d.scan_finish()
+			return errScanTimeout
+		}
+		err = d.check_status(d._sendIoctlBuf[:])
+		if err != nil {
+			return err
+		}
+		d.unlock_sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package cyw43439
+
+import (
+	"strconv"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+// Band is a set of WiFi frequency bands, see Device.SupportedBands.
+type Band uint8
+
+const (
+	Band2G4 Band = 1 << iota // 2.4GHz band, channels 1..14.
+	Band5G                   // 5GHz band, channels 36..165.
+)
+
+func (b Band) String() string {
+	switch b {
+	case Band2G4:
+		return "2.4GHz"
+	case Band5G:
+		return "5GHz"
+	case Band2G4 | Band5G:
+		return "2.4GHz+5GHz"
+	}
+	return "Band(" + strconv.Itoa(int(b)) + ")"
+}
+
+// Has returns true if all bands in band are in b.
+func (b Band) Has(band Band) bool { return band != 0 && b&band == band }
+
+// 20MHz channels of each band. Which of them may be used depends on the
+// country set in the firmware.
+var (
+	channels2G4 = [...]uint8{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+	channels5G  = [...]uint8{
+		36, 40, 44, 48, 52, 56, 60, 64, 100, 104, 108, 112, 116, 120, 124, 128,
+		132, 136, 140, 144, 149, 153, 157, 161, 165,
+	}
+)
+
+// ChannelError is returned when a channel is not supported by the chip,
+// either because it is not a valid channel or it lies in a band the chip does
+// not operate in, i.e: a 5GHz channel on the 2.4GHz only CYW43439.
+type ChannelError struct {
+	Channel uint8
+	// Band is the band of Channel, zero if Channel is not a valid channel.
+	Band Band
+}
+
+func (e *ChannelError) Error() string {
+	if e.Band == 0 {
+		return "invalid channel " + strconv.Itoa(int(e.Channel))
+	}
+	return "channel " + strconv.Itoa(int(e.Channel)) + " in unsupported " + e.Band.String() + " band"
+}
+
+// channelBand returns the band of the 20MHz channel ch, zero if ch is not a valid channel.
+func channelBand(ch uint8) Band {
+	if ch >= 1 && ch <= 14 {
+		return Band2G4
+	}
+	for _, c := range channels5G {
+		if c == ch {
+			return Band5G
+		}
+	}
+	return 0
+}
+
+// chanspec20 returns the chanspec of the 20MHz channel ch.
+func chanspec20(ch uint8) uint16 {
+	band := uint16(whd.CHANSPEC_BAND_2G)
+	if channelBand(ch) == Band5G {
+		band = whd.CHANSPEC_BAND_5G
+	}
+	return uint16(ch) | band | whd.CHANSPEC_BW_20
+}
+
+// SupportedBands returns the bands the detected chip operates in.
+// The CYW43439 and its siblings supported by the driver are 2.4GHz only.
+func (d *Device) SupportedBands() (Band, error) {
+	d.lock()
+	defer d.unlock()
+	if d.chip == nil {
+		return 0, errDeviceNotInit
+	}
+	return d.chip.bands, nil
+}
+
+// SupportedChannels appends the 20MHz channels of the bands the detected chip
+// operates in to dst. Whether a channel may be used also depends on the
+// regulatory rules of the country set in the firmware.
+func (d *Device) SupportedChannels(dst []uint8) ([]uint8, error) {
+	d.lock()
+	defer d.unlock()
+	if d.chip == nil {
+		return dst, errDeviceNotInit
+	}
+	if d.chip.bands.Has(Band2G4) {
+		dst = append(dst, channels2G4[:]...)
+	}
+	if d.chip.bands.Has(Band5G) {
+		dst = append(dst, channels5G[:]...)
+	}
+	return dst, nil
+}
+
+// check_channel returns a *ChannelError if ch is not supported by the chip.
+func (d *Device) check_channel(ch uint8) error {
+	bands := Band2G4 // Assume a CYW43439 before the chip is detected.
+	if d.chip != nil {
+		bands = d.chip.bands
+	}
+	band := channelBand(ch)
+	if !bands.Has(band) {
+		return &ChannelError{Channel: ch, Band: band}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package cyw43439
+
+import (
+	"net"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+const (
+	// apTableLen is the amount of APs whose join failures are tracked.
+	apTableLen = 8
+
+	defaultBlacklistFailures = 3
+	defaultBlacklistDuration = 5 * time.Minute
+)
+
+// APBlacklistConfig configures the blacklisting of access points which
+// repeatedly fail joins, see SetAPBlacklistConfig.
+type APBlacklistConfig struct {
+	// MaxFailures is the amount of consecutive join failures after which an
+	// AP is blacklisted. Zero disables blacklisting. Defaults to 3.
+	MaxFailures uint8
+	// Duration an AP stays blacklisted. Defaults to 5 minutes.
+	Duration time.Duration
+}
+
+// APBlacklistEntry is an access point with join failures, see APBlacklist.
+type APBlacklistEntry struct {
+	BSSID [6]byte
+	// Failures is the amount of consecutive join failures.
+	Failures uint8
+	// Remaining is the time left until the AP is no longer blacklisted, zero
+	// if it has not failed enough times to be blacklisted.
+	Remaining time.Duration
+}
+
+// apFailures tracks the join failures of an AP.
+type apFailures struct {
+	bssid    [6]byte
+	failures uint8
+	last     time.Time
+	until    time.Time
+}
+
+// SetAPBlacklistConfig configures AP blacklisting. In networks with several
+// access points sharing an SSID, such as mesh systems, a single misbehaving
+// node may keep rejecting the device. Join failures are tracked per BSSID,
+// for joins and for the firmware's reconnection attempts after a link loss,
+// and once an AP fails MaxFailures consecutive times JoinWPA2 and
+// JoinWithOptions join the strongest other AP of the network for Duration.
+// If no other AP is found the join proceeds as usual. Blacklisting is enabled
+// by default, see APBlacklistConfig.
+func (d *Device) SetAPBlacklistConfig(cfg APBlacklistConfig) {
+	d.lock()
+	defer d.unlock()
+	if cfg.Duration <= 0 {
+		cfg.Duration = defaultBlacklistDuration
+	}
+	d.apBlacklist = cfg
+}
+
+// APBlacklist appends the APs with join failures to dst, blacklisted or not.
+func (d *Device) APBlacklist(dst []APBlacklistEntry) []APBlacklistEntry {
+	d.lock()
+	defer d.unlock()
+	for i := range d.apTable {
+		ap := &d.apTable[i]
+		if ap.failures == 0 {
+			continue
+		}
+		dst = append(dst, APBlacklistEntry{
+			BSSID:     ap.bssid,
+			Failures:  ap.failures,
+			Remaining: max(-d.since(ap.until), 0),
+		})
+	}
+	return dst
+}
+
+// ClearAPBlacklist forgets all AP join failures, i.e: after fixing the network.
+func (d *Device) ClearAPBlacklist() {
+	d.lock()
+	defer d.unlock()
+	d.apTable = [apTableLen]apFailures{}
+}
+
+// blacklist_event tracks the AP rejecting the device from join related events.
+func (d *Device) blacklist_event(msg *whd.EventMessage) {
+	if d.apBlacklist.MaxFailures == 0 || msg.Addr == [6]byte{} {
+		return
+	}
+	failed := false
+	switch msg.EventType {
+	case whd.EvAUTH, whd.EvASSOC, whd.EvREASSOC:
+		failed = msg.Status != whd.CYW43_STATUS_SUCCESS && msg.Status != whd.CYW43_STATUS_UNSOLICITED
+	case whd.EvDEAUTH_IND, whd.EvDISASSOC_IND:
+		failed = d.state != linkStateUp
+	case whd.EvSET_SSID:
+		if msg.Status == whd.CYW43_STATUS_SUCCESS {
+			d.blacklist_clear(msg.Addr)
+		}
+	}
+	if !failed {
+		return
+	}
+	if d.state == linkStateWaitForReconnect {
+		// Firmware reconnection attempt, not waited on by a join.
+		d.blacklist_fail(msg.Addr)
+	} else {
+		d.apRejected = msg.Addr
+	}
+}
+
+// blacklist_fail counts a join failure of bssid.
+func (d *Device) blacklist_fail(bssid [6]byte) {
+	if d.apBlacklist.MaxFailures == 0 || bssid == [6]byte{} {
+		return
+	}
+	ap := d.blacklist_find(bssid)
+	if ap == nil {
+		// Replace the least recently failed AP.
+		ap = &d.apTable[0]
+		for i := range d.apTable {
+			if d.apTable[i].last.Before(ap.last) {
+				ap = &d.apTable[i]
+			}
+		}
+		*ap = apFailures{bssid: bssid}
+	}
+	ap.failures = min(ap.failures, 254) + 1
+	ap.last = d.now()
+	if ap.failures >= d.apBlacklist.MaxFailures {
+		ap.until = ap.last.Add(d.apBlacklist.Duration)
+		d.warn("blacklist", slog.String("bssid", net.HardwareAddr(bssid[:]).String()), slog.Int("failures", int(ap.failures)))
+	}
+}
+
+// blacklist_clear forgets the failures of bssid after a successful join.
+func (d *Device) blacklist_clear(bssid [6]byte) {
+	if ap := d.blacklist_find(bssid); ap != nil {
+		*ap = apFailures{}
+	}
+}
+
+func (d *Device) blacklist_find(bssid [6]byte) *apFailures {
+	for i := range d.apTable {
+		if d.apTable[i].failures > 0 && d.apTable[i].bssid == bssid {
+			return &d.apTable[i]
+		}
+	}
+	return nil
+}
+
+// blacklisted reports whether bssid is blacklisted.
+func (d *Device) blacklisted(bssid [6]byte) bool {
+	ap := d.blacklist_find(bssid)
+	return ap != nil && !ap.until.IsZero() && d.since(ap.until) < 0
+}
+
+// blacklist_candidate returns the strongest AP of ssid which is not
+// blacklisted. ok is false if no AP is blacklisted or no other AP was found.
+func (d *Device) blacklist_candidate(ssid string) (bssid [6]byte, ok bool) {
+	active := false
+	for i := range d.apTable {
+		active = active || d.blacklisted(d.apTable[i].bssid)
+	}
+	if !active || d.apBlacklist.MaxFailures == 0 {
+		return bssid, false
+	}
+	bestRSSI := int16(-1 << 15)
+	err := d.scan(ScanConfig{SSID: ssid}, func(bss *whd.BSSInfo) {
+		if string(bss.SSIDBytes()) != ssid || d.blacklisted(bss.BSSID) {
+			return
+		}
+		if bss.RSSI > bestRSSI {
+			bestRSSI = bss.RSSI
+			bssid = bss.BSSID
+			ok = true
+		}
+	})
+	if err != nil {
+		d.logerr("blacklist_candidate", slog.String("err", err.Error()))
+		return bssid, false
+	}
+	d.info("blacklist_candidate", slog.String("bssid", net.HardwareAddr(bssid[:]).String()), slog.Bool("found", ok))
+	return bssid, ok
+}
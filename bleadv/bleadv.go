@@ -0,0 +1,225 @@
+// Package bleadv broadcasts Bluetooth Low Energy advertisements, such as
+// iBeacon and Eddystone beacons, with the CYW43439's Bluetooth controller
+// without a BLE stack:
+//
+//	adv, err := bleadv.New(dev, bleadv.Config{Interval: 200 * time.Millisecond})
+//	data, err := bleadv.IBeacon(nil, uuid, 1, 2, -59)
+//	err = adv.Start(data)
+//
+// Advertisements are non-connectable. The advertiser drives the HCI transport
+// directly so it must not be used alongside a BLE stack. The Device must have
+// Bluetooth enabled, i.e: initialized with cyw43439.DefaultBluetoothConfig.
+package bleadv
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439"
+)
+
+// HCI packet types (H4 format).
+const (
+	hciCommandPkt = 0x01
+	hciEventPkt   = 0x04
+)
+
+// HCI command opcodes and events.
+const (
+	hciOpReset          = 0x0c03
+	hciOpLESetAdvParams = 0x2006
+	hciOpLESetAdvData   = 0x2008
+	hciOpLESetScanRsp   = 0x2009
+	hciOpLESetAdvEnable = 0x200a
+	hciEvCmdComplete    = 0x0e
+	hciEvCmdStatus      = 0x0f
+)
+
+// Advertising PDU types.
+const (
+	advScanInd    = 0x02
+	advNonconnInd = 0x03
+)
+
+const (
+	// MaxDataLen is the length of the largest legacy advertising and scan response data.
+	MaxDataLen = 31
+
+	defaultInterval = 100 * time.Millisecond
+	// Advertising intervals are in units of 0.625ms.
+	intervalUnit = 625 * time.Microsecond
+	minInterval  = 0x00a0 * intervalUnit // Non-connectable minimum, 100ms.
+	maxInterval  = 0x4000 * intervalUnit
+	cmdTimeout   = time.Second
+)
+
+var (
+	errCmdTimeout     = errors.New("bleadv: HCI command timeout")
+	errCmdFailed      = errors.New("bleadv: HCI command failed")
+	errDataTooLong    = errors.New("bleadv: advertising data too long")
+	errBadInterval    = errors.New("bleadv: advertising interval out of range")
+	errBadURLScheme   = errors.New("bleadv: URL scheme not http or https")
+	errNotAdvertising = errors.New("bleadv: not advertising")
+)
+
+// Config configures the advertiser.
+type Config struct {
+	// Interval between advertisements, 100ms to 10.24s. Defaults to 100ms.
+	Interval time.Duration
+	// ScanResponse is the data sent to scanners requesting it, such as the
+	// local name, see AppendName. Empty disables scan responses.
+	ScanResponse []byte
+}
+
+// Advertiser broadcasts advertisements with the Bluetooth controller of a Device.
+type Advertiser struct {
+	dev         *cyw43439.Device
+	cfg         Config
+	reset       bool
+	advertising bool
+	txbuf       [4 + 1 + MaxDataLen]byte
+	rxbuf       [260]byte
+}
+
+// New returns an Advertiser which uses the Bluetooth controller of dev.
+func New(dev *cyw43439.Device, cfg Config) (*Advertiser, error) {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.Interval < minInterval || cfg.Interval > maxInterval {
+		return nil, errBadInterval
+	} else if len(cfg.ScanResponse) > MaxDataLen {
+		return nil, errDataTooLong
+	}
+	return &Advertiser{dev: dev, cfg: cfg}, nil
+}
+
+// Start configures the controller and starts advertising data, which is built
+// with the helpers of this package such as IBeacon. The controller is reset
+// the first time Start is called. Calling Start while advertising updates the data.
+func (a *Advertiser) Start(data []byte) error {
+	if len(data) > MaxDataLen {
+		return errDataTooLong
+	} else if a.advertising {
+		return a.SetData(data)
+	}
+	if !a.reset {
+		err := a.command(hciOpReset)
+		if err != nil {
+			return err
+		}
+		a.reset = true
+	}
+	var params [15]byte
+	interval := uint16(a.cfg.Interval / intervalUnit)
+	binary.LittleEndian.PutUint16(params[0:], interval) // Min interval.
+	binary.LittleEndian.PutUint16(params[2:], interval) // Max interval.
+	params[4] = advNonconnInd
+	if len(a.cfg.ScanResponse) > 0 {
+		params[4] = advScanInd
+	}
+	params[13] = 0x07 // All advertising channels.
+	err := a.command(hciOpLESetAdvParams, params[:]...)
+	if err != nil {
+		return err
+	}
+	err = a.setData(hciOpLESetAdvData, data)
+	if err != nil {
+		return err
+	}
+	if len(a.cfg.ScanResponse) > 0 {
+		err = a.setData(hciOpLESetScanRsp, a.cfg.ScanResponse)
+		if err != nil {
+			return err
+		}
+	}
+	err = a.command(hciOpLESetAdvEnable, 1)
+	if err != nil {
+		return err
+	}
+	a.advertising = true
+	return nil
+}
+
+// SetData updates the advertised data while advertising, i.e: to broadcast
+// a new sensor reading.
+func (a *Advertiser) SetData(data []byte) error {
+	if !a.advertising {
+		return errNotAdvertising
+	} else if len(data) > MaxDataLen {
+		return errDataTooLong
+	}
+	return a.setData(hciOpLESetAdvData, data)
+}
+
+// Stop stops advertising.
+func (a *Advertiser) Stop() error {
+	if !a.advertising {
+		return nil
+	}
+	err := a.command(hciOpLESetAdvEnable, 0)
+	if err != nil {
+		return err
+	}
+	a.advertising = false
+	return nil
+}
+
+func (a *Advertiser) setData(op uint16, data []byte) error {
+	var params [1 + MaxDataLen]byte
+	params[0] = byte(len(data))
+	copy(params[1:], data)
+	return a.command(op, params[:]...)
+}
+
+// command sends an HCI command and waits for its completion. Other packets
+// received in the meantime are discarded.
+func (a *Advertiser) command(op uint16, params ...byte) error {
+	pkt := a.txbuf[:4+len(params)]
+	pkt[0] = hciCommandPkt
+	binary.LittleEndian.PutUint16(pkt[1:], op)
+	pkt[3] = byte(len(params))
+	copy(pkt[4:], params)
+	_, err := a.dev.WriteHCI(pkt)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(cmdTimeout)
+	for time.Since(deadline) < 0 {
+		n, err := a.dev.BufferedHCI()
+		if err != nil {
+			return err
+		} else if n == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		n, err = a.dev.ReadHCI(a.rxbuf[:])
+		if err != nil {
+			return err
+		}
+		if status, ok := cmdResult(op, a.rxbuf[:n]); ok {
+			if status != 0 {
+				return errCmdFailed
+			}
+			return nil
+		}
+	}
+	return errCmdTimeout
+}
+
+// cmdResult returns the status of the command op if pkt is its Command
+// Complete or Command Status event.
+func cmdResult(op uint16, pkt []byte) (status byte, ok bool) {
+	if len(pkt) < 3 || pkt[0] != hciEventPkt {
+		return 0, false
+	}
+	code, params := pkt[1], pkt[3:]
+	switch {
+	case code == hciEvCmdComplete && len(params) >= 4 && binary.LittleEndian.Uint16(params[1:]) == op:
+		return params[3], true
+	case code == hciEvCmdStatus && len(params) >= 4 && binary.LittleEndian.Uint16(params[2:]) == op:
+		return params[0], true
+	}
+	return 0, false
+}
@@ -0,0 +1,142 @@
+package bleadv
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Advertising data types.
+const (
+	TypeFlags            = 0x01
+	TypeComplete16UUIDs  = 0x03
+	TypeShortName        = 0x08
+	TypeCompleteName     = 0x09
+	TypeTxPower          = 0x0a
+	TypeServiceData16    = 0x16
+	TypeManufacturerData = 0xff
+)
+
+// FlagsBeacon are the flags of a beacon: LE General Discoverable, BR/EDR not supported.
+const FlagsBeacon = 0x06
+
+const (
+	appleCompanyID = 0x004c
+	eddystoneUUID  = 0xfeaa
+	// Eddystone frame types.
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+	// maxEddystoneURL is the length of the longest encoded Eddystone URL.
+	maxEddystoneURL = 17
+)
+
+// AppendField appends an advertising data field of type typ to dst.
+func AppendField(dst []byte, typ byte, data []byte) []byte {
+	dst = append(dst, byte(1+len(data)), typ)
+	return append(dst, data...)
+}
+
+// AppendFlags appends a flags field to dst.
+func AppendFlags(dst []byte, flags byte) []byte {
+	return append(dst, 2, TypeFlags, flags)
+}
+
+// AppendName appends a complete local name field to dst, typically used as scan response.
+func AppendName(dst []byte, name string) []byte {
+	dst = append(dst, byte(1+len(name)), TypeCompleteName)
+	return append(dst, name...)
+}
+
+// IBeacon appends the advertising data of an iBeacon to dst. txPower is the
+// calibrated RSSI in dBm measured at 1 meter.
+func IBeacon(dst []byte, uuid [16]byte, major, minor uint16, txPower int8) ([]byte, error) {
+	dst = AppendFlags(dst, FlagsBeacon)
+	dst = append(dst, 26, TypeManufacturerData)
+	dst = binary.LittleEndian.AppendUint16(dst, appleCompanyID)
+	dst = append(dst, 0x02, 0x15) // iBeacon type and length.
+	dst = append(dst, uuid[:]...)
+	dst = binary.BigEndian.AppendUint16(dst, major)
+	dst = binary.BigEndian.AppendUint16(dst, minor)
+	dst = append(dst, byte(txPower))
+	return dst, checkLen(dst)
+}
+
+// EddystoneUID appends the advertising data of an Eddystone-UID beacon to dst.
+// txPower is the calibrated RSSI in dBm measured at 0 meters.
+func EddystoneUID(dst []byte, namespace [10]byte, instance [6]byte, txPower int8) ([]byte, error) {
+	dst = appendEddystone(dst, 20)
+	dst = append(dst, eddystoneUID, byte(txPower))
+	dst = append(dst, namespace[:]...)
+	dst = append(dst, instance[:]...)
+	dst = append(dst, 0, 0) // Reserved.
+	return dst, checkLen(dst)
+}
+
+// EddystoneURL appends the advertising data of an Eddystone-URL beacon to dst.
+// The URL must start with http:// or https:// and is compressed with the
+// Eddystone encoding, which must fit in 17 bytes.
+// txPower is the calibrated RSSI in dBm measured at 0 meters.
+func EddystoneURL(dst []byte, url string, txPower int8) ([]byte, error) {
+	var enc [maxEddystoneURL + 1]byte
+	scheme := -1
+	for i, prefix := range urlSchemes {
+		if strings.HasPrefix(url, prefix) {
+			scheme, url = i, url[len(prefix):]
+			break
+		}
+	}
+	if scheme < 0 {
+		return dst, errBadURLScheme
+	}
+	enc[0] = byte(scheme)
+	n := 1
+	for len(url) > 0 && n < len(enc) {
+		code := -1
+		for i, exp := range urlExpansions {
+			if strings.HasPrefix(url, exp) {
+				code = i
+				break
+			}
+		}
+		if code >= 0 {
+			enc[n] = byte(code)
+			url = url[len(urlExpansions[code]):]
+		} else {
+			enc[n] = url[0]
+			url = url[1:]
+		}
+		n++
+	}
+	if len(url) > 0 {
+		return dst, errDataTooLong
+	}
+	dst = appendEddystone(dst, 2+n)
+	dst = append(dst, eddystoneURL, byte(txPower))
+	dst = append(dst, enc[:n]...)
+	return dst, checkLen(dst)
+}
+
+// appendEddystone appends the flags, service UUID and header of the service
+// data of an Eddystone frame of frameLen bytes.
+func appendEddystone(dst []byte, frameLen int) []byte {
+	dst = AppendFlags(dst, FlagsBeacon)
+	dst = append(dst, 3, TypeComplete16UUIDs)
+	dst = binary.LittleEndian.AppendUint16(dst, eddystoneUUID)
+	dst = append(dst, byte(3+frameLen), TypeServiceData16)
+	return binary.LittleEndian.AppendUint16(dst, eddystoneUUID)
+}
+
+func checkLen(data []byte) error {
+	if len(data) > MaxDataLen {
+		return errDataTooLong
+	}
+	return nil
+}
+
+var urlSchemes = [...]string{"http://www.", "https://www.", "http://", "https://"}
+
+// urlExpansions are indexed by their Eddystone-URL code. Expansions with a
+// trailing slash come first so they are preferred.
+var urlExpansions = [...]string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
@@ -0,0 +1,51 @@
+package bleadv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIBeacon(t *testing.T) {
+	uuid := [16]byte{0xe2, 0xc5, 0x6d, 0xb5, 0xdf, 0xfb, 0x48, 0xd2, 0xb0, 0x60, 0xd0, 0xf5, 0xa7, 0x10, 0x96, 0xe0}
+	got, err := IBeacon(nil, uuid, 1, 0x0203, -59)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{2, 0x01, 0x06, 26, 0xff, 0x4c, 0x00, 0x02, 0x15}, uuid[:]...)
+	want = append(want, 0, 1, 2, 3, 0xc5)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestEddystone(t *testing.T) {
+	got, err := EddystoneURL(nil, "https://www.example.com/", -20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{2, 0x01, 0x06, 3, 0x03, 0xaa, 0xfe, 14, 0x16, 0xaa, 0xfe, 0x10, 0xec, 0x01}
+	want = append(append(want, "example"...), 0x00)
+	if !bytes.Equal(got, want) {
+		t.Errorf("URL: got %x, want %x", got, want)
+	}
+	if _, err := EddystoneURL(nil, "ftp://example.com", 0); err != errBadURLScheme {
+		t.Error("want bad scheme error, got", err)
+	}
+	if _, err := EddystoneURL(nil, "http://a-very-long-example.org/", 0); err != errDataTooLong {
+		t.Error("want too long error, got", err)
+	}
+	uid, err := EddystoneUID(nil, [10]byte{1}, [6]byte{2}, -20)
+	if err != nil || len(uid) != MaxDataLen || uid[7] != 23 || uid[11] != eddystoneUID {
+		t.Errorf("UID: got %x, %v", uid, err)
+	}
+}
+
+func TestNewInterval(t *testing.T) {
+	if _, err := New(nil, Config{Interval: 20 * 625000}); err != errBadInterval {
+		t.Error("want bad interval error, got", err)
+	}
+	a, err := New(nil, Config{})
+	if err != nil || a.cfg.Interval != defaultInterval {
+		t.Fatal(a, err)
+	}
+}
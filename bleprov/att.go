@@ -0,0 +1,407 @@
+package bleprov
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// UUIDs of the provisioning GATT service and its characteristics.
+const (
+	// ServiceUUID is advertised so that provisioning apps can filter for the device.
+	ServiceUUID = "cf4b0001-0c8e-4a9b-9d5e-43439bf0a000"
+	// SSIDUUID is a write-only characteristic holding the network SSID (1..32 bytes).
+	SSIDUUID = "cf4b0002-0c8e-4a9b-9d5e-43439bf0a000"
+	// PassphraseUUID is a write-only characteristic holding the network passphrase (0..64 bytes).
+	// An empty passphrase joins an open network.
+	PassphraseUUID = "cf4b0003-0c8e-4a9b-9d5e-43439bf0a000"
+	// ControlUUID is a write-only characteristic. Writing ControlJoin starts the join.
+	ControlUUID = "cf4b0004-0c8e-4a9b-9d5e-43439bf0a000"
+	// StatusUUID is a read-only characteristic holding the provisioning status. See StatusIdle.
+	StatusUUID = "cf4b0005-0c8e-4a9b-9d5e-43439bf0a000"
+)
+
+// ControlJoin is written to the control characteristic to join the network
+// with the SSID and passphrase written previously.
+const ControlJoin = 0x01
+
+// Provisioning status values readable from the status characteristic.
+const (
+	StatusIdle uint8 = iota
+	StatusJoining
+	StatusJoined
+	StatusFailed
+)
+
+// ATT opcodes.
+const (
+	attOpError           = 0x01
+	attOpMTUReq          = 0x02
+	attOpMTURsp          = 0x03
+	attOpFindInfoReq     = 0x04
+	attOpFindInfoRsp     = 0x05
+	attOpReadByTypeReq   = 0x08
+	attOpReadByTypeRsp   = 0x09
+	attOpReadReq         = 0x0a
+	attOpReadRsp         = 0x0b
+	attOpReadByGroupReq  = 0x10
+	attOpReadByGroupRsp  = 0x11
+	attOpWriteReq        = 0x12
+	attOpWriteRsp        = 0x13
+	attOpPrepareWriteReq = 0x16
+	attOpPrepareWriteRsp = 0x17
+	attOpExecuteWriteReq = 0x18
+	attOpExecuteWriteRsp = 0x19
+	attOpWriteCmd        = 0x52
+)
+
+// ATT error codes.
+const (
+	attErrInvalidHandle        = 0x01
+	attErrReadNotPermitted     = 0x02
+	attErrWriteNotPermitted    = 0x03
+	attErrInvalidPDU           = 0x04
+	attErrRequestNotSupported  = 0x06
+	attErrInvalidOffset        = 0x07
+	attErrPrepareQueueFull     = 0x09
+	attErrAttrNotFound         = 0x0a
+	attErrInvalidAttrValueLen  = 0x0d
+	attErrUnsupportedGroupType = 0x10
+)
+
+const (
+	uuidPrimaryService = 0x2800
+	uuidCharacteristic = 0x2803
+
+	propRead        = 0x02
+	propWriteNoResp = 0x04
+	propWrite       = 0x08
+)
+
+// Attribute handles of the provisioning service.
+const (
+	hService = iota + 1
+	hSSIDDecl
+	hSSID
+	hPassDecl
+	hPass
+	hCtlDecl
+	hCtl
+	hStatusDecl
+	hStatus
+	hLast = hStatus
+)
+
+const (
+	attDefaultMTU = 23
+	// attServerMTU is the maximum ATT MTU we accept, limited by L2CAP reassembly buffer size.
+	attServerMTU = 128
+)
+
+var (
+	uuidService    = parseUUID(ServiceUUID)
+	uuidSSID       = parseUUID(SSIDUUID)
+	uuidPassphrase = parseUUID(PassphraseUUID)
+	uuidControl    = parseUUID(ControlUUID)
+	uuidStatus     = parseUUID(StatusUUID)
+)
+
+// parseUUID parses a 128 bit UUID string into its little-endian wire representation.
+func parseUUID(s string) (uuid [16]byte) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("bad uuid " + s)
+	}
+	for i := range uuid {
+		uuid[i] = b[15-i]
+	}
+	return uuid
+}
+
+// attServer is a minimal ATT server exposing the provisioning service.
+type attServer struct {
+	mtu     uint16
+	ssid    [32]byte
+	ssidLen uint8
+	pass    [64]byte
+	passLen uint8
+	status  uint8
+	// joinRequested is set when ControlJoin is written.
+	joinRequested bool
+	// Prepared write queue. Only supports a single attribute.
+	prepHandle uint16
+	prepBuf    [64]byte
+	prepLen    uint8
+}
+
+func (s *attServer) reset() {
+	*s = attServer{status: s.status, mtu: attDefaultMTU}
+}
+
+// attrType returns the 16 bit type of the attribute, or the 128 bit type if uuid16 is zero.
+func attrType(h uint16) (uuid16 uint16, uuid128 *[16]byte) {
+	switch h {
+	case hService:
+		return uuidPrimaryService, nil
+	case hSSIDDecl, hPassDecl, hCtlDecl, hStatusDecl:
+		return uuidCharacteristic, nil
+	case hSSID:
+		return 0, &uuidSSID
+	case hPass:
+		return 0, &uuidPassphrase
+	case hCtl:
+		return 0, &uuidControl
+	case hStatus:
+		return 0, &uuidStatus
+	}
+	return 0, nil
+}
+
+// readAttr puts the value of attribute h in dst and returns its length or an ATT error code.
+func (s *attServer) readAttr(h uint16, dst []byte) (n int, ecode uint8) {
+	var decl = func(props uint8, uuid *[16]byte) int {
+		dst[0] = props
+		binary.LittleEndian.PutUint16(dst[1:], h+1)
+		return 3 + copy(dst[3:], uuid[:])
+	}
+	var buf [19]byte
+	switch h {
+	case hService:
+		n = copy(buf[:], uuidService[:])
+	case hSSIDDecl:
+		n = decl(propWrite|propWriteNoResp, &uuidSSID)
+		return n, 0
+	case hPassDecl:
+		n = decl(propWrite|propWriteNoResp, &uuidPassphrase)
+		return n, 0
+	case hCtlDecl:
+		n = decl(propWrite, &uuidControl)
+		return n, 0
+	case hStatusDecl:
+		n = decl(propRead, &uuidStatus)
+		return n, 0
+	case hStatus:
+		buf[0] = s.status
+		n = 1
+	case hSSID, hPass, hCtl:
+		return 0, attErrReadNotPermitted
+	default:
+		return 0, attErrInvalidHandle
+	}
+	return copy(dst, buf[:n]), 0
+}
+
+func (s *attServer) writeAttr(h uint16, value []byte) (ecode uint8) {
+	switch h {
+	case hSSID:
+		if len(value) == 0 || len(value) > len(s.ssid) {
+			return attErrInvalidAttrValueLen
+		}
+		s.ssidLen = uint8(copy(s.ssid[:], value))
+	case hPass:
+		if len(value) > len(s.pass) {
+			return attErrInvalidAttrValueLen
+		}
+		s.passLen = uint8(copy(s.pass[:], value))
+	case hCtl:
+		if len(value) != 1 {
+			return attErrInvalidAttrValueLen
+		}
+		if value[0] == ControlJoin && s.status != StatusJoining {
+			s.joinRequested = true
+		}
+	case 0:
+		return attErrInvalidHandle
+	default:
+		if h > hLast {
+			return attErrInvalidHandle
+		}
+		return attErrWriteNotPermitted
+	}
+	return 0
+}
+
+// handle processes an ATT request and writes the response to rsp.
+// It returns the length of the response, which is zero for commands.
+// rsp must be at least attServerMTU bytes long.
+func (s *attServer) handle(req, rsp []byte) int {
+	if len(req) == 0 {
+		return 0
+	}
+	op := req[0]
+	rsp = rsp[:s.mtu]
+	switch op {
+	case attOpMTUReq:
+		if len(req) != 3 {
+			return attError(rsp, op, 0, attErrInvalidPDU)
+		}
+		clientMTU := binary.LittleEndian.Uint16(req[1:])
+		s.mtu = max(attDefaultMTU, min(clientMTU, attServerMTU))
+		rsp[0] = attOpMTURsp
+		binary.LittleEndian.PutUint16(rsp[1:], attServerMTU)
+		return 3
+
+	case attOpFindInfoReq:
+		start, end, ok := handleRange(req)
+		if !ok {
+			return attError(rsp, op, start, attErrInvalidHandle)
+		}
+		rsp[0] = attOpFindInfoRsp
+		n := 2
+		for h := start; h <= min(end, hLast); h++ {
+			uuid16, uuid128 := attrType(h)
+			if uuid128 != nil {
+				if n == 2 {
+					rsp[1] = 2 // 128 bit UUID format.
+					binary.LittleEndian.PutUint16(rsp[2:], h)
+					n += 2 + copy(rsp[4:], uuid128[:])
+				}
+				break // Only one 128 bit UUID fits in default MTU.
+			}
+			if n == 2 {
+				rsp[1] = 1 // 16 bit UUID format.
+			} else if rsp[1] != 1 || n+4 > len(rsp) {
+				break
+			}
+			binary.LittleEndian.PutUint16(rsp[n:], h)
+			binary.LittleEndian.PutUint16(rsp[n+2:], uuid16)
+			n += 4
+		}
+		if n == 2 {
+			return attError(rsp, op, start, attErrAttrNotFound)
+		}
+		return n
+
+	case attOpReadByGroupReq:
+		start, end, ok := handleRange(req)
+		if !ok {
+			return attError(rsp, op, start, attErrInvalidHandle)
+		} else if len(req) != 7 || binary.LittleEndian.Uint16(req[5:]) != uuidPrimaryService {
+			return attError(rsp, op, start, attErrUnsupportedGroupType)
+		} else if start > hService || end < hService {
+			return attError(rsp, op, start, attErrAttrNotFound)
+		}
+		rsp[0] = attOpReadByGroupRsp
+		rsp[1] = 4 + 16
+		binary.LittleEndian.PutUint16(rsp[2:], hService)
+		binary.LittleEndian.PutUint16(rsp[4:], hLast)
+		return 6 + copy(rsp[6:], uuidService[:])
+
+	case attOpReadByTypeReq:
+		start, end, ok := handleRange(req)
+		if !ok {
+			return attError(rsp, op, start, attErrInvalidHandle)
+		}
+		var uuid16 uint16
+		var uuid128 [16]byte
+		switch len(req) {
+		case 7:
+			uuid16 = binary.LittleEndian.Uint16(req[5:])
+		case 21:
+			copy(uuid128[:], req[5:])
+		default:
+			return attError(rsp, op, start, attErrInvalidPDU)
+		}
+		for h := start; h <= min(end, hLast); h++ {
+			t16, t128 := attrType(h)
+			if (uuid16 == 0 && (t128 == nil || *t128 != uuid128)) || (uuid16 != 0 && t16 != uuid16) {
+				continue
+			}
+			n, ecode := s.readAttr(h, rsp[4:])
+			if ecode != 0 {
+				return attError(rsp, op, h, ecode)
+			}
+			rsp[0] = attOpReadByTypeRsp
+			rsp[1] = byte(2 + n)
+			binary.LittleEndian.PutUint16(rsp[2:], h)
+			return 4 + n
+		}
+		return attError(rsp, op, start, attErrAttrNotFound)
+
+	case attOpReadReq:
+		if len(req) != 3 {
+			return attError(rsp, op, 0, attErrInvalidPDU)
+		}
+		h := binary.LittleEndian.Uint16(req[1:])
+		n, ecode := s.readAttr(h, rsp[1:])
+		if ecode != 0 {
+			return attError(rsp, op, h, ecode)
+		}
+		rsp[0] = attOpReadRsp
+		return 1 + n
+
+	case attOpWriteReq, attOpWriteCmd:
+		if len(req) < 3 {
+			if op == attOpWriteCmd {
+				return 0
+			}
+			return attError(rsp, op, 0, attErrInvalidPDU)
+		}
+		h := binary.LittleEndian.Uint16(req[1:])
+		ecode := s.writeAttr(h, req[3:])
+		if op == attOpWriteCmd {
+			return 0 // Commands are never responded to.
+		} else if ecode != 0 {
+			return attError(rsp, op, h, ecode)
+		}
+		rsp[0] = attOpWriteRsp
+		return 1
+
+	case attOpPrepareWriteReq:
+		if len(req) < 5 {
+			return attError(rsp, op, 0, attErrInvalidPDU)
+		}
+		h := binary.LittleEndian.Uint16(req[1:])
+		offset := binary.LittleEndian.Uint16(req[3:])
+		value := req[5:]
+		if h != hSSID && h != hPass {
+			return attError(rsp, op, h, attErrWriteNotPermitted)
+		} else if s.prepLen != 0 && s.prepHandle != h {
+			return attError(rsp, op, h, attErrPrepareQueueFull)
+		} else if offset != uint16(s.prepLen) {
+			return attError(rsp, op, h, attErrInvalidOffset)
+		} else if int(offset)+len(value) > len(s.prepBuf) {
+			return attError(rsp, op, h, attErrInvalidAttrValueLen)
+		}
+		s.prepHandle = h
+		s.prepLen += uint8(copy(s.prepBuf[offset:], value))
+		rsp[0] = attOpPrepareWriteRsp
+		return 1 + copy(rsp[1:], req[1:])
+
+	case attOpExecuteWriteReq:
+		if len(req) != 2 {
+			return attError(rsp, op, 0, attErrInvalidPDU)
+		}
+		h, n := s.prepHandle, s.prepLen
+		s.prepHandle, s.prepLen = 0, 0
+		if req[1] == 1 && n > 0 {
+			if ecode := s.writeAttr(h, s.prepBuf[:n]); ecode != 0 {
+				return attError(rsp, op, h, ecode)
+			}
+		}
+		rsp[0] = attOpExecuteWriteRsp
+		return 1
+	}
+	if op&0x40 != 0 {
+		return 0 // Unsupported command, ignore.
+	}
+	return attError(rsp, op, 0, attErrRequestNotSupported)
+}
+
+// handleRange decodes the handle range of a request. ok is false if the range is invalid.
+func handleRange(req []byte) (start, end uint16, ok bool) {
+	if len(req) < 5 {
+		return 0, 0, false
+	}
+	start = binary.LittleEndian.Uint16(req[1:])
+	end = binary.LittleEndian.Uint16(req[3:])
+	return start, end, start != 0 && start <= end
+}
+
+func attError(rsp []byte, reqOp uint8, h uint16, ecode uint8) int {
+	rsp[0] = attOpError
+	rsp[1] = reqOp
+	binary.LittleEndian.PutUint16(rsp[2:], h)
+	rsp[4] = ecode
+	return 5
+}
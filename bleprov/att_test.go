@@ -0,0 +1,97 @@
+package bleprov
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestATTDiscoveryAndWrite(t *testing.T) {
+	var s attServer
+	s.reset()
+	var rsp [attServerMTU]byte
+	req := func(b ...byte) []byte {
+		t.Helper()
+		n := s.handle(b, rsp[:])
+		return rsp[:n]
+	}
+
+	got := req(attOpMTUReq, 247, 0)
+	if got[0] != attOpMTURsp || s.mtu != attServerMTU {
+		t.Fatalf("MTU exchange: got %x, mtu=%d", got, s.mtu)
+	}
+
+	got = req(attOpReadByGroupReq, 1, 0, 0xff, 0xff, 0x00, 0x28)
+	if got[0] != attOpReadByGroupRsp || !bytes.Equal(got[6:], uuidService[:]) {
+		t.Fatalf("primary service discovery: got %x", got)
+	}
+	if end := binary.LittleEndian.Uint16(got[4:]); end != hLast {
+		t.Fatalf("service end handle: got %d, want %d", end, hLast)
+	}
+
+	// Discover characteristics one by one as a client would.
+	var chars [][16]byte
+	for start := uint16(hService); ; {
+		got = req(attOpReadByTypeReq, byte(start), byte(start>>8), 0xff, 0xff, 0x03, 0x28)
+		if got[0] == attOpError {
+			if got[4] != attErrAttrNotFound {
+				t.Fatalf("unexpected error %x", got)
+			}
+			break
+		}
+		h := binary.LittleEndian.Uint16(got[2:])
+		var uuid [16]byte
+		copy(uuid[:], got[7:])
+		chars = append(chars, uuid)
+		start = h + 1
+	}
+	want := [][16]byte{uuidSSID, uuidPassphrase, uuidControl, uuidStatus}
+	if len(chars) != len(want) {
+		t.Fatalf("discovered %d characteristics, want %d", len(chars), len(want))
+	}
+	for i := range want {
+		if chars[i] != want[i] {
+			t.Errorf("characteristic %d: got %x, want %x", i, chars[i], want[i])
+		}
+	}
+
+	// Write SSID in a single request and passphrase as a long write.
+	got = req(append([]byte{attOpWriteReq, hSSID, 0}, "mynet"...)...)
+	if len(got) != 1 || got[0] != attOpWriteRsp {
+		t.Fatalf("write SSID: got %x", got)
+	}
+	got = req(append([]byte{attOpPrepareWriteReq, hPass, 0, 0, 0}, "pass"...)...)
+	if got[0] != attOpPrepareWriteRsp {
+		t.Fatalf("prepare write: got %x", got)
+	}
+	got = req(append([]byte{attOpPrepareWriteReq, hPass, 0, 4, 0}, "word"...)...)
+	if got[0] != attOpPrepareWriteRsp {
+		t.Fatalf("prepare write: got %x", got)
+	}
+	got = req(attOpExecuteWriteReq, 1)
+	if got[0] != attOpExecuteWriteRsp {
+		t.Fatalf("execute write: got %x", got)
+	}
+	if ssid := string(s.ssid[:s.ssidLen]); ssid != "mynet" {
+		t.Errorf("ssid: got %q", ssid)
+	}
+	if pass := string(s.pass[:s.passLen]); pass != "password" {
+		t.Errorf("passphrase: got %q", pass)
+	}
+
+	// Passphrase must not be readable.
+	got = req(attOpReadReq, hPass, 0)
+	if got[0] != attOpError || got[4] != attErrReadNotPermitted {
+		t.Errorf("read passphrase: got %x", got)
+	}
+
+	got = req(attOpWriteReq, hCtl, 0, ControlJoin)
+	if got[0] != attOpWriteRsp || !s.joinRequested {
+		t.Fatalf("control write: got %x, joinRequested=%v", got, s.joinRequested)
+	}
+	s.status = StatusJoined
+	got = req(attOpReadReq, hStatus, 0)
+	if len(got) != 2 || got[0] != attOpReadRsp || got[1] != StatusJoined {
+		t.Errorf("read status: got %x", got)
+	}
+}
@@ -0,0 +1,456 @@
+// Package bleprov implements WiFi provisioning over Bluetooth Low Energy using
+// the combined WLAN+Bluetooth stack of the CYW43439.
+//
+// The device advertises a GATT service (see ServiceUUID) with characteristics
+// for the SSID, passphrase, a control point and a status. A phone app writes
+// the credentials, writes ControlJoin to the control point and polls the status
+// characteristic until the device reports StatusJoined or StatusFailed.
+//
+// The provisioner drives the HCI transport directly with a minimal LE
+// peripheral implementation: no pairing, a single connection and a single
+// GATT service. It is meant to be run once after boot, before the network
+// stack is brought up.
+package bleprov
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+// HCI packet types (H4 format).
+const (
+	hciCommandPkt = 0x01
+	hciACLPkt     = 0x02
+	hciEventPkt   = 0x04
+)
+
+// HCI command opcodes.
+const (
+	hciOpDisconnect      = 0x0406
+	hciOpReset           = 0x0c03
+	hciOpLESetAdvParams  = 0x2006
+	hciOpLESetAdvData    = 0x2008
+	hciOpLESetScanRsp    = 0x2009
+	hciOpLESetAdvEnable  = 0x200a
+	hciEvDisconnComplete = 0x05
+	hciEvCmdComplete     = 0x0e
+	hciEvCmdStatus       = 0x0f
+	hciEvLEMeta          = 0x3e
+
+	hciLEConnComplete         = 0x01
+	hciLEEnhancedConnComplete = 0x0a
+)
+
+// L2CAP channel identifiers.
+const (
+	l2capCIDATT = 0x0004
+	l2capCIDSMP = 0x0006
+)
+
+const (
+	aclPBContinuation = 0b01
+	aclHeaderLen      = 4
+	l2capHeaderLen    = 4
+	// joinGracePeriod is the time the connection is kept serviced after a
+	// successful join so that the client can read the final status.
+	joinGracePeriod = 2 * time.Second
+	cmdTimeout      = time.Second
+)
+
+var (
+	errCmdTimeout   = errors.New("bleprov: HCI command timeout")
+	errCmdFailed    = errors.New("bleprov: HCI command failed")
+	errNameTooLong  = errors.New("bleprov: local name too long")
+	errBadEventData = errors.New("bleprov: malformed HCI event")
+)
+
+// Config configures the provisioner.
+type Config struct {
+	// LocalName is advertised in the scan response. Defaults to "cyw43439".
+	// Must be at most 29 bytes long.
+	LocalName string
+	// Logger, if set, logs the provisioning progress. Its type is
+	// *log/slog.Logger unless built with the cy43noslog tag, see cyw43439.NewLogger.
+	Logger *slog.Logger
+}
+
+// Credentials are the network credentials received over BLE.
+type Credentials struct {
+	SSID       string
+	Passphrase string
+}
+
+// Provisioner advertises the provisioning service and joins the network with
+// the credentials received. The Device must have been initialized with
+// Bluetooth enabled, i.e: with cyw43439.DefaultBluetoothConfig.
+type Provisioner struct {
+	dev    *cyw43439.Device
+	log    *slog.Logger
+	name   string
+	att    attServer
+	conn   uint16
+	isConn bool
+	// readvertise is set on disconnection, advertising is stopped by the controller on connection.
+	readvertise bool
+	// L2CAP reassembly state.
+	l2len int
+	l2cid uint16
+	l2n   int
+	l2buf [l2capHeaderLen + attServerMTU]byte
+	// joinDone receives the result of the join started by join.
+	joinDone chan error
+	// rxbuf holds an entire HCI packet, largest being events and LE ACL packets.
+	rxbuf [512]byte
+	txbuf [1 + aclHeaderLen + l2capHeaderLen + attServerMTU]byte
+}
+
+// New returns a Provisioner which uses the Bluetooth controller of dev.
+func New(dev *cyw43439.Device, cfg Config) (*Provisioner, error) {
+	if cfg.LocalName == "" {
+		cfg.LocalName = "cyw43439"
+	}
+	if len(cfg.LocalName) > 29 {
+		return nil, errNameTooLong
+	}
+	p := &Provisioner{dev: dev, log: cfg.Logger, name: cfg.LocalName}
+	p.att.reset()
+	return p, nil
+}
+
+// Run advertises the provisioning service until a client provisions
+// credentials with which the device successfully joins the network or ctx is done.
+// Failed joins are reported to the client which may retry with new credentials.
+func (p *Provisioner) Run(ctx context.Context) (Credentials, error) {
+	err := p.command(hciOpReset)
+	if err != nil {
+		return Credentials{}, err
+	}
+	err = p.setupAdvertising()
+	if err != nil {
+		return Credentials{}, err
+	}
+	err = p.setAdvertising(true)
+	if err != nil {
+		return Credentials{}, err
+	}
+	p.info("bleprov:advertising", slog.String("name", p.name))
+	var doneAt time.Time
+	for {
+		if ctx.Err() != nil {
+			p.stop()
+			return Credentials{}, ctx.Err()
+		}
+		if p.readvertise && doneAt.IsZero() {
+			p.readvertise = false
+			if err := p.setAdvertising(true); err != nil {
+				return Credentials{}, err
+			}
+		}
+		if p.att.joinRequested {
+			p.att.joinRequested = false
+			p.join()
+		}
+		select {
+		case err := <-p.joinDone:
+			p.joined(err)
+			if p.att.status == StatusJoined {
+				doneAt = time.Now().Add(joinGracePeriod)
+			}
+		default:
+		}
+		if !doneAt.IsZero() && (time.Since(doneAt) > 0 || !p.isConn) {
+			p.stop()
+			return p.credentials(), nil
+		}
+		err := p.poll()
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+}
+
+func (p *Provisioner) credentials() Credentials {
+	return Credentials{
+		SSID:       string(p.att.ssid[:p.att.ssidLen]),
+		Passphrase: string(p.att.pass[:p.att.passLen]),
+	}
+}
+
+// join starts joining the network in a goroutine so the BLE connection keeps
+// being serviced during the join, which takes several seconds. The join
+// releases the device lock while it waits on the network, see JoinOptions.YieldLock.
+func (p *Provisioner) join() {
+	creds := p.credentials()
+	p.att.status = StatusJoining
+	p.info("bleprov:join", slog.String("ssid", creds.SSID))
+	if p.joinDone == nil {
+		p.joinDone = make(chan error, 1)
+	}
+	go func() {
+		p.joinDone <- p.dev.JoinWithOptions(creds.SSID, creds.Passphrase, cyw43439.JoinOptions{YieldLock: true})
+	}()
+}
+
+// joined reports the result of the join to the client.
+func (p *Provisioner) joined(err error) {
+	if err != nil {
+		p.logerr("bleprov:join", slog.String("err", err.Error()))
+		p.att.status = StatusFailed
+		return
+	}
+	p.att.status = StatusJoined
+}
+
+// stop disconnects the client and stops advertising. Errors are logged since
+// the controller is no longer used after provisioning.
+func (p *Provisioner) stop() {
+	var err error
+	if p.isConn {
+		var params [3]byte
+		binary.LittleEndian.PutUint16(params[:], p.conn)
+		params[2] = 0x13 // Remote user terminated connection.
+		err = p.command(hciOpDisconnect, params[:]...)
+	} else {
+		err = p.setAdvertising(false)
+	}
+	if err != nil {
+		p.logerr("bleprov:stop", slog.String("err", err.Error()))
+	}
+}
+
+func (p *Provisioner) setupAdvertising() error {
+	var params [15]byte
+	binary.LittleEndian.PutUint16(params[0:], 0x00a0) // Min interval 100ms.
+	binary.LittleEndian.PutUint16(params[2:], 0x00a0) // Max interval 100ms.
+	params[4] = 0x00                                  // ADV_IND, connectable undirected.
+	params[13] = 0x07                                 // All advertising channels.
+	err := p.command(hciOpLESetAdvParams, params[:]...)
+	if err != nil {
+		return err
+	}
+
+	var adv [32]byte
+	adv[0] = 3 + 18
+	adv[1], adv[2], adv[3] = 2, 0x01, 0x06 // Flags: LE General Discoverable, BR/EDR not supported.
+	adv[4], adv[5] = 17, 0x07              // Complete list of 128 bit service UUIDs.
+	copy(adv[6:], uuidService[:])
+	err = p.command(hciOpLESetAdvData, adv[:]...)
+	if err != nil {
+		return err
+	}
+
+	var rsp [32]byte
+	rsp[0] = byte(2 + len(p.name))
+	rsp[1], rsp[2] = byte(1+len(p.name)), 0x09 // Complete local name.
+	copy(rsp[3:], p.name)
+	return p.command(hciOpLESetScanRsp, rsp[:]...)
+}
+
+func (p *Provisioner) setAdvertising(enable bool) error {
+	var b byte
+	if enable {
+		b = 1
+	}
+	return p.command(hciOpLESetAdvEnable, b)
+}
+
+// command sends an HCI command and waits for its completion. Other packets
+// received in the meantime are processed.
+func (p *Provisioner) command(op uint16, params ...byte) error {
+	pkt := p.txbuf[:4+len(params)]
+	pkt[0] = hciCommandPkt
+	binary.LittleEndian.PutUint16(pkt[1:], op)
+	pkt[3] = byte(len(params))
+	copy(pkt[4:], params)
+	_, err := p.dev.WriteHCI(pkt)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(cmdTimeout)
+	for time.Since(deadline) < 0 {
+		pkt, err := p.read()
+		if err != nil {
+			return err
+		} else if len(pkt) == 0 {
+			continue
+		}
+		if pkt[0] == hciEventPkt && len(pkt) >= 3 {
+			code, params := pkt[1], pkt[3:]
+			switch {
+			case code == hciEvCmdComplete && len(params) >= 4 && binary.LittleEndian.Uint16(params[1:]) == op:
+				return cmdStatus(op, params[3])
+			case code == hciEvCmdStatus && len(params) >= 4 && binary.LittleEndian.Uint16(params[2:]) == op:
+				return cmdStatus(op, params[0])
+			}
+		}
+		if err := p.handle(pkt); err != nil {
+			return err
+		}
+	}
+	return errCmdTimeout
+}
+
+func cmdStatus(op uint16, status byte) error {
+	if status != 0 {
+		return errors.Join(errCmdFailed, errors.New("opcode "+hex16(op)+" status "+hex16(uint16(status))))
+	}
+	return nil
+}
+
+// poll reads and processes a single packet if available.
+func (p *Provisioner) poll() error {
+	pkt, err := p.read()
+	if err != nil || len(pkt) == 0 {
+		return err
+	}
+	return p.handle(pkt)
+}
+
+// read reads a single HCI packet. It returns an empty packet if none is pending.
+func (p *Provisioner) read() ([]byte, error) {
+	n, err := p.dev.BufferedHCI()
+	if err != nil {
+		return nil, err
+	} else if n == 0 {
+		time.Sleep(5 * time.Millisecond)
+		return nil, nil
+	}
+	n, err = p.dev.ReadHCI(p.rxbuf[:])
+	if err != nil {
+		return nil, err
+	}
+	return p.rxbuf[:n], nil
+}
+
+func (p *Provisioner) handle(pkt []byte) error {
+	switch pkt[0] {
+	case hciEventPkt:
+		return p.handleEvent(pkt[1:])
+	case hciACLPkt:
+		return p.handleACL(pkt[1:])
+	}
+	return nil
+}
+
+func (p *Provisioner) handleEvent(ev []byte) error {
+	if len(ev) < 2 || int(ev[1]) > len(ev)-2 {
+		return errBadEventData
+	}
+	code, params := ev[0], ev[2:2+ev[1]]
+	switch code {
+	case hciEvLEMeta:
+		if len(params) < 4 || (params[0] != hciLEConnComplete && params[0] != hciLEEnhancedConnComplete) {
+			break
+		}
+		if params[1] != 0 {
+			p.warn("bleprov:connfail", slog.Int("status", int(params[1])))
+			p.readvertise = true
+			break
+		}
+		p.conn = binary.LittleEndian.Uint16(params[2:]) & 0x0fff
+		p.isConn = true
+		p.att.reset()
+		p.l2len = 0
+		p.info("bleprov:connected", slog.Int("handle", int(p.conn)))
+
+	case hciEvDisconnComplete:
+		if len(params) < 4 || params[0] != 0 || !p.isConn ||
+			binary.LittleEndian.Uint16(params[1:])&0x0fff != p.conn {
+			break // Not our connection.
+		}
+		p.isConn = false
+		p.readvertise = true
+		p.info("bleprov:disconnected", slog.Int("reason", int(params[3])))
+	}
+	return nil
+}
+
+func (p *Provisioner) handleACL(acl []byte) error {
+	if len(acl) < aclHeaderLen {
+		return nil
+	}
+	hf := binary.LittleEndian.Uint16(acl)
+	dlen := int(binary.LittleEndian.Uint16(acl[2:]))
+	if hf&0x0fff != p.conn || !p.isConn || dlen > len(acl)-aclHeaderLen {
+		return nil
+	}
+	data := acl[aclHeaderLen : aclHeaderLen+dlen]
+	if (hf>>12)&0b11 == aclPBContinuation {
+		if p.l2len == 0 || p.l2n+len(data) > len(p.l2buf) {
+			p.l2len = 0 // Unexpected continuation or too large, drop.
+			return nil
+		}
+		p.l2n += copy(p.l2buf[p.l2n:], data)
+	} else {
+		if len(data) < l2capHeaderLen {
+			return nil
+		}
+		p.l2len = l2capHeaderLen + int(binary.LittleEndian.Uint16(data))
+		if p.l2len > len(p.l2buf) {
+			p.l2len = 0
+			return nil
+		}
+		p.l2n = copy(p.l2buf[:], data)
+	}
+	if p.l2n < p.l2len {
+		return nil // Wait for continuation fragments.
+	}
+	cid := binary.LittleEndian.Uint16(p.l2buf[2:])
+	payload := p.l2buf[l2capHeaderLen:p.l2len]
+	p.l2len = 0
+	return p.handleL2CAP(cid, payload)
+}
+
+func (p *Provisioner) handleL2CAP(cid uint16, payload []byte) error {
+	const hdr = 1 + aclHeaderLen + l2capHeaderLen
+	var n int
+	switch cid {
+	case l2capCIDATT:
+		n = p.att.handle(payload, p.txbuf[hdr:])
+	case l2capCIDSMP:
+		if len(payload) > 0 && payload[0] == 0x01 { // Pairing request.
+			p.txbuf[hdr] = 0x05   // Pairing failed.
+			p.txbuf[hdr+1] = 0x05 // Pairing not supported.
+			n = 2
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	pkt := p.txbuf[:hdr+n]
+	pkt[0] = hciACLPkt
+	binary.LittleEndian.PutUint16(pkt[1:], p.conn) // PB=0b00 first non-flushable, BC=0b00.
+	binary.LittleEndian.PutUint16(pkt[3:], uint16(l2capHeaderLen+n))
+	binary.LittleEndian.PutUint16(pkt[5:], uint16(n))
+	binary.LittleEndian.PutUint16(pkt[7:], cid)
+	_, err := p.dev.WriteHCI(pkt)
+	return err
+}
+
+func hex16(v uint16) string {
+	const hexdigits = "0123456789abcdef"
+	return string([]byte{'0', 'x', hexdigits[v>>12], hexdigits[(v>>8)&0xf], hexdigits[(v>>4)&0xf], hexdigits[v&0xf]})
+}
+
+func (p *Provisioner) info(msg string, attrs ...slog.Attr) {
+	p.logattrs(slog.LevelInfo, msg, attrs...)
+}
+
+func (p *Provisioner) warn(msg string, attrs ...slog.Attr) {
+	p.logattrs(slog.LevelWarn, msg, attrs...)
+}
+
+func (p *Provisioner) logerr(msg string, attrs ...slog.Attr) {
+	p.logattrs(slog.LevelError, msg, attrs...)
+}
+
+func (p *Provisioner) logattrs(level slog.Level, msg string, attrs ...slog.Attr) {
+	if p.log != nil {
+		slog.Log(p.log, level, msg, attrs...)
+	}
+}
@@ -0,0 +1,27 @@
+package bleprov
+
+import "testing"
+
+func TestDisconnectHandle(t *testing.T) {
+	p, err := New(nil, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LE Connection Complete of handle 0x40.
+	connected := []byte{hciEvLEMeta, 19, hciLEConnComplete, 0, 0x40, 0x00}
+	connected = append(connected, make([]byte, 21-len(connected))...)
+	if err := p.handleEvent(connected); err != nil || !p.isConn || p.conn != 0x40 {
+		t.Fatalf("not connected: %v conn=%#x", err, p.conn)
+	}
+	// Disconnection Complete of another link is ignored.
+	if err := p.handleEvent([]byte{hciEvDisconnComplete, 4, 0, 0x41, 0x00, 0x13}); err != nil {
+		t.Fatal(err)
+	} else if !p.isConn || p.readvertise {
+		t.Fatal("disconnection of another link reset the connection")
+	}
+	if err := p.handleEvent([]byte{hciEvDisconnComplete, 4, 0, 0x40, 0x00, 0x13}); err != nil {
+		t.Fatal(err)
+	} else if p.isConn || !p.readvertise {
+		t.Error("disconnection not handled")
+	}
+}
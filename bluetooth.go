@@ -0,0 +1,980 @@
+package cyw43439
+
+// This file is based on bluetooth.rs from the Embassy project and
+// cybt_shared_bus_driver.c from the pico-sdk.
+// https://github.com/embassy-rs/embassy/blob/main/cyw43/src/bluetooth.rs
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// ErrHCIWouldBlock is returned by WriteHCI when the host-to-controller ring
+// buffer does not have enough free space for the packet. The controller frees
+// space as it consumes packets, so the write may be retried later.
+var ErrHCIWouldBlock = errors.New("HCI host-to-controller buffer full")
+
+var (
+	errBTNotEnabled        = errors.New("bluetooth not enabled")
+	errBTWatermark         = errors.New("bluetooth F2 watermark check failed")
+	errBTInvalidFirmware   = errors.New("invalid bluetooth firmware")
+	errBTWaitCtrlTimeout   = errors.New("timeout waiting for bluetooth ctrl bits")
+	errBTInvalidRAMBase    = errors.New("bluetooth WLAN RAM base address is zero")
+	errHCIPacketTooShort   = errors.New("HCI packet must contain type byte and payload")
+	errHCIPacketTooLarge   = errors.New("HCI packet too large")
+	errHCIHeaderLength     = errors.New("HCI header length does not match packet length")
+	errHCIPacketType       = errors.New("invalid HCI packet type")
+	errHCIPartialRead      = errors.New("partial ReadHCI in progress")
+	errHCIInvalidRingState = errors.New("HCI ring buffer pointer out of range")
+)
+
+// hciHeaderLen is the length of the header preceding every HCI packet in the
+// BTSDIO ring buffers: a 3 byte little-endian payload length followed by the HCI packet type.
+const hciHeaderLen = 4
+
+// MaxHCIPacketLen is the length of the largest H4 HCI packet that can be passed
+// to WriteHCI or read with ReadHCI in a single call. It comfortably fits LE Data
+// Length Extension PDUs (251 bytes) and the largest ACL buffers of the controller.
+const MaxHCIPacketLen = 2048 - hciHeaderLen + 1
+
+// BTSDIO ring buffer geometry for BLE stacks pacing writes against the
+// host-to-controller ring buffer, see HCIRingFree.
+const (
+	// HCIRingSize is the size of each of the host-to-controller and
+	// controller-to-host ring buffers.
+	HCIRingSize = whd.BTSDIO_FWBUF_SIZE
+	// HCIRingCapacity is the most bytes a ring buffer holds. One word is
+	// always kept free so that a full buffer can be told apart from an empty one.
+	HCIRingCapacity = HCIRingSize - 4
+	// HCIRingHeaderLen is the length of the header preceding each packet in
+	// the ring buffers, replacing the H4 packet type byte.
+	HCIRingHeaderLen = hciHeaderLen
+)
+
+// HCIRingFootprint returns the bytes an H4 HCI packet of length n, packet type
+// byte included, occupies in a ring buffer: its header, payload and padding to 4 bytes.
+func HCIRingFootprint(n int) int {
+	if n < 1 {
+		return 0
+	}
+	return hciHeaderLen + int(align(uint32(n-1), 4))
+}
+
+// HCI opcodes and event codes inspected to track controller ACL buffer credits.
+const (
+	hciOpReset               = 0x0c03
+	hciOpReadBufferSize      = 0x1005
+	hciOpLEReadBufferSize    = 0x2002
+	hciEvCommandComplete     = 0x0e
+	hciEvNumCompletedPackets = 0x13
+)
+
+// HCI packet types (H4 format) as passed in the first byte to WriteHCI and ReadHCI.
+const (
+	hciPacketCommand = 0x01
+	hciPacketACL     = 0x02
+	hciPacketSCO     = 0x03
+	hciPacketEvent   = 0x04
+	hciPacketISO     = 0x05
+)
+
+// Length of the header following the packet type of each HCI packet type.
+const (
+	hciCommandHeaderLen = 3 // Opcode and parameter length.
+	hciACLHeaderLen     = 4 // Handle and flags followed by data length.
+	hciSCOHeaderLen     = 3 // Handle and flags followed by data length.
+	hciEventHeaderLen   = 2 // Event code and parameter length.
+	hciISOHeaderLen     = 4 // Handle and flags followed by 14 bit data length.
+)
+
+// DefaultBluetoothConfig returns a configuration that brings up both WLAN and
+// Bluetooth. The WLAN firmware used supports WLAN/Bluetooth coexistence.
+func DefaultBluetoothConfig() Config {
+	fw, clm := wifibtFirmware()
+	return Config{
+		Firmware:          fw,
+		CLM:               clm,
+		BluetoothFirmware: btFW,
+	}
+}
+
+// WriteHCI writes a single HCI packet to the Bluetooth controller. The first
+// byte of b is the HCI packet type (H4 format) followed by the packet payload.
+// b must hold exactly one command, ACL, SCO or ISO packet as given by its header.
+//
+// ErrHCIWouldBlock is returned for ACL packets when the controller has no free
+// ACL buffers. Controller buffers are tracked once the host issues an LE Read
+// Buffer Size or Read Buffer Size command and reads its completion with
+// ReadHCI. Buffers are freed by Number Of Completed Packets events.
+// ACL packets with more data than the controller buffers hold, see HCIACLDataLen,
+// are rejected instead of being truncated by the controller.
+func (d *Device) WriteHCI(b []byte) (int, error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	}
+	err := d.hci_check_packet(b)
+	if err != nil {
+		return 0, err
+	}
+	n, err := d.hci_write(b)
+	if err == nil {
+		d.stats.HCITxPackets++
+		d.stats.HCITxBytes += uint64(len(b))
+		d.hci_snoop(b, false)
+		if b[0] == hciPacketACL && d.aclMax != 0 {
+			d.aclCredits--
+		}
+	}
+	return n, err
+}
+
+// ReadHCI reads a single HCI packet from the Bluetooth controller into b in
+// H4 format: the first byte is the HCI packet type followed by the payload.
+// If no packet is available within the configured HCI read timeout
+// ErrDataNotAvailable is returned. With a zero timeout ReadHCI does not block.
+//
+// If b is too small to hold the packet, the first len(b) bytes are returned
+// and the remainder of the packet is returned by the following calls to
+// ReadHCI, so that the packets read form an H4 stream in which packet
+// boundaries are given by the HCI packet headers. Use ReadHCIPacket for
+// packet-at-a-time semantics.
+func (d *Device) ReadHCI(b []byte) (int, error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	} else if len(b) == 0 {
+		return 0, nil
+	}
+	deadline := d.now().Add(d.hciReadTimeout)
+	for {
+		n, err := d.hci_read(b)
+		if err != ErrDataNotAvailable || d.since(deadline) >= 0 {
+			return n, err
+		}
+		d.sleep(time.Millisecond)
+	}
+}
+
+// HCIACLDataLen returns the maximum ACL data length of the controller buffers
+// as reported by the last LE Read Buffer Size or Read Buffer Size command issued
+// by the host. It is zero until known. Hosts using LE Data Length Extension
+// should fragment L2CAP PDUs to this length.
+func (d *Device) HCIACLDataLen() int {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	return int(d.aclDataLen)
+}
+
+// hci_check_packet validates an H4 packet written by the host against its
+// header, and ACL packets against the controller buffers.
+func (d *Device) hci_check_packet(b []byte) error {
+	if len(b) < 2 {
+		return errHCIPacketTooShort
+	} else if b[0] == hciPacketEvent {
+		return errHCIPacketType // Events are sent only by the controller.
+	}
+	plen, ok := hciPacketLen(b)
+	if !ok {
+		if b[0] > hciPacketISO || b[0] == 0 {
+			return errHCIPacketType
+		}
+		return errHCIPacketTooShort
+	} else if plen != len(b) {
+		return errHCIHeaderLength
+	}
+	if b[0] != hciPacketACL {
+		return nil
+	}
+	dataLen := len(b) - 1 - hciACLHeaderLen
+	if d.aclDataLen != 0 && dataLen > int(d.aclDataLen) {
+		return errHCIPacketTooLarge
+	} else if d.aclMax != 0 && d.aclCredits == 0 {
+		return ErrHCIWouldBlock
+	}
+	return nil
+}
+
+// hciPacketLen returns the length of the H4 packet starting in b as given by
+// its header. ok is false if the packet type is unknown or b is shorter than the header.
+func hciPacketLen(b []byte) (n int, ok bool) {
+	if len(b) < 1 {
+		return 0, false
+	}
+	switch b[0] {
+	case hciPacketCommand:
+		if len(b) >= 1+hciCommandHeaderLen {
+			return 1 + hciCommandHeaderLen + int(b[3]), true
+		}
+	case hciPacketACL:
+		if len(b) >= 1+hciACLHeaderLen {
+			return 1 + hciACLHeaderLen + (int(b[3]) | int(b[4])<<8), true
+		}
+	case hciPacketSCO:
+		if len(b) >= 1+hciSCOHeaderLen {
+			return 1 + hciSCOHeaderLen + int(b[3]), true
+		}
+	case hciPacketEvent:
+		if len(b) >= 1+hciEventHeaderLen {
+			return 1 + hciEventHeaderLen + int(b[2]), true
+		}
+	case hciPacketISO:
+		if len(b) >= 1+hciISOHeaderLen {
+			return 1 + hciISOHeaderLen + (int(b[3])|int(b[4])<<8)&0x3fff, true
+		}
+	}
+	return 0, false
+}
+
+// ReadHCIPacket reads a single whole HCI packet from the Bluetooth controller
+// into b in H4 format. Unlike ReadHCI packets are never split: if b is too
+// small to hold the next packet io.ErrShortBuffer is returned and the packet
+// is kept for a following call with a larger buffer. Buffers of length
+// MaxHCIPacketLen hold any packet. Timeouts behave as in ReadHCI.
+func (d *Device) ReadHCIPacket(b []byte) (int, error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	} else if d.hciReadOff != 0 {
+		return 0, errHCIPartialRead
+	}
+	deadline := d.now().Add(d.hciReadTimeout)
+	for {
+		pkt, next, err := d.hci_peek()
+		if err == nil {
+			if len(pkt) > len(b) {
+				return 0, io.ErrShortBuffer
+			}
+			d.hci_received(pkt)
+			return copy(b, pkt), d.hci_consume(next)
+		} else if err != ErrDataNotAvailable || d.since(deadline) >= 0 {
+			return 0, err
+		}
+		d.sleep(time.Millisecond)
+	}
+}
+
+// RecvHCIHandle sets handler to receive HCI packets in H4 format drained by
+// Poll. The packet is only valid during the call. Packets are drained by Poll
+// only when a handler is set; ReadHCI should not be used along with a handler.
+// Errors returned by handler are handled as set with SetRecvErrorPolicy, the
+// packet is consumed in any case.
+func (d *Device) RecvHCIHandle(handler func(pkt []byte) error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	d.rcvHCI = handler
+}
+
+const (
+	// hciCacheTTL is how long BufferedHCI returns the cached amount without
+	// taking the device lock nor accessing the bus.
+	hciCacheTTL = time.Millisecond
+	// hciCacheRefresh is how long BufferedHCI trusts the cached amount while
+	// the controller raises no interrupt before reading the ring buffer again.
+	hciCacheRefresh = 50 * time.Millisecond
+)
+
+// BufferedHCI returns the amount of bytes pending in the controller-to-host
+// ring buffer, including ring buffer headers and padding.
+// The amount is cached so BLE stacks may call BufferedHCI at high frequency:
+// calls within a millisecond of the last check return without taking the
+// device lock, and after that the ring buffer is only read again once the
+// controller signals new data, or the ring is consumed, or every 50ms.
+func (d *Device) BufferedHCI() (int, error) {
+	if at := d.hciCheckedAt.Load(); at != 0 && d.now().UnixNano()-at < int64(hciCacheTTL) {
+		return int(d.hciBuffered.Load()), nil
+	}
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	}
+	now := d.now()
+	// Clear the interrupt before reading so data written after the read raises it again.
+	pending := d.bt_irq_pending()
+	if !pending && d.hciCheckedAt.Load() != 0 && now.Sub(d.hciReadAt) < hciCacheRefresh {
+		d.hciCheckedAt.Store(now.UnixNano())
+		return int(d.hciBuffered.Load()), nil
+	}
+	in, err := d.bp_read32(d.btaddr + whd.BTSDIO_OFFSET_BT2HOST_IN)
+	if err != nil {
+		d.hci_invalidate()
+		return 0, err
+	}
+	n := int32((in - d.b2hReadPtr) % whd.BTSDIO_FWBUF_SIZE)
+	d.hciBuffered.Store(n)
+	d.hciReadAt = now
+	d.hciCheckedAt.Store(now.UnixNano())
+	return int(n), nil
+}
+
+// hci_invalidate discards the amount cached by BufferedHCI.
+func (d *Device) hci_invalidate() { d.hciCheckedAt.Store(0) }
+
+// bt_irq_pending reports whether the controller raised an interrupt since the
+// last call, i.e: it wrote to the ring buffer, clearing the interrupt.
+//
+//	reference: cyw43_ll_bt_has_work
+func (d *Device) bt_irq_pending() bool {
+	if d.getInterrupts()&Interrupts(irqF1_INTR) == 0 {
+		return false
+	}
+	status, err := d.bp_read32(whd.SDIO_INT_STATUS)
+	if err != nil {
+		return true
+	} else if status&whd.I_HMB_FC_CHANGE != 0 {
+		d.bp_write32(whd.SDIO_INT_STATUS, whd.I_HMB_FC_CHANGE) // Write 1 to clear.
+	}
+	return true
+}
+
+// BufferedHCIPackets returns the amount of complete packets pending in the
+// controller-to-host ring buffer. A packet partially returned by ReadHCI is counted.
+func (d *Device) BufferedHCIPackets() (int, error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	}
+	in, err := d.bp_read32(d.btaddr + whd.BTSDIO_OFFSET_BT2HOST_IN)
+	if err != nil {
+		return 0, err
+	} else if in >= whd.BTSDIO_FWBUF_SIZE || in%4 != 0 {
+		return 0, d.flight_failure(FailureHCIDesync, errHCIInvalidRingState)
+	} else if in == d.b2hReadPtr {
+		return 0, nil
+	}
+	err = d.bt_bus_request()
+	if err != nil {
+		return 0, err
+	}
+	var hdr [hciHeaderLen]byte
+	n := 0
+	for off := d.b2hReadPtr; off != in; n++ {
+		_, err = d.bt_ring_read(off, hdr[:])
+		if err != nil {
+			return n, err
+		}
+		payloadLen := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+		totalLen := hciHeaderLen + align(payloadLen, 4)
+		if totalLen > (in-off)%whd.BTSDIO_FWBUF_SIZE {
+			return n, d.flight_failure(FailureHCIDesync, errHCIInvalidRingState)
+		}
+		off = (off + totalLen) % whd.BTSDIO_FWBUF_SIZE
+	}
+	return n, nil
+}
+
+// hci_track_credits updates the controller ACL buffer credits from a
+// received H4 HCI event packet.
+func (d *Device) hci_track_credits(pkt []byte) {
+	if len(pkt) < 3 || pkt[0] != hciPacketEvent || int(pkt[2]) > len(pkt)-3 {
+		return
+	}
+	params := pkt[3 : 3+pkt[2]]
+	switch pkt[1] {
+	case hciEvCommandComplete:
+		if len(params) < 4 || params[3] != 0 {
+			return
+		}
+		var total, dataLen uint16
+		switch _busOrder.Uint16(params[1:]) {
+		case hciOpReset:
+			d.aclMax, d.aclCredits, d.aclDataLen = 0, 0, 0
+			return
+		case hciOpLEReadBufferSize:
+			if len(params) < 7 {
+				return
+			}
+			total = uint16(params[6])
+			dataLen = _busOrder.Uint16(params[4:])
+		case hciOpReadBufferSize:
+			if len(params) < 9 || d.aclMax != 0 {
+				return // LE buffers take precedence over shared buffers.
+			}
+			total = _busOrder.Uint16(params[7:])
+			dataLen = _busOrder.Uint16(params[4:])
+		default:
+			return
+		}
+		if total != 0 {
+			// A zero total means LE uses the shared buffers reported by Read Buffer Size.
+			d.aclMax, d.aclCredits, d.aclDataLen = total, total, dataLen
+			d.debug("hci:acl-buffers", slog.Int("total", int(total)), slog.Int("len", int(dataLen)))
+		}
+
+	case hciEvNumCompletedPackets:
+		if len(params) < 1 || len(params) < 1+4*int(params[0]) || d.aclMax == 0 {
+			return
+		}
+		// Connection handle and completed packet count pairs.
+		for i := 0; i < int(params[0]); i++ {
+			completed := _busOrder.Uint16(params[1+4*i+2:])
+			d.aclCredits = min(d.aclMax, d.aclCredits+completed)
+		}
+	}
+}
+
+// EnableBluetooth brings up the Bluetooth controller on a device already
+// initialized with Init, so applications may bring up networking quickly and
+// Bluetooth only when needed. The WLAN firmware passed to Init must support
+// WLAN/Bluetooth coexistence, such as the one in DefaultBluetoothConfig.
+// The F2 watermark set by Init or SetF2Watermark is kept.
+// Calling EnableBluetooth with Bluetooth already enabled is a no-op.
+func (d *Device) EnableBluetooth(firmware string) error {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if d.btaddr != 0 {
+		return nil
+	}
+	err := d.bt_check_watermark()
+	if err != nil {
+		return err
+	}
+	err = d.bt_init(firmware)
+	if err != nil {
+		d.btaddr = 0
+		return errjoin(errors.New("bluetooth init failed"), err)
+	}
+	d.debug("bluetooth init done")
+	return nil
+}
+
+// DisableBluetooth stops HCI traffic and powers down the Bluetooth controller
+// to save power and remove the WLAN/Bluetooth coexistence penalty while
+// Bluetooth is unused. Pending HCI packets are discarded. Bluetooth may be
+// brought up again with EnableBluetooth, which uploads the firmware anew.
+// Calling DisableBluetooth with Bluetooth disabled is a no-op.
+func (d *Device) DisableBluetooth() error {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return nil
+	}
+	err := d.bt_deinit()
+	// Forget controller state even on error since it is re-initialized on enable.
+	d.bt_forget()
+	if err != nil {
+		return errjoin(errors.New("bluetooth deinit failed"), err)
+	}
+	d.debug("bluetooth disabled")
+	return nil
+}
+
+// ResetHCI recovers HCI traffic after the host and controller lose sync on
+// the ring buffers, as reported by a ring buffer pointer out of range error,
+// without tearing down WLAN. Pending HCI packets are discarded and the ring
+// buffers and host ready bits are reinitialized. If firmware is not empty the
+// Bluetooth firmware is uploaded anew, resetting the controller, in which case
+// the BLE stack must set up the controller again as after EnableBluetooth.
+func (d *Device) ResetHCI(firmware string) error {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return errBTNotEnabled
+	}
+	if firmware != "" {
+		err := d.bt_deinit()
+		d.bt_forget()
+		if err == nil {
+			err = d.bt_init(firmware)
+		}
+		if err != nil {
+			d.btaddr = 0
+			return errjoin(errors.New("bluetooth reset failed"), err)
+		}
+		d.debug("bluetooth reset with firmware upload")
+		return nil
+	}
+	err := d.bt_clear_host_ready()
+	if err != nil {
+		return err
+	}
+	err = d.bt_init_buffers()
+	if err != nil {
+		return err
+	}
+	err = d.bt_bus_request()
+	if err != nil {
+		return err
+	}
+	err = d.bt_set_host_ready()
+	if err != nil {
+		return err
+	}
+	// Packets in flight were discarded along with their completions.
+	d.aclCredits = d.aclMax
+	d.debug("bluetooth HCI reset")
+	return d.bt_toggle_intr()
+}
+
+// bt_forget clears the driver's controller state.
+func (d *Device) bt_forget() {
+	d.btaddr = 0
+	d.h2bWritePtr = 0
+	d.b2hReadPtr = 0
+	d.hciReadOff = 0
+	d.hci_invalidate()
+	d.aclMax, d.aclCredits, d.aclDataLen = 0, 0, 0
+}
+
+// bt_deinit clears the host ready and wake bits so the controller stops
+// servicing the ring buffers and withdraws the power up request made in bt_init.
+func (d *Device) bt_deinit() error {
+	err := d.bt_clear_host_ready()
+	if err != nil {
+		return err
+	}
+	return d.bp_write32(whd.BTFW_MEM_OFFSET+whd.BT2WLAN_PWRUP_ADDR, 0)
+}
+
+// bt_clear_host_ready clears the host ready and wake bits so the controller
+// stops servicing the ring buffers.
+func (d *Device) bt_clear_host_ready() error {
+	val, err := d.bp_read32(whd.HOST_CTRL_REG_ADDR)
+	if err != nil {
+		return err
+	}
+	val &^= whd.BTSDIO_REG_SW_RDY_BITMASK | whd.BTSDIO_REG_WAKE_BT_BITMASK
+	return d.bp_write32(whd.HOST_CTRL_REG_ADDR, val^whd.BTSDIO_REG_DATA_VALID_BITMASK)
+}
+
+// btF2Watermark is the F2 watermark set by pico-sdk when Bluetooth is used
+// and no watermark has been set yet.
+const btF2Watermark = 0x10
+
+// bt_check_watermark checks the F2 watermark can be set, needed for Bluetooth
+// operation. See pico-sdk's cyw43_ll_bus_init. A watermark already set by Init,
+// i.e: Config.F2Watermark, or by SetF2Watermark is written back unchanged.
+func (d *Device) bt_check_watermark() error {
+	watermark := d.f2Watermark
+	if watermark == 0 {
+		watermark = btF2Watermark
+		d.info("bt_check_watermark:default", slog.Int("watermark", int(watermark)))
+	}
+	err := d.set_f2_watermark(watermark)
+	if err != nil {
+		return errjoin(errBTWatermark, err)
+	}
+	return nil
+}
+
+// bt_init uploads the Bluetooth firmware and sets up the shared bus.
+//
+//	reference: init_bluetooth
+func (d *Device) bt_init(firmware string) error {
+	d.debug("bt_init", slog.Int("fwlen", len(firmware)))
+	// Enable Bluetooth interrupts via F1 before bringing up the controller.
+	err := d.bp_write32(whd.SDIO_INT_HOST_MASK, whd.I_HMB_FC_CHANGE)
+	if err != nil {
+		return err
+	}
+	err = d.bp_write32(whd.BTFW_MEM_OFFSET+whd.BT2WLAN_PWRUP_ADDR, whd.BT2WLAN_PWRUP_WAKE)
+	if err != nil {
+		return err
+	}
+	err = d.bt_upload_firmware(firmware)
+	if err != nil {
+		return err
+	}
+	err = d.bt_wait_ctrl_bits(whd.BTSDIO_REG_FW_RDY_BITMASK, 300*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	err = d.bt_init_buffers()
+	if err != nil {
+		return err
+	}
+	err = d.bt_wait_ctrl_bits(whd.BTSDIO_REG_BT_AWAKE_BITMASK, 300*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	err = d.bt_set_host_ready()
+	if err != nil {
+		return err
+	}
+	return d.bt_toggle_intr()
+}
+
+// bt_upload_firmware writes the Bluetooth firmware records to controller memory.
+// The firmware starts with a length-prefixed version string followed by a
+// record count byte. Each record is [len, addrHi, addrLo, type, data[len]...].
+func (d *Device) bt_upload_firmware(firmware string) error {
+	if len(firmware) < 2 || int(firmware[0])+2 > len(firmware) {
+		return errBTInvalidFirmware
+	}
+	versionLen := int(firmware[0])
+	d.debug("bt_upload_firmware", slog.String("version", firmware[1:versionLen]))
+	records := firmware[versionLen+2:]
+	scratch := u32AsU8(d._sendIoctlBuf[:])
+	var addrHi uint32
+	// Progress is reported every progressStep bytes since records are short.
+	const progressStep = 4096
+	lastReport := 0
+	for len(records) >= 4 {
+		if written := len(firmware) - len(records); written-lastReport >= progressStep {
+			d.report_progress("bluetooth", written, len(firmware))
+			lastReport = written
+		}
+		n := int(records[0])
+		addr := uint32(records[1])<<8 | uint32(records[2])
+		typ := records[3]
+		if 4+n > len(records) {
+			return errBTInvalidFirmware
+		}
+		data := records[4 : 4+n]
+		records = records[4+n:]
+		switch typ {
+		case whd.BTFW_HEX_LINE_TYPE_DATA:
+			err := d.bt_write_unaligned(whd.BTFW_MEM_OFFSET+addrHi<<16+addr, data, scratch)
+			if err != nil {
+				return err
+			}
+		case whd.BTFW_HEX_LINE_TYPE_EXTENDED_ADDRESS:
+			if n < 2 {
+				return errBTInvalidFirmware
+			}
+			addrHi = uint32(data[0])<<8 | uint32(data[1])
+		case whd.BTFW_HEX_LINE_TYPE_END_OF_DATA:
+			d.report_progress("bluetooth", len(firmware), len(firmware))
+			return nil
+		default:
+			d.warn("bt_upload_firmware:unhandled record", slog.Int("type", int(typ)))
+		}
+	}
+	d.report_progress("bluetooth", len(firmware), len(firmware))
+	return nil
+}
+
+// bt_write_unaligned writes data at an address that need not be 4-byte aligned.
+// Bytes of the first and last words not covered by data are preserved.
+func (d *Device) bt_write_unaligned(addr uint32, data string, scratch []byte) error {
+	front := addr & 3
+	start := addr - front
+	n := align(front+uint32(len(data)), 4)
+	if int(n) > len(scratch) {
+		return errBTInvalidFirmware
+	}
+	buf := scratch[:n]
+	if front != 0 {
+		if err := d.bp_read(start, buf[:4]); err != nil {
+			return err
+		}
+	}
+	if (front+uint32(len(data)))%4 != 0 {
+		if err := d.bp_read(start+n-4, buf[n-4:]); err != nil {
+			return err
+		}
+	}
+	copy(buf[front:], data)
+	return d.bp_write(start, buf)
+}
+
+// bt_wait_ctrl_bits waits until all bits in mask are set in the BT control register.
+func (d *Device) bt_wait_ctrl_bits(mask uint32, timeout time.Duration) error {
+	deadline := d.now().Add(timeout)
+	for {
+		val, err := d.bp_read32(whd.BT_CTRL_REG_ADDR)
+		if err != nil {
+			return err
+		}
+		if val&mask == mask {
+			return nil
+		}
+		if d.since(deadline) >= 0 {
+			return errBTWaitCtrlTimeout
+		}
+		d.sleep(time.Millisecond)
+	}
+}
+
+func (d *Device) bt_init_buffers() error {
+	addr, err := d.bp_read32(whd.WLAN_RAM_BASE_REG_ADDR)
+	if err != nil {
+		return err
+	} else if addr == 0 {
+		return errBTInvalidRAMBase
+	}
+	d.debug("bt_init_buffers", slog.Uint64("wlan_ram_base", uint64(addr)))
+	d.btaddr = addr
+	d.h2bWritePtr = 0
+	d.b2hReadPtr = 0
+	d.hciReadOff = 0
+	d.hci_invalidate()
+	for _, off := range [...]uint32{
+		whd.BTSDIO_OFFSET_HOST2BT_IN, whd.BTSDIO_OFFSET_HOST2BT_OUT,
+		whd.BTSDIO_OFFSET_BT2HOST_IN, whd.BTSDIO_OFFSET_BT2HOST_OUT,
+	} {
+		err = d.bp_write32(addr+off, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Device) bt_set_host_ready() error {
+	val, err := d.bp_read32(whd.HOST_CTRL_REG_ADDR)
+	if err != nil {
+		return err
+	}
+	return d.bp_write32(whd.HOST_CTRL_REG_ADDR, val|whd.BTSDIO_REG_SW_RDY_BITMASK)
+}
+
+func (d *Device) bt_set_awake(awake bool) error {
+	val, err := d.bp_read32(whd.HOST_CTRL_REG_ADDR)
+	if err != nil {
+		return err
+	}
+	if awake {
+		val |= whd.BTSDIO_REG_WAKE_BT_BITMASK
+	} else {
+		val &^= whd.BTSDIO_REG_WAKE_BT_BITMASK
+	}
+	return d.bp_write32(whd.HOST_CTRL_REG_ADDR, val)
+}
+
+// bt_toggle_intr signals the controller that the ring buffer pointers changed.
+func (d *Device) bt_toggle_intr() error {
+	val, err := d.bp_read32(whd.HOST_CTRL_REG_ADDR)
+	if err != nil {
+		return err
+	}
+	return d.bp_write32(whd.HOST_CTRL_REG_ADDR, val^whd.BTSDIO_REG_DATA_VALID_BITMASK)
+}
+
+// bt_bus_request wakes the Bluetooth core before accessing the shared bus.
+func (d *Device) bt_bus_request() error {
+	err := d.bt_set_awake(true)
+	if err != nil {
+		return err
+	}
+	return d.bt_wait_ctrl_bits(whd.BTSDIO_REG_BT_AWAKE_BITMASK, 300*time.Millisecond)
+}
+
+func (d *Device) hci_write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, errHCIPacketTooShort
+	}
+	buf8 := u32AsU8(d._sendIoctlBuf[:])
+	payloadLen := uint32(len(b) - 1)
+	totalLen := hciHeaderLen + align(payloadLen, 4)
+	if int(totalLen) > len(buf8) || totalLen > HCIRingCapacity {
+		return 0, errHCIPacketTooLarge
+	}
+	err := d.bt_bus_request()
+	if err != nil {
+		return 0, err
+	}
+	err = d.bt_wait_write_space(totalLen)
+	if err != nil {
+		return 0, err
+	}
+	buf8[0] = byte(payloadLen)
+	buf8[1] = byte(payloadLen >> 8)
+	buf8[2] = byte(payloadLen >> 16)
+	buf8[3] = b[0] // HCI packet type.
+	n := copy(buf8[hciHeaderLen:], b[1:])
+	for i := hciHeaderLen + n; i < int(totalLen); i++ {
+		buf8[i] = 0 // Zero out padding.
+	}
+	ptr, err := d.bt_ring_write(d.h2bWritePtr, buf8[:totalLen])
+	if err != nil {
+		return 0, err
+	}
+	d.h2bWritePtr = ptr
+	err = d.bp_write32(d.btaddr+whd.BTSDIO_OFFSET_HOST2BT_IN, d.h2bWritePtr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), d.bt_toggle_intr()
+}
+
+// bt_wait_write_space waits until the host-to-controller ring buffer has room
+// for n bytes or the configured HCI write timeout elapses, in which case
+// ErrHCIWouldBlock is returned.
+func (d *Device) bt_wait_write_space(n uint32) error {
+	deadline := d.now().Add(d.hciWriteTimeout)
+	for {
+		free, err := d.bt_write_space()
+		if err != nil || free >= n {
+			return err
+		}
+		if d.since(deadline) >= 0 {
+			return ErrHCIWouldBlock
+		}
+		d.sleep(time.Millisecond)
+	}
+}
+
+// HCIRingFree returns the free bytes in the host-to-controller ring buffer.
+// A packet may be written with WriteHCI without blocking if its HCIRingFootprint
+// does not exceed the free bytes.
+func (d *Device) HCIRingFree() (int, error) {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	if d.btaddr == 0 {
+		return 0, errBTNotEnabled
+	}
+	free, err := d.bt_write_space()
+	return int(free), err
+}
+
+// HCIRingUsed returns the bytes in the host-to-controller ring buffer not yet
+// consumed by the controller. See BufferedHCI for the controller-to-host ring buffer.
+func (d *Device) HCIRingUsed() (int, error) {
+	free, err := d.HCIRingFree()
+	if err != nil {
+		return 0, err
+	}
+	return HCIRingCapacity - free, nil
+}
+
+// bt_write_space returns the free space in the host-to-controller ring buffer.
+// One word is always kept free so that a full buffer can be told apart from an empty one.
+func (d *Device) bt_write_space() (uint32, error) {
+	out, err := d.bp_read32(d.btaddr + whd.BTSDIO_OFFSET_HOST2BT_OUT)
+	if err != nil {
+		return 0, err
+	} else if out >= whd.BTSDIO_FWBUF_SIZE || out%4 != 0 {
+		return 0, d.flight_failure(FailureHCIDesync, errHCIInvalidRingState)
+	}
+	used := (d.h2bWritePtr - out) % HCIRingSize
+	return HCIRingCapacity - used, nil
+}
+
+// bt_ring_write writes src to the host-to-controller ring buffer starting at
+// offset, wrapping around the end of the buffer. len(src) must be a multiple of 4.
+// Returns the offset following the last byte written.
+func (d *Device) bt_ring_write(offset uint32, src []byte) (uint32, error) {
+	if strictMode {
+		d.strict_check(offset < whd.BTSDIO_FWBUF_SIZE && offset%4 == 0 && len(src)%4 == 0,
+			"invalid host-to-controller ring write", slog.Uint64("offset", uint64(offset)), slog.Int("len", len(src)))
+	}
+	base := d.btaddr + whd.BTSDIO_OFFSET_HOST_WRITE_BUF
+	for len(src) > 0 {
+		n := min(uint32(len(src)), whd.BTSDIO_FWBUF_SIZE-offset)
+		err := d.bp_write(base+offset, src[:n])
+		if err != nil {
+			return offset, err
+		}
+		offset = (offset + n) % whd.BTSDIO_FWBUF_SIZE
+		src = src[n:]
+	}
+	return offset, nil
+}
+
+// hci_read copies the next packet in the controller-to-host ring buffer into b
+// in H4 format. If b is too small the packet is kept in the ring buffer and the
+// remainder is copied on following calls.
+// Returns ErrDataNotAvailable if the ring buffer is empty.
+func (d *Device) hci_read(b []byte) (int, error) {
+	pkt, next, err := d.hci_peek()
+	if err != nil {
+		return 0, err
+	}
+	if d.hciReadOff == 0 {
+		d.hci_received(pkt)
+	}
+	n := copy(b, pkt[d.hciReadOff:])
+	d.hciReadOff += uint32(n)
+	if int(d.hciReadOff) < len(pkt) {
+		return n, nil // Remainder of packet is read on next call.
+	}
+	d.hciReadOff = 0
+	return n, d.hci_consume(next)
+}
+
+// hci_peek reads the next packet in the controller-to-host ring buffer into
+// _rxBuf without consuming it and returns it in H4 format along with the ring
+// buffer offset following the packet, to be passed to hci_consume. Delivered
+// packets must be passed to hci_received.
+// Returns ErrDataNotAvailable if the ring buffer is empty.
+func (d *Device) hci_peek() (pkt []byte, next uint32, err error) {
+	in, err := d.bp_read32(d.btaddr + whd.BTSDIO_OFFSET_BT2HOST_IN)
+	if err != nil {
+		return nil, 0, err
+	} else if in >= whd.BTSDIO_FWBUF_SIZE || in%4 != 0 {
+		return nil, 0, d.flight_failure(FailureHCIDesync, errHCIInvalidRingState)
+	} else if in == d.b2hReadPtr {
+		return nil, 0, ErrDataNotAvailable
+	}
+	err = d.bt_bus_request()
+	if err != nil {
+		return nil, 0, err
+	}
+	buf8 := u32AsU8(d._rxBuf[:])
+	_, err = d.bt_ring_read(d.b2hReadPtr, buf8[:hciHeaderLen])
+	if err != nil {
+		return nil, 0, err
+	}
+	payloadLen := uint32(buf8[0]) | uint32(buf8[1])<<8 | uint32(buf8[2])<<16
+	totalLen := hciHeaderLen + align(payloadLen, 4)
+	if strictMode {
+		avail := (in - d.b2hReadPtr) % whd.BTSDIO_FWBUF_SIZE
+		d.strict_check(totalLen <= avail, "HCI packet exceeds ring buffer write pointer",
+			slog.Uint64("len", uint64(totalLen)), slog.Uint64("avail", uint64(avail)))
+	}
+	if int(totalLen) > len(buf8) || totalLen > HCIRingCapacity {
+		// Drop the packet so it does not block the ring buffer forever.
+		d.stats.RxDropped++
+		return nil, 0, errjoin(errHCIPacketTooLarge, d.hci_consume((d.b2hReadPtr+totalLen)%whd.BTSDIO_FWBUF_SIZE))
+	}
+	next, err = d.bt_ring_read(d.b2hReadPtr, buf8[:totalLen])
+	if err != nil {
+		return nil, 0, err
+	}
+	// Last header byte is the HCI packet type, which precedes the payload as in H4 format.
+	pkt = buf8[hciHeaderLen-1 : hciHeaderLen+payloadLen]
+	return pkt, next, nil
+}
+
+// hci_received accounts for a packet returned by hci_peek being delivered to
+// the host. It must be called once per packet.
+func (d *Device) hci_received(pkt []byte) {
+	d.stats.HCIRxPackets++
+	d.stats.HCIRxBytes += uint64(len(pkt))
+	d.hci_snoop(pkt, true)
+	d.hci_track_credits(pkt)
+}
+
+// hci_consume releases the ring buffer space of the packets preceding next to the controller.
+func (d *Device) hci_consume(next uint32) error {
+	d.b2hReadPtr = next
+	d.hci_invalidate()
+	err := d.bp_write32(d.btaddr+whd.BTSDIO_OFFSET_BT2HOST_OUT, next)
+	if err != nil {
+		return err
+	}
+	return d.bt_toggle_intr()
+}
+
+// bt_ring_read reads len(dst) bytes from the controller-to-host ring buffer
+// starting at offset, wrapping around the end of the buffer. len(dst) must be a multiple of 4.
+// Returns the offset following the last byte read.
+func (d *Device) bt_ring_read(offset uint32, dst []byte) (uint32, error) {
+	if strictMode {
+		d.strict_check(offset < whd.BTSDIO_FWBUF_SIZE && offset%4 == 0 && len(dst)%4 == 0,
+			"invalid controller-to-host ring read", slog.Uint64("offset", uint64(offset)), slog.Int("len", len(dst)))
+	}
+	base := d.btaddr + whd.BTSDIO_OFFSET_HOST_READ_BUF
+	for len(dst) > 0 {
+		n := min(uint32(len(dst)), whd.BTSDIO_FWBUF_SIZE-offset)
+		err := d.bp_read(base+offset, dst[:n])
+		if err != nil {
+			return offset, err
+		}
+		offset = (offset + n) % whd.BTSDIO_FWBUF_SIZE
+		dst = dst[n:]
+	}
+	return offset, nil
+}
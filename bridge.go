@@ -0,0 +1,242 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errBridgeNoAP = errors.New("bridge requires a concurrent AP+STA SoftAP")
+
+const (
+	// bridgeTableLen is the amount of SoftAP clients tracked by the bridge.
+	bridgeTableLen = 16
+
+	ethHeaderLen    = 14
+	ethTypeIPv4     = 0x0800
+	ethTypeARP      = 0x0806
+	arpSenderHW     = ethHeaderLen + 8
+	arpSenderIP     = ethHeaderLen + 14
+	arpTargetHW     = ethHeaderLen + 18
+	arpTargetIP     = ethHeaderLen + 24
+	arpLen          = 28
+	ipv4HeaderLen   = 20
+	ipProtoUDP      = 17
+	dhcpFlagsOffset = 10 // Offset of flags in DHCP message.
+	dhcpFlagBcast   = 0x80
+)
+
+// bridgeState holds the state of the AP/STA bridge, see StartBridge.
+type bridgeState struct {
+	// apMAC is the MAC address of the SoftAP interface.
+	apMAC [6]byte
+	buf   [MTU]byte
+	table [bridgeTableLen]bridgeEntry
+	// age is incremented on every learned address to find the least recently used entry.
+	age uint32
+}
+
+// bridgeDir is the direction of a bridged frame.
+type bridgeDir uint8
+
+const (
+	bridgeOut   bridgeDir = iota // SoftAP client to upstream.
+	bridgeIn                     // Upstream to SoftAP client.
+	bridgeFlood                  // Upstream broadcast to SoftAP clients, not translated.
+)
+
+// bridgeEntry maps a SoftAP client's IPv4 address to its MAC address.
+type bridgeEntry struct {
+	ip   [4]byte
+	mac  [6]byte
+	used uint32
+}
+
+// StartBridge forwards frames between SoftAP clients and the upstream network
+// the station interface is joined to, turning the device into a range extender.
+// It requires a SoftAP started with APConfig.Concurrent set.
+//
+// Upstream access points only accept frames from their associated stations so
+// the bridge translates client MAC addresses to the station's own MAC address
+// (MAC NAT), learning client IPv4 addresses from their ARP and IPv4 traffic to
+// deliver replies. Only IPv4 and ARP are bridged. DHCP requests from clients
+// have the broadcast flag set so that upstream DHCP replies reach them.
+//
+// Broadcast frames and frames addressed to the device itself are still passed
+// to the receive handlers. Frames are forwarded during Poll; frames that cannot
+// be forwarded right away for lack of bus credit are dropped and counted in
+// Stats.BridgeDropped.
+func (d *Device) StartBridge() error {
+	d.lock()
+	defer d.unlock()
+	if !d.apUp || !d.apsta {
+		return errBridgeNoAP
+	}
+	var apMAC [6]byte
+	_, err := d.get_iovar_n("cur_etheraddr", d.apIface, apMAC[:])
+	if err != nil {
+		return err
+	}
+	if d.bridge == nil {
+		d.bridge = new(bridgeState)
+	}
+	*d.bridge = bridgeState{apMAC: apMAC}
+	d.info("StartBridge")
+	return nil
+}
+
+// StopBridge stops forwarding frames between the SoftAP and station interfaces.
+func (d *Device) StopBridge() {
+	d.lock()
+	defer d.unlock()
+	d.bridge = nil
+}
+
+// bridge_rx forwards a received Ethernet frame to the other interface if the
+// bridge is running. It reports whether the frame was consumed by the bridge,
+// in which case it must not be passed to the receive handlers.
+func (d *Device) bridge_rx(iface whd.IoctlInterface, pkt []byte) (consumed bool) {
+	if len(pkt) < ethHeaderLen {
+		return false
+	}
+	dstGroup := pkt[0]&1 != 0 // Broadcast or multicast.
+	switch iface {
+	case d.apIface:
+		if dst := [6]byte(pkt[0:6]); !dstGroup && (dst == d.bridge.apMAC || dst == d.mac) {
+			return false // Addressed to us.
+		}
+		d.bridge_tx(whd.IF_STA, pkt, bridgeOut)
+		return !dstGroup
+	case whd.IF_STA:
+		if dstGroup {
+			d.bridge_tx(d.apIface, pkt, bridgeFlood)
+			return false
+		}
+		return d.bridge_tx(d.apIface, pkt, bridgeIn)
+	}
+	return false
+}
+
+// bridge_tx copies pkt to the bridge buffer, translates it according to dir
+// and sends the result over iface. Returns false if translation rejected the frame.
+func (d *Device) bridge_tx(iface whd.IoctlInterface, pkt []byte, dir bridgeDir) bool {
+	br := d.bridge
+	if len(pkt) > len(br.buf) {
+		d.stats.BridgeDropped++
+		return false
+	}
+	frame := br.buf[:len(pkt)]
+	copy(frame, pkt)
+	ok := true
+	switch dir {
+	case bridgeOut:
+		ok = br.translateOut(&d.mac, frame)
+	case bridgeIn:
+		ok = br.translateIn(frame)
+	}
+	if !ok {
+		return false
+	}
+	// Waiting for credit would process further packets from within the receive path.
+	if !d.has_credit() || !d.isIfaceUp(iface) {
+		d.stats.BridgeDropped++
+		return true
+	}
+	if d.tx(iface, 0, frame) != nil {
+		d.stats.BridgeDropped++
+		return true
+	}
+	d.stats.BridgeForwarded++
+	return true
+}
+
+// translateOut rewrites a frame from a SoftAP client to be sent upstream with
+// the station's MAC address, learning the client's addresses.
+func (br *bridgeState) translateOut(staMAC *[6]byte, frame []byte) bool {
+	src := [6]byte(frame[6:12])
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case ethTypeARP:
+		if len(frame) < ethHeaderLen+arpLen {
+			return false
+		}
+		br.learn([4]byte(frame[arpSenderIP:]), src)
+		copy(frame[arpSenderHW:], staMAC[:])
+	case ethTypeIPv4:
+		if len(frame) < ethHeaderLen+ipv4HeaderLen {
+			return false
+		}
+		ip := frame[ethHeaderLen:]
+		br.learn([4]byte(ip[12:16]), src)
+		ihl := int(ip[0]&0xf) * 4
+		if ip[9] == ipProtoUDP && len(ip) >= ihl+8+dhcpFlagsOffset+1 {
+			udp := ip[ihl:]
+			if binary.BigEndian.Uint16(udp[0:2]) == 68 && binary.BigEndian.Uint16(udp[2:4]) == 67 {
+				udp[8+dhcpFlagsOffset] |= dhcpFlagBcast
+				udp[6], udp[7] = 0, 0 // Checksum is optional for UDP over IPv4.
+			}
+		}
+	default:
+		return false
+	}
+	copy(frame[6:12], staMAC[:])
+	return true
+}
+
+// translateIn rewrites a frame addressed to the station so it is delivered to
+// the SoftAP client owning the destination IPv4 address. Frames for unknown
+// addresses are rejected, as they are addressed to the device itself.
+func (br *bridgeState) translateIn(frame []byte) bool {
+	var dstIP [4]byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case ethTypeARP:
+		if len(frame) < ethHeaderLen+arpLen {
+			return false
+		}
+		dstIP = [4]byte(frame[arpTargetIP:])
+	case ethTypeIPv4:
+		if len(frame) < ethHeaderLen+ipv4HeaderLen {
+			return false
+		}
+		dstIP = [4]byte(frame[ethHeaderLen+16:])
+	default:
+		return false
+	}
+	mac, ok := br.lookup(dstIP)
+	if !ok {
+		return false
+	}
+	copy(frame[0:6], mac[:])
+	if binary.BigEndian.Uint16(frame[12:14]) == ethTypeARP {
+		copy(frame[arpTargetHW:], mac[:])
+	}
+	return true
+}
+
+func (br *bridgeState) learn(ip [4]byte, mac [6]byte) {
+	if ip == [4]byte{} {
+		return // Unconfigured client, i.e: during DHCP.
+	}
+	br.age++
+	oldest := 0
+	for i := range br.table {
+		e := &br.table[i]
+		if e.ip == ip {
+			e.mac, e.used = mac, br.age
+			return
+		} else if e.used < br.table[oldest].used {
+			oldest = i
+		}
+	}
+	br.table[oldest] = bridgeEntry{ip: ip, mac: mac, used: br.age}
+}
+
+func (br *bridgeState) lookup(ip [4]byte) (mac [6]byte, ok bool) {
+	for i := range br.table {
+		e := &br.table[i]
+		if e.used != 0 && e.ip == ip {
+			return e.mac, true
+		}
+	}
+	return mac, false
+}
@@ -6,17 +6,34 @@ package cyw43439
 import (
 	"encoding/binary"
 	"errors"
-	"log/slog"
+	"math/bits"
 	"time"
 	"unsafe"
 
+	"github.com/soypat/cyw43439/internal/slog"
 	"github.com/soypat/cyw43439/whd"
 	"golang.org/x/exp/constraints"
 )
 
+var errChipNotReset = errors.New("chip not reset by power cycle, check WL_REG_ON wiring and supply")
+
+const (
+	// spiRegTestRW is the gSPI read/write test register, clear out of reset.
+	spiRegTestRW  = 0x18
+	rwTestPattern = 0x12345678
+	// maxColdResets bounds the extended power cycles done on a chip which
+	// was not reset by the first power cycle of Init.
+	maxColdResets = 2
+	coldResetHold = 500 * time.Millisecond
+)
+
 type spibus struct {
 	spi cmdBus
 	cs  outputPin
+	// errs counts transactions the chip flagged with a command or data error.
+	errs uint32
+	// tap is called after every transaction, see AttachBusTap.
+	tap BusTap
 }
 
 func New(pwr, cs outputPin, spi cmdBus) *Device {
@@ -35,7 +52,10 @@ func (d *spibus) cmd_read(cmd uint32, buf []uint32) (status uint32, err error) {
 	d.csEnable(true)
 	err = d.spi.CmdRead(cmd, buf)
 	d.csEnable(false)
-	return d.spi.LastStatus(), err
+	if d.tap != nil {
+		d.tap_cmd(cmd, buf)
+	}
+	return d.status(), err
 }
 
 func (d *spibus) cmd_write(cmd uint32, buf []uint32) (status uint32, err error) {
@@ -43,7 +63,19 @@ func (d *spibus) cmd_write(cmd uint32, buf []uint32) (status uint32, err error)
 	d.csEnable(true)
 	err = d.spi.CmdWrite(cmd, buf)
 	d.csEnable(false)
-	return d.spi.LastStatus(), err
+	if d.tap != nil {
+		d.tap_cmd(cmd, buf)
+	}
+	return d.status(), err
+}
+
+// status returns the status word of the last transaction, counting errors.
+func (d *spibus) status() uint32 {
+	status := d.spi.LastStatus()
+	if Status(status).HostCommandDataError() {
+		d.errs++
+	}
+	return status
 }
 
 func (d *spibus) csEnable(b bool) {
@@ -54,25 +86,33 @@ func (d *spibus) Status() Status {
 	return Status(d.spi.LastStatus())
 }
 
-func (d *Device) initBus() error {
+func (d *Device) initBus(r *InitReport) error {
 	// https://github.com/embassy-rs/embassy/blob/26870082427b64d3ca42691c55a2cded5eadc548/cyw43/src/bus.rs#L51
-	d.Reset()
-	retries := 128
-	for {
-		got := d.read32_swapped(whd.SPI_READ_TEST_REGISTER)
-		if got == whd.TEST_PATTERN {
-			break
-		} else if retries <= 0 {
-			return errors.New("spi test failed:" + hex32(got))
+	d.power_cycle()
+	d.wordOrder = wordOrderSwap16
+	err := d.probe_word_order()
+	if err != nil {
+		return err
+	}
+	// A brown-out or a WL_REG_ON pulse too short for the chip's supply to
+	// discharge may leave the chip running with its previous bus setup and
+	// firmware. Such a chip fails later in Init, so power cycle it for longer.
+	for d.bus_stale() {
+		if r.ColdResets == maxColdResets {
+			return errChipNotReset
+		}
+		r.ColdResets++
+		d.warn("initBus:partial_reset", slog.Int("attempt", r.ColdResets))
+		d.cold_reset()
+		err = d.probe_word_order()
+		if err != nil {
+			return err
 		}
-		retries--
 	}
-	const RWTestPattern = 0x12345678
-	const spiRegTestRW = 0x18
-	d.write32_swapped(spiRegTestRW, RWTestPattern)
-	got := d.read32_swapped(spiRegTestRW)
-	if got != RWTestPattern {
-		return errors.New("spi test failed:" + hex32(got) + " wanted " + hex32(RWTestPattern))
+	d.write32_as(d.wordOrder, spiRegTestRW, rwTestPattern)
+	got := d.read32_as(d.wordOrder, spiRegTestRW)
+	if got != rwTestPattern {
+		return errors.New("spi test failed:" + hex32(got) + " wanted " + hex32(rwTestPattern))
 	}
 
 	// Address 0x0000 registers.
@@ -94,13 +134,38 @@ func (d *Device) initBus() error {
 			(1 << InterruptPolPos) | (1 << WakeUpPos) |
 			(1 << InterruptWithStatusPos) | (1 << StatusEnablePos)
 	)
-	val := d.read32_swapped(0)
+	val := d.read32_as(d.wordOrder, 0)
 
-	d.write32_swapped(whd.SPI_BUS_CONTROL, setupValue)
+	setup := uint32(setupValue)
+	if d.hostWake.ActiveLow {
+		setup &^= 1 << InterruptPolPos
+	}
+	// The rest of the driver needs the chip's 32 bit words to arrive as
+	// written. Little endian words do on hosts which send words most
+	// significant byte first; other hosts may need big endian words.
+	for _, bigEndian := range [2]bool{false, true} {
+		if bigEndian {
+			setup |= 1 << EndianessBigPos
+		}
+		d.write32_as(d.wordOrder, whd.SPI_BUS_CONTROL, setup)
+		got, err = d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
+		if err == nil && got == whd.TEST_PATTERN {
+			d.wordOrder = wordOrderNative
+			break
+		}
+		// The setup took effect, find out the resulting word order to retry.
+		err = d.probe_word_order()
+		if err != nil {
+			return err
+		}
+	}
+	if d.wordOrder != wordOrderNative {
+		return errors.New("spi word order unsupported, detected " + d.wordOrder.String())
+	}
 	got8, _ := d.read8(FuncBus, whd.SPI_BUS_CONTROL)
 	d.debug("read back bus ctl", slog.Uint64("got", uint64(got8)))
 
-	got, err := d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
+	got, err = d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
 
 	d.debug("current bus ctl", slog.Uint64("val", uint64(val)), slog.Uint64("got", uint64(got)))
 	if err != nil || got != whd.TEST_PATTERN {
@@ -108,12 +173,85 @@ func (d *Device) initBus() error {
 	}
 
 	got, err = d.read32(FuncBus, spiRegTestRW)
-	if err != nil || got != RWTestPattern {
+	if err != nil || got != rwTestPattern {
 		return errjoin(errors.New("spi RW test failed:"+hex32(got)), err)
 	}
 	return nil
 }
 
+// wordOrder is the transformation between the words the driver writes and
+// the words the chip reads, and vice versa, before the bus is configured.
+type wordOrder uint8
+
+const (
+	// wordOrderSwap16 is the order after power up: the chip takes 16 bit
+	// words, least significant first.
+	wordOrderSwap16 wordOrder = iota
+	// wordOrderNative is the order once the bus is configured, which is also
+	// found after power up if WL_REG_ON did not reset the chip.
+	wordOrderNative
+	// wordOrderReversed and wordOrderReversedSwap16 are found on hosts which
+	// send words least significant byte first.
+	wordOrderReversed
+	wordOrderReversedSwap16
+	numWordOrders
+)
+
+func (o wordOrder) String() string {
+	switch o {
+	case wordOrderSwap16:
+		return "swap16"
+	case wordOrderNative:
+		return "native"
+	case wordOrderReversed:
+		return "reversed"
+	case wordOrderReversedSwap16:
+		return "reversed-swap16"
+	}
+	return "wordOrder(" + hex32(uint32(o)) + ")"
+}
+
+// apply transforms w, which undoes the transformation.
+func (o wordOrder) apply(w uint32) uint32 {
+	switch o {
+	case wordOrderSwap16:
+		return swap16(w)
+	case wordOrderReversed:
+		return bits.ReverseBytes32(w)
+	case wordOrderReversedSwap16:
+		return swap16(bits.ReverseBytes32(w))
+	}
+	return w
+}
+
+// bus_stale reports whether the chip's bus registers kept the values set by a
+// previous Init across a power cycle, meaning the chip was not reset: out of
+// reset the bus uses 16 bit words and the read/write test register is clear.
+func (d *Device) bus_stale() bool {
+	const WordLength32 = 1
+	ctl := d.read32_as(d.wordOrder, whd.SPI_BUS_CONTROL)
+	return ctl&WordLength32 != 0 || d.read32_as(d.wordOrder, spiRegTestRW) == rwTestPattern
+}
+
+// probe_word_order sets d.wordOrder to the order for which the test register
+// reads the test pattern, retrying while the chip boots.
+func (d *Device) probe_word_order() error {
+	var got uint32
+	for retries := 128; retries >= 0; retries-- {
+		for o := wordOrderSwap16; o < numWordOrders; o++ {
+			got = d.read32_as(o, whd.SPI_READ_TEST_REGISTER)
+			if got == whd.TEST_PATTERN {
+				if o != d.wordOrder {
+					d.info("probe_word_order", slog.String("order", o.String()))
+				}
+				d.wordOrder = o
+				return nil
+			}
+		}
+	}
+	return errors.New("spi test failed:" + hex32(got))
+}
+
 func (d *Device) core_disable(coreID uint8) error {
 	base := coreaddress(coreID)
 
@@ -126,7 +264,7 @@ func (d *Device) core_disable(coreID uint8) error {
 
 	d.bp_write8(base+whd.AI_IOCTRL_OFFSET, 0)
 	d.bp_read8(base + whd.AI_IOCTRL_OFFSET) // Another dummy read.
-	time.Sleep(time.Millisecond)
+	d.sleep(time.Millisecond)
 
 	d.bp_write8(base+whd.AI_RESETCTRL_OFFSET, whd.AIRC_RESET)
 	r, _ = d.bp_read8(base + whd.AI_RESETCTRL_OFFSET)
@@ -151,11 +289,11 @@ func (d *Device) core_reset(coreID uint8, coreHalt bool) error {
 	d.bp_read8(base + whd.AI_IOCTRL_OFFSET) // Dummy read.
 
 	d.bp_write8(base+whd.AI_RESETCTRL_OFFSET, 0)
-	time.Sleep(time.Millisecond)
+	d.sleep(time.Millisecond)
 
 	d.bp_write8(base+whd.AI_IOCTRL_OFFSET, whd.SICF_CLOCK_EN|cpuhaltFlag)
 	d.bp_read8(base + whd.AI_IOCTRL_OFFSET) // Dummy read.
-	time.Sleep(time.Millisecond)
+	d.sleep(time.Millisecond)
 	return nil
 }
 
@@ -237,28 +375,36 @@ func decodeSharedMemLog(order binary.ByteOrder, buf []byte) (s sharedMemLog) {
 
 func (d *Device) wlan_read(buf []uint32, lenInBytes int) (err error) {
 	// d.trace("wlan_read:start")
+	if err = d.bus_awake(); err != nil {
+		return err
+	}
 	cmd := cmd_word(false, true, FuncWLAN, 0, uint32(lenInBytes))
 	lenU32 := (lenInBytes + 3) / 4
 	_, err = d.spi.cmd_read(cmd, buf[:lenU32])
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	return err
 }
 
 func (d *Device) wlan_write(data []uint32, plen uint32) (err error) {
 	// d.trace("wlan_write:start")
+	if err = d.bus_awake(); err != nil {
+		return err
+	}
 	cmd := cmd_word(true, true, FuncWLAN, 0, plen)
 	_, err = d.spi.cmd_write(cmd, data)
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	return err
 }
 
 func (d *Device) bp_read(addr uint32, data []byte) (err error) {
 	// d.trace("bp_read:start")
+	if err = d.bus_awake(); err != nil {
+		return err
+	}
 	const maxTxSize = whd.BUS_SPI_MAX_BACKPLANE_TRANSFER_SIZE
 	alignedLen := align(uint32(len(data)), 4)
 	data = data[:alignedLen]
-	// buf := d._iovarBuf[:maxTxSize/4+1]
-	var buf [maxTxSize/4 + 1]uint32 // TODO: heapalloc replace.
+	buf := d._bpReadBuf[:]
 	buf8 := unsafeAsSlice[uint32, byte](buf[:])
 	for len(data) > 0 {
 		// Calculate address and length of next write.
@@ -282,7 +428,7 @@ func (d *Device) bp_read(addr uint32, data []byte) (err error) {
 		addr += lenBytes
 		data = data[lenBytes:]
 	}
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	return err
 }
 
@@ -295,8 +441,12 @@ func (d *Device) bp_writestring(addr uint32, data string) error {
 func (d *Device) bp_write(addr uint32, data []byte) (err error) {
 	if addr%4 != 0 {
 		return errors.New("addr must be 4-byte aligned")
+	} else if err = d.bus_awake(); err != nil {
+		return err
+	}
+	if d.logenabled(slog.LevelDebug) {
+		d.debug("bp_write", slog.Uint64("addr", uint64(addr)))
 	}
-	d.debug("bp_write", slog.Uint64("addr", uint64(addr)))
 
 	const maxTxSize = whd.BUS_SPI_MAX_BACKPLANE_TRANSFER_SIZE
 	// var buf [maxTxSize]byte
@@ -322,7 +472,7 @@ func (d *Device) bp_write(addr uint32, data []byte) (err error) {
 		addr += length
 		data = data[length:]
 	}
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	if d.isTraceEnabled() {
 		d.trace("bp_write:done", slog.String("status", d.status().String()))
 	}
@@ -430,15 +580,25 @@ func (d *Device) write8(fn Function, addr uint32, val uint8) error {
 
 // writen is primitive SPI write function for <= 4 byte writes.
 func (d *Device) writen(fn Function, addr, val, size uint32) (err error) {
+	if fn != FuncBus {
+		if err = d.bus_awake(); err != nil {
+			return err
+		}
+	}
 	cmd := cmd_word(true, true, fn, addr, size)
 	d.rwBuf = [2]uint32{val, 0}
 	_, err = d.spi.cmd_write(cmd, d.rwBuf[:1])
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	return err
 }
 
 // readn is primitive SPI read function for <= 4 byte reads.
 func (d *Device) readn(fn Function, addr, size uint32) (result uint32, err error) {
+	if fn != FuncBus {
+		if err = d.bus_awake(); err != nil {
+			return 0, err
+		}
+	}
 	cmd := cmd_word(false, true, fn, addr, size)
 	buf := d.rwBuf[:]
 	var padding uint32
@@ -446,21 +606,23 @@ func (d *Device) readn(fn Function, addr, size uint32) (result uint32, err error
 		padding = 1
 	}
 	_, err = d.spi.cmd_read(cmd, buf[:1+padding])
-	d.lastStatusGet = time.Now()
+	d.lastStatusGet = d.now()
 	return buf[padding], err
 }
 
-func (d *Device) read32_swapped(addr uint32) uint32 {
+// read32_as reads a bus register with the word order o, see wordOrder.
+func (d *Device) read32_as(o wordOrder, addr uint32) uint32 {
 	cmd := cmd_word(false, true, FuncBus, addr, 4)
-	cmd = swap16(cmd)
 	buf := d.rwBuf[:1]
-	d.spi.cmd_read(cmd, buf)
-	return swap16(buf[0])
+	d.spi.cmd_read(o.apply(cmd), buf)
+	return o.apply(buf[0])
 }
-func (d *Device) write32_swapped(addr uint32, value uint32) {
+
+// write32_as writes a bus register with the word order o, see wordOrder.
+func (d *Device) write32_as(o wordOrder, addr uint32, value uint32) {
 	cmd := cmd_word(true, true, FuncBus, addr, 4)
-	d.rwBuf = [2]uint32{swap16(value), 0}
-	d.spi.cmd_write(swap16(cmd), d.rwBuf[:1])
+	d.rwBuf = [2]uint32{o.apply(value), 0}
+	d.spi.cmd_write(o.apply(cmd), d.rwBuf[:1])
 }
 
 func u32AsU8(buf []uint32) []byte {
@@ -4,12 +4,17 @@ package cyw43439
 
 import (
 	"encoding/binary"
+
+	"github.com/soypat/cyw43439/gspi"
 )
 
 var _busOrder = binary.LittleEndian
 
-type cmdBus interface {
-	CmdRead(cmd uint32, buf []uint32) error
-	CmdWrite(cmd uint32, buf []uint32) error
-	LastStatus() uint32
+// cmdBus is any gSPI bus, i.e: gspi.SPI over an SPI peripheral.
+type cmdBus = gspi.CmdBus
+
+// crc_bus returns the bus as a CRCBus if it implements it.
+func (d *spibus) crc_bus() (gspi.CRCBus, bool) {
+	b, ok := d.spi.(gspi.CRCBus)
+	return b, ok
 }
@@ -6,36 +6,16 @@ import (
 	"encoding/binary"
 	"machine"
 
-	pio "github.com/tinygo-org/pio/rp2-pio"
-	"github.com/tinygo-org/pio/rp2-pio/piolib"
+	"github.com/soypat/cyw43439/gspi"
 )
 
 var _busOrder = binary.LittleEndian
 
-type cmdBus struct {
-	piolib.SPI3w
-}
+type cmdBus = gspi.PIO
 
+// NewPicoWCmdBus returns the PIO gSPI bus of the Pico W, see gspi.NewPicoWPIO.
 func NewPicoWCmdBus(baud uint32) (cmdBus, error) {
-	const (
-		DATA_OUT = machine.GPIO24
-		DATA_IN  = DATA_OUT
-		CLK      = machine.GPIO29
-	)
-	sm, err := pio.PIO0.ClaimStateMachine()
-	if err != nil {
-		panic(err.Error())
-	}
-	spi, err := piolib.NewSPI3w(sm, DATA_IN, CLK, baud)
-	if err != nil {
-		panic(err.Error())
-	}
-	spi.EnableStatus(true)
-	err = spi.EnableDMA(true)
-	if err != nil {
-		panic(err.Error())
-	}
-	return cmdBus{*spi}, nil
+	return gspi.NewPicoWPIO(baud)
 }
 
 func NewPicoWDevice() *Device {
@@ -51,9 +31,21 @@ func NewPicoWDevice() *Device {
 	WL_REG_ON.Configure(machine.PinConfig{Mode: machine.PinOutput})
 	CS.Configure(machine.PinConfig{Mode: machine.PinOutput})
 	CS.High()
-	cmd, err := NewPicoWCmdBus(25000_000 - 1)
+	cmd, err := NewPicoWCmdBus(defaultBusClock)
 	if err != nil {
 		panic(err)
 	}
 	return New(WL_REG_ON.Set, CS.Set, cmd)
 }
+
+// PicoWHostWake returns the Pico W host-wake configuration, where WL_HOST_WAKE
+// shares GPIO24 with the gSPI data line so it is read but never reconfigured.
+func PicoWHostWake() HostWakeConfig {
+	return HostWakeConfig{Get: machine.GPIO24.Get}
+}
+
+// crc_bus returns the bus as a CRCBus if it implements it.
+func (d *spibus) crc_bus() (gspi.CRCBus, bool) {
+	b, ok := any(&d.spi).(gspi.CRCBus)
+	return b, ok
+}
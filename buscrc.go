@@ -0,0 +1,46 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errBusNoCRC = errors.New("bus does not implement gspi.CRCBus")
+
+// SetBusCRC enables or disables gSPI error checking of commands and data at
+// runtime. With error checking the chip verifies a check sequence sent along
+// with each transaction and flags the transactions which fail it in the
+// status word; failures are counted in Stats.BusCRCErrors. Counting failures
+// quantifies marginal wiring, such as long jumper wires, at the cost of the
+// throughput taken by the check sequences. The bus must implement
+// gspi.CRCBus, which generates the check sequences. Init disables error checking.
+func (d *Device) SetBusCRC(enable bool) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	bus, ok := d.spi.crc_bus()
+	if !ok {
+		return errBusNoCRC
+	}
+	v, err := d.read8(FuncBus, whd.SPI_STATUS_ENABLE)
+	if err != nil {
+		return err
+	}
+	const bits = whd.CMD_ERR_CHK_EN | whd.DATA_ERR_CHK_EN
+	if enable {
+		v |= bits
+	} else {
+		v &^= bits
+	}
+	// The register write still uses the previous setting, the host switches after it.
+	err = d.write8(FuncBus, whd.SPI_STATUS_ENABLE, v)
+	if err != nil {
+		return err
+	}
+	d.info("SetBusCRC", slog.Bool("enable", enable))
+	return bus.SetCRC(enable)
+}
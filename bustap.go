@@ -0,0 +1,76 @@
+package cyw43439
+
+import (
+	"io"
+	"strconv"
+)
+
+// Directions of the transactions passed to a bus tap, see AttachBusTap.
+const (
+	BusTapRead  uint32 = 0
+	BusTapWrite uint32 = 1
+)
+
+// BusTap receives every gSPI transaction, see AttachBusTap.
+type BusTap func(dir, fn, addr uint32, data []byte)
+
+// AttachBusTap calls tap after every gSPI transaction with its direction
+// (BusTapRead or BusTapWrite), function (see Function), register or backplane
+// window address and the data transferred, without the response delay padding
+// of backplane reads. Transactions done before the bus is configured during
+// Init are passed as sent, with their command word still byte swapped.
+//
+// The tap is called with the device lock held and must not call Device
+// methods nor retain data. It adds a call per transaction so it is meant for
+// protocol debugging and recording traces, i.e: with NewHexDumpTap.
+// The tap is kept across Init. Passing nil detaches the tap.
+func (d *Device) AttachBusTap(tap BusTap) {
+	d.lock()
+	defer d.unlock()
+	d.spi.tap = tap
+}
+
+// tap_cmd passes the transaction of command word cmd to the attached tap.
+func (d *spibus) tap_cmd(cmd uint32, buf []uint32) {
+	dir, fn := cmd>>31, (cmd>>28)&0b11
+	data := u32AsU8(buf)
+	if dir == BusTapRead && fn == uint32(FuncBackplane) {
+		data = data[min(4, len(data)):]
+	}
+	n := int(cmd & 0x7ff)
+	if n == 0 {
+		n = 2048 // Packet length field overflows for full size packets.
+	}
+	d.tap(dir, fn, (cmd>>11)&0x1ffff, data[:min(n, len(data))])
+}
+
+// NewHexDumpTap returns a bus tap writing a line per transaction to w:
+//
+//	W 1 0x1000e 4 2c000000
+//
+// with the direction (R or W), function, address, length in bytes and the
+// data in hex. Write errors are ignored.
+func NewHexDumpTap(w io.Writer) BusTap {
+	var line []byte
+	return func(dir, fn, addr uint32, data []byte) {
+		line = line[:0]
+		if dir == BusTapWrite {
+			line = append(line, 'W', ' ')
+		} else {
+			line = append(line, 'R', ' ')
+		}
+		line = strconv.AppendUint(line, uint64(fn), 10)
+		line = append(line, " 0x"...)
+		line = strconv.AppendUint(line, uint64(addr), 16)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, int64(len(data)), 10)
+		line = append(line, ' ')
+		for _, b := range data {
+			line = append(line, hexDigits[b>>4], hexDigits[b&0xf])
+		}
+		line = append(line, '\n')
+		w.Write(line)
+	}
+}
+
+const hexDigits = "0123456789abcdef"
@@ -0,0 +1,170 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errChanimVersion = errors.New("unsupported chanim_stats version")
+
+// chanim_stats iovar layout, see wl_chanim_stats_t and chanim_stats_v2_t.
+const (
+	chanimVersion   = 2
+	chanimCountOne  = 1
+	chanimHeaderLen = 12 // buflen, version and count.
+	chanimStatsLen  = 36
+	// Indices of ccastats, time spent in each state in percent.
+	ccaTxDur  = 0 // Transmitting.
+	ccaInBSS  = 1 // Receiving frames of our BSS.
+	ccaOBSS   = 2 // Receiving frames of other BSSs.
+	ccaNoCat  = 3 // Busy, not attributable to a frame.
+	ccaNoPkt  = 4 // Busy with energy not decoded as a frame.
+	ccaDoze   = 5 // Radio asleep.
+	ccaTxOp   = 6 // Transmit opportunity available.
+	ccaNStats = 9 // Length of ccastats, background noise follows.
+
+	defaultCarrierMaxBusy = 60
+)
+
+// ChannelLoad is the clear channel assessment of the operating channel
+// measured by the firmware over its last sampling interval, see Device.ChannelLoad.
+// Percentages are of the time spent in each state during the interval.
+type ChannelLoad struct {
+	Channel uint8
+	// Tx is the percentage of time the device spent transmitting.
+	Tx uint8
+	// InBSS and OBSS are the percentages of time receiving frames of the joined
+	// BSS and of other BSSs sharing the channel.
+	InBSS uint8
+	OBSS  uint8
+	// NoCategory and NoPacket are the percentages of time the channel was busy
+	// with energy not attributable to a frame, i.e: non WiFi interference.
+	NoCategory uint8
+	NoPacket   uint8
+	// Doze is the percentage of time the radio was asleep.
+	Doze uint8
+	// TxOpportunity is the percentage of time the device could have transmitted.
+	TxOpportunity uint8
+	// Idle is the percentage of time the channel was idle.
+	Idle uint8
+	// Noise is the background noise in dBm.
+	Noise int8
+	// Glitches and BadPLCP count receive glitches and frames with bad
+	// PLCP headers, both signs of interference.
+	Glitches uint32
+	BadPLCP  uint32
+}
+
+// Busy returns the percentage of time the channel was occupied by other
+// transmitters or interference, excluding the device's own transmissions.
+func (l ChannelLoad) Busy() uint8 {
+	busy := int(l.InBSS) + int(l.OBSS) + int(l.NoCategory) + int(l.NoPacket)
+	return uint8(min(busy, 100))
+}
+
+// CarrierCheck configures CarrierClear.
+type CarrierCheck struct {
+	// MaxBusy is the busy percentage, see ChannelLoad.Busy, above which the
+	// channel is considered saturated. Zero selects 60%.
+	MaxBusy uint8
+	// MaxAge is how long a measurement is reused by CarrierClear so calling
+	// it before every transmission does not cost an IOCTL each. Zero measures
+	// on every call.
+	MaxAge time.Duration
+}
+
+// carrierState caches the last ChannelLoad measured by CarrierClear.
+type carrierState struct {
+	cfg  CarrierCheck
+	load ChannelLoad
+	at   time.Time
+}
+
+// ChannelLoad returns the clear channel assessment statistics of the
+// operating channel, which allow latency sensitive applications to defer
+// bulk transfers while the channel is saturated. See CarrierClear.
+func (d *Device) ChannelLoad() (ChannelLoad, error) {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return ChannelLoad{}, errDeviceNotInit
+	}
+	return d.channel_load()
+}
+
+func (d *Device) channel_load() (load ChannelLoad, err error) {
+	const respLen = chanimHeaderLen + chanimStatsLen
+	buf8 := u32AsU8(d._iovarBuf[:])
+	n := copy(buf8, "chanim_stats")
+	buf8[n] = 0
+	n++
+	_busOrder.PutUint32(buf8[n:], respLen)
+	_busOrder.PutUint32(buf8[n+4:], chanimVersion)
+	_busOrder.PutUint32(buf8[n+8:], chanimCountOne)
+	n += chanimHeaderLen
+	length := max(n, respLen)
+	clear(buf8[n:length])
+	// The firmware writes the response over the request.
+	plen, err := d.doIoctlGet(whd.WLC_GET_VAR, whd.IF_STA, buf8[:length])
+	if err != nil {
+		return load, err
+	} else if plen < respLen || _busOrder.Uint32(buf8[4:8]) != chanimVersion {
+		return load, errChanimVersion
+	}
+	st := buf8[chanimHeaderLen:respLen]
+	load = ChannelLoad{
+		Glitches:      _busOrder.Uint32(st[0:4]),
+		BadPLCP:       _busOrder.Uint32(st[4:8]),
+		Tx:            st[8+ccaTxDur],
+		InBSS:         st[8+ccaInBSS],
+		OBSS:          st[8+ccaOBSS],
+		NoCategory:    st[8+ccaNoCat],
+		NoPacket:      st[8+ccaNoPkt],
+		Doze:          st[8+ccaDoze],
+		TxOpportunity: st[8+ccaTxOp],
+		Noise:         int8(st[8+ccaNStats]),
+		Channel:       uint8(_busOrder.Uint16(st[18:20]) & whd.CHANSPEC_CHAN_MASK),
+		Idle:          st[32],
+	}
+	return load, nil
+}
+
+// SetCarrierCheck configures CarrierClear.
+func (d *Device) SetCarrierCheck(cfg CarrierCheck) {
+	d.lock()
+	defer d.unlock()
+	if cfg.MaxBusy == 0 {
+		cfg.MaxBusy = defaultCarrierMaxBusy
+	}
+	d.carrier = carrierState{cfg: cfg}
+}
+
+// CarrierClear is a listen before send check: it reports whether the
+// operating channel is busy less than the threshold set with SetCarrierCheck,
+// 60% by default, along with the measurement it is based on. Applications
+// call it before a large transmission and defer it while the channel is
+// saturated so latency sensitive traffic is not delayed further.
+func (d *Device) CarrierClear() (ok bool, load ChannelLoad, err error) {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return false, load, errDeviceNotInit
+	}
+	c := &d.carrier
+	maxBusy := c.cfg.MaxBusy
+	if maxBusy == 0 {
+		maxBusy = defaultCarrierMaxBusy
+	}
+	if c.at.IsZero() || c.cfg.MaxAge == 0 || d.since(c.at) > c.cfg.MaxAge {
+		load, err = d.channel_load()
+		if err != nil {
+			return false, load, err
+		}
+		c.load, c.at = load, d.now()
+		d.debug("CarrierClear:measure", slog.Int("busy", int(load.Busy())), slog.Int("idle", int(load.Idle)))
+	}
+	return c.load.Busy() <= maxBusy, c.load, nil
+}
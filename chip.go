@@ -0,0 +1,111 @@
+package cyw43439
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errChipUnknown = errors.New("unsupported chip ID")
+	errChipNVRAM   = errors.New("chip has no default NVRAM, set Config.NVRAM or a FirmwareVariant")
+)
+
+// Chip IDs read from the chipcommon core. CYW43438 and CYW4343W report the
+// CYW43430 ID and share its firmware.
+const (
+	Chip43439 uint16 = 43439
+	Chip43430 uint16 = 43430
+)
+
+// ChipInfo identifies the chip detected by Init, see Device.ChipInfo.
+type ChipInfo struct {
+	ID   uint16
+	Rev  uint8
+	Name string
+}
+
+func (c ChipInfo) String() string {
+	return c.Name + " rev " + strconv.Itoa(int(c.Rev))
+}
+
+// FirmwareVariant is the firmware for a chip other than the CYW43439, selected
+// by Init when the detected chip ID matches, see Config.Variants.
+type FirmwareVariant struct {
+	ChipID   uint16
+	Firmware string
+	CLM      string
+	// NVRAM is the board configuration. Required since only the Pico W NVRAM is embedded.
+	NVRAM string
+}
+
+// chipQuirks holds the differences between supported chips. All share the
+// CYW43439 core layout (see coreaddress) and backplane registers.
+type chipQuirks struct {
+	id   uint16
+	name string
+	// ramSize is the size of chip RAM, NVRAM is written at its end.
+	ramSize uint32
+	// srmemSize is the RAM at the end of chip RAM reserved for save/restore.
+	srmemSize uint32
+	// nvram is the default board configuration, empty if none is embedded.
+	nvram string
+	// bands are the WiFi bands the chip operates in.
+	bands Band
+}
+
+var chipTable = [...]chipQuirks{
+	{id: Chip43439, name: "CYW43439", ramSize: 512 * 1024, srmemSize: 64 * 1024, nvram: nvram43439, bands: Band2G4},
+	{id: Chip43430, name: "CYW43438/CYW4343W", ramSize: 512 * 1024, srmemSize: 64 * 1024, bands: Band2G4},
+}
+
+// ChipInfo returns the chip detected by the last Init.
+func (d *Device) ChipInfo() (ChipInfo, error) {
+	d.lock()
+	defer d.unlock()
+	if d.chip == nil {
+		return ChipInfo{}, errDeviceNotInit
+	}
+	return ChipInfo{ID: d.chip.id, Rev: d.chipRev, Name: d.chip.name}, nil
+}
+
+// chip_detect reads the chipcommon chip ID register and looks up the chip's quirks.
+//
+//	reference: whd_chip_get_chip_id
+func (d *Device) chip_detect() (id uint16, err error) {
+	reg, err := d.bp_read32(whd.CHIPCOMMON_BASE_ADDRESS)
+	if err != nil {
+		return 0, err
+	}
+	id = uint16(reg)
+	for i := range chipTable {
+		if chipTable[i].id == id {
+			d.chip = &chipTable[i]
+			d.chipRev = uint8(reg>>16) & 0xf
+			d.info("chip_detect", slog.String("chip", d.chip.name), slog.Int("rev", int(d.chipRev)))
+			return id, nil
+		}
+	}
+	d.logerr("chip_detect", slog.Uint64("id", uint64(id)))
+	return id, errChipUnknown
+}
+
+// chip_firmware returns cfg with the firmware of the variant matching the
+// detected chip and the chip's default NVRAM if none is set.
+func (d *Device) chip_firmware(cfg Config) (Config, error) {
+	for _, v := range cfg.Variants {
+		if v.ChipID == d.chip.id {
+			cfg.Firmware, cfg.CLM, cfg.NVRAM = v.Firmware, v.CLM, v.NVRAM
+			break
+		}
+	}
+	if cfg.NVRAM == "" {
+		cfg.NVRAM = d.chip.nvram
+	}
+	if cfg.NVRAM == "" {
+		return cfg, errChipNVRAM
+	}
+	return cfg, nil
+}
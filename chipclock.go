@@ -0,0 +1,155 @@
+package cyw43439
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errClockInvalid  = errors.New("invalid chip clock")
+	errClockNotHeld  = errors.New("chip clock released more times than requested")
+	errClockTimeout  = errors.New("timeout waiting for requested chip clock")
+	errClockOverflow = errors.New("too many chip clock requests")
+)
+
+// clockTimeout is the time to wait for a requested clock to become available.
+const clockTimeout = 20 * time.Millisecond
+
+// ChipClock is a backplane clock which may be requested from the chip, see Device.RequestClock.
+type ChipClock uint8
+
+const (
+	// ClockALP is the always-on low power clock, sufficient for backplane register access.
+	ClockALP ChipClock = iota
+	// ClockHT is the high throughput clock which WLAN and Bluetooth cores run on.
+	// The HT clock being available implies the ALP clock is too.
+	ClockHT
+	numClocks
+)
+
+func (c ChipClock) String() string {
+	switch c {
+	case ClockALP:
+		return "ALP"
+	case ClockHT:
+		return "HT"
+	}
+	return "ChipClock(" + hex32(uint32(c)) + ")"
+}
+
+// ClockStatus is the state of the chip clocks and the driver's outstanding requests.
+type ClockStatus struct {
+	// ALPAvailable and HTAvailable are set when the chip reports the clock running.
+	ALPAvailable bool
+	HTAvailable  bool
+	// ALPRequests and HTRequests are the outstanding RequestClock calls.
+	ALPRequests uint8
+	HTRequests  uint8
+	// CSR is the raw chip clock control and status register.
+	CSR uint8
+}
+
+// RequestClock requests the chip keep clk running and waits for it to become
+// available. Requests are reference counted: the clock stays requested until
+// ReleaseClock is called once per RequestClock call. Applications implementing
+// their own low power flows can use this to keep the backplane accessible
+// while the firmware would otherwise let the chip sleep.
+// The driver itself keeps the ALP clock requested from Init onwards, or forces
+// the HT clock if the save/restore engine is enabled, see SaveRestoreEnabled.
+// Requests are cleared when the device is reset.
+func (d *Device) RequestClock(clk ChipClock) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if clk >= numClocks {
+		return errClockInvalid
+	} else if d.clkRefs[clk] == 255 {
+		return errClockOverflow
+	}
+	d.clkRefs[clk]++
+	if d.clkRefs[clk] > 1 {
+		return nil // Already requested and available.
+	}
+	err := d.clock_update()
+	if err != nil {
+		d.clkRefs[clk]--
+		return err
+	}
+	avail := uint8(whd.SBSDIO_ALP_AVAIL)
+	if clk == ClockHT {
+		avail = whd.SBSDIO_HT_AVAIL
+	}
+	if _, ok := d.clock_wait(avail, clockTimeout); !ok {
+		d.clkRefs[clk]--
+		d.clock_update()
+		return errClockTimeout
+	}
+	return nil
+}
+
+// ReleaseClock releases a request made with RequestClock. Once all requests
+// are released the chip is free to manage its clocks, i.e: to gate them when idle.
+func (d *Device) ReleaseClock(clk ChipClock) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if clk >= numClocks {
+		return errClockInvalid
+	} else if d.clkRefs[clk] == 0 {
+		return errClockNotHeld
+	}
+	d.clkRefs[clk]--
+	if d.clkRefs[clk] > 0 {
+		return nil
+	}
+	return d.clock_update()
+}
+
+// ClockStatus reads the chip clock state.
+func (d *Device) ClockStatus() (ClockStatus, error) {
+	d.lock()
+	defer d.unlock()
+	st := ClockStatus{ALPRequests: d.clkRefs[ClockALP], HTRequests: d.clkRefs[ClockHT]}
+	if !d.initialized {
+		return st, errDeviceNotInit
+	}
+	csr, err := d.read8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR)
+	st.CSR = csr
+	st.ALPAvailable = csr&whd.SBSDIO_ALP_AVAIL != 0
+	st.HTAvailable = csr&whd.SBSDIO_HT_AVAIL != 0
+	return st, err
+}
+
+// clock_update writes the clock request bits of the driver and the outstanding requests.
+func (d *Device) clock_update() error {
+	req := d.clkBase
+	if d.clkRefs[ClockALP] > 0 {
+		req |= whd.SBSDIO_ALP_AVAIL_REQ
+	}
+	if d.clkRefs[ClockHT] > 0 {
+		req |= whd.SBSDIO_HT_AVAIL_REQ
+	}
+	d.debug("clock_update", slog.Uint64("req", uint64(req)))
+	return d.write8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR, req)
+}
+
+// clock_wait waits until any of the avail bits are set in the chip clock
+// control and status register, returning the last value read.
+func (d *Device) clock_wait(avail uint8, timeout time.Duration) (csr uint8, ok bool) {
+	deadline := d.now().Add(timeout)
+	for {
+		csr, _ = d.read8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR)
+		if csr&avail != 0 {
+			return csr, true
+		} else if d.since(deadline) >= 0 {
+			return csr, false
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,69 @@
+package cyw43439
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by the driver for delays, timeouts and
+// packet timestamps. Replacing it allows simulated devices and tests to run
+// the driver's wait and timeout logic instantly and deterministically, and
+// ports running under an RTOS to sleep with the RTOS's primitives so other
+// tasks run while the driver waits on the chip, see SetLocker.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// SetClock sets the time source used by the device. If nil the system clock is used.
+// SetClock should be called before Init.
+func (d *Device) SetClock(c Clock) {
+	d.lock()
+	defer d.unlock()
+	d.clock = c
+}
+
+func (d *Device) now() time.Time {
+	if d.clock == nil {
+		return time.Now()
+	}
+	return d.clock.Now()
+}
+
+func (d *Device) since(t time.Time) time.Duration {
+	return d.now().Sub(t)
+}
+
+func (d *Device) sleep(dur time.Duration) {
+	if d.clock == nil {
+		time.Sleep(dur)
+		return
+	}
+	d.clock.Sleep(dur)
+}
+
+// NopLocker is a sync.Locker which does nothing, for bare-metal superloops
+// where the device is only used from a single thread of execution and
+// interrupt handlers only call ISRNotify. See SetLocker.
+type NopLocker struct{}
+
+func (NopLocker) Lock()   {}
+func (NopLocker) Unlock() {}
+
+// SetLocker replaces the mutex serializing access to the device, i.e: with
+// an RTOS mutex for ports where the Go runtime does not schedule the tasks
+// using the device, or NopLocker where there is a single task. The lock is
+// not reentrant: driver callbacks are called with it held. SetLocker must be
+// called before the device is used and never concurrently with other methods.
+// If nil the device's sync.Mutex is used.
+func (d *Device) SetLocker(l sync.Locker) {
+	d.locker = l
+}
+
+// mutex returns the lock serializing access to the device.
+func (d *Device) mutex() sync.Locker {
+	if d.locker != nil {
+		return d.locker
+	}
+	return &d.mu
+}
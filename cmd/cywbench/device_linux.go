@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+import (
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/gspi"
+)
+
+// openDevice brings up the Bluetooth controller of a CYW43439 wired to
+// spidev and GPIO lines. The returned function powers it down.
+func openDevice(cfg deviceFlags) (*cyw43439.Device, func(), error) {
+	bus, err := gspi.OpenSPIDev(cfg.spi, uint32(cfg.hz), cfg.threeWire)
+	if err != nil {
+		return nil, nil, err
+	}
+	pwrLine, err := gspi.OpenOutput(cfg.gpiochip, uint32(cfg.pwr))
+	if err != nil {
+		bus.Close()
+		return nil, nil, err
+	}
+	csLine, err := gspi.OpenOutput(cfg.gpiochip, uint32(cfg.cs))
+	if err != nil {
+		pwrLine.Close()
+		bus.Close()
+		return nil, nil, err
+	}
+	dev := cyw43439.New(pwrLine.Set, csLine.Set, gspi.NewSPI(bus))
+	closeAll := func() {
+		dev.Close()
+		csLine.Close()
+		pwrLine.Close()
+		bus.Close()
+	}
+	btcfg := cyw43439.DefaultBluetoothConfig()
+	btcfg.HCIReadTimeout = time.Second
+	err = dev.Init(btcfg)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return dev, closeAll, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439"
+)
+
+func openDevice(cfg deviceFlags) (*cyw43439.Device, func(), error) {
+	return nil, nil, errors.New("hci mode requires a CYW43439 wired to Linux spidev")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// H4 packet types and HCI opcodes and events used in HCI loopback mode.
+const (
+	hciCommandPkt = 0x01
+	hciACLPkt     = 0x02
+	hciEventPkt   = 0x04
+
+	opReset            = 0x0c03
+	opWriteLoopback    = 0x1802
+	loopbackLocal      = 0x01
+	evtConnComplete    = 0x03
+	evtCommandComplete = 0x0e
+)
+
+var errLoopbackHandle = errors.New("no connection handle for loopback")
+
+// hciConn is the HCI transport of the device under test, implemented by
+// *cyw43439.Device.
+type hciConn interface {
+	WriteHCI(b []byte) (int, error)
+	ReadHCIPacket(b []byte) (int, error)
+}
+
+// hciBench runs ACL packets through the Bluetooth controller in local
+// loopback mode, measuring the round trip latency and throughput of HCI
+// traffic over the bus.
+type hciBench struct {
+	conn   hciConn
+	handle uint16
+	pkt    []byte
+	buf    [1024]byte
+}
+
+// enableLoopback resets the controller and puts it in local loopback mode,
+// in which ACL packets written are sent back by the controller.
+func (b *hciBench) enableLoopback(aclSize int) error {
+	if _, err := b.command(opReset); err != nil {
+		return err
+	}
+	handle, err := b.command(opWriteLoopback, loopbackLocal)
+	if err != nil {
+		return err
+	} else if handle == 0 {
+		return errLoopbackHandle
+	}
+	b.handle = handle
+	b.pkt = make([]byte, 5+aclSize)
+	b.pkt[0] = hciACLPkt
+	binary.LittleEndian.PutUint16(b.pkt[1:], handle|0x2000) // First automatically flushable packet.
+	binary.LittleEndian.PutUint16(b.pkt[3:], uint16(aclSize))
+	return nil
+}
+
+// command sends an HCI command and waits for its Command Complete event.
+// It returns the connection handle of the last Connection Complete event seen, if any.
+func (b *hciBench) command(opcode uint16, params ...byte) (handle uint16, err error) {
+	cmd := append([]byte{hciCommandPkt, byte(opcode), byte(opcode >> 8), byte(len(params))}, params...)
+	if _, err = b.conn.WriteHCI(cmd); err != nil {
+		return 0, err
+	}
+	for {
+		n, err := b.conn.ReadHCIPacket(b.buf[:])
+		if err != nil {
+			return 0, err
+		} else if n < 6 || b.buf[0] != hciEventPkt {
+			continue
+		}
+		switch b.buf[1] {
+		case evtConnComplete:
+			handle = binary.LittleEndian.Uint16(b.buf[4:])
+		case evtCommandComplete:
+			if binary.LittleEndian.Uint16(b.buf[4:]) == opcode {
+				return handle, nil
+			}
+		}
+	}
+}
+
+// roundTrip writes an ACL packet and waits for it to come back, skipping
+// events such as Number Of Completed Packets. It returns the round trip time.
+func (b *hciBench) roundTrip() (time.Duration, error) {
+	start := time.Now()
+	if _, err := b.conn.WriteHCI(b.pkt); err != nil {
+		return 0, err
+	}
+	for {
+		n, err := b.conn.ReadHCIPacket(b.buf[:])
+		if err != nil {
+			return 0, err
+		} else if n > 0 && b.buf[0] == hciACLPkt {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// latencies accumulates the round trip times of loopback packets.
+type latencies struct {
+	rtts  []time.Duration
+	bytes int
+}
+
+func (l *latencies) add(rtt time.Duration, n int) {
+	l.rtts = append(l.rtts, rtt)
+	l.bytes += n
+}
+
+// percentile returns the p-th percentile round trip time, 0 <= p <= 100.
+func (l *latencies) percentile(p int) time.Duration {
+	if len(l.rtts) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(l.rtts)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (l *latencies) report(elapsed time.Duration) string {
+	var total time.Duration
+	for _, rtt := range l.rtts {
+		total += rtt
+	}
+	avg := total / time.Duration(max(len(l.rtts), 1))
+	mbps := float64(8*l.bytes) / elapsed.Seconds() / 1e6
+	return fmt.Sprintf("%7.3f Mbps %6d pkts rtt avg %v p50 %v p99 %v max %v", mbps, len(l.rtts), avg,
+		l.percentile(50), l.percentile(99), l.percentile(100))
+}
+
+// run measures loopback round trips for duration, zero runs until
+// interrupted, calling report with the statistics of every interval and
+// the totals.
+func (b *hciBench) run(interval, duration time.Duration, report func(string)) error {
+	var total, period latencies
+	start := time.Now()
+	periodStart := start
+	for duration == 0 || time.Since(start) < duration {
+		rtt, err := b.roundTrip()
+		if err != nil {
+			return err
+		}
+		n := 2 * (len(b.pkt) - 5) // ACL data sent and received back.
+		total.add(rtt, n)
+		period.add(rtt, n)
+		if elapsed := time.Since(periodStart); elapsed >= interval {
+			report(period.report(elapsed))
+			period = latencies{rtts: period.rtts[:0]}
+			periodStart = time.Now()
+		}
+	}
+	report("total: " + total.report(time.Since(start)))
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// Benchmark packet format sent by the examples/bench program:
+//
+//	[0:4]  magic "CYWB"
+//	[4:8]  sequence number, big endian
+//	[8:12] device uptime in milliseconds at send time, big endian
+//	[12:]  padding
+const (
+	benchMagic  = "CYWB"
+	benchHdrLen = 12
+)
+
+var errNotBench = errors.New("not a benchmark packet")
+
+// deviceFlags locates a CYW43439 wired to a Linux board for HCI mode.
+type deviceFlags struct {
+	spi       string
+	gpiochip  string
+	pwr, cs   uint
+	hz        uint
+	threeWire bool
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `cywbench - Benchmark a CYW43439.
+	udp mode: receive UDP blast traffic from a device running examples/bench and report throughput and loss.
+	hci mode: run ACL packets through the Bluetooth controller of a CYW43439 wired to Linux spidev
+	in local loopback mode and report HCI throughput and round trip latency.
+	Usage:
+`)
+		flag.PrintDefaults()
+	}
+	mode := flag.String("mode", "udp", "Benchmark to run: udp or hci.")
+	addr := flag.String("addr", ":9000", "UDP address to listen on for benchmark packets.")
+	aclSize := flag.Int("size", 200, "ACL data length of the loopback packets in hci mode.")
+	interval := flag.Duration("interval", time.Second, "Reporting interval.")
+	duration := flag.Duration("t", 0, "Stop after this duration. Zero runs until interrupted.")
+	var dev deviceFlags
+	flag.StringVar(&dev.spi, "spi", "/dev/spidev0.0", "spidev device the chip's gSPI bus is wired to in hci mode.")
+	flag.StringVar(&dev.gpiochip, "gpiochip", "/dev/gpiochip0", "GPIO character device of the power and chip select lines in hci mode.")
+	flag.UintVar(&dev.pwr, "pwr", 23, "GPIO line wired to WL_REG_ON in hci mode.")
+	flag.UintVar(&dev.cs, "cs", 24, "GPIO line wired to chip select in hci mode.")
+	flag.UintVar(&dev.hz, "hz", 10_000_000, "SPI clock frequency in hci mode.")
+	flag.BoolVar(&dev.threeWire, "3wire", false, "Use SPI_3WIRE half duplex mode, data on MOSI only.")
+	flag.Parse()
+
+	var err error
+	switch *mode {
+	case "udp":
+		err = runUDP(*addr, *interval, *duration)
+	case "hci":
+		err = runHCI(dev, *aclSize, *interval, *duration)
+	default:
+		err = fmt.Errorf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runUDP(addr string, interval, duration time.Duration) error {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "listening on %s\n", conn.LocalAddr())
+
+	var total, period counter
+	var buf [2048]byte
+	start := time.Now()
+	nextReport := start.Add(interval)
+	for duration == 0 || time.Since(start) < duration {
+		conn.SetReadDeadline(nextReport)
+		n, from, err := conn.ReadFrom(buf[:])
+		if err == nil {
+			seq, err := parseBench(buf[:n])
+			if err != nil {
+				continue
+			}
+			if total.packets == 0 {
+				fmt.Fprintf(os.Stderr, "receiving from %s\n", from)
+			}
+			total.add(seq, n)
+			period.add(seq, n)
+		} else if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if now := time.Now(); now.After(nextReport) {
+			fmt.Println(period.report(interval))
+			period = counter{lastSeq: period.lastSeq, started: period.started}
+			nextReport = now.Add(interval)
+		}
+	}
+	fmt.Println("total:", total.report(time.Since(start)))
+	return nil
+}
+
+func runHCI(cfg deviceFlags, aclSize int, interval, duration time.Duration) error {
+	dev, closeDev, err := openDevice(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeDev()
+	bench := hciBench{conn: dev}
+	err = bench.enableLoopback(aclSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "hci loopback enabled, handle %#x\n", bench.handle)
+	return bench.run(interval, duration, func(s string) { fmt.Println(s) })
+}
+
+func parseBench(b []byte) (seq uint32, err error) {
+	if len(b) < benchHdrLen || string(b[:4]) != benchMagic {
+		return 0, errNotBench
+	}
+	return binary.BigEndian.Uint32(b[4:8]), nil
+}
+
+// counter accumulates received benchmark packets. Loss is inferred from
+// gaps in the sequence numbers, late packets are counted as reordered.
+type counter struct {
+	packets   int
+	bytes     int
+	lost      int
+	reordered int
+	lastSeq   uint32
+	started   bool
+}
+
+func (c *counter) add(seq uint32, n int) {
+	c.packets++
+	c.bytes += n
+	switch {
+	case !c.started:
+		c.started = true
+	case seq > c.lastSeq:
+		c.lost += int(seq - c.lastSeq - 1)
+	default:
+		c.reordered++
+		if c.lost > 0 {
+			c.lost-- // Packet previously accounted as lost arrived late.
+		}
+		return
+	}
+	c.lastSeq = seq
+}
+
+func (c *counter) report(elapsed time.Duration) string {
+	mbps := float64(8*c.bytes) / elapsed.Seconds() / 1e6
+	lossPct := 0.0
+	if c.packets+c.lost > 0 {
+		lossPct = 100 * float64(c.lost) / float64(c.packets+c.lost)
+	}
+	return fmt.Sprintf("%7.3f Mbps %6d pkts %5d lost (%.2f%%) %4d reordered", mbps, c.packets, c.lost, lossPct, c.reordered)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterLoss(t *testing.T) {
+	var c counter
+	for _, seq := range []uint32{10, 11, 14, 12, 15} {
+		c.add(seq, 100)
+	}
+	if c.packets != 5 || c.bytes != 500 {
+		t.Errorf("got %d packets %d bytes", c.packets, c.bytes)
+	}
+	// 13 never arrived, 12 arrived late.
+	if c.lost != 1 || c.reordered != 1 {
+		t.Errorf("got lost=%d reordered=%d, want 1, 1", c.lost, c.reordered)
+	}
+	if _, err := parseBench([]byte("CYWX00000000")); err != errNotBench {
+		t.Error("expected bad magic to be rejected")
+	}
+}
+
+// loopbackConn emulates a controller in local loopback mode: commands are
+// completed, Write Loopback Mode reports a connection and ACL packets are
+// sent back after a Number Of Completed Packets event.
+type loopbackConn struct {
+	rx     [][]byte
+	writes int
+}
+
+func (c *loopbackConn) WriteHCI(b []byte) (int, error) {
+	c.writes++
+	switch b[0] {
+	case hciCommandPkt:
+		if binary.LittleEndian.Uint16(b[1:]) == opWriteLoopback {
+			c.rx = append(c.rx, []byte{hciEventPkt, evtConnComplete, 11, 0, 0x0b, 0x00})
+		}
+		c.rx = append(c.rx, []byte{hciEventPkt, evtCommandComplete, 4, 1, b[1], b[2], 0})
+	case hciACLPkt:
+		c.rx = append(c.rx, []byte{hciEventPkt, 0x13, 5, 1, 0x0b, 0, 1, 0}, append([]byte(nil), b...))
+	}
+	return len(b), nil
+}
+
+func (c *loopbackConn) ReadHCIPacket(b []byte) (int, error) {
+	if len(c.rx) == 0 {
+		return 0, errors.New("no packet")
+	}
+	n := copy(b, c.rx[0])
+	c.rx = c.rx[1:]
+	return n, nil
+}
+
+func TestHCILoopback(t *testing.T) {
+	var conn loopbackConn
+	bench := hciBench{conn: &conn}
+	err := bench.enableLoopback(100)
+	if err != nil {
+		t.Fatal(err)
+	} else if bench.handle != 0x0b || binary.LittleEndian.Uint16(bench.pkt[1:]) != 0x200b {
+		t.Fatalf("got handle %#x, packet % x", bench.handle, bench.pkt[:5])
+	}
+	var reports []string
+	err = bench.run(0, 10*time.Millisecond, func(s string) { reports = append(reports, s) })
+	if err != nil {
+		t.Fatal(err)
+	} else if len(reports) < 2 || !strings.HasPrefix(reports[len(reports)-1], "total:") {
+		t.Errorf("got reports %q", reports)
+	}
+	if len(conn.rx) != 0 {
+		t.Errorf("%d packets left unread", len(conn.rx))
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	var l latencies
+	for i := 100; i > 0; i-- {
+		l.add(time.Duration(i)*time.Millisecond, 10)
+	}
+	if p := l.percentile(50); p != 50*time.Millisecond {
+		t.Errorf("got p50 %v", p)
+	}
+	if p := l.percentile(100); p != 100*time.Millisecond {
+		t.Errorf("got max %v", p)
+	}
+	if l.rtts[0] != 100*time.Millisecond {
+		t.Error("percentile reordered the samples")
+	}
+	if got := l.report(time.Second); !strings.Contains(got, "100 pkts") || !strings.Contains(got, "p99 99ms") {
+		t.Errorf("got report %q", got)
+	}
+}
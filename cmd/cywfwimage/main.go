@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/soypat/cyw43439"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "cywfwimage - Create or inspect combined CYW43439 firmware images loadable with cyw43439.ParseFirmwareImage.\n"+
+			"With -in a byte range of a single file is extracted, and compressed with -compress.\n\tUsage:\n")
+		flag.PrintDefaults()
+	}
+	wlan := flag.String("wlan", "", "WLAN firmware file. Required when creating an image.")
+	clm := flag.String("clm", "", "CLM file.")
+	bt := flag.String("bt", "", "Bluetooth firmware file.")
+	nvram := flag.String("nvram", "", "NVRAM board configuration file.")
+	out := flag.String("o", "", "Output image file.")
+	list := flag.String("list", "", "Image file to print the sections of.")
+	compress := flag.Bool("compress", false, "Compress the WLAN firmware, see cyw43439.CompressFirmware.")
+	in := flag.String("in", "", "Single input file to extract a byte range of.")
+	off := flag.Int("off", 0, "Offset of byte range extracted with -in.")
+	length := flag.Int("len", -1, "Length of byte range extracted with -in. Negative extracts until the end of file.")
+	flag.Parse()
+
+	if *list != "" {
+		image, err := os.ReadFile(*list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg, err := cyw43439.ParseFirmwareImage(string(image))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wlan\t%d bytes\nclm\t%d bytes\nbluetooth\t%d bytes\nnvram\t%d bytes\n",
+			len(cfg.Firmware), len(cfg.CLM), len(cfg.BluetoothFirmware), len(cfg.NVRAM))
+		return
+	}
+	if *in != "" && *out != "" {
+		data, err := os.ReadFile(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		end := len(data)
+		if *length >= 0 {
+			end = *off + *length
+		}
+		if *off < 0 || *off > end || end > len(data) {
+			log.Fatalf("range [%d:%d] out of bounds of %d byte file", *off, end, len(data))
+		}
+		data = data[*off:end]
+		if *compress {
+			data = cyw43439.CompressFirmware(nil, data)
+		}
+		err = os.WriteFile(*out, data, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *wlan == "" || *out == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var cfg cyw43439.Config
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{{*wlan, &cfg.Firmware}, {*clm, &cfg.CLM}, {*bt, &cfg.BluetoothFirmware}, {*nvram, &cfg.NVRAM}} {
+		if f.name == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*f.dst = string(data)
+	}
+	if *compress {
+		cfg.Firmware = string(cyw43439.CompressFirmware(nil, []byte(cfg.Firmware)))
+	}
+	err := os.WriteFile(*out, cyw43439.AppendFirmwareImage(nil, cfg), 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
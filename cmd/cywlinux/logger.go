@@ -0,0 +1,13 @@
+//go:build linux && !cy43noslog
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// newDebugLogger returns a logger of the driver's debug output to stderr.
+func newDebugLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
@@ -0,0 +1,14 @@
+//go:build linux && cy43noslog
+
+package main
+
+import (
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+// newDebugLogger returns a logger of the driver's debug output to stderr,
+// where the print builtin writes.
+func newDebugLogger() *slog.Logger {
+	return cyw43439.NewLogger(cyw43439.NewPrintLogHandler(cyw43439.LogLevelDebug))
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/gspi"
+	"github.com/soypat/cyw43439/whd"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "cywlinux - Bring up a CYW43439 wired to a Linux board's spidev and GPIO lines and scan for networks.\n\tUsage:\n")
+		flag.PrintDefaults()
+	}
+	spiPath := flag.String("spi", "/dev/spidev0.0", "spidev device the chip's gSPI bus is wired to.")
+	chip := flag.String("gpiochip", "/dev/gpiochip0", "GPIO character device of the power and chip select lines.")
+	pwr := flag.Uint("pwr", 23, "GPIO line wired to WL_REG_ON.")
+	cs := flag.Uint("cs", 24, "GPIO line wired to chip select.")
+	hz := flag.Uint("hz", 10_000_000, "SPI clock frequency.")
+	threeWire := flag.Bool("3wire", false, "Use SPI_3WIRE half duplex mode, data on MOSI only.")
+	verbose := flag.Bool("v", false, "Log driver debug output.")
+	flag.Parse()
+
+	bus, err := gspi.OpenSPIDev(*spiPath, uint32(*hz), *threeWire)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pwrLine, err := gspi.OpenOutput(*chip, uint32(*pwr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pwrLine.Close()
+	csLine, err := gspi.OpenOutput(*chip, uint32(*cs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer csLine.Close()
+
+	dev := cyw43439.New(pwrLine.Set, csLine.Set, gspi.NewSPI(bus))
+	defer dev.Close()
+	if *verbose {
+		dev.SetLogger(newDebugLogger())
+	}
+	err = dev.Init(cyw43439.DefaultWifiConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	info, _ := dev.ChipInfo()
+	mac, _ := dev.HardwareAddr6()
+	fmt.Println("chip:", info, "mac:", net.HardwareAddr(mac[:]))
+	err = dev.Scan(cyw43439.ScanConfig{}, func(bss *whd.BSSInfo) {
+		fmt.Printf("%s ch=%-2d rssi=%-4d %s\n", net.HardwareAddr(bss.BSSID[:]), bss.Channel(), bss.RSSI, bss.SSID[:bss.SSIDLength])
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pwrLine.Err != nil || csLine.Err != nil {
+		log.Fatal("gpio: ", pwrLine.Err, csLine.Err)
+	}
+}
@@ -0,0 +1,377 @@
+// Command cywreplay replays a bus trace recorded with cyw43439.NewHexDumpTap
+// against the driver's parsing layers on the host: SDPCM framing, ioctl
+// responses, async events and, given the Bluetooth buffer address, HCI packets.
+// It prints a line per decoded packet and reports protocol anomalies such as
+// corrupted SDPCM headers or sequence gaps, exiting with status 1 if any are
+// found so traces of user-reported corruption can be used as regression tests.
+//
+//	cywreplay -btaddr 0x19000 trace.txt
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+// gSPI functions.
+const (
+	fnBus       = 0
+	fnBackplane = 1
+	fnWLAN      = 2
+)
+
+// hciHeaderLen is the length of the header preceding HCI packets in the
+// Bluetooth ring buffers: a 3 byte little-endian length and the packet type.
+const hciHeaderLen = 4
+
+var (
+	errBadLine   = errors.New("malformed trace line")
+	errHCILength = errors.New("HCI packet length exceeds ring buffer")
+)
+
+type transaction struct {
+	line  int
+	write bool
+	fn    uint32
+	addr  uint32
+	data  []byte
+}
+
+func main() {
+	btaddr := flag.String("btaddr", "", "Bluetooth buffer address (hex), enables HCI decoding.")
+	verbose := flag.Bool("v", false, "Print packet data in hex.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "cywreplay - Replay a CYW43439 bus trace recorded with NewHexDumpTap.\n\tUsage: cywreplay [flags] [trace]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var in io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	r := &replayer{w: os.Stdout, verbose: *verbose}
+	if *btaddr != "" {
+		v, err := strconv.ParseUint(strings.TrimPrefix(*btaddr, "0x"), 16, 32)
+		if err != nil {
+			log.Fatalf("parsing btaddr: %s", err)
+		}
+		r.btaddr = uint32(v)
+	}
+	err := r.run(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(r.w, "%d transactions, %d anomalies\n", r.transactions, r.anomalies)
+	if r.anomalies > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseLine parses a trace line written by NewHexDumpTap.
+func parseLine(s string) (t transaction, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 && len(fields) != 4 {
+		return t, errBadLine
+	}
+	switch fields[0] {
+	case "W":
+		t.write = true
+	case "R":
+	default:
+		return t, errBadLine
+	}
+	fn, err := strconv.ParseUint(fields[1], 10, 2)
+	if err != nil {
+		return t, err
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 17)
+	if err != nil {
+		return t, err
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return t, err
+	}
+	if len(fields) == 5 {
+		t.data, err = hex.DecodeString(fields[4])
+		if err != nil {
+			return t, err
+		}
+	}
+	if len(t.data) != n {
+		return t, errBadLine
+	}
+	t.fn, t.addr = uint32(fn), uint32(addr)
+	return t, nil
+}
+
+// hciRing mirrors a Bluetooth ring buffer to reassemble the packets written
+// to or read from it in backplane transfers of limited size.
+type hciRing struct {
+	mem [whd.BTSDIO_FWBUF_SIZE]byte
+	// next is the offset of the next packet, end the end of the last transfer.
+	next, end uint32
+}
+
+// copyIn copies data transferred at offset off to the mirror.
+func (h *hciRing) copyIn(off uint32, data []byte) {
+	for i, b := range data {
+		h.mem[(off+uint32(i))%whd.BTSDIO_FWBUF_SIZE] = b
+	}
+	h.end = (off + uint32(len(data))) % whd.BTSDIO_FWBUF_SIZE
+}
+
+// packet returns the next complete packet in the mirror, nil if there is none.
+func (h *hciRing) packet() (pkt []byte, err error) {
+	avail := (h.end - h.next) % whd.BTSDIO_FWBUF_SIZE
+	if avail < hciHeaderLen {
+		return nil, nil
+	}
+	var hdr [hciHeaderLen]byte
+	for i := range hdr {
+		hdr[i] = h.mem[(h.next+uint32(i))%whd.BTSDIO_FWBUF_SIZE]
+	}
+	n := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+	total := (hciHeaderLen + n + 3) &^ 3
+	if total >= whd.BTSDIO_FWBUF_SIZE {
+		h.next = h.end
+		return nil, errHCILength
+	} else if total > avail {
+		return nil, nil
+	}
+	pkt = make([]byte, 1+n) // H4 packet: type followed by payload.
+	pkt[0] = hdr[3]
+	for i := uint32(0); i < n; i++ {
+		pkt[1+i] = h.mem[(h.next+hciHeaderLen+i)%whd.BTSDIO_FWBUF_SIZE]
+	}
+	h.next = (h.next + total) % whd.BTSDIO_FWBUF_SIZE
+	return pkt, nil
+}
+
+type replayer struct {
+	w       io.Writer
+	verbose bool
+	btaddr  uint32
+	// window is the backplane window set through the backplane address registers.
+	window     uint32
+	rxSeq      uint8
+	rxSeqValid bool
+	h2b, b2h   hciRing
+
+	transactions int
+	anomalies    int
+}
+
+func (r *replayer) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 8192), 8192)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		t, err := parseLine(s)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		t.line = line
+		r.transactions++
+		r.replay(t)
+	}
+	return scanner.Err()
+}
+
+func (r *replayer) printf(t transaction, format string, args ...any) {
+	fmt.Fprintf(r.w, "%d: "+format+"\n", append([]any{t.line}, args...)...)
+}
+
+func (r *replayer) anomaly(t transaction, format string, args ...any) {
+	r.anomalies++
+	r.printf(t, "ANOMALY "+format, args...)
+}
+
+func (r *replayer) replay(t transaction) {
+	switch t.fn {
+	case fnWLAN:
+		r.wlan(t)
+	case fnBackplane:
+		r.backplane(t)
+	}
+}
+
+// wlan decodes an SDPCM packet as the driver's rx and send paths do.
+func (r *replayer) wlan(t transaction) {
+	dir := "rx"
+	if t.write {
+		dir = "tx"
+	}
+	if len(t.data) < whd.SDPCM_HEADER_LEN {
+		r.anomaly(t, "%s short packet len=%d", dir, len(t.data))
+		return
+	}
+	hdr := whd.DecodeSDPCMHeader(binary.LittleEndian, t.data)
+	if int(hdr.Size) <= len(t.data) {
+		t.data = t.data[:hdr.Size] // Transfers are padded to words.
+	}
+	payload, err := hdr.Parse(t.data)
+	if err != nil {
+		r.anomaly(t, "%s sdpcm size=%d ^size=%d len=%d: %s", dir, hdr.Size, hdr.SizeCom, len(t.data), err)
+		return
+	}
+	if !t.write {
+		r.check_seq(t, hdr.Seq)
+	}
+	switch hdr.Type() {
+	case whd.CONTROL_HEADER:
+		if len(payload) < whd.CDC_HEADER_LEN {
+			r.anomaly(t, "%s control short len=%d", dir, len(payload))
+			return
+		}
+		cdc := whd.DecodeCDCHeader(binary.LittleEndian, payload)
+		r.printf(t, "%s control seq=%d id=%d cmd=%s len=%d status=%d", dir, hdr.Seq, cdc.ID, cdc.Cmd, cdc.Length, cdc.Status)
+		if cmd := cdc.Cmd; t.write && (cmd == whd.WLC_GET_VAR || cmd == whd.WLC_SET_VAR) {
+			data := payload[whd.CDC_HEADER_LEN:]
+			if i := strings.IndexByte(string(data), 0); i > 0 {
+				r.printf(t, "  iovar %q", data[:i])
+			}
+		}
+		r.dump(payload[whd.CDC_HEADER_LEN:])
+	case whd.ASYNCEVENT_HEADER:
+		pkt, ok := r.bdc(t, dir, payload)
+		if !ok {
+			return
+		}
+		ev, err := whd.DecodeEventPacket(binary.BigEndian, pkt)
+		if err != nil {
+			r.anomaly(t, "%s event: %s", dir, err)
+			return
+		}
+		m := ev.Message
+		r.printf(t, "%s event seq=%d %s status=%d reason=%d if=%d datalen=%d", dir, hdr.Seq, m.EventType, m.Status, m.Reason, m.IFIdx, m.DataLen)
+		if int(m.DataLen) > len(pkt)-whd.EVENT_PACKET_LEN {
+			r.anomaly(t, "%s event data exceeds packet", dir)
+		}
+	case whd.DATA_HEADER:
+		pkt, ok := r.bdc(t, dir, payload)
+		if !ok {
+			return
+		}
+		if len(pkt) < 14 {
+			r.anomaly(t, "%s data short frame len=%d", dir, len(pkt))
+			return
+		}
+		r.printf(t, "%s data seq=%d len=%d dst=% x src=% x type=%#04x", dir, hdr.Seq, len(pkt), pkt[0:6], pkt[6:12], binary.BigEndian.Uint16(pkt[12:]))
+		r.dump(pkt)
+	default:
+		r.anomaly(t, "%s sdpcm unknown channel %d", dir, hdr.ChanAndFlags&0xf)
+	}
+}
+
+// bdc returns the packet following the BDC header of payload.
+func (r *replayer) bdc(t transaction, dir string, payload []byte) ([]byte, bool) {
+	if len(payload) < whd.BDC_HEADER_LEN {
+		r.anomaly(t, "%s bdc short len=%d", dir, len(payload))
+		return nil, false
+	}
+	bdc := whd.DecodeBDCHeader(payload)
+	start := whd.BDC_HEADER_LEN + 4*int(bdc.DataOffset)
+	if start > len(payload) {
+		r.anomaly(t, "%s bdc offset %d exceeds len=%d", dir, start, len(payload))
+		return nil, false
+	}
+	return payload[start:], true
+}
+
+// check_seq checks the sequence number of a received packet like the driver.
+func (r *replayer) check_seq(t transaction, seq uint8) {
+	expect := r.rxSeq
+	r.rxSeq = seq + 1
+	if !r.rxSeqValid {
+		r.rxSeqValid = true
+		return
+	}
+	switch diff := seq - expect; {
+	case diff == 0:
+	case diff < 0x80:
+		r.anomaly(t, "rx seq gap expect=%d got=%d", expect, seq)
+	default:
+		r.rxSeq = expect
+		r.anomaly(t, "rx seq duplicate expect=%d got=%d", expect, seq)
+	}
+}
+
+// backplane tracks the backplane window and decodes Bluetooth ring buffer transfers.
+func (r *replayer) backplane(t transaction) {
+	if t.write && len(t.data) > 0 {
+		switch t.addr {
+		case whd.SDIO_BACKPLANE_ADDRESS_LOW:
+			r.window = r.window&^0xff00 | uint32(t.data[0])<<8
+			return
+		case whd.SDIO_BACKPLANE_ADDRESS_MID:
+			r.window = r.window&^0xff0000 | uint32(t.data[0])<<16
+			return
+		case whd.SDIO_BACKPLANE_ADDRESS_HIGH:
+			r.window = r.window&^0xff000000 | uint32(t.data[0])<<24
+			return
+		}
+	}
+	if r.btaddr == 0 || t.addr >= whd.SDIO_BACKPLANE_ADDRESS_LOW {
+		return
+	}
+	addr := r.window | t.addr&whd.BACKPLANE_ADDR_MASK
+	h2b := r.btaddr + whd.BTSDIO_OFFSET_HOST_WRITE_BUF
+	b2h := r.btaddr + whd.BTSDIO_OFFSET_HOST_READ_BUF
+	switch {
+	case t.write && addr >= h2b && addr < h2b+whd.BTSDIO_FWBUF_SIZE:
+		r.hci(t, "tx", &r.h2b, addr-h2b)
+	case !t.write && addr >= b2h && addr < b2h+whd.BTSDIO_FWBUF_SIZE:
+		r.hci(t, "rx", &r.b2h, addr-b2h)
+	}
+}
+
+func (r *replayer) hci(t transaction, dir string, ring *hciRing, off uint32) {
+	if off != ring.end {
+		// A packet may be read again from its start, i.e: after peeking its
+		// header. Otherwise the ring pointers were reset or resynchronized.
+		if off != ring.next && ring.end != ring.next {
+			r.anomaly(t, "hci %s transfer at %#x, partial packet ends at %#x", dir, off, ring.end)
+		}
+		ring.next = off
+	}
+	ring.copyIn(off, t.data)
+	for {
+		pkt, err := ring.packet()
+		if err != nil {
+			r.anomaly(t, "hci %s: %s", dir, err)
+			return
+		} else if pkt == nil {
+			return
+		}
+		r.printf(t, "%s hci type=%#02x len=%d", dir, pkt[0], len(pkt)-1)
+		r.dump(pkt)
+	}
+}
+
+func (r *replayer) dump(data []byte) {
+	if r.verbose && len(data) > 0 {
+		fmt.Fprint(r.w, hex.Dump(data))
+	}
+}
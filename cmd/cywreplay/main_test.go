@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/whd"
+)
+
+func sdpcm(seq uint8, typ whd.SDPCMHeaderType, payload []byte) []byte {
+	pkt := make([]byte, whd.SDPCM_HEADER_LEN+len(payload))
+	hdr := whd.SDPCMHeader{Size: uint16(len(pkt)), SizeCom: ^uint16(len(pkt)), Seq: seq,
+		ChanAndFlags: uint8(typ), HeaderLength: whd.SDPCM_HEADER_LEN}
+	hdr.Put(binary.LittleEndian, pkt)
+	copy(pkt[whd.SDPCM_HEADER_LEN:], payload)
+	return pkt
+}
+
+func TestReplay(t *testing.T) {
+	var trace bytes.Buffer
+	tap := cyw43439.NewHexDumpTap(&trace)
+	cdc := make([]byte, whd.CDC_HEADER_LEN+16)
+	(&whd.CDCHeader{Cmd: whd.WLC_GET_VAR, Length: 16, ID: 1}).Put(binary.LittleEndian, cdc)
+	copy(cdc[whd.CDC_HEADER_LEN:], "cur_etheraddr\x00")
+	tap(cyw43439.BusTapWrite, 2, 0, sdpcm(0, whd.CONTROL_HEADER, cdc))
+	tap(cyw43439.BusTapRead, 2, 0, append(sdpcm(5, whd.CONTROL_HEADER, cdc), 0, 0)) // Word padding.
+	tap(cyw43439.BusTapRead, 2, 0, sdpcm(7, whd.CONTROL_HEADER, cdc))               // Gap.
+	bad := sdpcm(8, whd.CONTROL_HEADER, cdc)
+	bad[2] ^= 1 // Corrupted size complement.
+	tap(cyw43439.BusTapRead, 2, 0, bad)
+
+	// An HCI command split across two backplane transfers.
+	const btaddr = 0x19000
+	tap(cyw43439.BusTapWrite, 1, whd.SDIO_BACKPLANE_ADDRESS_LOW, []byte{0x80, 0, 0, 0})
+	tap(cyw43439.BusTapWrite, 1, whd.SDIO_BACKPLANE_ADDRESS_MID, []byte{0x01, 0, 0, 0})
+	hci := []byte{3, 0, 0, 0x01, 0x03, 0x0c, 0, 0} // HCI Reset padded to a word.
+	tap(cyw43439.BusTapWrite, 1, btaddr&whd.BACKPLANE_ADDR_MASK, hci[:4])
+	tap(cyw43439.BusTapWrite, 1, btaddr&whd.BACKPLANE_ADDR_MASK+4, hci[4:])
+
+	var out bytes.Buffer
+	r := &replayer{w: &out, btaddr: btaddr}
+	err := r.run(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		`1: tx control seq=0 id=1 cmd=GET_VAR len=16`,
+		`1:   iovar "cur_etheraddr"`,
+		`2: rx control seq=5`,
+		`3: ANOMALY rx seq gap expect=6 got=7`,
+		`4: ANOMALY rx sdpcm`,
+		`8: tx hci type=0x01 len=3`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+	if r.anomalies != 2 || r.transactions != 8 {
+		t.Errorf("got %d anomalies in %d transactions", r.anomalies, r.transactions)
+	}
+}
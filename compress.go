@@ -0,0 +1,55 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/lzss"
+)
+
+var errFirmwareCorrupt = errors.New("compressed firmware length mismatch")
+
+// Compressed firmware layout: magic "CYWZ", uncompressed length as a little
+// endian uint32 and the LZSS compressed firmware.
+const (
+	compressedMagic  = "CYWZ"
+	compressedHdrLen = 8
+)
+
+// CompressFirmware appends the compressed form of WLAN firmware fw to dst and
+// returns the extended buffer. Compressed firmware may be passed as
+// Config.Firmware and is decompressed while uploaded during Init using the
+// driver's own buffers, so no extra RAM is needed. The embedded firmware is
+// stored compressed when building with the cy43compressed build tag, which
+// saves about a quarter of the flash used by firmware.
+func CompressFirmware(dst, fw []byte) []byte {
+	dst = append(dst, compressedMagic...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(fw)))
+	return lzss.Encode(dst, fw)
+}
+
+func isCompressedFirmware(fw string) bool {
+	return len(fw) >= compressedHdrLen && fw[:4] == compressedMagic
+}
+
+// upload_compressed decompresses firmware fw into chip RAM at addr using _rxBuf as window.
+func (d *Device) upload_compressed(addr uint32, fw string) error {
+	const progressStep = 16 * 1024
+	total := int(leUint32(fw[4:8]))
+	window := u32AsU8(d._rxBuf[:])[:lzss.WindowSize]
+	written := 0
+	n, err := lzss.Decode(fw[compressedHdrLen:], window, func(chunk []byte) error {
+		err := d.bp_write(addr+uint32(written), chunk)
+		written += len(chunk)
+		if written%progressStep == 0 || written == total {
+			d.report_progress("wlan", written, total)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	} else if n != total {
+		return errFirmwareCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package connmgr coordinates the power saving settings of a CYW43439 around
+// the traffic pattern of an application, such as an MQTT client with a 60
+// second keep alive, so firmware power save, listen interval, AP keep-alive
+// offload and host poll frequency are chosen consistently:
+//
+//	m := connmgr.New(dev, connmgr.MQTT(60*time.Second))
+//	err := m.Apply() // After joining the network.
+//	for {
+//		wait, err := m.Service()
+//		// Handle err, run the application.
+//		time.Sleep(wait)
+//	}
+//
+// Settings are derived from the latency the application tolerates for
+// unsolicited downlink traffic: the longer, the longer the chip and host may
+// sleep between beacons and polls. The chip wakes for the AP's beacons
+// regardless, so sending is never delayed.
+package connmgr
+
+import (
+	"time"
+
+	"github.com/soypat/cyw43439"
+)
+
+const (
+	// beaconInterval is the usual AP beacon interval of 100 time units.
+	beaconInterval = 100 * 1024 * time.Microsecond
+	// maxSleepBeacons bounds the beacon intervals slept between wakeups, as
+	// APs may drop frames buffered for longer or reject larger listen intervals.
+	maxSleepBeacons = 10
+
+	defaultAPIdleTimeout = 60 * time.Second
+	defaultPollInterval  = 20 * time.Millisecond
+	minPollInterval      = 5 * time.Millisecond
+)
+
+// TrafficPattern describes the traffic of an application.
+type TrafficPattern struct {
+	// KeepAlive is the period of the application protocol's keep-alive,
+	// i.e: MQTT PINGREQ, zero if it has none.
+	KeepAlive time.Duration
+	// MaxLatency is the longest delay tolerated in receiving unsolicited
+	// downlink traffic, such as MQTT publishes to subscribed topics. Latencies
+	// of a few beacon intervals and above enable the deepest power save.
+	// Zero selects power save with a latency of about a beacon interval.
+	MaxLatency time.Duration
+	// Bulk is set for applications transferring bulk data, which disables
+	// power save altogether.
+	Bulk bool
+	// APIdleTimeout is the time after which the AP drops an idle station.
+	// Defaults to 60 seconds, on the low end of common AP configurations.
+	APIdleTimeout time.Duration
+}
+
+// MQTT returns the traffic pattern of an MQTT client with the keep alive
+// period keepAlive, tolerating a second of downlink latency.
+func MQTT(keepAlive time.Duration) TrafficPattern {
+	latency := time.Second
+	if keepAlive > 0 {
+		latency = min(latency, keepAlive/2)
+	}
+	return TrafficPattern{KeepAlive: keepAlive, MaxLatency: latency}
+}
+
+// Plan holds the settings derived from a TrafficPattern.
+type Plan struct {
+	Profile cyw43439.PerformanceProfile
+	Listen  cyw43439.ListenConfig
+	// KeepAlive is the period of the firmware's keep-alive frames to the AP,
+	// zero if the application's keep-alive traffic is frequent enough.
+	KeepAlive time.Duration
+	// PollInterval is the time the host may wait between idle polls.
+	PollInterval time.Duration
+	Budget       cyw43439.PollBudget
+}
+
+// NewPlan returns the settings for the traffic pattern p.
+func NewPlan(p TrafficPattern) Plan {
+	var plan Plan
+	switch {
+	case p.Bulk:
+		plan.Profile = cyw43439.ProfileThroughput
+	case p.MaxLatency <= 2*beaconInterval:
+		plan.Profile = cyw43439.ProfileBalanced
+		plan.PollInterval = defaultPollInterval
+		if p.MaxLatency > 0 {
+			plan.PollInterval = max(p.MaxLatency/2, minPollInterval)
+		}
+	default:
+		plan.Profile = cyw43439.ProfileLowPower
+		beacons := uint8(min(p.MaxLatency/beaconInterval, maxSleepBeacons))
+		// Assumes a DTIM period of one beacon, the usual AP default.
+		plan.Listen = cyw43439.ListenConfig{ListenInterval: beacons, DTIMSkip: beacons}
+		plan.PollInterval = p.MaxLatency / 2
+	}
+	if p.KeepAlive > 0 && plan.PollInterval > 0 {
+		// Poll often enough to receive keep-alive responses in time.
+		plan.PollInterval = min(plan.PollInterval, p.KeepAlive/4)
+	}
+	idle := p.APIdleTimeout
+	if idle <= 0 {
+		idle = defaultAPIdleTimeout
+	}
+	if p.KeepAlive == 0 || p.KeepAlive > idle/2 {
+		plan.KeepAlive = idle / 2
+	}
+	plan.Budget = plan.Profile.PollBudget()
+	return plan
+}
+
+// Manager applies a Plan to a device and polls it accordingly.
+type Manager struct {
+	dev  *cyw43439.Device
+	plan Plan
+}
+
+// New returns a manager of dev for the traffic pattern p.
+func New(dev *cyw43439.Device, p TrafficPattern) *Manager {
+	return &Manager{dev: dev, plan: NewPlan(p)}
+}
+
+// Plan returns the settings of the manager.
+func (m *Manager) Plan() Plan { return m.plan }
+
+// Apply configures the device with the settings of the plan. Call after
+// joining the network; the listen interval is announced to the AP on
+// association, so a plan's listen interval takes full effect from the next join.
+func (m *Manager) Apply() error {
+	// The listen configuration is set first since the profile's power
+	// management mode is applied with it.
+	err := m.dev.SetListenConfig(m.plan.Listen)
+	if err != nil {
+		return err
+	}
+	err = m.dev.SetPerformanceProfile(m.plan.Profile)
+	if err != nil {
+		return err
+	}
+	return m.dev.SetKeepAlive(m.plan.KeepAlive)
+}
+
+// Service polls the device with the plan's budget and returns the time the
+// caller may wait before calling Service again: zero while there is traffic
+// to process, the plan's PollInterval when idle.
+func (m *Manager) Service() (wait time.Duration, err error) {
+	frames, hci, err := m.dev.Poll(m.plan.Budget)
+	if err != nil || frames+hci > 0 {
+		return 0, err
+	}
+	return m.plan.PollInterval, nil
+}
@@ -0,0 +1,40 @@
+package connmgr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soypat/cyw43439"
+)
+
+func TestNewPlan(t *testing.T) {
+	plan := NewPlan(MQTT(60 * time.Second))
+	if plan.Profile != cyw43439.ProfileLowPower {
+		t.Errorf("got profile %s", plan.Profile)
+	}
+	if l := plan.Listen; l.ListenInterval != 9 || l.DTIMSkip > l.ListenInterval {
+		t.Errorf("unexpected listen config %+v", l)
+	}
+	// MQTT keep-alive is longer than half the AP idle timeout.
+	if plan.KeepAlive != 30*time.Second {
+		t.Errorf("got keep-alive %s", plan.KeepAlive)
+	}
+	if plan.PollInterval != 500*time.Millisecond {
+		t.Errorf("got poll interval %s", plan.PollInterval)
+	}
+
+	plan = NewPlan(MQTT(10 * time.Second))
+	if plan.KeepAlive != 0 {
+		t.Errorf("firmware keep-alive %s redundant with application's", plan.KeepAlive)
+	}
+
+	plan = NewPlan(TrafficPattern{KeepAlive: 10 * time.Second, MaxLatency: 50 * time.Millisecond})
+	if plan.Profile != cyw43439.ProfileBalanced || plan.Listen != (cyw43439.ListenConfig{}) || plan.PollInterval != 25*time.Millisecond {
+		t.Errorf("unexpected low latency plan %+v", plan)
+	}
+
+	plan = NewPlan(TrafficPattern{Bulk: true})
+	if plan.Profile != cyw43439.ProfileThroughput || plan.PollInterval != 0 {
+		t.Errorf("unexpected bulk plan %+v", plan)
+	}
+}
@@ -0,0 +1,138 @@
+package cyw43439
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errPassphraseLen = errors.New("WPA2 passphrase must be 8 to 63 characters or a 64 digit hexadecimal key")
+
+// JoinWPA2Secret joins a WPA2-PSK network like JoinWPA2 taking the passphrase
+// as a byte slice, which is zeroed before returning, whether the join succeeds
+// or not. The pairwise master key is derived from the passphrase on the host
+// and handed to the firmware in place of the passphrase, so no copy of the
+// passphrase is kept by the driver or the chip. Buffers which held the key
+// are zeroed after use. Deriving the PMK takes a while on microcontrollers,
+// though joins restored with RestoreState skip it.
+func (d *Device) JoinWPA2Secret(ssid string, pass []byte) error {
+	defer clear(pass)
+	if len(pass) < 8 || len(pass) > 64 {
+		return errPassphraseLen
+	}
+	pmk := pskPMK(ssid, pass)
+	defer clear(pmk[:])
+	d.lock()
+	defer d.unlock()
+	if d.joining {
+		return errJoinBusy
+	}
+	err := d.join_wpa2(ssid, "", &pmk, nil)
+	if err == nil {
+		d.creds = joinCreds{ssid: ssid, pmk: pmk, hasPMK: true}
+	}
+	return err
+}
+
+// pskCreds returns the credentials kept after joining the network ssid with
+// passphrase pass: the PMK derived from it, so the passphrase is not retained.
+// The copy of pass made for the derivation is zeroed.
+func pskCreds(ssid, pass string, hidden bool) joinCreds {
+	c := joinCreds{ssid: ssid, hidden: hidden}
+	if pass != "" {
+		b := []byte(pass)
+		c.pmk, c.hasPMK = pskPMK(ssid, b), true
+		clear(b)
+	}
+	return c
+}
+
+// setPMK sets the pairwise master key of a WPA2-PSK join. The firmware takes
+// a passphrase of 64 hexadecimal digits as the PMK itself.
+func (d *Device) setPMK(pmk *[32]byte, iface whd.IoctlInterface) error {
+	var buf [68]byte // wsec_pmk_t.
+	_busOrder.PutUint16(buf[0:2], 2*uint16(len(pmk)))
+	_busOrder.PutUint16(buf[2:4], 1) // WSEC_PASSPHRASE.
+	hex.Encode(buf[4:], pmk[:])
+	return d.set_secret(whd.WLC_SET_WSEC_PMK, iface, buf[:])
+}
+
+// set_secret sets key material with an ioctl, zeroing data and the ioctl
+// buffer, which also holds the firmware's echo of data, afterwards.
+func (d *Device) set_secret(cmd whd.SDPCMCommand, iface whd.IoctlInterface, data []byte) error {
+	err := d.doIoctlSet(cmd, iface, data)
+	clear(data)
+	clear(d._sendIoctlBuf[:])
+	return err
+}
+
+// set_secret_iovar is set_secret for key material set with an iovar.
+func (d *Device) set_secret_iovar(VAR string, iface whd.IoctlInterface, data []byte) error {
+	err := d.set_iovar_n(VAR, iface, data)
+	clear(data)
+	clear(d._iovarBuf[:])
+	clear(d._sendIoctlBuf[:])
+	return err
+}
+
+// pskPMK returns the WPA2-PSK pairwise master key of a network, which is
+// PBKDF2-HMAC-SHA1 of the passphrase with the SSID as salt. HMAC is computed
+// here instead of with crypto/hmac so the key pads can be zeroed.
+//
+//	reference: IEEE 802.11-2020 J.4.1
+func pskPMK(ssid string, pass []byte) (pmk [32]byte) {
+	if len(pass) == 64 {
+		if _, err := hex.Decode(pmk[:], pass); err == nil {
+			return pmk // Passphrase is the PMK in hexadecimal.
+		}
+	}
+	var ipad, opad [64]byte
+	if len(pass) > len(ipad) {
+		key := sha1.Sum(pass)
+		copy(ipad[:], key[:])
+		clear(key[:])
+	} else {
+		copy(ipad[:], pass)
+	}
+	for i := range ipad {
+		opad[i] = ipad[i] ^ 0x5c
+		ipad[i] ^= 0x36
+	}
+	inner, outer := sha1.New(), sha1.New()
+	var u, t [sha1.Size]byte
+	var index [4]byte
+	for block := uint32(1); block <= 2; block++ {
+		binary.BigEndian.PutUint32(index[:], block)
+		hmacSHA1(&u, inner, outer, &ipad, &opad, []byte(ssid), index[:])
+		t = u
+		for i := 1; i < 4096; i++ {
+			hmacSHA1(&u, inner, outer, &ipad, &opad, u[:], nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		copy(pmk[(block-1)*sha1.Size:], t[:])
+	}
+	clear(ipad[:])
+	clear(opad[:])
+	clear(u[:])
+	clear(t[:])
+	return pmk
+}
+
+// hmacSHA1 stores HMAC-SHA1 of msg0 and msg1 in dst, which may alias msg0.
+func hmacSHA1(dst *[sha1.Size]byte, inner, outer hash.Hash, ipad, opad *[64]byte, msg0, msg1 []byte) {
+	inner.Reset()
+	inner.Write(ipad[:])
+	inner.Write(msg0)
+	inner.Write(msg1)
+	inner.Sum(dst[:0])
+	outer.Reset()
+	outer.Write(opad[:])
+	outer.Write(dst[:])
+	outer.Sum(dst[:0])
+}
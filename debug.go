@@ -1,11 +1,10 @@
 package cyw43439
 
 import (
-	"context"
 	"encoding/hex"
 	"runtime"
 
-	"log/slog"
+	"github.com/soypat/cyw43439/internal/slog"
 )
 
 const (
@@ -39,27 +38,37 @@ func (d *Device) trace(msg string, attrs ...slog.Attr) {
 	d.logattrs(levelTrace, msg, attrs...)
 }
 
+// strict_check panics with a description of the violated invariant if ok is
+// false and the driver is built with the cy43strict tag. It is used to validate
+// lengths and pointers received from the firmware during development so that
+// driver/firmware disagreement is caught where it happens instead of
+// corrupting state further down the line. Without the tag checks compile out.
+func (d *Device) strict_check(ok bool, what string, attrs ...slog.Attr) {
+	if !strictMode || ok {
+		return
+	}
+	d.logerr("strict:"+what, attrs...)
+	panic("cyw43439 strict: " + what)
+}
+
 func (d *Device) logenabled(level slog.Level) bool {
 	if heapAllocDebugging {
 		return true
 	}
-	return d.logger != nil && d.logger.Handler().Enabled(context.Background(), level)
+	return d.logger != nil && slog.Enabled(d.logger, level)
 }
 
 func (d *Device) isTraceEnabled() bool {
 	return d.logenabled(levelTrace)
 }
 
-var (
-	memstats   runtime.MemStats
-	lastAllocs uint64
-)
-
 func (d *Device) logattrs(level slog.Level, msg string, attrs ...slog.Attr) {
+	d.flight.note(msg)
 	if heapAllocDebugging {
+		var memstats runtime.MemStats
 		runtime.ReadMemStats(&memstats)
-		if memstats.TotalAlloc != lastAllocs {
-			print("[ALLOC] inc=", int64(memstats.TotalAlloc)-int64(lastAllocs))
+		if memstats.TotalAlloc != d.lastAllocs {
+			print("[ALLOC] inc=", int64(memstats.TotalAlloc)-int64(d.lastAllocs))
 			print(" tot=", memstats.TotalAlloc, " cyw43439")
 			println()
 		}
@@ -79,34 +88,30 @@ func (d *Device) logattrs(level slog.Level, msg string, attrs ...slog.Attr) {
 		}
 		println()
 		runtime.ReadMemStats(&memstats)
-		if memstats.TotalAlloc != lastAllocs {
-			lastAllocs = memstats.TotalAlloc
+		if memstats.TotalAlloc != d.lastAllocs {
+			d.lastAllocs = memstats.TotalAlloc
 		}
 		return
 	}
 	if d.logger != nil {
-		d.logger.LogAttrs(context.Background(), level, msg, attrs...)
+		slog.Log(d.logger, level, msg, attrs...)
 	}
 }
 
 // SetLogger sets the logger for the device. If nil logging is disabled.
 func (d *Device) SetLogger(l *slog.Logger) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	d.lock()
+	defer d.unlock()
 	d.logger = l
 }
 
 func (d *Device) log_init() error {
-	if d.logger == nil || !d.logger.Handler().Enabled(context.Background(), deviceLevel) {
+	if d.logger == nil || !slog.Enabled(d.logger, deviceLevel) {
 		return nil
 	}
 	d.trace("log_init")
-	const (
-		ramBase           = 0
-		ramSize           = 512 * 1024
-		socram_srmem_size = 64 * 1024
-	)
-	const addr = ramBase + ramSize - 4 - socram_srmem_size
+	const ramBase = 0
+	addr := ramBase + d.chip.ramSize - 4 - d.chip.srmemSize
 	sharedAddr, err := d.bp_read32(addr)
 	if err != nil {
 		return err
@@ -131,7 +136,7 @@ func (d *Device) log_init() error {
 // log_read reads the CY43439's internal logs and prints them to the structured logger
 // under the CY43 level.
 func (d *Device) log_read() error {
-	if d.logger == nil || !d.logger.Handler().Enabled(context.Background(), deviceLevel) {
+	if d.logger == nil || !slog.Enabled(d.logger, deviceLevel) {
 		return nil
 	}
 	d.trace("log_read")
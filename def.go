@@ -10,6 +10,11 @@ import (
 
 var ErrDataNotAvailable = errors.New("requested data not available")
 
+var (
+	errDeviceNotInit = errors.New("device not initialized")
+	errDeviceClosed  = errors.New("device closed")
+)
+
 type Function uint32
 
 const (
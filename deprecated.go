@@ -9,7 +9,7 @@ var deprecated sync.Once
 
 func printDeprecationOnce() {
 	deprecated.Do(func() {
-		println("github.com/soypat/cyw43439: use of deprecated MACAs6 or TryPoll *Device method. Will be removed in future version. This message is only printed once")
+		println("github.com/soypat/cyw43439: use of deprecated MACAs6 *Device method. Will be removed in future version. This message is only printed once")
 	})
 }
 
@@ -21,11 +21,3 @@ func (d *Device) MACAs6() [6]byte {
 	mac, _ := d.HardwareAddr6()
 	return mac
 }
-
-// TryPoll
-//
-// Deprecated: Use PollOne instead.
-func (d *Device) TryPoll() (gotPacket bool, err error) {
-	printDeprecationOnce()
-	return d.PollOne()
-}
@@ -2,12 +2,13 @@ package cyw43439
 
 import (
 	"errors"
+	"io"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"log/slog"
-
+	"github.com/soypat/cyw43439/internal/slog"
 	"github.com/soypat/cyw43439/whd"
 	"golang.org/x/exp/constraints"
 )
@@ -36,6 +37,7 @@ func DefaultWifiConfig() Config {
 // type OutputPin func(bool)
 type Device struct {
 	mu              sync.Mutex
+	locker          sync.Locker // Replaces mu if set, see SetLocker.
 	pwr             outputPin
 	lastStatusGet   time.Time
 	spi             spibus
@@ -46,49 +48,319 @@ type Device struct {
 	sdpcmSeqMax     uint8
 	mac             [6]byte
 	eventmask       eventMask
+	// fwevents are the events the firmware is configured to send.
+	fwevents eventMask
+	// rxSeq is the expected sequence number of the next received SDPCM packet,
+	// valid once the first packet is received.
+	rxSeq      uint8
+	rxSeqValid bool
 	// uint32 buffers to ensure alignment of buffers.
 	rwBuf         [2]uint32        // rwBuf used for read* and write* functions.
 	_sendIoctlBuf [2048 / 4]uint32 // _sendIoctlBuf used only in sendIoctl and tx.
 	_iovarBuf     [2048 / 4]uint32 // _iovarBuf used in get_iovar* and set_iovar* calls.
 	_rxBuf        [2048 / 4]uint32 // Used in check_status->rx calls and handle_irq.
+	// _bpReadBuf used in bp_read, which may read into any of the buffers above.
+	_bpReadBuf [whd.BUS_SPI_MAX_BACKPLANE_TRANSFER_SIZE/4 + 1]uint32
 	// We define headers in the Device struct to alleviate stack growth. Also used along with _sendIoctlBuf
 	lastSDPCMHeader whd.SDPCMHeader
 	auxCDCHeader    whd.CDCHeader
 	auxBDCHeader    whd.BDCHeader
 	rcvEth          func([]byte) error
-	logger          *slog.Logger
-	state           linkState
+	// rcvEthTS receives packets along with rxTime, taking precedence over rcvEth.
+	rcvEthTS func([]byte, time.Time) error
+	// rxTime is the time the last packet was read from the bus.
+	rxTime time.Time
+	// rcvEthIface holds per-interface receive handlers which take precedence over rcvEth.
+	rcvEthIface [whd.IF_P2P + 1]func([]byte) error
+	// rcvMux holds the handlers registered with AddRecvHandler.
+	rcvMux [maxRecvHandlers]recvHandler
+	// rcvPolicy is applied to receive handler errors, rcvHalted is set while
+	// reception is halted by RecvErrorHalt.
+	rcvPolicy RecvErrorPolicy
+	rcvHalted bool
+	// rxFilter is the host-side destination filter, see SetRxFilter.
+	// rxFilterAP is the MAC address of the concurrent SoftAP interface.
+	rxFilter   RxFilterMode
+	rxFilterAP [6]byte
+	rxLimit    groupLimiter
+	// carrier is the configuration and last measurement of CarrierClear.
+	carrier carrierState
+	// linkCheck schedules the link state verification, see SetLinkCheck.
+	linkCheck linkCheck
+	// scanCache holds the BSSs found by recent scans, see LastScanResults.
+	scanCache [scanCacheLen]scanEntry
+	// Settings applied since Init, see Settings.
+	country     [2]byte
+	countryRev  uint8
+	macOverride bool
+	profile     PerformanceProfile
+	// mcast are the multicast addresses joined with JoinMulticastGroup.
+	mcast [whd.MAX_MULTICAST_REGISTERED_ADDRESS]mcastGroup
+	// lldp is set while LLDP announcements are enabled, see StartLLDP.
+	lldp *lldpState
+	// joinTrace is set while join tracing is enabled, see SetJoinTrace.
+	joinTrace *joinTrace
+	// apTable tracks AP join failures, see SetAPBlacklistConfig.
+	apTable     [apTableLen]apFailures
+	apBlacklist APBlacklistConfig
+	// apRejected is the AP which rejected the current join.
+	apRejected [6]byte
+	// txq is set while the TX queue is enabled, see SetTxQueue.
+	txq *txQueue
+	// txDone is called when SendEthWithHeadroom is done with a buffer and
+	// txPend holds the buffers waiting for credit, see SetTxDoneHandler.
+	txDone func([]byte, error)
+	txPend txPending
+	// dscpClassify enables access category tagging from DSCP, see SetDSCPClassification.
+	dscpClassify bool
+	// creds are the credentials of the last join and lease the station
+	// interface lease, saved by SaveState.
+	creds joinCreds
+	lease Lease
+	// lockm holds the lock metrics, see EnableLockMetrics. lockOn mirrors
+	// lockm.enabled to be read before the lock is taken.
+	lockm  lockMetrics
+	lockOn atomic.Bool
+	// hciBuffered caches the BufferedHCI result, valid while hciCheckedAt,
+	// in Unix nanoseconds, is not zero. hciReadAt is the last ring buffer read.
+	hciBuffered  atomic.Int32
+	hciCheckedAt atomic.Int64
+	// isrPending is set by ISRNotify from interrupt context.
+	isrPending atomic.Bool
+	hciReadAt  time.Time
+	logger     *slog.Logger
+	state      linkState
+	// clock is the time source, nil for the system clock.
+	clock Clock
+	// wordOrder is the bus word order detected by initBus.
+	wordOrder wordOrder
+	// initialized is set once Init completes successfully.
+	initialized bool
+	// closed is set by Close. A closed device may not be used again.
+	closed bool
+	// apsta is set when the firmware runs station and AP interfaces concurrently.
+	apsta bool
+	// apUp is set once a SoftAP has been started on apIface.
+	apUp    bool
+	apIface whd.IoctlInterface
+	// Bluetooth shared bus state. btaddr is the WLAN RAM base address of the
+	// BTSDIO ring buffers, zero if Bluetooth is not enabled.
+	btaddr      uint32
+	h2bWritePtr uint32
+	b2hReadPtr  uint32
+	snoop       hciSnoop
+	// hciWriteTimeout is the time to wait for space in the host-to-controller ring buffer.
+	hciWriteTimeout time.Duration
+	hciReadTimeout  time.Duration
+	// hciReadOff is the amount of bytes of the packet at the controller-to-host
+	// ring buffer read pointer already returned by a partial ReadHCI.
+	hciReadOff uint32
+	// uploadProgress is called during firmware uploads in Init.
+	uploadProgress func(what string, written, total int)
+	// scanFn is the callback of the scan in progress, nil if no scan in progress.
+	scanFn     func(*whd.BSSInfo)
+	scanDone   bool
+	scanStatus uint32
+	// scanAsync is set while a scan started by StartScan runs and scanSeq
+	// identifies the last such scan.
+	scanAsync bool
+	scanSeq   uint32
+	// async is the ioctl started by StartIoctl.
+	async asyncIoctl
+	// joinPol holds the timeouts of the join in progress, see JoinOptions.
+	joinPol joinPolicy
+	// flight records recent driver history for LastFailure.
+	flight flightRecorder
+	// rcvHCI receives HCI packets drained by Poll.
+	rcvHCI func([]byte) error
+	// lastIdlePoll is the time of the last Poll which found no work, used for coalescing.
+	lastIdlePoll time.Time
+	// probeFn receives probe requests seen by the SoftAP.
+	probeFn func(ProbeRequest)
+	// Controller ACL buffer flow control. aclMax is zero until the controller
+	// buffer count is known, in which case ACL writes are not limited.
+	aclMax     uint16
+	aclCredits uint16
+	// aclDataLen is the maximum ACL data length accepted by the controller, zero if unknown.
+	aclDataLen uint16
+	// ampduWsize is the AMPDU block ack window size set on join.
+	ampduWsize uint32
+	stats      Stats
+	// ampduDisabled is set when aggregation was turned off with the ampdu iovar.
+	ampduDisabled bool
+	// f2Watermark is the F2 watermark last set, zero before Init sets it.
+	f2Watermark uint8
+	// joining is set while a join waits with the device lock released, see JoinOptions.YieldLock.
+	joining bool
+	// bridge is the AP/STA bridge state, nil if not bridging.
+	bridge *bridgeState
+	listen ListenConfig
+	// clkBase holds the chip clock request bits set by the driver itself and
+	// clkRefs the outstanding RequestClock calls per ChipClock.
+	clkBase uint8
+	clkRefs [numClocks]uint8
+	// pmMode is the firmware power management mode last set.
+	pmMode powerManagementMode
+	// srEnabled is set once the save/restore engine is configured, after which
+	// the bus is put to KSO sleep (busAsleep) after busIdlePolls consecutive idle polls.
+	srEnabled    bool
+	busAsleep    bool
+	busIdlePolls uint8
+	// hostAsleep is set between HostSleep and HostWake.
+	hostAsleep bool
+	hostWake   HostWakeConfig
+	// chip holds the quirks of the chip detected during Init, nil before detection.
+	chip    *chipQuirks
+	chipRev uint8
+	// lastAllocs is the heap allocation total last seen when heapAllocDebugging.
+	lastAllocs uint64
 }
 
 type Config struct {
 	Firmware string
-	CLM      string
+	// CLM is the regulatory data uploaded to the firmware. If empty Init
+	// leaves the WLAN interface down for the application to set up.
+	CLM string
+	// BluetoothFirmware is the Bluetooth controller firmware. If non-empty
+	// Bluetooth is brought up during Init and HCI packets may be exchanged with
+	// ReadHCI and WriteHCI. Firmware must support WLAN/Bluetooth coexistence.
+	// See DefaultBluetoothConfig. Bluetooth may also be brought up after Init with EnableBluetooth.
+	BluetoothFirmware string
+	// HCIWriteTimeout is the maximum time WriteHCI waits for space in the
+	// host-to-controller ring buffer. If zero WriteHCI returns ErrHCIWouldBlock
+	// immediately when the ring buffer is full.
+	HCIWriteTimeout time.Duration
+	// HCIReadTimeout is the maximum time ReadHCI waits for a packet. If zero
+	// ReadHCI returns ErrDataNotAvailable immediately when no packet is pending.
+	HCIReadTimeout time.Duration
+	// UploadProgress, if set, is called during Init as firmware is uploaded to
+	// the chip with the amount of bytes written out of total. what is one of
+	// "wlan", "clm" or "bluetooth". Uploads may take over a second.
+	UploadProgress func(what string, written, total int)
+	// PowerControl, if set, drives the WL_REG_ON pin which powers the chip,
+	// replacing the pin control passed to New. Used by Init and Reset.
+	PowerControl func(on bool)
+	// F2Watermark is the F2 FIFO watermark in bytes, see SetF2Watermark.
+	// Zero selects the default of 32 bytes.
+	F2Watermark uint8
+	// NVRAM is the board configuration uploaded along the firmware.
+	// If empty the Pico W configuration is used for the CYW43439.
+	NVRAM string
+	// Variants holds firmware for chips other than the one Firmware is built
+	// for, i.e: CYW43438 and CYW4343W modules. Init uses the variant matching
+	// the detected chip ID in place of Firmware, CLM and NVRAM. See ChipInfo.
+	Variants []FirmwareVariant
+	// FirmwareProvider, if set, supplies a combined firmware image whose
+	// sections replace Firmware, CLM, NVRAM, and BluetoothFirmware if non-empty.
+	// If the provider holds no valid image the Config fields are used, so
+	// embedded firmware remains as fallback. See UpdateFirmware.
+	FirmwareProvider FirmwareProvider
+	// HostWake describes the wiring of the host-wake interrupt. The zero value
+	// matches the Pico W. Init returns an error if the configuration is invalid.
+	HostWake HostWakeConfig
 	Logger   *slog.Logger
 }
 
+// upload_firmware writes the WLAN firmware to chip RAM in chunks, reporting progress after each.
+func (d *Device) upload_firmware(addr uint32, fw string) error {
+	if isCompressedFirmware(fw) {
+		return d.upload_compressed(addr, fw)
+	}
+	const chunkSize = 16 * 1024
+	for off := 0; off < len(fw); off += chunkSize {
+		end := min(off+chunkSize, len(fw))
+		err := d.bp_writestring(addr+uint32(off), fw[off:end])
+		if err != nil {
+			return err
+		}
+		d.report_progress("wlan", end, len(fw))
+	}
+	return nil
+}
+
+func (d *Device) report_progress(what string, written, total int) {
+	if d.uploadProgress != nil {
+		d.uploadProgress(what, written, total)
+	}
+}
+
+// Init powers up the chip, uploads the firmware in cfg and configures it.
+// A chip left running by a brown-out or by a power cycle too short to reset
+// it is detected and power cycled again for longer before proceeding.
+// If Init fails the returned error is a *InitReport describing the failure.
 func (d *Device) Init(cfg Config) (err error) {
 	d.lock()
 	defer d.unlock()
+	if d.joining {
+		return errJoinBusy
+	} else if d.closed {
+		return errDeviceClosed
+	}
 	d.logger = cfg.Logger
+	d.hciWriteTimeout = cfg.HCIWriteTimeout
+	d.hciReadTimeout = cfg.HCIReadTimeout
+	d.uploadProgress = cfg.UploadProgress
+	if cfg.PowerControl != nil {
+		d.pwr = cfg.PowerControl
+	}
+	err = cfg.HostWake.validate()
+	if err != nil {
+		return err
+	}
+	if cfg.HostWake.Configure != nil {
+		err = cfg.HostWake.Configure(cfg.HostWake.Pull)
+		if err != nil {
+			return err
+		}
+	}
+	d.hostWake = cfg.HostWake
+	d.reset_state()
 	d.info("Init:start")
-	start := time.Now()
+	start := d.now()
+	if cfg.FirmwareProvider != nil {
+		cfg = d.apply_firmware_image(cfg)
+	}
+	report := InitReport{phaseStart: start}
+	err = d.init(cfg, &report)
+	if err != nil {
+		return d.init_fail(&report, err, start)
+	}
+	d.info("Init:done", slog.Duration("took", d.since(start)))
+	return nil
+}
+
+// init brings up the chip with cfg recording the phase reached in r.
+func (d *Device) init(cfg Config, r *InitReport) (err error) {
 	// Reference: https://github.com/embassy-rs/embassy/blob/6babd5752e439b234151104d8d20bae32e41d714/cyw43/src/runner.rs#L76
-	err = d.initBus()
+	err = d.initBus(r)
 	if err != nil {
 		return errjoin(errors.New("failed to init bus"), err)
 	}
+	d.init_phase(r, InitPhaseALPClock)
 	d.backplaneWindow = 0xaaaa_aaaa
-	d.write8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR, 0x08) // BACKPLANE_ALP_AVAIL_REQ
-	for {
-		got, _ := d.read8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR)
-		if got&0x40 != 0 {
-			break // ALP available-> clock OK.
+	d.clkBase = whd.SBSDIO_ALP_AVAIL_REQ
+	d.clock_update()
+	if _, ok := d.clock_wait(whd.SBSDIO_ALP_AVAIL, 100*time.Millisecond); !ok {
+		return errors.New("timeout waiting for ALP clock")
+	}
+	if cfg.BluetoothFirmware != "" {
+		err = d.bt_check_watermark()
+		if err != nil {
+			return err
 		}
 	}
 
-	chip_id, _ := d.bp_read16(0x1800_0000)
+	r.ChipID, err = d.chip_detect()
+	if err != nil {
+		return err
+	}
+	cfg, err = d.chip_firmware(cfg)
+	if err != nil {
+		return err
+	}
 
 	// Upload firmware.
+	d.init_phase(r, InitPhaseFirmware)
 	err = d.core_disable(whd.CORE_WLAN_ARM)
 	if err != nil {
 		return err
@@ -100,18 +372,19 @@ func (d *Device) Init(cfg Config) (err error) {
 	d.bp_write32(whd.SOCSRAM_BASE_ADDRESS+0x10, 3)
 	d.bp_write32(whd.SOCSRAM_BASE_ADDRESS+0x44, 0)
 
-	d.debug("flashing firmware", slog.Uint64("chip_id", uint64(chip_id)), slog.Int("fwlen", len(cfg.Firmware)))
+	d.debug("flashing firmware", slog.Uint64("chip_id", uint64(r.ChipID)), slog.Int("fwlen", len(cfg.Firmware)))
 	var ramAddr uint32 // Start at ATCM_RAM_BASE_ADDRESS = 0.
-	err = d.bp_writestring(ramAddr, cfg.Firmware)
+	err = d.upload_firmware(ramAddr, cfg.Firmware)
 	if err != nil {
 		return err
 	}
 
 	// Load NVRAM
-	const chipRAMSize = 512 * 1024
-	nvramLen := align(uint32(len(nvram43439)), 4)
+	chipRAMSize := d.chip.ramSize
+	nvram := cfg.NVRAM
+	nvramLen := align(uint32(len(nvram)), 4)
 	d.debug("flashing nvram")
-	err = d.bp_writestring(ramAddr+chipRAMSize-4-nvramLen, nvram43439)
+	err = d.bp_writestring(ramAddr+chipRAMSize-4-nvramLen, nvram)
 	if err != nil {
 		return err
 	}
@@ -120,6 +393,7 @@ func (d *Device) Init(cfg Config) (err error) {
 	d.bp_write32(ramAddr+chipRAMSize-4, nvramLenMagic)
 
 	// Start core.
+	d.init_phase(r, InitPhaseCore)
 	err = d.core_reset(whd.CORE_WLAN_ARM, false)
 	if err != nil {
 		return err
@@ -128,16 +402,9 @@ func (d *Device) Init(cfg Config) (err error) {
 		return errors.New("core not up after reset")
 	}
 	d.debug("core up")
-	deadline := time.Now().Add(20 * time.Millisecond)
-	for {
-		got, _ := d.read8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR)
-		if got&0x80 != 0 {
-			break
-		}
-		if time.Since(deadline) >= 0 {
-			return errors.New("timeout waiting for chip clock")
-		}
-		runtime.Gosched()
+	d.init_phase(r, InitPhaseHTClock)
+	if _, ok := d.clock_wait(whd.SBSDIO_HT_AVAIL, 20*time.Millisecond); !ok {
+		return errors.New("timeout waiting for chip clock")
 	}
 
 	// "Set up the interrupt mask and enable interrupts"
@@ -146,44 +413,70 @@ func (d *Device) Init(cfg Config) (err error) {
 	// ""Lower F2 Watermark to avoid DMA Hang in F2 when SD Clock is stopped.""
 	// "Sounds scary..."
 	// yea it does
-	const REG_BACKPLANE_FUNCTION2_WATERMARK = 0x10008
-	d.write8(FuncBackplane, REG_BACKPLANE_FUNCTION2_WATERMARK, 32)
+	watermark := cfg.F2Watermark
+	if watermark == 0 {
+		watermark = whd.SPI_F2_WATERMARK
+	}
+	err = d.set_f2_watermark(watermark)
+	if err != nil {
+		return err
+	}
 
 	// Wait for wifi startup.
-	deadline = time.Now().Add(100 * time.Millisecond)
+	d.init_phase(r, InitPhaseWLANReady)
+	deadline := d.now().Add(100 * time.Millisecond)
 	for !d.status().F2RxReady() {
-		if time.Since(deadline) >= 0 {
+		if d.since(deadline) >= 0 {
 			return errors.New("wifi startup timeout")
 		}
 		runtime.Gosched()
 	}
 
+	d.srEnabled, err = d.sr_init()
+	if err != nil {
+		d.warn("Init:save-restore", slog.String("err", err.Error()))
+	}
+
 	// Clear pulls.
 	d.write8(FuncBackplane, whd.SDIO_PULL_UP, 0)
 	d.read8(FuncBackplane, whd.SDIO_PULL_UP)
 
+	if cfg.BluetoothFirmware != "" {
+		d.init_phase(r, InitPhaseBluetooth)
+		err = d.bt_init(cfg.BluetoothFirmware)
+		if err != nil {
+			return errjoin(errors.New("bluetooth init failed"), err)
+		}
+		d.debug("bluetooth init done")
+	}
+
+	d.init_phase(r, InitPhaseControl)
 	err = d.log_init()
 	if err != nil {
 		return err
 	}
 	d.log_read()
 	d.debug("base init done")
-	if cfg.CLM == "" {
-		return nil
-	}
-
-	// Starting polling to simulate hw interrupts
-	// go d.irqPoll()
+	return d.init_wlan(cfg.CLM)
+}
 
-	err = d.initControl(cfg.CLM)
-	if err != nil {
-		return err
+// init_wlan finishes Init once the firmware is running, uploading clm and
+// bringing up the WLAN interface if clm is not empty. Without clm the
+// application is left to set up the interface, i.e: with WLCommand.
+func (d *Device) init_wlan(clm string) (err error) {
+	if clm != "" {
+		err = d.initControl(clm)
+		if err != nil {
+			return err
+		}
+		err = d.set_power_management(PowerSave)
+		if err != nil {
+			return err
+		}
 	}
-
-	err = d.set_power_management(PowerSave)
 	d.state = linkStateDown
-	d.info("Init:done", slog.Duration("took", time.Since(start)))
-	return err
+	d.initialized = true
+	return nil
 }
 
 func (d *Device) GPIOSet(wlGPIO uint8, value bool) (err error) {
@@ -201,22 +494,135 @@ func (d *Device) GPIOSet(wlGPIO uint8, value bool) (err error) {
 // status gets gSPI last bus status or reads it from the device if it's stale, for some definition of stale.
 func (d *Device) status() Status {
 	// TODO(soypat): Are we sure we don't want to re-acquire status if it's been very long?
-	sinceStat := time.Since(d.lastStatusGet)
+	sinceStat := d.since(d.lastStatusGet)
 	if sinceStat < 10*time.Microsecond {
 		runtime.Gosched() // Probably in hot loop.
 	} else {
-		d.lastStatusGet = time.Now()
+		d.lastStatusGet = d.now()
 		got, _ := d.read32(FuncBus, whd.SPI_STATUS_REGISTER) // Explicitly get Status.
 		return Status(got)
 	}
 	return d.spi.Status()
 }
 
+// Reset power cycles the chip by toggling WL_REG_ON and clears all driver
+// state so that the device may be initialized again with Init. Useful for
+// recovering from an unresponsive chip without rebooting the host.
+// Receive handlers and the HCI snoop are preserved. A join waiting with
+// JoinOptions.YieldLock is aborted.
 func (d *Device) Reset() {
+	d.lock()
+	defer d.unlock()
+	if d.closed {
+		return
+	}
+	d.reset_state()
+	d.power_cycle()
+}
+
+// Close leaves the network, stops the SoftAP and Bluetooth, powers the chip
+// down and releases the bus. If the bus passed to New implements io.Closer it
+// is closed. The device is unusable after Close: Init returns an error.
+func (d *Device) Close() error {
+	d.lock()
+	defer d.unlock()
+	if d.closed {
+		return errDeviceClosed
+	} else if d.joining {
+		return errJoinBusy
+	}
+	var err error
+	if d.initialized {
+		if d.state == linkStateUp {
+			err = errjoin(err, d.disassociate())
+		}
+		if d.apUp {
+			bsscfg := uint32(0)
+			if d.apIface == whd.IF_AP {
+				bsscfg = 1
+			}
+			err = errjoin(err, d.set_iovar2("bss", whd.IF_STA, bsscfg, 0))
+		}
+		if d.btaddr != 0 {
+			err = errjoin(err, d.bt_deinit())
+		}
+		err = errjoin(err, d.doIoctlSet(whd.WLC_DOWN, whd.IF_STA, nil))
+	}
+	d.reset_state()
+	d.closed = true
+	d.pwr(false) // WL_REG_ON low powers down all cores.
+	d.spi.csEnable(false)
+	if closer, ok := any(d.spi.spi).(io.Closer); ok {
+		err = errjoin(err, closer.Close())
+	}
+	return err
+}
+
+// power_cycle toggles WL_REG_ON which resets the chip.
+func (d *Device) power_cycle() {
 	d.pwr(false)
-	time.Sleep(20 * time.Millisecond)
+	d.sleep(20 * time.Millisecond)
 	d.pwr(true)
-	time.Sleep(250 * time.Millisecond) // Wait for bus to initialize.
+	d.sleep(250 * time.Millisecond) // Wait for bus to initialize.
+}
+
+// cold_reset holds WL_REG_ON low long enough for the chip's supply to fully
+// discharge before powering it up, resetting a chip a short pulse did not.
+func (d *Device) cold_reset() {
+	d.pwr(false)
+	d.sleep(coldResetHold)
+	d.pwr(true)
+	d.sleep(250 * time.Millisecond)
+}
+
+// reset_state clears driver state tied to the chip's state.
+func (d *Device) reset_state() {
+	d.backplaneWindow = 0
+	d.ioctlID = 0
+	d.sdpcmSeq = 0
+	d.sdpcmSeqMax = 1
+	d.rxSeq, d.rxSeqValid = 0, false
+	d.mac = [6]byte{}
+	d.eventmask = eventMask{}
+	d.fwevents = eventMask{}
+	d.probeFn = nil
+	d.scanFn, d.scanAsync = nil, false
+	d.scanSeq++                                // Outstanding scan handles become stale.
+	d.async = asyncIoctl{seq: d.async.seq + 1} // Outstanding handles become stale.
+	d.scanCache = [scanCacheLen]scanEntry{}
+	d.log = logstate{}
+	d.state = linkStateDown
+	d.initialized = false
+	d.apsta, d.apUp, d.apIface = false, false, whd.IF_STA
+	d.btaddr, d.h2bWritePtr, d.b2hReadPtr = 0, 0, 0
+	d.hciReadOff = 0
+	d.hci_invalidate()
+	d.aclMax, d.aclCredits, d.aclDataLen = 0, 0, 0
+	d.ampduWsize, d.ampduDisabled = defaultAMPDUWsize, false
+	d.f2Watermark = 0
+	d.stats = Stats{}
+	d.spi.errs = 0
+	if bus, ok := d.spi.crc_bus(); ok {
+		bus.SetCRC(false) // The chip powers up with error checking disabled.
+	}
+	d.bridge = nil
+	d.lldp = nil
+	d.txq = nil
+	d.txpend_drop(errLinkDown)
+	d.dscpClassify = false
+	d.mcast = [whd.MAX_MULTICAST_REGISTERED_ADDRESS]mcastGroup{}
+	d.rcvHalted = false
+	d.rxFilter, d.rxFilterAP, d.rxLimit = RxFilterOff, [6]byte{}, groupLimiter{}
+	d.carrier.load, d.carrier.at = ChannelLoad{}, time.Time{}
+	d.country, d.countryRev, d.macOverride, d.profile = [2]byte{}, 0, false, ProfileBalanced
+	d.creds, d.lease = joinCreds{}, Lease{}
+	d.apTable, d.apRejected = [apTableLen]apFailures{}, [6]byte{}
+	d.apBlacklist = APBlacklistConfig{MaxFailures: defaultBlacklistFailures, Duration: defaultBlacklistDuration}
+	d.listen = ListenConfig{}
+	d.clkBase, d.clkRefs = 0, [numClocks]uint8{}
+	d.pmMode, d.srEnabled, d.busAsleep, d.busIdlePolls = None, false, false, 0
+	d.hostAsleep = false
+	d.chip, d.chipRev = nil, 0
 }
 
 func (d *Device) getInterrupts() Interrupts {
@@ -227,9 +633,6 @@ func (d *Device) getInterrupts() Interrupts {
 	return Interrupts(irq)
 }
 
-func (d *Device) lock()   { d.mu.Lock() }
-func (d *Device) unlock() { d.mu.Unlock() }
-
 // align rounds `val` up to nearest multiple of `align`.
 func align[T constraints.Unsigned](val, align T) T {
 	return (val + align - 1) &^ (align - 1)
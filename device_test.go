@@ -0,0 +1,2878 @@
+package cyw43439
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+// fakeBus emulates just enough of the chip for the packet hot paths to run:
+// WLAN reads return pkt, backplane reads return regs contents and gSPI bus
+// register reads return busRegs contents.
+// IOCTLs written are recorded and answered, see fakeIoctl.
+type fakeBus struct {
+	status  uint32
+	more    int // WLAN packets pending after the one read.
+	window  uint32
+	pkt     []byte
+	regs    map[uint32]uint32
+	busRegs map[uint32]uint32
+	mem     map[uint32]uint32 // If not nil, records backplane writes.
+	ioctls  []fakeIoctl
+	// ioctlResp, if set, returns the response data and CDC status of an
+	// IOCTL. Otherwise GETs echo the request and all IOCTLs succeed.
+	ioctlResp func(io fakeIoctl) ([]byte, uint32)
+	ioctlMute bool     // IOCTLs are recorded but not answered.
+	resps     [][]byte // Control packets pending to be read.
+}
+
+// fakeIoctl is an IOCTL written to the fake bus.
+type fakeIoctl struct {
+	kind  uint8
+	cmd   whd.SDPCMCommand
+	iface whd.IoctlInterface
+	data  []byte
+}
+
+// iovar splits the data of a WLC_GET_VAR or WLC_SET_VAR IOCTL into the
+// iovar name and value.
+func (io fakeIoctl) iovar() (name string, value []byte) {
+	n := bytes.IndexByte(io.data, 0)
+	if n < 0 {
+		return "", nil
+	}
+	return string(io.data[:n]), io.data[n+1:]
+}
+
+// findIovar returns the last IOCTL setting the iovar name.
+func (b *fakeBus) findIovar(name string) (value []byte, ok bool) {
+	for i := len(b.ioctls) - 1; i >= 0; i-- {
+		if n, v := b.ioctls[i].iovar(); b.ioctls[i].cmd == whd.WLC_SET_VAR && n == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// findIoctl returns the last IOCTL with command cmd.
+func (b *fakeBus) findIoctl(cmd whd.SDPCMCommand) (io fakeIoctl, ok bool) {
+	for i := len(b.ioctls) - 1; i >= 0; i-- {
+		if b.ioctls[i].cmd == cmd {
+			return b.ioctls[i], true
+		}
+	}
+	return io, false
+}
+
+// ioctl records an IOCTL written to the bus and queues its response.
+func (b *fakeBus) ioctl(pkt []byte) {
+	cdc := whd.DecodeCDCHeader(_busOrder, pkt[whd.SDPCM_HEADER_LEN:])
+	start := whd.SDPCM_HEADER_LEN + whd.CDC_HEADER_LEN
+	io := fakeIoctl{
+		kind:  uint8(cdc.Flags & 3),
+		cmd:   cdc.Cmd,
+		iface: whd.IoctlInterface(cdc.Flags >> whd.CDCF_IOC_IF_SHIFT),
+		data:  append([]byte(nil), pkt[start:start+int(cdc.Length)]...),
+	}
+	b.ioctls = append(b.ioctls, io)
+	if b.ioctlMute {
+		return
+	}
+	var resp []byte
+	var status uint32
+	if b.ioctlResp != nil {
+		resp, status = b.ioctlResp(io)
+	} else if io.kind == whd.SDPCM_GET {
+		resp = io.data
+	}
+	total := start + len(resp)
+	out := make([]byte, total)
+	hdr := whd.SDPCMHeader{
+		Size:          uint16(total),
+		SizeCom:       ^uint16(total),
+		Seq:           b.pkt[4],
+		HeaderLength:  whd.SDPCM_HEADER_LEN,
+		BusDataCredit: whd.DecodeSDPCMHeader(_busOrder, pkt).Seq + 8, // Credit never runs out.
+	}
+	hdr.Put(_busOrder, out)
+	b.pkt[4]++ // Control and data packets share sequence numbers.
+	cdc.Length, cdc.Status = uint32(len(resp)), status
+	cdc.Put(_busOrder, out[whd.SDPCM_HEADER_LEN:])
+	copy(out[start:], resp)
+	b.resps = append(b.resps, out)
+	b.status = 1<<8 | uint32(len(b.resps[0]))<<9
+}
+
+func (b *fakeBus) CmdRead(cmd uint32, buf []uint32) error {
+	fn := Function(cmd >> 28 & 0b11)
+	addr := cmd >> 11 & 0x1ffff
+	switch fn {
+	case FuncWLAN:
+		if len(b.resps) > 0 {
+			copy(u32AsU8(buf), b.resps[0])
+			b.resps = b.resps[1:]
+			b.status = 0
+			if len(b.resps) > 0 {
+				b.status = 1<<8 | uint32(len(b.resps[0]))<<9
+			}
+			return nil
+		}
+		copy(u32AsU8(buf), b.pkt)
+		b.pkt[4]++ // Next SDPCM sequence number.
+		if b.more > 0 {
+			b.more--
+		} else {
+			b.status = 0
+		}
+	case FuncBackplane:
+		// Backplane reads are preceded by a padding word. SDIO registers are not windowed.
+		if addr < 0x10000 {
+			addr = b.window | addr&^0x08000
+		}
+		buf[len(buf)-1] = b.regs[addr]
+	default:
+		clear(buf)
+		buf[0] = b.busRegs[addr]
+	}
+	return nil
+}
+
+func (b *fakeBus) CmdWrite(cmd uint32, buf []uint32) error {
+	fn := Function(cmd >> 28 & 0b11)
+	addr := cmd >> 11 & 0x1ffff
+	if fn == FuncWLAN {
+		pkt := u32AsU8(buf)
+		if whd.DecodeSDPCMHeader(_busOrder, pkt).ChanAndFlags&0xf == uint8(whd.CONTROL_HEADER) {
+			b.ioctl(pkt)
+		}
+	} else if fn == FuncBackplane {
+		switch addr {
+		case 0x1000a:
+			b.window = b.window&^0xff00 | (buf[0]&0xff)<<8
+		case 0x1000b:
+			b.window = b.window&^0xff0000 | (buf[0]&0xff)<<16
+		case 0x1000c:
+			b.window = b.window&^0xff000000 | (buf[0]&0xff)<<24
+		default:
+			if b.mem == nil || addr >= 0x10000 {
+				break
+			}
+			addr = b.window | addr&^0x08000
+			for i := uint32(0); i < (cmd&0x7ff+3)/4; i++ {
+				b.mem[addr+4*i] = buf[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (b *fakeBus) LastStatus() uint32 { return b.status }
+
+func newFakeDevice(t *testing.T) (*Device, *fakeBus) {
+	const ethLen = 64
+	const total = whd.SDPCM_HEADER_LEN + 2 + whd.BDC_HEADER_LEN + ethLen
+	bus := &fakeBus{
+		pkt: make([]byte, total),
+		regs: map[uint32]uint32{
+			whd.BT_CTRL_REG_ADDR: whd.BTSDIO_REG_BT_AWAKE_BITMASK,
+		},
+	}
+	hdr := whd.SDPCMHeader{
+		Size:          total,
+		SizeCom:       ^uint16(total),
+		ChanAndFlags:  uint8(whd.DATA_HEADER),
+		HeaderLength:  whd.SDPCM_HEADER_LEN + 2,
+		BusDataCredit: 0xff,
+	}
+	hdr.Put(_busOrder, bus.pkt)
+	bus.pkt[whd.SDPCM_HEADER_LEN+2] = 2 << 4 // BDC version.
+	d := New(func(bool) {}, func(bool) {}, bus)
+	d.reset_state()
+	d.state = linkStateUp
+	d.btaddr = 0x19000
+	return d, bus
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.RecvEthHandle(func(pkt []byte) error { return nil })
+	frame := make([]byte, 64)
+	headroomFrame := make([]byte, TxHeadroom+64)
+	hci := []byte{hciPacketCommand, 0x03, 0x0c, 0}
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{name: "SendEth", fn: func() {
+			d.sdpcmSeqMax = d.sdpcmSeq + 8
+			if err := d.SendEth(frame); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "SendEthWithHeadroom", fn: func() {
+			d.sdpcmSeqMax = d.sdpcmSeq + 8
+			if err := d.SendEthWithHeadroom(headroomFrame); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "TryPoll", fn: func() {
+			bus.status = 1<<8 | uint32(len(bus.pkt))<<9 // F2 packet available.
+			if didWork, err := d.TryPoll(); err != nil || !didWork {
+				t.Fatal(didWork, err)
+			}
+		}},
+		{name: "WriteHCI", fn: func() {
+			if _, err := d.WriteHCI(hci); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "ReadHCI", fn: func() {
+			bus.regs[d.btaddr+whd.BTSDIO_OFFSET_BT2HOST_IN] += 4 // Controller wrote an empty packet.
+			if n, err := d.ReadHCI(frame); err != nil || n != 1 {
+				t.Fatal(n, err)
+			}
+		}},
+		{name: "ReadHCIPacket", fn: func() {
+			bus.regs[d.btaddr+whd.BTSDIO_OFFSET_BT2HOST_IN] += 4
+			if n, err := d.ReadHCIPacket(frame); err != nil || n != 1 {
+				t.Fatal(n, err)
+			}
+		}},
+		{name: "Poll", fn: func() {
+			bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+			bus.regs[d.btaddr+whd.BTSDIO_OFFSET_BT2HOST_IN] += 4
+			if frames, hci, err := d.Poll(PollBudget{MaxFrames: 2, MaxHCI: 2}); err != nil || frames != 1 || hci != 1 {
+				t.Fatal(frames, hci, err)
+			}
+		}},
+	}
+	// Logging enabled at a level above the hot path logs must not allocate either.
+	d.SetLogger(newDiscardLogger())
+	d.RecvHCIHandle(func(pkt []byte) error { return nil })
+	for _, test := range tests {
+		allocs := testing.AllocsPerRun(100, test.fn)
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per run, want 0", test.name, allocs)
+		}
+	}
+	if stats := d.Stats(); stats.RxFrames == 0 || stats.TxFrames == 0 || stats.RxSeqGaps != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// fakeClock advances only when slept on.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Sleep(dur time.Duration) { c.t = c.t.Add(dur) }
+
+func TestClockTimeouts(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	clk := &fakeClock{t: time.Unix(1, 0)}
+	d.SetClock(clk)
+	d.hciReadTimeout = time.Second
+	start := time.Now()
+	_, err := d.ReadHCI(make([]byte, 8))
+	if err != ErrDataNotAvailable {
+		t.Errorf("ReadHCI: got %v, want %v", err, ErrDataNotAvailable)
+	}
+	if waited := clk.t.Sub(time.Unix(1, 0)); waited < d.hciReadTimeout {
+		t.Errorf("ReadHCI returned after %s, want at least %s", waited, d.hciReadTimeout)
+	}
+
+	delete(bus.regs, whd.BT_CTRL_REG_ADDR) // Controller never wakes.
+	err = d.bt_bus_request()
+	if err != errBTWaitCtrlTimeout {
+		t.Errorf("bt_bus_request: got %v, want %v", err, errBTWaitCtrlTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("fake clock timeouts took %s of real time", elapsed)
+	}
+}
+
+func TestBridgeTranslate(t *testing.T) {
+	var br bridgeState
+	staMAC := [6]byte{0x28, 0xcd, 0xc1, 0, 0, 1}
+	client := [6]byte{0xaa, 0, 0, 0, 0, 2}
+	upstream := [6]byte{0xbb, 0, 0, 0, 0, 3}
+	clientIP := [4]byte{192, 168, 1, 50}
+
+	// ARP request from client to upstream router.
+	frame := make([]byte, ethHeaderLen+arpLen)
+	copy(frame[0:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:], client[:])
+	frame[12], frame[13] = ethTypeARP>>8, ethTypeARP&0xff
+	copy(frame[arpSenderHW:], client[:])
+	copy(frame[arpSenderIP:], clientIP[:])
+	if !br.translateOut(&staMAC, frame) {
+		t.Fatal("ARP request rejected")
+	}
+	if [6]byte(frame[6:12]) != staMAC || [6]byte(frame[arpSenderHW:]) != staMAC {
+		t.Errorf("client MAC not translated: %x", frame)
+	}
+
+	// ARP reply from upstream back to the client.
+	copy(frame[0:], staMAC[:])
+	copy(frame[6:], upstream[:])
+	copy(frame[arpTargetHW:], staMAC[:])
+	copy(frame[arpTargetIP:], clientIP[:])
+	if !br.translateIn(frame) {
+		t.Fatal("ARP reply rejected")
+	}
+	if [6]byte(frame[0:6]) != client || [6]byte(frame[arpTargetHW:]) != client {
+		t.Errorf("reply not translated to client MAC: %x", frame)
+	}
+
+	// IPv4 for an address not behind the bridge is not forwarded.
+	frame = make([]byte, ethHeaderLen+ipv4HeaderLen)
+	frame[12], frame[13] = ethTypeIPv4>>8, ethTypeIPv4&0xff
+	copy(frame[ethHeaderLen+16:], []byte{192, 168, 1, 2})
+	if br.translateIn(frame) {
+		t.Error("frame for unknown address forwarded")
+	}
+}
+
+func TestHCIDataLengthExtension(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	// LE Read Buffer Size complete: 251 byte ACL data length, 2 buffers.
+	d.hci_track_credits([]byte{hciPacketEvent, hciEvCommandComplete, 7, 1, 0x02, 0x20, 0, 251, 0, 2})
+	if got := d.HCIACLDataLen(); got != 251 {
+		t.Fatalf("ACL data length: got %d, want 251", got)
+	}
+	acl := func(dataLen int) []byte {
+		pkt := make([]byte, 1+hciACLHeaderLen+dataLen)
+		pkt[0] = hciPacketACL
+		pkt[3], pkt[4] = byte(dataLen), byte(dataLen>>8)
+		return pkt
+	}
+	if _, err := d.WriteHCI(acl(251)); err != nil {
+		t.Errorf("DLE sized ACL packet: %v", err)
+	}
+	if _, err := d.WriteHCI(acl(252)); err != errHCIPacketTooLarge {
+		t.Errorf("oversized ACL packet: got %v, want %v", err, errHCIPacketTooLarge)
+	}
+	if _, err := d.WriteHCI(acl(251)[:100]); err != errHCIHeaderLength {
+		t.Errorf("truncated ACL packet: got %v, want %v", err, errHCIHeaderLength)
+	}
+}
+
+func TestHCIPacketTypes(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	tests := []struct {
+		pkt  []byte
+		want error
+	}{
+		{pkt: []byte{hciPacketCommand, 0x03, 0x0c, 0}},
+		{pkt: []byte{hciPacketCommand, 0x03, 0x0c, 1}, want: errHCIHeaderLength},
+		{pkt: []byte{hciPacketSCO, 0x01, 0x00, 2, 0xaa, 0xbb}},
+		{pkt: []byte{hciPacketISO, 0x01, 0x00, 2, 0xc0, 0xaa, 0xbb}}, // Length ignores top bits.
+		{pkt: []byte{hciPacketISO, 0x01, 0x00, 3, 0x00, 0xaa, 0xbb}, want: errHCIHeaderLength},
+		{pkt: []byte{hciPacketEvent, 0x0e, 0}, want: errHCIPacketType},
+		{pkt: []byte{0x06, 0, 0, 0}, want: errHCIPacketType},
+		{pkt: []byte{hciPacketACL, 0x01, 0x00}, want: errHCIPacketTooShort},
+	}
+	for _, test := range tests {
+		if _, err := d.WriteHCI(test.pkt); err != test.want {
+			t.Errorf("WriteHCI(%x): got %v, want %v", test.pkt, err, test.want)
+		}
+	}
+	if n, ok := hciPacketLen([]byte{hciPacketEvent, 0x0e, 4}); !ok || n != 7 {
+		t.Errorf("event packet length: got %d, %v", n, ok)
+	}
+}
+
+func TestFirmwareImage(t *testing.T) {
+	want := Config{Firmware: "wlan-firmware", CLM: "clm", BluetoothFirmware: "bt"}
+	image := string(AppendFirmwareImage(nil, want))
+	got, err := ParseFirmwareImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Firmware != want.Firmware || got.CLM != want.CLM || got.BluetoothFirmware != want.BluetoothFirmware {
+		t.Errorf("got %q %q %q", got.Firmware, got.CLM, got.BluetoothFirmware)
+	}
+	if _, err = ParseFirmwareImage(image[:len(image)-4]); err != errImageBounds {
+		t.Errorf("truncated image: got %v, want %v", err, errImageBounds)
+	}
+	if _, err = ParseFirmwareImage(string(AppendFirmwareImage(nil, Config{CLM: "clm"}))); err != errImageNoWLAN {
+		t.Errorf("image without WLAN: got %v, want %v", err, errImageNoWLAN)
+	}
+}
+
+// memProvider is a FirmwareProvider backed by memory.
+type memProvider struct{ image string }
+
+func (p *memProvider) FirmwareImage() (string, error) { return p.image, nil }
+
+func (p *memProvider) StoreImage(r io.Reader, size int) error {
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	p.image = string(b)
+	return err
+}
+
+func TestUpdateFirmware(t *testing.T) {
+	image := AppendFirmwareImage(nil, Config{Firmware: "wlan", CLM: "clm", NVRAM: "nvram"})
+	var p memProvider
+	err := UpdateFirmware(&p, bytes.NewReader(image), len(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.image != string(image) {
+		t.Errorf("stored image %q, want %q", p.image, image)
+	}
+	d, _ := newFakeDevice(t)
+	cfg := d.apply_firmware_image(Config{Firmware: "embedded", BluetoothFirmware: "bt", FirmwareProvider: &p})
+	if cfg.Firmware != "wlan" || cfg.CLM != "clm" || cfg.NVRAM != "nvram" || cfg.BluetoothFirmware != "bt" {
+		t.Errorf("bad config from provider %+v", cfg)
+	}
+	// Images whose size does not match the directory must not be stored.
+	var empty memProvider
+	err = UpdateFirmware(&empty, bytes.NewReader(image), len(image)+64)
+	if err != errImageSize || empty.image != "" {
+		t.Errorf("got %v, want %v", err, errImageSize)
+	}
+}
+
+func TestUploadCompressed(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	fw := bytes.Repeat([]byte("\x00\x20\x01\x48firmware"), 3000)
+	var written, total int
+	d.uploadProgress = func(what string, w, tot int) { written, total = w, tot }
+	err := d.upload_firmware(0, string(CompressFirmware(nil, fw)))
+	if err != nil {
+		t.Fatal(err)
+	} else if written != len(fw) || total != len(fw) {
+		t.Errorf("progress %d/%d, want %d", written, total, len(fw))
+	}
+}
+
+func TestInitReport(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	err := d.Init(Config{}) // Fake bus test register never matches.
+	var report *InitReport
+	if !errors.As(err, &report) {
+		t.Fatalf("Init: got %v, want *InitReport", err)
+	}
+	if report.Phase != InitPhaseBus || report.Err == nil {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.PhaseTimes[InitPhaseBus] < 270*time.Millisecond || report.Elapsed < report.PhaseTimes[InitPhaseBus] {
+		t.Errorf("bus phase took %s of %s, want power cycle time", report.PhaseTimes[InitPhaseBus], report.Elapsed)
+	}
+}
+
+func TestChipClockRefs(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	if err := d.RequestClock(ClockHT); err != errClockTimeout {
+		t.Fatalf("RequestClock: got %v, want %v", err, errClockTimeout)
+	}
+	bus.regs[whd.SDIO_CHIP_CLOCK_CSR] = whd.SBSDIO_ALP_AVAIL | whd.SBSDIO_HT_AVAIL
+	for i := 0; i < 2; i++ {
+		if err := d.RequestClock(ClockHT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := d.ClockStatus()
+	if err != nil || !st.HTAvailable || st.HTRequests != 2 || st.ALPRequests != 0 {
+		t.Errorf("unexpected status %+v %v", st, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.ReleaseClock(ClockHT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.ReleaseClock(ClockHT); err != errClockNotHeld {
+		t.Errorf("ReleaseClock: got %v, want %v", err, errClockNotHeld)
+	}
+}
+
+func TestBusSleep(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	if enabled, err := d.sr_init(); enabled || err != nil {
+		t.Fatalf("sr_init without firmware support: got %v, %v", enabled, err)
+	}
+	bus.regs[whd.CHIPCOMMON_SR_CONTROL1] = 1
+	bus.regs[whd.SDIO_SLEEP_CSR] = whd.SBSDIO_SLPCSR_KEEP_SDIO_ON
+	if enabled, err := d.sr_init(); !enabled || err != nil || d.clkBase != whd.SBSDIO_FORCE_HT {
+		t.Fatalf("sr_init: got %v, %v", enabled, err)
+	}
+	bus.regs[whd.SDIO_SLEEP_CSR] = 0
+	d.initialized, d.srEnabled, d.pmMode, d.btaddr = true, true, PowerSave, 0
+	bus.status = 0 // No F2 packet available.
+	for i := 0; i < busSleepIdlePolls; i++ {
+		if didWork, err := d.TryPoll(); err != nil || didWork {
+			t.Fatal(didWork, err)
+		}
+	}
+	if !d.busAsleep {
+		t.Fatal("bus not asleep after idle polls")
+	}
+	bus.regs[whd.SDIO_SLEEP_CSR] = whd.SBSDIO_SLPCSR_KEEP_SDIO_ON | whd.SBSDIO_SLPCSR_DEVICE_ON
+	if _, err := d.ClockStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if d.busAsleep || d.Stats().BusWakeups != 1 {
+		t.Errorf("backplane access did not wake bus: asleep=%v stats=%+v", d.busAsleep, d.Stats())
+	}
+}
+
+func TestHostWakeConfig(t *testing.T) {
+	configure := func(Pull) error { return nil }
+	tests := []struct {
+		cfg  HostWakeConfig
+		want error
+	}{
+		{cfg: HostWakeConfig{}},
+		{cfg: HostWakeConfig{Configure: configure, Pull: PullDown}},
+		{cfg: HostWakeConfig{Configure: configure, Pull: PullUp, ActiveLow: true}},
+		{cfg: HostWakeConfig{Configure: configure, Pull: PullUp}, want: errHostWakeAsserted},
+		{cfg: HostWakeConfig{Configure: configure, Pull: PullDown, ActiveLow: true}, want: errHostWakeAsserted},
+		{cfg: HostWakeConfig{Pull: PullDown}, want: errHostWakeNoConfig},
+		{cfg: HostWakeConfig{Configure: configure, Pull: PullDown + 1}, want: errHostWakePull},
+	}
+	for i, test := range tests {
+		if err := test.cfg.validate(); err != test.want {
+			t.Errorf("%d: got %v, want %v", i, err, test.want)
+		}
+	}
+}
+
+func TestChipDetect(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	bus.regs[whd.CHIPCOMMON_BASE_ADDRESS] = 0x1234
+	if _, err := d.chip_detect(); err != errChipUnknown {
+		t.Fatalf("chip_detect: got %v, want %v", err, errChipUnknown)
+	}
+	bus.regs[whd.CHIPCOMMON_BASE_ADDRESS] = 1<<16 | uint32(Chip43430)
+	if id, err := d.chip_detect(); err != nil || id != Chip43430 {
+		t.Fatalf("chip_detect: got %d, %v", id, err)
+	}
+	if info, _ := d.ChipInfo(); info.Rev != 1 || info.ID != Chip43430 {
+		t.Errorf("unexpected chip info %+v", info)
+	}
+	cfg := DefaultWifiConfig()
+	if _, err := d.chip_firmware(cfg); err != errChipNVRAM {
+		t.Errorf("chip_firmware without NVRAM: got %v, want %v", err, errChipNVRAM)
+	}
+	cfg.Variants = []FirmwareVariant{{ChipID: Chip43430, Firmware: "fw", CLM: "clm", NVRAM: "nvram"}}
+	cfg, err := d.chip_firmware(cfg)
+	if err != nil || cfg.Firmware != "fw" || cfg.CLM != "clm" || cfg.NVRAM != "nvram" {
+		t.Errorf("chip_firmware: got %v, %q %q %q", err, cfg.Firmware, cfg.CLM, cfg.NVRAM)
+	}
+}
+
+func TestMultipleDevices(t *testing.T) {
+	const n = 50
+	var devs [2]*Device
+	var buses [2]*fakeBus
+	for i := range devs {
+		devs[i], buses[i] = newFakeDevice(t)
+		devs[i].SetClock(&fakeClock{t: time.Unix(1, 0)})
+	}
+	errs := make(chan error, len(devs))
+	for i := range devs {
+		go func(d *Device, bus *fakeBus) {
+			var report *InitReport
+			if err := d.Init(Config{}); !errors.As(err, &report) || report.Phase != InitPhaseBus {
+				errs <- err
+				return
+			}
+			// Init failure resets the device, restore fake device state for traffic.
+			d.state, d.btaddr = linkStateUp, 0x19000
+			frame := make([]byte, 64)
+			for j := 0; j < n; j++ {
+				d.sdpcmSeqMax = d.sdpcmSeq + 8
+				if err := d.SendEth(frame); err != nil {
+					errs <- err
+					return
+				}
+				bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+				if _, err := d.TryPoll(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(devs[i], buses[i])
+	}
+	for range devs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, d := range devs {
+		if stats := d.Stats(); stats.TxFrames != n || stats.RxFrames != n {
+			t.Errorf("device %d: unexpected stats %+v", i, stats)
+		}
+	}
+}
+
+func TestRecvHandlers(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	ethType := whd.SDPCM_HEADER_LEN + 2 + whd.BDC_HEADER_LEN + 12
+	bus.pkt[ethType], bus.pkt[ethType+1] = 0x08, 0x00 // IPv4.
+	var ipv4, any, eapol int
+	idIPv4, _ := d.AddRecvHandler(EtherTypeIPv4, func(pkt []byte) error { ipv4++; return errors.New("stack error") })
+	d.AddRecvHandler(EtherTypeAny, func(pkt []byte) error { any++; return nil })
+	d.AddRecvHandler(EtherTypeEAPOL, func(pkt []byte) error { eapol++; return nil })
+	poll := func() {
+		bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+		if _, err := d.TryPoll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll()
+	if err := d.RemoveRecvHandler(idIPv4); err != nil {
+		t.Fatal(err)
+	}
+	poll()
+	if ipv4 != 1 || any != 2 || eapol != 0 {
+		t.Errorf("got ipv4=%d any=%d eapol=%d, want 1, 2, 0", ipv4, any, eapol)
+	}
+	if stats := d.Stats(); stats.RxHandlerErrors != 1 || stats.RxDropped != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if err := d.RemoveRecvHandler(idIPv4); err != errRecvHandlerID {
+		t.Errorf("got %v removing twice, want %v", err, errRecvHandlerID)
+	}
+}
+
+func TestLLDP(t *testing.T) {
+	mac := [6]byte{0x28, 0xcd, 0xc1, 1, 2, 3}
+	frame := appendLLDP(nil, mac, 120, LLDPConfig{SystemName: "pico", PortDescription: "wlan0"})
+	want := []byte{
+		0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e, 0x28, 0xcd, 0xc1, 1, 2, 3, 0x88, 0xcc,
+		0x02, 0x07, 4, 0x28, 0xcd, 0xc1, 1, 2, 3, // Chassis ID.
+		0x04, 0x07, 3, 0x28, 0xcd, 0xc1, 1, 2, 3, // Port ID.
+		0x06, 0x02, 0, 120, // TTL.
+		0x08, 0x05, 'w', 'l', 'a', 'n', '0',
+		0x0a, 0x04, 'p', 'i', 'c', 'o',
+		0x0e, 0x04, 0, 0x80, 0, 0x80, // Capabilities.
+		0, 0,
+	}
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("got frame\n%x\nwant\n%x", frame, want)
+	} else if binary.BigEndian.Uint16(frame[lldpTTLOffset:]) != 120 {
+		t.Fatal("bad TTL offset")
+	}
+
+	d, _ := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	if err := d.StartLLDP(LLDPConfig{}); err != errLLDPNoMAC {
+		t.Fatalf("got %v, want %v", err, errLLDPNoMAC)
+	}
+	d.mac = mac
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	if err := d.StartLLDP(LLDPConfig{SystemName: "pico"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		d.TryPoll()
+	}
+	if tx := d.Stats().TxFrames; tx != 1 {
+		t.Errorf("got %d announcements, want 1 until the interval elapses", tx)
+	}
+	d.sleep(lldpDefaultInterval)
+	d.TryPoll()
+	if err := d.StopLLDP(); err != nil {
+		t.Fatal(err)
+	}
+	if tx := d.Stats().TxFrames; tx != 3 {
+		t.Errorf("got %d frames, want 3 including the shutdown announcement", tx)
+	}
+}
+
+func TestJoinTrace(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.SetJoinTrace(true)
+	d.jointrace_start("home")
+	eapol := func(keyInfo uint16) []byte {
+		pkt := make([]byte, 32)
+		binary.BigEndian.PutUint16(pkt[12:], EtherTypeEAPOL)
+		pkt[ethHeaderLen+1] = eapolTypeKey
+		binary.BigEndian.PutUint16(pkt[ethHeaderLen+eapolKeyInfo:], keyInfo)
+		return pkt
+	}
+	d.jointrace_event(&whd.EventMessage{EventType: whd.EvAUTH})
+	d.jointrace_event(&whd.EventMessage{EventType: whd.EvASSOC})
+	d.jointrace_eapol(eapol(eapolKeyPairwise | eapolKeyAck))
+	d.jointrace_event(&whd.EventMessage{EventType: whd.EvRSSI}) // Not recorded.
+	d.jointrace_event(&whd.EventMessage{EventType: whd.EvDEAUTH_IND, Reason: reasonFourWayTimeout})
+	err := d.jointrace_end(errJoinGeneric)
+	var report *JoinReport
+	if !errors.As(err, &report) || !errors.Is(err, errJoinGeneric) {
+		t.Fatalf("got %v, want *JoinReport wrapping errJoinGeneric", err)
+	}
+	if len(report.Steps) != 4 || report.Steps[2].EAPOLKey != 1 {
+		t.Fatalf("unexpected steps:\n%s", report)
+	}
+	if diag := report.Diagnosis(); !strings.Contains(diag, "wrong passphrase") {
+		t.Errorf("unexpected diagnosis %q", diag)
+	}
+	// Successful joins and joins with tracing disabled return errors untouched.
+	d.jointrace_start("home")
+	if err := d.jointrace_end(nil); err != nil {
+		t.Error(err)
+	}
+	d.SetJoinTrace(false)
+	d.jointrace_start("home")
+	if err := d.jointrace_end(errJoinGeneric); err != errJoinGeneric {
+		t.Error(err)
+	}
+	r := JoinReport{Steps: []JoinStep{{Event: whd.EvSET_SSID, Status: whd.CYW43_STATUS_NO_NETWORKS}}}
+	if diag := r.Diagnosis(); !strings.Contains(diag, "not found") {
+		t.Errorf("unexpected diagnosis %q", diag)
+	}
+}
+
+func TestAPBlacklist(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	bad := [6]byte{0xaa, 1, 2, 3, 4, 5}
+	d.state = linkStateWaitForReconnect
+	for i := 0; i < defaultBlacklistFailures; i++ {
+		if d.blacklisted(bad) {
+			t.Fatalf("blacklisted after %d failures", i)
+		}
+		d.blacklist_event(&whd.EventMessage{EventType: whd.EvAUTH, Status: whd.CYW43_STATUS_FAIL, Addr: bad})
+	}
+	list := d.APBlacklist(nil)
+	if !d.blacklisted(bad) || len(list) != 1 || list[0].Remaining != defaultBlacklistDuration {
+		t.Fatalf("not blacklisted: %+v", list)
+	}
+	d.sleep(defaultBlacklistDuration)
+	if d.blacklisted(bad) {
+		t.Error("blacklisted after duration elapsed")
+	}
+	// Failures during a join are counted once by the join.
+	d.state = linkStateDown
+	d.blacklist_event(&whd.EventMessage{EventType: whd.EvDEAUTH_IND, Addr: bad})
+	if d.apRejected != bad || d.APBlacklist(nil)[0].Failures != defaultBlacklistFailures {
+		t.Error("join failure not deferred to join")
+	}
+	d.blacklist_event(&whd.EventMessage{EventType: whd.EvSET_SSID, Addr: bad})
+	if list := d.APBlacklist(nil); len(list) != 0 {
+		t.Errorf("successful join did not clear failures: %+v", list)
+	}
+}
+
+func TestTxQueue(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	if err := d.SetTxQueue(TxQueueConfig{Depth: 2, MaxAge: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 64)
+	d.sdpcmSeqMax = d.sdpcmSeq // No credit.
+	for i := 0; i < 3; i++ {
+		if err := d.SendEth(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.SendEthWithin(frame, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stats := d.Stats(); stats.TxQueueDepth != 2 || stats.TxQueueDropped != 2 || stats.TxFrames != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// The frame sent with SendEth ages out, the one sent with SendEthWithin is sent once credit arrives.
+	d.sleep(20 * time.Millisecond)
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	d.TryPoll()
+	if stats := d.Stats(); stats.TxQueueDepth != 0 || stats.TxQueueAged != 1 || stats.TxFrames != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	d.SendEth(frame)
+	if stats := d.Stats(); stats.TxFrames != 2 {
+		t.Errorf("frame not sent right away with credit: %+v", stats)
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.EnableLockMetrics(true)
+	for i := 0; i < 10; i++ {
+		d.Stats()
+		d.HCIACLDataLen()
+	}
+	for s := SubsystemWiFi; s < numSubsystems; s++ {
+		st := d.LockStats(s)
+		if st.Acquisitions < 10 || st.HoldMax < st.Hold95 || st.HoldTotal < st.HoldMax {
+			t.Errorf("%s: unexpected stats %+v", s, st)
+		}
+	}
+	d.EnableLockMetrics(false)
+	d.ResetLockStats()
+	d.Stats()
+	if st := d.LockStats(SubsystemWiFi); st.Acquisitions != 0 {
+		t.Errorf("measured with metrics disabled: %+v", st)
+	}
+}
+
+func TestBufferedHCICache(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	in := d.btaddr + whd.BTSDIO_OFFSET_BT2HOST_IN
+	bus.regs[in] = 8
+	if n, err := d.BufferedHCI(); err != nil || n != 8 {
+		t.Fatal(n, err)
+	}
+	// Cached while the controller raises no interrupt.
+	bus.regs[in] = 16
+	if n, _ := d.BufferedHCI(); n != 8 {
+		t.Errorf("got %d, want cached 8", n)
+	}
+	d.hciCheckedAt.Store(1) // Expire the lock-free fast path.
+	if n, _ := d.BufferedHCI(); n != 8 {
+		t.Errorf("got %d, want cached 8 without interrupt", n)
+	}
+	// Consuming the ring invalidates the cache.
+	if err := d.hci_consume(4); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := d.BufferedHCI(); n != 12 {
+		t.Errorf("got %d, want 12 after consuming", n)
+	}
+}
+
+func TestDeviceState(t *testing.T) {
+	// IEEE 802.11-2020 J.4.2 test vector.
+	pmk := pskPMK("IEEE", []byte("password"))
+	want := "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"
+	if got := hex.EncodeToString(pmk[:]); got != want {
+		t.Errorf("PMK got %s, want %s", got, want)
+	}
+	if got := pskPMK("IEEE", []byte(want)); got != pmk {
+		t.Error("hexadecimal passphrase not taken as PMK")
+	}
+
+	d, _ := newFakeDevice(t)
+	d.initialized = true
+	var buf bytes.Buffer
+	if err := d.SaveState(&buf); err != errStateNoJoin {
+		t.Errorf("saved state without join: %v", err)
+	}
+	state := make([]byte, stateLen)
+	copy(state, "CYWS\x02")
+	if err := d.RestoreState(bytes.NewReader(state)); err != errStateInvalid {
+		t.Errorf("restored invalid state: %v", err)
+	}
+	if err := d.RestoreState(bytes.NewReader(state[:10])); err != io.ErrUnexpectedEOF {
+		t.Errorf("restored truncated state: %v", err)
+	}
+}
+
+func TestJoinKeepsPMK(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd == whd.WLC_SET_SSID {
+			d.state = linkStateUp
+		} else if io.kind == whd.SDPCM_GET {
+			return io.data, 0
+		}
+		return nil, 0
+	}
+	if err := d.JoinWPA2("IEEE", "password"); err != nil {
+		t.Fatal(err)
+	}
+	want := pskPMK("IEEE", []byte("password"))
+	if !d.creds.hasPMK || d.creds.pmk != want {
+		t.Errorf("got credentials %+v, want PMK %x", d.creds, want)
+	}
+	var buf bytes.Buffer
+	if err := d.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if state := buf.Bytes(); !bytes.Equal(state[39:71], want[:]) || bytes.Contains(state, []byte("password")) {
+		t.Errorf("got state % x, want PMK and no passphrase", state)
+	}
+
+	if err := d.JoinWPA2("open", ""); err != nil {
+		t.Fatal(err)
+	} else if d.creds.hasPMK || d.creds.pmk != [32]byte{} || d.creds.ssid != "open" {
+		t.Errorf("got credentials %+v for open network", d.creds)
+	}
+}
+
+func TestJoinWPA2SecretZeroes(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	pass := []byte("short")
+	if err := d.JoinWPA2Secret("ssid", pass); err != errPassphraseLen {
+		t.Errorf("got %v, want %v", err, errPassphraseLen)
+	}
+	if !bytes.Equal(pass, make([]byte, len(pass))) {
+		t.Errorf("passphrase not zeroed: %q", pass)
+	}
+}
+
+func TestBusCRCErrors(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	if err := d.SetBusCRC(true); err != errBusNoCRC {
+		t.Errorf("got %v, want %v", err, errBusNoCRC)
+	}
+	bus.status |= whd.STATUS_HOST_CMD_DATA_ERR
+	d.read32(FuncBus, whd.SPI_STATUS_REGISTER)
+	if got := d.Stats().BusCRCErrors; got != 1 {
+		t.Errorf("got %d CRC errors, want 1", got)
+	}
+	d.ResetStats()
+	if got := d.Stats().BusCRCErrors; got != 0 {
+		t.Errorf("got %d CRC errors after reset", got)
+	}
+}
+
+func TestWordOrder(t *testing.T) {
+	// Test pattern as read by a host sending words least significant byte first.
+	const garbled = 0xedfeadbe
+	found := 0
+	for o := wordOrderSwap16; o < numWordOrders; o++ {
+		if o.apply(o.apply(garbled)) != garbled {
+			t.Errorf("%s: apply is not an involution", o)
+		}
+		if o.apply(garbled) == whd.TEST_PATTERN {
+			found++
+			if o != wordOrderReversedSwap16 {
+				t.Errorf("pattern recovered by %s", o)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("pattern recovered by %d orders", found)
+	}
+}
+
+func TestFrameSizeLimit(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	if d.LinkMTU() != 1500 || d.MaxFrameSize() != 1518 {
+		t.Errorf("got link MTU %d and frame size %d", d.LinkMTU(), d.MaxFrameSize())
+	}
+	if d.MTU() != MTU {
+		t.Errorf("MTU changed to %d", d.MTU())
+	}
+	frame := make([]byte, MaxFrameSize+1)
+	if err := d.SendEth(frame); err != errTxPacketTooLarge {
+		t.Errorf("sent oversized frame: %v", err)
+	}
+	if err := d.SendEth(frame[:MaxFrameSize]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendEthWithHeadroom(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	buf := make([]byte, TxHeadroom+61, TxHeadroom+64)
+	frame := buf[TxHeadroom:]
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	if err := d.SendEthWithHeadroom(buf); err != nil {
+		t.Fatal(err)
+	}
+	// Headers are written in place.
+	if size := binary.LittleEndian.Uint16(buf); int(size) != len(buf) {
+		t.Errorf("SDPCM size %d, want %d", size, len(buf))
+	}
+	for i := range frame {
+		if frame[i] != byte(i) {
+			t.Fatal("frame modified")
+		}
+	}
+	// Unaligned buffers are copied.
+	if err := d.SendEthWithHeadroom(make([]byte, TxHeadroom+65)[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SendEthWithHeadroom(buf[:TxHeadroom-1]); err != errTxHeadroom {
+		t.Errorf("got %v, want %v", err, errTxHeadroom)
+	}
+	if st := d.Stats(); st.TxFrames != 2 || st.TxBytes != 61+64 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestTxDoneHandler(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	var done [][]byte
+	d.SetTxDoneHandler(func(buf []byte, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		done = append(done, buf)
+	})
+	bufs := make([][]byte, maxTxPending+1)
+	for i := range bufs {
+		bufs[i] = make([]byte, TxHeadroom+64)
+	}
+	// No credit: buffers are held until it is available.
+	d.sdpcmSeqMax = d.sdpcmSeq
+	for i := 0; i < maxTxPending; i++ {
+		if err := d.SendEthWithHeadroom(bufs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.SendEthWithHeadroom(bufs[maxTxPending]); err != errTxPendingFull {
+		t.Errorf("got %v, want %v", err, errTxPendingFull)
+	}
+	if len(done) != 0 {
+		t.Fatalf("%d buffers done without credit", len(done))
+	}
+	d.sdpcmSeqMax = d.sdpcmSeq + 16
+	if _, err := d.TryPoll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != maxTxPending || &done[0][0] != &bufs[0][0] {
+		t.Fatalf("got %d buffers done, want %d in order", len(done), maxTxPending)
+	}
+	// Sent right away with credit.
+	if err := d.SendEthWithHeadroom(bufs[maxTxPending]); err != nil || len(done) != maxTxPending+1 {
+		t.Fatal(err, len(done))
+	}
+	if st := d.Stats(); st.TxFrames != maxTxPending+1 {
+		t.Errorf("sent %d frames", st.TxFrames)
+	}
+}
+
+func TestAsyncIoctl(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	if _, err := d.StartIoctl(IoctlRequest{Cmd: whd.WLC_GET_RSSI}); err != errDeviceNotInit {
+		t.Fatal("want not initialized error, got", err)
+	}
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	var resp [4]byte
+	h, err := d.StartIoctl(IoctlRequest{Cmd: whd.WLC_GET_RSSI, Iface: whd.IF_STA, Resp: resp[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.StartIoctl(IoctlRequest{Cmd: whd.WLC_GET_RSSI}); err != errIoctlBusy {
+		t.Fatal("want busy error, got", err)
+	}
+	if h.Done() {
+		t.Fatal("ioctl done before response")
+	}
+	// Firmware response to the ioctl.
+	const total = whd.SDPCM_HEADER_LEN + whd.CDC_HEADER_LEN + 4
+	pkt := make([]byte, total)
+	sdpcm := whd.SDPCMHeader{
+		Size:          total,
+		SizeCom:       ^uint16(total),
+		ChanAndFlags:  uint8(whd.CONTROL_HEADER),
+		HeaderLength:  whd.SDPCM_HEADER_LEN,
+		BusDataCredit: 0xff,
+	}
+	sdpcm.Put(_busOrder, pkt)
+	cdc := whd.CDCHeader{Cmd: whd.WLC_GET_RSSI, Length: 4, ID: d.ioctlID}
+	cdc.Put(_busOrder, pkt[whd.SDPCM_HEADER_LEN:])
+	copy(pkt[whd.SDPCM_HEADER_LEN+whd.CDC_HEADER_LEN:], []byte{0xc4, 0xff, 0xff, 0xff})
+	_, _, hdr, err := d.rx(pkt)
+	if err != nil || hdr != noPacket {
+		t.Fatal("async response not consumed:", hdr, err)
+	}
+	n, err := h.Wait(time.Second)
+	if err != nil || n != 4 || int32(binary.LittleEndian.Uint32(resp[:])) != -60 {
+		t.Fatal(n, err, resp)
+	}
+	d.reset_state()
+	if _, err := h.Result(); err != errStaleHandle {
+		t.Fatal("want stale handle after reset, got", err)
+	}
+}
+
+func TestPollHCIInterleave(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	hciIn := d.btaddr + whd.BTSDIO_OFFSET_BT2HOST_IN
+	var order []byte
+	d.RecvEthHandle(func(pkt []byte) error {
+		order = append(order, 'w')
+		if len(bytes.ReplaceAll(order, []byte("h"), nil)) == 2 {
+			bus.regs[hciIn] += 4 // HCI packet arrives during WLAN traffic.
+		}
+		return nil
+	})
+	d.RecvHCIHandle(func(pkt []byte) error { order = append(order, 'h'); return nil })
+	for _, test := range []struct {
+		interleave int
+		want       string
+	}{
+		{interleave: 0, want: "wwwwwwhh"},
+		{interleave: 2, want: "hwwhwwww"},
+	} {
+		order = order[:0]
+		bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+		bus.more = 5
+		bus.regs[hciIn] += 4
+		frames, hci, err := d.Poll(PollBudget{MaxFrames: 6, MaxHCI: 2, HCIInterleave: test.interleave})
+		if err != nil || frames != 6 || hci != 2 {
+			t.Fatal(frames, hci, err)
+		} else if string(order) != test.want {
+			t.Errorf("interleave %d: got order %q, want %q", test.interleave, order, test.want)
+		}
+	}
+}
+
+func TestHCIRing(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	if got := HCIRingFootprint(4); got != 8 {
+		t.Errorf("footprint of HCI command: got %d, want 8", got)
+	}
+	bus.regs[d.btaddr+whd.BTSDIO_OFFSET_HOST2BT_OUT] = HCIRingSize - 8
+	d.h2bWritePtr = 16 // Wrapped around the end of the ring buffer.
+	free, err := d.HCIRingFree()
+	if err != nil || free != HCIRingCapacity-24 {
+		t.Fatal(free, err)
+	}
+	used, err := d.HCIRingUsed()
+	if err != nil || used != 24 {
+		t.Fatal(used, err)
+	}
+	d.btaddr = 0
+	if _, err := d.HCIRingFree(); err != errBTNotEnabled {
+		t.Fatal("want bluetooth not enabled error, got", err)
+	}
+}
+
+func TestResetHCI(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	bus.regs[whd.WLAN_RAM_BASE_REG_ADDR] = d.btaddr
+	d.h2bWritePtr, d.b2hReadPtr, d.hciReadOff = 64, 0x2000, 3 // Desynced ring pointers.
+	d.aclMax, d.aclCredits = 8, 2
+	if err := d.ResetHCI(""); err != nil {
+		t.Fatal(err)
+	}
+	if d.h2bWritePtr != 0 || d.b2hReadPtr != 0 || d.hciReadOff != 0 {
+		t.Error("ring pointers not reset", d.h2bWritePtr, d.b2hReadPtr, d.hciReadOff)
+	}
+	if d.btaddr == 0 || d.aclCredits != d.aclMax {
+		t.Error("controller state lost", d.btaddr, d.aclCredits)
+	}
+	d.btaddr = 0
+	if err := d.ResetHCI(""); err != errBTNotEnabled {
+		t.Fatal("want bluetooth not enabled error, got", err)
+	}
+}
+
+func TestLastFailure(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	if _, ok := d.LastFailure(); ok {
+		t.Fatal("failure before any failure")
+	}
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	bus.ioctlMute = true
+	var magic [4]byte
+	_, err := d.doIoctlGet(whd.WLC_GET_MAGIC, whd.IF_STA, magic[:]) // No response.
+	if err != errIoctlPollTimeout {
+		t.Fatal("want ioctl timeout, got", err)
+	}
+	f, ok := d.LastFailure()
+	if !ok || f.Kind != FailureIoctlTimeout || f.Err != errIoctlPollTimeout || len(f.Trace) == 0 {
+		t.Fatalf("bad failure snapshot: %+v", f)
+	}
+	if !strings.Contains(f.String(), "trace: sendIoctl") {
+		t.Error("trace does not contain ioctl:", f.String())
+	}
+	d.reset_state()
+	d.btaddr = 0x19000
+	bus.regs[d.btaddr+whd.BTSDIO_OFFSET_HOST2BT_OUT] = 3 // Unaligned ring pointer.
+	if _, err := d.HCIRingFree(); err != errHCIInvalidRingState {
+		t.Fatal("want HCI desync, got", err)
+	}
+	if f, _ := d.LastFailure(); f.Kind != FailureHCIDesync {
+		t.Error("want HCI desync failure, got", f.Kind)
+	}
+}
+
+func TestSSIDBinary(t *testing.T) {
+	ssid := "a\x00b\xff"
+	info, err := makeSSIDInfo(ssid)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.length != 4 || string(info.ssid[:4]) != ssid {
+		t.Errorf("got ssid info %d %q", info.length, info.ssid[:info.length])
+	}
+	if _, err = makeSSIDInfo(strings.Repeat("x", 33)); err != errSSIDTooLong {
+		t.Errorf("got %v for 33 byte SSID", err)
+	}
+	got, err := SSIDFromBytes(bytes.Repeat([]byte{0xff}, 32))
+	if err != nil || len(got) != 32 {
+		t.Errorf("got %q %v for 32 byte SSID", got, err)
+	}
+	if _, err = SSIDFromBytes(make([]byte, 33)); err != errSSIDTooLong {
+		t.Errorf("got %v for 33 byte SSID", err)
+	}
+	if attr := ssidAttr(ssid); attr.Value.String() != `"a\x00b\xff"` {
+		t.Errorf("got attr %s", attr.Value.String())
+	}
+	if attr := ssidAttr("café"); attr.Value.String() != "café" {
+		t.Errorf("got attr %s", attr.Value.String())
+	}
+}
+
+func TestChannelSupport(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.initialized = true
+	d.chip = &chipTable[0]
+	bands, err := d.SupportedBands()
+	if err != nil || bands != Band2G4 || bands.Has(Band5G) {
+		t.Fatalf("got bands %v %v", bands, err)
+	}
+	chans, err := d.SupportedChannels(nil)
+	if err != nil || len(chans) != 14 || chans[0] != 1 || chans[13] != 14 {
+		t.Errorf("got channels %v %v", chans, err)
+	}
+	var cerr *ChannelError
+	err = d.Scan(ScanConfig{Channels: []uint8{6, 36}}, func(*whd.BSSInfo) {})
+	if !errors.As(err, &cerr) || cerr.Channel != 36 || cerr.Band != Band5G {
+		t.Errorf("got %v for 5GHz scan channel", err)
+	}
+	err = d.StartAPWithConfig(APConfig{SSID: "ap", Channel: 15})
+	if !errors.As(err, &cerr) || cerr.Band != 0 {
+		t.Errorf("got %v for AP channel 15", err)
+	}
+	if chanspec20(36) != 36|whd.CHANSPEC_BAND_5G|whd.CHANSPEC_BW_20 {
+		t.Errorf("got 5GHz chanspec %#x", chanspec20(36))
+	}
+}
+
+func TestBusTap(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	var out bytes.Buffer
+	d.AttachBusTap(NewHexDumpTap(&out))
+	d.write32(FuncBackplane, 0x1000e, 0x2c)
+	d.AttachBusTap(nil)
+	d.write32(FuncBackplane, 0x1000e, 0x2c)
+	if got := out.String(); got != "W 1 0x1000e 4 2c000000\n" {
+		t.Errorf("got bus tap output %q", got)
+	}
+}
+
+func TestRecvErrorPolicy(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	pkt := make([]byte, whd.BDC_HEADER_LEN+14)
+	errHandler := errors.New("handler")
+	fail := true
+	d.RecvEthHandle(func(pkt []byte) error {
+		if fail {
+			return errHandler
+		}
+		panic("bad frame")
+	})
+	if err := d.rxData(pkt); err != nil {
+		t.Fatal("drop policy returned", err)
+	}
+	d.SetRecvErrorPolicy(RecvErrorReturn)
+	if err := d.rxData(pkt); err != errHandler {
+		t.Fatal("want handler error, got", err)
+	}
+	fail = false
+	if err := d.rxData(pkt); err != errRecvPanic {
+		t.Fatal("want recovered panic, got", err)
+	}
+	d.SetRecvErrorPolicy(RecvErrorHalt)
+	if err := d.rxData(pkt); err != errRecvHalted {
+		t.Fatal("want halt, got", err)
+	}
+	if err := d.rxData(pkt); err != nil {
+		t.Fatal("frames received while halted must be dropped, got", err)
+	}
+	if f, ok := d.LastFailure(); !ok || f.Kind != FailureRecvHandler || f.Err != errRecvPanic {
+		t.Fatal("missing failure", f.Kind, f.Err)
+	}
+	stats := d.Stats()
+	if stats.RxHandlerErrors != 4 || stats.RxHandlerPanics != 2 || stats.RxDropped != 1 {
+		t.Fatalf("bad stats %+v", stats)
+	}
+}
+
+func TestRxFilter(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.mac = [6]byte{2, 0, 0, 0, 0, 1}
+	d.mcast[0] = mcastGroup{mac: [6]byte{0x01, 0x00, 0x5e, 0, 0, 0xfb}, refs: 1}
+	var got int
+	d.RecvEthHandle(func(pkt []byte) error { got++; return nil })
+	frame := func(dst [6]byte) []byte {
+		pkt := make([]byte, whd.BDC_HEADER_LEN+14)
+		copy(pkt[whd.BDC_HEADER_LEN:], dst[:])
+		return pkt
+	}
+	dsts := [][6]byte{
+		d.mac,
+		{2, 0, 0, 0, 0, 2},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		d.mcast[0].mac,
+		{0x01, 0x00, 0x5e, 0, 0, 1},
+	}
+	for _, test := range []struct {
+		mode RxFilterMode
+		want int
+	}{
+		{mode: RxFilterOff, want: 5},
+		{mode: RxFilterUnicast, want: 4},
+		{mode: RxFilterStrict, want: 3},
+	} {
+		got = 0
+		d.rxFilter = test.mode
+		for _, dst := range dsts {
+			if err := d.rxData(frame(dst)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got != test.want {
+			t.Errorf("mode %d: got %d frames, want %d", test.mode, got, test.want)
+		}
+	}
+	if filtered := d.Stats().RxFiltered; filtered != 3 {
+		t.Errorf("got %d filtered frames, want 3", filtered)
+	}
+}
+
+type memBank []byte
+
+func (b memBank) ReadAt(p []byte, off int64) (int, error)  { return copy(p, b[off:]), nil }
+func (b memBank) WriteAt(p []byte, off int64) (int, error) { return copy(b[off:], p), nil }
+func (b memBank) Erase() error {
+	for i := range b {
+		b[i] = 0xff
+	}
+	return nil
+}
+
+func TestSettingsDualBank(t *testing.T) {
+	want := Settings{Country: "DE", CountryRev: 4, MAC: [6]byte{2, 1, 2, 3, 4, 5}, Profile: ProfileLowPower, State: []byte("state")}
+	record := AppendSettings(nil, &want)
+	// Unknown entries written by newer versions are skipped.
+	newer := append([]byte{}, record[:len(record)-4]...)
+	newer = appendSettingsEntry(newer, 0x7f, "future")
+	binary.LittleEndian.PutUint16(newer[6:], uint16(len(newer)-settingsHeaderLen))
+	newer = binary.LittleEndian.AppendUint32(newer, crc32.ChecksumIEEE(newer))
+	for _, rec := range [][]byte{record, newer} {
+		got, err := ParseSettings(rec)
+		if err != nil {
+			t.Fatal(err)
+		} else if got.Country != want.Country || got.CountryRev != want.CountryRev || got.MAC != want.MAC ||
+			got.Profile != want.Profile || string(got.State) != string(want.State) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+	record[10] ^= 1
+	if _, err := ParseSettings(record); err != errSettingsCRC {
+		t.Fatal("want checksum error, got", err)
+	}
+
+	store := &DualBankStore{Banks: [2]SettingsBank{make(memBank, 64), make(memBank, 64)}, Size: 64}
+	if _, err := store.LoadSettings(); err != errSettingsNone {
+		t.Fatal("want no settings, got", err)
+	}
+	for _, country := range []string{"US", "GB", "FR"} {
+		if err := store.StoreSettings(AppendSettings(nil, &Settings{Country: country})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// FR was written to bank 0, tear the write so GB in bank 1 is loaded.
+	store.Banks[0].(memBank)[20] ^= 0xff
+	rec, err := store.LoadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ParseSettings(rec); err != nil || got.Country != "GB" {
+		t.Fatal("want fallback to previous record, got", got.Country, err)
+	}
+}
+
+func TestRxGroupLimit(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	var got int
+	d.RecvEthHandle(func(pkt []byte) error { got++; return nil })
+	bcast := make([]byte, whd.BDC_HEADER_LEN+14)
+	copy(bcast[whd.BDC_HEADER_LEN:], "\xff\xff\xff\xff\xff\xff")
+	unicast := make([]byte, whd.BDC_HEADER_LEN+14)
+	d.SetRxGroupLimit(10, 2)
+	start := d.rxLimit.last
+	for i := 0; i < 5; i++ {
+		d.rxTime = start
+		d.rxData(bcast)
+		d.rxData(unicast)
+	}
+	if got != 2+5 {
+		t.Fatalf("got %d frames, want burst of 2 broadcast and 5 unicast", got)
+	}
+	got = 0
+	d.rxTime = start.Add(150 * time.Millisecond) // One token accrued.
+	d.rxData(bcast)
+	d.rxData(bcast)
+	if got != 1 {
+		t.Fatalf("got %d frames after refill, want 1", got)
+	}
+	if limited := d.Stats().RxRateLimited; limited != 4 {
+		t.Errorf("got %d rate limited frames, want 4", limited)
+	}
+}
+
+func TestPollNotified(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.RecvEthHandle(func(pkt []byte) error { return nil })
+	bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+	bus.more = 2
+	if frames, _, err := d.PollNotified(PollBudget{MaxFrames: 2}); err != nil || frames != 0 {
+		t.Fatal("polled without notification", frames, err)
+	}
+	d.ISRNotify()
+	if frames, _, err := d.PollNotified(PollBudget{MaxFrames: 2}); err != nil || frames != 2 {
+		t.Fatal(frames, err)
+	}
+	// Budget was exhausted so the notification is kept.
+	if frames, _, err := d.PollNotified(PollBudget{MaxFrames: 2}); err != nil || frames != 1 {
+		t.Fatal(frames, err)
+	}
+	if d.isrPending.Load() {
+		t.Error("notification kept after draining pending packets")
+	}
+}
+
+type countLocker struct{ locks, unlocks int }
+
+func (l *countLocker) Lock()   { l.locks++ }
+func (l *countLocker) Unlock() { l.unlocks++ }
+
+func TestSetLocker(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	var l countLocker
+	d.SetLocker(&l)
+	d.RecvEthHandle(func(pkt []byte) error { return nil })
+	bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+	if _, _, err := d.PollNotified(PollBudget{MaxFrames: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if l.locks == 0 || l.locks != l.unlocks {
+		t.Errorf("locker not used: %d locks, %d unlocks", l.locks, l.unlocks)
+	}
+	if !d.mu.TryLock() {
+		t.Error("device mutex held with locker set")
+	}
+}
+
+func TestLinkSane(t *testing.T) {
+	bssid := [6]byte{0x02, 1, 2, 3, 4, 5}
+	for _, tc := range []struct {
+		bssid [6]byte
+		rssi  int32
+		want  bool
+	}{
+		{bssid, -60, true},
+		{bssid, -110, true},
+		{bssid, 0, false}, // No beacons.
+		{bssid, -200, false},
+		{[6]byte{}, -60, false}, // Not associated.
+	} {
+		if got := linkSane(tc.bssid, tc.rssi); got != tc.want {
+			t.Errorf("linkSane(%x, %d) = %v, want %v", tc.bssid, tc.rssi, got, tc.want)
+		}
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	clk := &fakeClock{t: time.Unix(1, 0)}
+	d.SetClock(clk)
+	bss := func(id byte, ssid string, ch uint8) *whd.BSSInfo {
+		b := &whd.BSSInfo{BSSID: [6]byte{0x02, 0, 0, 0, 0, id}, SSIDLength: uint8(len(ssid)), ChanSpec: uint16(ch)}
+		copy(b.SSID[:], ssid)
+		return b
+	}
+	for i := 0; i < scanCacheLen+2; i++ {
+		d.rxTime = clk.Now()
+		d.scancache_add(bss(byte(i), "other", 1))
+		clk.Sleep(time.Second)
+	}
+	d.rxTime = clk.Now()
+	d.scancache_add(bss(5, "net", 6)) // Replaces entry of same BSSID.
+	d.scancache_add(bss(100, "net", 11))
+	results := d.LastScanResults(nil)
+	if len(results) != scanCacheLen {
+		t.Fatal("want full cache, got", len(results))
+	}
+	for _, r := range results {
+		if id := r.BSS.BSSID[5]; id <= 2 {
+			t.Error("oldest entry not evicted", id)
+		} else if id == 5 && (r.Age != 0 || r.BSS.Channel() != 6) {
+			t.Error("entry not updated", r.Age, r.BSS.Channel())
+		}
+	}
+	if chans := d.scancache_channels(nil, "net"); len(chans) != 2 || chans[0]+chans[1] != 6+11 {
+		t.Error("bad channels", chans)
+	}
+	clk.Sleep(scanCacheFresh + time.Second)
+	if chans := d.scancache_channels(nil, "net"); len(chans) != 0 {
+		t.Error("stale channels", chans)
+	}
+}
+
+func TestStartAPBeaconInterval(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		d, bus := newFakeDevice(t)
+		d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+		err := d.StartAPWithConfig(APConfig{SSID: "ap", Channel: 6, BeaconInterval: 200, Concurrent: concurrent})
+		if err != nil {
+			t.Fatal(concurrent, err)
+		}
+		io, ok := bus.findIoctl(whd.WLC_SET_BCNPRD)
+		if !ok || _busOrder.Uint32(io.data) != 200 {
+			t.Errorf("concurrent=%v: beacon period not set: %+v", concurrent, io)
+		}
+		want := whd.IF_STA
+		if concurrent {
+			want = whd.IF_AP
+		}
+		if io.iface != want {
+			t.Errorf("concurrent=%v: beacon period set on %v", concurrent, io.iface)
+		}
+		if io, ok := bus.findIoctl(whd.WLC_SET_CHANNEL); !ok || io.iface != want || _busOrder.Uint32(io.data) != 6 {
+			t.Errorf("concurrent=%v: channel not set on the AP: %+v", concurrent, io)
+		}
+	}
+}
+
+func TestStartAPConcurrent(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	// Without a channel the AP follows the station's.
+	err := d.StartAPWithConfig(APConfig{SSID: "ap", MaxClients: 3, Concurrent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if io, ok := bus.findIoctl(whd.WLC_SET_CHANNEL); ok {
+		t.Errorf("channel set: %+v", io)
+	}
+	if _, ok := bus.findIovar("maxassoc"); ok {
+		t.Error("global station limit set")
+	}
+	v, ok := bus.findIovar("bsscfg:bss_maxassoc")
+	if !ok || _busOrder.Uint32(v[0:]) != uint32(whd.IF_AP) || _busOrder.Uint32(v[4:]) != 3 {
+		t.Errorf("got bss_maxassoc % x, want 3 stations on the AP bsscfg", v)
+	}
+}
+
+// lockProbeClock records whether the device lock is free while sleeping.
+type lockProbeClock struct {
+	fakeClock
+	d    *Device
+	free bool
+	// whileFree, if set, is called while sleeping with the lock free as if
+	// by another goroutine.
+	whileFree func()
+}
+
+func (c *lockProbeClock) Sleep(dur time.Duration) {
+	c.fakeClock.Sleep(dur)
+	if c.d.mu.TryLock() {
+		c.free = true
+		c.d.mu.Unlock()
+		if c.whileFree != nil {
+			c.whileFree()
+		}
+	}
+}
+
+func TestUnlockSleep(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	clk := &lockProbeClock{d: d}
+	d.SetClock(clk)
+	d.lock()
+	d.unlock_sleep(time.Second)
+	if d.mu.TryLock() {
+		t.Fatal("lock not taken again after sleeping")
+	}
+	d.unlock()
+	if !clk.free {
+		t.Error("lock held while sleeping")
+	}
+}
+
+func TestHCINumCompletedPackets(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.aclMax, d.aclCredits = 8, 1
+	// Two handles: 0x0040 completed 2 packets and 0x0041 completed 3.
+	d.hci_track_credits([]byte{hciPacketEvent, hciEvNumCompletedPackets, 9, 2, 0x40, 0, 2, 0, 0x41, 0, 3, 0})
+	if d.aclCredits != 6 {
+		t.Errorf("got %d credits, want 6", d.aclCredits)
+	}
+	d.hci_track_credits([]byte{hciPacketEvent, hciEvNumCompletedPackets, 5, 1, 0x40, 0, 7, 0})
+	if d.aclCredits != d.aclMax {
+		t.Errorf("credits %d exceed maximum %d", d.aclCredits, d.aclMax)
+	}
+}
+
+func TestInitWithoutCLM(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	d.initialized = false
+	if err := d.init_wlan(""); err != nil {
+		t.Fatal(err)
+	}
+	if !d.initialized {
+		t.Fatal("device not initialized without CLM")
+	}
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	if _, err := d.Healthcheck(); err == errDeviceNotInit {
+		t.Error("guarded call failed after Init without CLM")
+	}
+}
+
+func TestInitWLANError(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	d.initialized = false
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd == whd.WLC_SET_PM {
+			return nil, 1
+		} else if io.kind == whd.SDPCM_GET {
+			return io.data, 0
+		}
+		return nil, 0
+	}
+	if err := d.init_wlan("clm"); err == nil {
+		t.Fatal("power management error not returned")
+	} else if _, ok := bus.findIoctl(whd.WLC_SET_PM); !ok {
+		t.Fatal("failed before setting power management:", err)
+	}
+	if d.initialized {
+		t.Error("device initialized after failed Init")
+	}
+
+	// A rejected Init leaves the configuration untouched.
+	d.closed = true
+	if err := d.Init(Config{HCIReadTimeout: time.Second}); err != errDeviceClosed {
+		t.Errorf("got %v, want %v", err, errDeviceClosed)
+	} else if d.hciReadTimeout != 0 {
+		t.Error("closed device configured by Init")
+	}
+}
+
+func TestTryPollError(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	errHandler := errors.New("handler")
+	d.RecvEthHandle(func(pkt []byte) error { return errHandler })
+	d.SetRecvErrorPolicy(RecvErrorReturn)
+	bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+	if didWork, err := d.TryPoll(); didWork || err == nil {
+		t.Fatal("want no work reported with error, got", didWork, err)
+	}
+	if didWork, err := d.TryPoll(); didWork || err != nil {
+		t.Fatal("failed packet not consumed", didWork, err)
+	}
+}
+
+func TestPollHCIHandlerError(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	errHandler := errors.New("handler")
+	calls := 0
+	d.RecvHCIHandle(func(pkt []byte) error {
+		calls++
+		return errHandler
+	})
+	d.SetRecvErrorPolicy(RecvErrorReturn)
+	bus.regs[d.btaddr+whd.BTSDIO_OFFSET_BT2HOST_IN] += 4 // Controller wrote an empty packet.
+	_, hci, err := d.Poll(PollBudget{MaxHCI: 2})
+	if err != errHandler || hci != 1 {
+		t.Fatal("want handler error after one packet, got", hci, err)
+	}
+	_, hci, err = d.Poll(PollBudget{MaxHCI: 2})
+	if err != nil || hci != 0 || calls != 1 {
+		t.Fatal("failed packet redelivered", hci, err, calls)
+	}
+	if stats := d.Stats(); stats.HCIRxPackets != 1 || stats.RxHandlerErrors != 1 {
+		t.Errorf("packet counted more than once: %+v", stats)
+	}
+}
+
+func TestSetListenConfig(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	cfg := ListenConfig{ListenInterval: 10, DTIMSkip: 3}
+	if err := d.SetListenConfig(cfg); err != errDeviceNotInit {
+		t.Fatal("want not initialized error, got", err)
+	} else if d.listen != (ListenConfig{}) || len(bus.ioctls) != 0 {
+		t.Fatal("configuration applied before Init")
+	}
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	if err := d.SetListenConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := bus.findIovar("bcn_li_dtim"); !ok || _busOrder.Uint32(v) != 3 {
+		t.Errorf("got bcn_li_dtim % x", v)
+	}
+	if v, ok := bus.findIovar("assoc_listen"); !ok || _busOrder.Uint32(v) != 10 {
+		t.Errorf("got assoc_listen % x", v)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	magic := uint32(whd.WLC_IOCTL_MAGIC)
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		return _busOrder.AppendUint32(nil, magic), 0
+	}
+	bus.busRegs = map[uint32]uint32{whd.SPI_READ_TEST_REGISTER: whd.TEST_PATTERN}
+	if _, err := d.Healthcheck(); err != nil {
+		t.Fatal(err)
+	}
+	io, ok := bus.findIoctl(whd.WLC_GET_MAGIC)
+	if !ok || io.kind != whd.SDPCM_GET || io.iface != whd.IF_STA || len(io.data) != 4 {
+		t.Fatalf("got magic IOCTL %+v", io)
+	}
+
+	magic = 0x1234
+	if _, err := d.Healthcheck(); err != errHealthMagic {
+		t.Error("want bad magic error, got", err)
+	}
+	magic = whd.WLC_IOCTL_MAGIC
+	bus.busRegs[whd.SPI_READ_TEST_REGISTER] = 0xbeadfeed // Swapped words.
+	if _, err := d.Healthcheck(); err != errHealthBusTest {
+		t.Error("want bus test error, got", err)
+	}
+	bus.busRegs[whd.SPI_READ_TEST_REGISTER] = whd.TEST_PATTERN
+	bus.busRegs[whd.SPI_STATUS_REGISTER] = 1 << 2 // F2/F3 FIFO overflow.
+	h, err := d.Healthcheck()
+	if err != errHealthBusStatus || !h.Status.IsOverflow() {
+		t.Error("want bus status error, got", err, h.Status)
+	}
+}
+
+func TestVendorIE(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	oui := [3]byte{0x00, 0x11, 0x22}
+	data := []byte{1, 2, 3, 4}
+	err := d.AddVendorIE(VendorIEProbeRequest|VendorIEAssocRequest, oui, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io, ok := bus.findIoctl(whd.WLC_SET_VAR)
+	name, v := io.iovar()
+	if !ok || name != "vndr_ie" || io.iface != whd.IF_STA {
+		t.Fatalf("got IOCTL %q on %v", name, io.iface)
+	}
+	want := []byte{'a', 'd', 'd', 0, 1, 0, 0, 0}
+	want = _busOrder.AppendUint32(want, whd.VNDR_IE_PRBREQ_FLAG|whd.VNDR_IE_ASSOCREQ_FLAG)
+	want = append(want, whd.DOT11_IE_ID_VENDOR_SPECIFIC, 7, 0x00, 0x11, 0x22, 1, 2, 3, 4)
+	if !bytes.Equal(v, want) {
+		t.Errorf("got vndr_ie\n% x, want\n% x", v, want)
+	}
+	if err := d.RemoveVendorIE(VendorIEProbeRequest, oui, data); err != nil {
+		t.Fatal(err)
+	} else if v, _ := bus.findIovar("vndr_ie"); string(v[:4]) != "del\x00" {
+		t.Errorf("got remove command %q", v[:4])
+	}
+
+	n := len(bus.ioctls)
+	if err := d.AddVendorIE(VendorIEBeacon, oui, data); err != errVendorIENoAP {
+		t.Error("want no AP error, got", err)
+	}
+	if err := d.AddVendorIE(VendorIEBeacon|VendorIEProbeRequest, oui, data); err != errVendorIEBadFlags {
+		t.Error("want bad flags error, got", err)
+	}
+	if err := d.AddVendorIE(VendorIEProbeRequest, oui, make([]byte, maxVendorIEData+1)); err != errVendorIETooLong {
+		t.Error("want too long error, got", err)
+	}
+	if len(bus.ioctls) != n {
+		t.Error("invalid vendor IE sent to firmware")
+	}
+	d.apUp, d.apIface = true, whd.IF_AP
+	if err := d.AddVendorIE(VendorIEBeacon, oui, data); err != nil {
+		t.Fatal(err)
+	} else if io, _ := bus.findIoctl(whd.WLC_SET_VAR); io.iface != whd.IF_AP {
+		t.Errorf("beacon vendor IE set on %v", io.iface)
+	}
+}
+
+func TestHostSleep(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	if err := d.HostSleep(HostSleepConfig{}); err != errHostNoWake {
+		t.Fatal("want no wake filter error, got", err)
+	}
+	if err := d.HostSleep(HostSleepConfig{Wake: WakeMagicPacket | WakeConnection}); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, io := range bus.ioctls {
+		name, _ := io.iovar()
+		names = append(names, name)
+	}
+	if got := strings.Join(names, ","); got != "wowl_clear,wowl,wowl_activate" {
+		t.Errorf("got iovars %s", got)
+	}
+	if v, _ := bus.findIovar("wowl"); _busOrder.Uint32(v) != whd.WL_WOWL_MAGIC|whd.WL_WOWL_DIS|whd.WL_WOWL_BCN|whd.WL_WOWL_LINKDOWN {
+		t.Errorf("got wake filter % x", v)
+	} else if v, _ := bus.findIovar("wowl_activate"); _busOrder.Uint32(v) != 1 {
+		t.Errorf("got wowl_activate % x", v)
+	}
+	if err := d.HostSleep(HostSleepConfig{Wake: WakeMagicPacket}); err != errHostAsleep {
+		t.Error("want already asleep error, got", err)
+	}
+
+	bus.ioctls = nil
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if name, _ := io.iovar(); io.kind == whd.SDPCM_GET && name == "wowl_wakeind" {
+			// The firmware answers in place, with the request's length.
+			resp := make([]byte, len(io.data))
+			copy(resp, []byte{0, 0, 0, 0, whd.WL_WOWL_MAGIC, 0, 0, 0}) // pci_wakeind, ucode_wakeind.
+			return resp, 0
+		}
+		return nil, 0
+	}
+	woke, err := d.HostWake()
+	if err != nil {
+		t.Fatal(err)
+	} else if woke != WakeMagicPacket {
+		t.Errorf("got wake reason %#x", woke)
+	}
+	if v, _ := bus.findIovar("wowl_activate"); _busOrder.Uint32(v) != 0 {
+		t.Errorf("got wowl_activate % x", v)
+	} else if _, ok := bus.findIovar("wowl_clear"); !ok {
+		t.Error("wake filters not cleared")
+	}
+	if _, err := d.HostWake(); err != errHostNotAsleep {
+		t.Error("want not asleep error, got", err)
+	}
+}
+
+func TestBTWatermark(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	// The fake bus does not store writes, readback values are set by hand.
+	bus.regs[whd.SDIO_FUNCTION2_WATERMARK] = btF2Watermark
+	if err := d.bt_check_watermark(); err != nil {
+		t.Fatal(err)
+	} else if d.f2Watermark != btF2Watermark {
+		t.Fatalf("got unset watermark lowered to %#x", d.f2Watermark)
+	}
+	bus.regs[whd.SDIO_FUNCTION2_WATERMARK] = 0x40
+	if err := d.SetF2Watermark(0x40); err != nil {
+		t.Fatal(err)
+	}
+	// A readback of 0x40 fails the check if the watermark is overwritten.
+	if err := d.bt_check_watermark(); err != nil {
+		t.Fatal(err)
+	} else if d.f2Watermark != 0x40 {
+		t.Errorf("user watermark overridden with %#x", d.f2Watermark)
+	}
+}
+
+func TestDSCPPriority(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	ipv4 := func(dscp uint8) []byte {
+		pkt := make([]byte, ethHeaderLen+20)
+		binary.BigEndian.PutUint16(pkt[12:], EtherTypeIPv4)
+		pkt[ethHeaderLen] = 0x45
+		pkt[ethHeaderLen+1] = dscp<<2 | 1 // ECN bits must be ignored.
+		return pkt
+	}
+	ipv6 := func(dscp uint8) []byte {
+		pkt := make([]byte, ethHeaderLen+40)
+		binary.BigEndian.PutUint16(pkt[12:], EtherTypeIPv6)
+		binary.BigEndian.PutUint16(pkt[ethHeaderLen:], 6<<12|uint16(dscp)<<6)
+		return pkt
+	}
+	if d.tx_priority(ipv4(46)) != 0 {
+		t.Error("frame classified with classification disabled")
+	}
+	d.SetDSCPClassification(true)
+	for _, tc := range []struct {
+		name string
+		dscp uint8
+		want uint8
+	}{
+		{"CS0", 0, 0},
+		{"CS1", 8, 1},
+		{"AF11", 10, 0},
+		{"AF21", 18, 3},
+		{"AF41", 34, 4},
+		{"CS5", 40, 5},
+		{"EF", 46, 6},
+		{"CS6", 48, 7},
+		{"CS7", 56, 7},
+		{"unassigned", 5, 0},
+	} {
+		if got := d.tx_priority(ipv4(tc.dscp)); got != tc.want {
+			t.Errorf("%s over IPv4: got priority %d, want %d", tc.name, got, tc.want)
+		}
+		if got := d.tx_priority(ipv6(tc.dscp)); got != tc.want {
+			t.Errorf("%s over IPv6: got priority %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:], EtherTypeARP)
+	if d.tx_priority(arp) != 0 {
+		t.Error("non-IP frame classified")
+	}
+}
+
+func TestSetAMPDU(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	if err := d.SetAMPDU(AMPDUConfig{RxWindow: 16, TxMPDUs: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bus.findIovar("ampdu_ba_wsize"); _busOrder.Uint32(v) != 16 {
+		t.Errorf("got ampdu_ba_wsize % x", v)
+	} else if v, _ := bus.findIovar("ampdu_mpdu"); _busOrder.Uint32(v) != 8 {
+		t.Errorf("got ampdu_mpdu % x", v)
+	}
+	if _, ok := bus.findIovar("ampdu"); ok {
+		t.Error("ampdu set while up without changing it")
+	} else if _, ok := bus.findIoctl(whd.WLC_DOWN); ok || d.state != linkStateUp {
+		t.Error("interface taken down without changing ampdu")
+	}
+
+	// Disabling aggregation requires a down/up cycle.
+	bus.ioctls = nil
+	if err := d.SetAMPDU(AMPDUConfig{Disable: true}); err != nil {
+		t.Fatal(err)
+	}
+	var seq []string
+	for _, io := range bus.ioctls {
+		name, v := io.iovar()
+		switch {
+		case io.cmd == whd.WLC_DOWN:
+			seq = append(seq, "down")
+		case io.cmd == whd.WLC_UP:
+			seq = append(seq, "up")
+		case name == "ampdu":
+			seq = append(seq, "ampdu="+hex32(_busOrder.Uint32(v)))
+		}
+	}
+	if got := strings.Join(seq, ","); got != "down,ampdu=00000000,up" {
+		t.Errorf("got %s", got)
+	}
+	if d.state != linkStateDown {
+		t.Error("link still up after down/up cycle")
+	}
+	bus.ioctls = nil
+	if err := d.SetAMPDU(AMPDUConfig{Disable: true}); err != nil {
+		t.Fatal(err)
+	} else if _, ok := bus.findIoctl(whd.WLC_DOWN); ok {
+		t.Error("interface taken down with aggregation already disabled")
+	}
+}
+
+func TestEntropyReader(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.state = linkStateDown
+	var noise []int32
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd != whd.WLC_GET_PHY_NOISE || len(noise) == 0 {
+			return nil, 1
+		}
+		v := noise[0]
+		noise = noise[1:]
+		return _busOrder.AppendUint32(nil, uint32(v)), 0
+	}
+	r := d.EntropyReader()
+	var buf [2 * entropyBlockLen]byte
+	if _, err := r.Read(buf[:]); err != errDeviceNotInit {
+		t.Fatal("want not initialized error, got", err)
+	}
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+
+	// A noise floor updated now and then, repeating below the cutoff.
+	for i := 0; len(noise) < 2*entropySamples; i++ {
+		for j := 0; j < entropyRepeatCutoff-1; j++ {
+			noise = append(noise, -90-int32(i%7))
+		}
+	}
+	noise = noise[:2*entropySamples]
+	n, err := r.Read(buf[:])
+	if err != nil || n != len(buf) {
+		t.Fatal(n, err)
+	} else if len(bus.ioctls) != 2*entropySamples {
+		t.Errorf("got %d measurements for %d bytes", len(bus.ioctls), n)
+	}
+	if bytes.Equal(buf[:entropyBlockLen], buf[entropyBlockLen:]) {
+		t.Error("blocks repeat")
+	}
+
+	// Stuck source fails the repetition count test before a block completes.
+	bus.ioctls = nil
+	noise = noise[:0]
+	for i := 0; i < entropySamples; i++ {
+		noise = append(noise, -92)
+	}
+	if _, err := r.Read(buf[:]); err != errEntropyRepetition {
+		t.Fatal("want repetition error, got", err)
+	} else if len(bus.ioctls) != entropyRepeatCutoff {
+		t.Errorf("health test failed after %d measurements", len(bus.ioctls))
+	}
+}
+
+// ioctlResponse returns a control packet answering the ioctl id with data.
+func ioctlResponse(d *Device, cmd whd.SDPCMCommand, id uint16, data []byte) []byte {
+	total := whd.SDPCM_HEADER_LEN + whd.CDC_HEADER_LEN + len(data)
+	pkt := make([]byte, total)
+	sdpcm := whd.SDPCMHeader{
+		Size:          uint16(total),
+		SizeCom:       ^uint16(total),
+		Seq:           d.rxSeq,
+		ChanAndFlags:  uint8(whd.CONTROL_HEADER),
+		HeaderLength:  whd.SDPCM_HEADER_LEN,
+		BusDataCredit: d.sdpcmSeq + 8,
+	}
+	sdpcm.Put(_busOrder, pkt)
+	cdc := whd.CDCHeader{Cmd: cmd, Length: uint32(len(data)), ID: id}
+	cdc.Put(_busOrder, pkt[whd.SDPCM_HEADER_LEN:])
+	copy(pkt[whd.SDPCM_HEADER_LEN+whd.CDC_HEADER_LEN:], data)
+	return pkt
+}
+
+func TestAsyncWaitStale(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 8
+	clk := &lockProbeClock{d: d, fakeClock: fakeClock{t: time.Unix(1, 0)}}
+	d.SetClock(clk)
+	bus.ioctlMute = true
+	var resp1, resp2 [4]byte
+	h1, err := d.StartIoctl(IoctlRequest{Cmd: whd.WLC_GET_RSSI, Resp: resp1[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := d.ioctlID
+	if _, err := h1.Wait(10 * time.Millisecond); err != errIoctlTimeout {
+		t.Fatal("want timeout, got", err)
+	} else if !clk.free {
+		t.Error("lock held while waiting")
+	}
+	h2, err := d.StartIoctl(IoctlRequest{Cmd: whd.WLC_GET_RSSI, Resp: resp2[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The late response of the abandoned ioctl must not complete the new one
+	// nor be taken as the response of a sync ioctl.
+	_, _, hdr, err := d.rx(ioctlResponse(d, whd.WLC_GET_RSSI, id1, []byte{1, 0, 0, 0}))
+	if err != nil || hdr != noPacket {
+		t.Fatal("stale response not dropped:", hdr, err)
+	} else if h2.Done() || resp1 != [4]byte{} || resp2 != [4]byte{} {
+		t.Fatal("stale response delivered")
+	}
+	_, _, hdr, err = d.rx(ioctlResponse(d, whd.WLC_GET_RSSI, d.ioctlID, []byte{2, 0, 0, 0}))
+	if err != nil || hdr != noPacket {
+		t.Fatal(hdr, err)
+	}
+	if n, err := h2.Wait(time.Second); err != nil || n != 4 || resp2[0] != 2 {
+		t.Fatal(n, err, resp2)
+	}
+
+	// Scans release the lock while waiting too.
+	bus.ioctlMute = false
+	bus.pkt[4] = d.rxSeq // Responses above were not read from the bus.
+	clk.free = false
+	sh, err := d.StartScan(ScanConfig{}, func(*whd.BSSInfo) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Wait(50 * time.Millisecond); err != errScanTimeout {
+		t.Fatal("want scan timeout, got", err)
+	} else if !clk.free {
+		t.Error("lock held while waiting for scan")
+	}
+}
+
+// resetBus emulates the gSPI bus registers of a chip which is only reset by
+// holding WL_REG_ON low for at least hold, as with a slowly discharging supply.
+type resetBus struct {
+	clk    *fakeClock
+	hold   time.Duration
+	offAt  time.Time
+	word32 bool   // Bus configured for 32 bit words, see SPI_BUS_CONTROL.
+	rwTest uint32 // Read/write test register.
+	resets int
+}
+
+func (b *resetBus) power(on bool) {
+	if !on {
+		b.offAt = b.clk.Now()
+	} else if b.clk.Now().Sub(b.offAt) >= b.hold {
+		b.word32, b.rwTest = false, 0
+		b.resets++
+	}
+}
+
+// word converts between host words and the chip's: out of reset the chip
+// takes 16 bit words.
+func (b *resetBus) word(w uint32) uint32 {
+	if b.word32 {
+		return w
+	}
+	return swap16(w)
+}
+
+func (b *resetBus) CmdRead(cmd uint32, buf []uint32) error {
+	cmd = b.word(cmd)
+	clear(buf)
+	if Function(cmd>>28&0b11) != FuncBus {
+		return nil
+	}
+	switch addr := cmd >> 11 & 0x1ffff; addr {
+	case whd.SPI_BUS_CONTROL:
+		buf[0] = b2u32(b.word32)
+	case whd.SPI_READ_TEST_REGISTER:
+		buf[0] = whd.TEST_PATTERN
+	case spiRegTestRW:
+		buf[0] = b.rwTest
+	}
+	buf[0] = b.word(buf[0])
+	return nil
+}
+
+func (b *resetBus) CmdWrite(cmd uint32, buf []uint32) error {
+	cmd = b.word(cmd)
+	if Function(cmd>>28&0b11) != FuncBus {
+		return nil
+	}
+	val := b.word(buf[0])
+	switch addr := cmd >> 11 & 0x1ffff; addr {
+	case whd.SPI_BUS_CONTROL:
+		b.word32 = val&1 != 0
+	case spiRegTestRW:
+		b.rwTest = val
+	}
+	return nil
+}
+
+func (b *resetBus) LastStatus() uint32 { return 0 }
+
+func TestInitBusStale(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		hold       time.Duration
+		wantResets int
+		wantErr    error
+	}{
+		{name: "reset", hold: 0, wantResets: 0},
+		{name: "cold reset", hold: 100 * time.Millisecond, wantResets: 1},
+		{name: "never reset", hold: time.Hour, wantResets: maxColdResets, wantErr: errChipNotReset},
+	} {
+		clk := &fakeClock{t: time.Unix(1, 0)}
+		bus := &resetBus{clk: clk, hold: tc.hold}
+		d := New(bus.power, func(bool) {}, bus)
+		d.SetClock(clk)
+		// Bus left configured by a previous Init.
+		bus.word32, bus.rwTest = true, rwTestPattern
+		var r InitReport
+		err := d.initBus(&r)
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if r.ColdResets != tc.wantResets {
+			t.Errorf("%s: got %d cold resets, want %d", tc.name, r.ColdResets, tc.wantResets)
+		}
+		if err == nil && (!bus.word32 || bus.rwTest != rwTestPattern || d.wordOrder != wordOrderNative) {
+			t.Errorf("%s: bus not configured after reset: %+v", tc.name, bus)
+		}
+	}
+}
+
+func TestJoinRetries(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	clk := &fakeClock{t: time.Unix(1, 0)}
+	d.SetClock(clk)
+	attempts := func() (n int) {
+		for _, io := range bus.ioctls {
+			if io.cmd == whd.WLC_SET_SSID {
+				n++
+			}
+		}
+		return n
+	}
+	join := func(opts JoinOptions) (time.Duration, error) {
+		bus.ioctls = bus.ioctls[:0]
+		d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+		start := clk.Now()
+		err := d.JoinWithOptions("home", "password", opts)
+		return clk.Now().Sub(start), err
+	}
+
+	// No link up event arrives so every attempt times out.
+	elapsed, err := join(JoinOptions{AssocTimeout: time.Second, HandshakeTimeout: 4 * time.Second, ScanRetries: 2})
+	if !errors.Is(err, errJoinGeneric) || attempts() != 3 {
+		t.Errorf("got %v after %d attempts, want %v after 3", err, attempts(), errJoinGeneric)
+	}
+	if elapsed < 3*time.Second+2*joinRetryDelay || elapsed > 5*time.Second {
+		t.Errorf("3 attempts of 1s took %v", elapsed)
+	}
+	if v, ok := bus.findIovar("bsscfg:sup_wpa_tmo"); !ok || _busOrder.Uint32(v[4:]) != 4000 {
+		t.Errorf("got sup_wpa_tmo % x, want 4000ms", v)
+	}
+	if _, ok := bus.findIoctl(whd.WLC_DISASSOC); !ok {
+		t.Error("attempt not stopped before retrying")
+	}
+
+	// Defaults: a single attempt of defaultAssocTimeout.
+	elapsed, err = join(JoinOptions{})
+	if !errors.Is(err, errJoinGeneric) || attempts() != 1 || elapsed < defaultAssocTimeout || elapsed > defaultAssocTimeout+time.Second {
+		t.Errorf("got %v after %d attempts in %v", err, attempts(), elapsed)
+	}
+	if v, _ := bus.findIovar("bsscfg:sup_wpa_tmo"); _busOrder.Uint32(v[4:]) != uint32(defaultHandshakeTimeout.Milliseconds()) {
+		t.Errorf("got sup_wpa_tmo % x, want default", v)
+	}
+
+	// The deadline bounds the join, retries included.
+	elapsed, err = join(JoinOptions{Deadline: 2 * time.Second, ScanRetries: 10})
+	if !errors.Is(err, errJoinGeneric) || elapsed > 2*time.Second+time.Second {
+		t.Errorf("got %v in %v, want join to stop at the 2s deadline", err, elapsed)
+	}
+	if attempts() != 1 {
+		t.Errorf("got %d attempts, want 1 within the deadline", attempts())
+	}
+
+	// Authentication failures are counted apart from scan failures.
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd == whd.WLC_SET_SSID {
+			d.state = linkStateAuthFailed
+		}
+		if io.kind == whd.SDPCM_GET {
+			return io.data, 0
+		}
+		return nil, 0
+	}
+	_, err = join(JoinOptions{AuthRetries: 1, ScanRetries: 5})
+	if !errors.Is(err, errJoinAuth) || attempts() != 2 {
+		t.Errorf("got %v after %d attempts, want %v after 2", err, attempts(), errJoinAuth)
+	}
+}
+
+func TestUpdateAP(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	d.apUp, d.apIface = true, whd.IF_STA
+	old := APCredentials{SSID: "old", Passphrase: "oldpassword"}
+	// ssids returns the SSIDs set in order and whether the BSS was last brought up.
+	ssids := func() (set []string, up bool) {
+		for _, io := range bus.ioctls {
+			switch name, v := io.iovar(); {
+			case io.cmd != whd.WLC_SET_VAR:
+			case name == "bsscfg:ssid":
+				set = append(set, string(v[8:8+_busOrder.Uint32(v[4:])]))
+			case name == "bss":
+				up = _busOrder.Uint32(v[4:]) == 1
+			}
+		}
+		return set, up
+	}
+
+	// The new passphrase is rejected: the old credentials are restored.
+	rejected := "newpassword"
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd == whd.WLC_SET_WSEC_PMK && bytes.Contains(io.data, []byte(rejected)) {
+			return nil, 1
+		}
+		return nil, 0
+	}
+	err := d.UpdateAP(APCredentials{SSID: "new", Passphrase: rejected}, old)
+	if err == nil {
+		t.Fatal("rejected passphrase accepted")
+	}
+	if set, up := ssids(); len(set) != 2 || set[0] != "new" || set[1] != "old" || !up || !d.apUp {
+		t.Errorf("got SSIDs %q up=%v apUp=%v, want old SSID restored and BSS up", set, up, d.apUp)
+	}
+	io, _ := bus.findIoctl(whd.WLC_SET_WSEC_PMK)
+	if !bytes.Contains(io.data, []byte("oldpassword")) {
+		t.Errorf("old passphrase not restored: % x", io.data)
+	}
+
+	// Success switches to an open AP.
+	bus.ioctls = bus.ioctls[:0]
+	if err := d.UpdateAP(APCredentials{SSID: "open"}, old); err != nil {
+		t.Fatal(err)
+	}
+	if set, up := ssids(); len(set) != 1 || set[0] != "open" || !up {
+		t.Errorf("got SSIDs %q up=%v", set, up)
+	}
+	if v, ok := bus.findIovar("bsscfg:wpa_auth"); !ok || _busOrder.Uint32(v[4:]) != 0 {
+		t.Errorf("got wpa_auth % x, want open", v)
+	}
+
+	// Invalid previous credentials are rejected before stopping the AP.
+	bus.ioctls = bus.ioctls[:0]
+	if err := d.UpdateAP(old, APCredentials{SSID: "open", Passphrase: "short"}); err != errAPPassphraseLen {
+		t.Errorf("got %v, want %v", err, errAPPassphraseLen)
+	} else if len(bus.ioctls) != 0 {
+		t.Error("AP changed with invalid previous credentials")
+	}
+	d.apUp = false
+	if err := d.UpdateAP(APCredentials{SSID: "new"}, old); err != errAPNotUp {
+		t.Errorf("got %v, want %v", err, errAPNotUp)
+	}
+}
+
+func TestSetAPIdle(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	if err := d.SetAPIdle(APIdleConfig{Timeout: time.Minute}); err != errAPNotUp {
+		t.Errorf("got %v, want %v", err, errAPNotUp)
+	}
+	if err := d.SetAPIdle(APIdleConfig{Timeout: maxAPIdle * time.Second}); err != errAPIdleRange {
+		t.Errorf("got %v, want %v", err, errAPIdleRange)
+	}
+	d.apUp, d.apIface = true, whd.IF_AP
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if io.cmd != whd.WLC_GET_VAR {
+			return nil, 0
+		} else if name, _ := io.iovar(); name != "scb_probe" {
+			return nil, 1
+		}
+		// Firmware defaults: 60s timeout, probe after 30s idle, 5 probes.
+		cur := make([]byte, 12)
+		_busOrder.PutUint32(cur[0:], 60)
+		_busOrder.PutUint32(cur[4:], 30)
+		_busOrder.PutUint32(cur[8:], 5)
+		return cur, 0
+	}
+	// Unset fields keep the firmware's values.
+	if err := d.SetAPIdle(APIdleConfig{Timeout: 10*time.Second + 900*time.Millisecond, MaxProbes: 2}); err != nil {
+		t.Fatal(err)
+	}
+	io, ok := bus.findIoctl(whd.WLC_SET_VAR)
+	name, v := io.iovar()
+	if !ok || name != "scb_probe" || io.iface != whd.IF_AP {
+		t.Fatalf("got iovar %q on interface %d, want scb_probe on the AP", name, io.iface)
+	}
+	want := []byte{10, 0, 0, 0, 30, 0, 0, 0, 2, 0, 0, 0}
+	if !bytes.Equal(v, want) {
+		t.Errorf("got scb_probe % x, want % x", v, want)
+	}
+}
+
+func TestChannelLoad(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	clk := &fakeClock{t: time.Unix(1, 0)}
+	d.SetClock(clk)
+	if _, err := d.ChannelLoad(); err != errDeviceNotInit {
+		t.Errorf("got %v, want %v", err, errDeviceNotInit)
+	}
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	version := uint32(chanimVersion)
+	var gets int
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		name, req := io.iovar()
+		if io.cmd != whd.WLC_GET_VAR || name != "chanim_stats" {
+			return nil, 1
+		}
+		gets++
+		if !bytes.Equal(req[:chanimHeaderLen], []byte{48, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0}) {
+			t.Errorf("got chanim_stats request % x", req)
+		}
+		resp := make([]byte, chanimHeaderLen+chanimStatsLen)
+		_busOrder.PutUint32(resp[0:], uint32(len(resp)))
+		_busOrder.PutUint32(resp[4:], version)
+		_busOrder.PutUint32(resp[8:], 1)
+		st := resp[chanimHeaderLen:]
+		_busOrder.PutUint32(st[0:], 7)                // glitchcnt
+		_busOrder.PutUint32(st[4:], 3)                // badplcp
+		copy(st[8:], []byte{5, 20, 30, 5, 10, 2, 25}) // ccastats
+		st[8+ccaNStats] = 0xa6                        // -90dBm
+		_busOrder.PutUint16(st[18:], 0x1006)          // 2.4GHz 20MHz channel 6.
+		st[32] = 28                                   // chan_idle
+		return resp, 0
+	}
+	load, err := d.ChannelLoad()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChannelLoad{Channel: 6, Tx: 5, InBSS: 20, OBSS: 30, NoCategory: 5, NoPacket: 10,
+		Doze: 2, TxOpportunity: 25, Idle: 28, Noise: -90, Glitches: 7, BadPLCP: 3}
+	if load != want {
+		t.Errorf("got %+v, want %+v", load, want)
+	} else if load.Busy() != 65 {
+		t.Errorf("got busy %d, want 65", load.Busy())
+	}
+
+	// 65% busy is above the default threshold. Measurements are reused for MaxAge.
+	gets = 0
+	d.SetCarrierCheck(CarrierCheck{MaxAge: time.Second})
+	for i := 0; i < 3; i++ {
+		if ok, _, err := d.CarrierClear(); err != nil || ok {
+			t.Errorf("got clear=%v %v, want saturated channel", ok, err)
+		}
+	}
+	if gets != 1 {
+		t.Errorf("got %d measurements within MaxAge, want 1", gets)
+	}
+	clk.Sleep(2 * time.Second)
+	d.SetCarrierCheck(CarrierCheck{MaxBusy: 70})
+	if ok, _, err := d.CarrierClear(); err != nil || !ok || gets != 2 {
+		t.Errorf("got clear=%v %v after %d measurements, want new clear measurement", ok, err, gets)
+	}
+
+	version = 3
+	if _, err := d.ChannelLoad(); err != errChanimVersion {
+		t.Errorf("got %v, want %v", err, errChanimVersion)
+	}
+}
+
+func TestWLCommand(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	if _, err := d.WLCommand("", nil); err != errWLName {
+		t.Errorf("got %v, want %v", err, errWLName)
+	}
+	if _, err := d.WLCommand("up", nil); err != errDeviceNotInit {
+		t.Errorf("got %v, want %v", err, errDeviceNotInit)
+	}
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	mac := []byte{0x28, 0xcd, 0xc1, 1, 2, 3}
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		switch name, _ := io.iovar(); {
+		case io.cmd == whd.WLC_GET_CHANNEL:
+			return []byte{6, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0}, 0 // channel_info_t
+		case io.cmd == whd.WLC_GET_VAR && name == "cur_etheraddr":
+			resp := make([]byte, len(io.data)) // The firmware answers in place.
+			copy(resp, mac)
+			return resp, 0
+		case io.kind == whd.SDPCM_GET:
+			return nil, 1
+		}
+		return nil, 0
+	}
+	last := func() fakeIoctl { return bus.ioctls[len(bus.ioctls)-1] }
+
+	// IOCTL mapped commands.
+	if resp, err := d.WLCommand("channel", nil); err != nil || !bytes.Equal(resp, []byte{6, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("got channel % x, %v", resp, err)
+	} else if io := last(); io.kind != whd.SDPCM_GET || io.cmd != whd.WLC_GET_CHANNEL || len(io.data) != 12 {
+		t.Errorf("got IOCTL %+v, want a 12 byte WLC_GET_CHANNEL", io)
+	}
+	if _, err := d.WLCommand("PM", []byte{2, 0, 0, 0}); err != nil {
+		t.Error(err)
+	} else if io := last(); io.kind != whd.SDPCM_SET || io.cmd != whd.WLC_SET_PM || !bytes.Equal(io.data, []byte{2, 0, 0, 0}) {
+		t.Errorf("got IOCTL %+v, want WLC_SET_PM 2", io)
+	}
+	if _, err := d.WLCommand("up", nil); err != nil {
+		t.Error(err)
+	} else if io := last(); io.cmd != whd.WLC_UP || len(io.data) != 0 {
+		t.Errorf("got IOCTL %+v, want WLC_UP without arguments", io)
+	}
+	if _, err := d.WLCommand("rssi", []byte{1, 0, 0, 0}); err != errWLNoSet {
+		t.Errorf("got %v, want %v", err, errWLNoSet)
+	}
+
+	// Other commands are iovars.
+	if resp, err := d.WLCommand("cur_etheraddr", nil); err != nil || !bytes.Equal(resp[:len(mac)], mac) {
+		t.Errorf("got cur_etheraddr % x, %v", resp, err)
+	} else if name, _ := last().iovar(); last().cmd != whd.WLC_GET_VAR || name != "cur_etheraddr" {
+		t.Errorf("got IOCTL %+v, want cur_etheraddr iovar read", last())
+	}
+	if _, err := d.WLCommand("bsscfg:wsec", []byte{4, 0, 0, 0}); err != nil {
+		t.Error(err)
+	} else if v, ok := bus.findIovar("bsscfg:wsec"); !ok || !bytes.Equal(v, []byte{4, 0, 0, 0}) {
+		t.Errorf("got bsscfg:wsec % x, want 04 00 00 00", v)
+	}
+	if _, err := d.WLCommand("nonexistent", nil); err == nil {
+		t.Error("firmware error not returned")
+	}
+}
+
+func TestJoinYieldLock(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	clk := &lockProbeClock{d: d, fakeClock: fakeClock{t: time.Unix(1, 0)}}
+	d.SetClock(clk)
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	opts := JoinOptions{AssocTimeout: time.Second}
+
+	// Joins hold the lock unless asked otherwise.
+	if err := d.JoinWithOptions("home", "password", opts); !errors.Is(err, errJoinGeneric) {
+		t.Fatal(err)
+	} else if clk.free {
+		t.Error("lock released by join")
+	}
+
+	// Calls which would disturb a yielding join fail while it waits.
+	opts.YieldLock = true
+	var errs []error
+	clk.whileFree = func() {
+		if len(errs) > 0 {
+			return
+		}
+		errs = append(errs,
+			d.JoinWPA2("other", "password"),
+			d.JoinAuto("other", "password"),
+			d.Scan(ScanConfig{}, func(*whd.BSSInfo) {}),
+			d.StartAPWithConfig(APConfig{SSID: "ap"}),
+			d.Init(Config{}),
+			d.Close(),
+		)
+	}
+	if err := d.JoinWithOptions("home", "password", opts); !errors.Is(err, errJoinGeneric) {
+		t.Fatal(err)
+	} else if !clk.free {
+		t.Error("lock held by yielding join")
+	}
+	for i, err := range errs {
+		if err != errJoinBusy {
+			t.Errorf("call %d during join: got %v, want %v", i, err, errJoinBusy)
+		}
+	}
+	if d.joining || d.closed {
+		t.Fatal("join state not cleared")
+	}
+
+	// A Reset while the lock is released aborts the join.
+	bus.pkt[4] = d.rxSeq
+	clk.whileFree = d.Reset
+	if err := d.JoinWithOptions("home", "password", opts); err != errJoinAborted {
+		t.Errorf("got %v, want %v", err, errJoinAborted)
+	}
+	if d.joining {
+		t.Error("join state not cleared after abort")
+	}
+}
+
+func TestRxSeq(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	var got int
+	d.RecvEthHandle(func(pkt []byte) error { got++; return nil })
+	// recv reads a data packet with SDPCM sequence number seq and reports whether it was delivered.
+	recv := func(seq uint8) bool {
+		bus.pkt[4] = seq
+		bus.status = 1<<8 | uint32(len(bus.pkt))<<9
+		before := got
+		if _, err := d.TryPoll(); err != nil {
+			t.Fatal(err)
+		}
+		return got > before
+	}
+	for _, tc := range []struct {
+		name       string
+		seq        uint8
+		delivered  bool
+		gaps, lost uint32
+		dups       uint32
+	}{
+		{name: "first", seq: 0xfe, delivered: true},
+		{name: "in order", seq: 0xff, delivered: true},
+		{name: "wrap", seq: 0x00, delivered: true},
+		{name: "gap", seq: 0x03, delivered: true, gaps: 1, lost: 2},
+		{name: "duplicate", seq: 0x03, gaps: 1, lost: 2, dups: 1},
+		{name: "backwards", seq: 0x01, gaps: 1, lost: 2, dups: 2},
+		{name: "resumed", seq: 0x04, delivered: true, gaps: 1, lost: 2, dups: 2},
+		{name: "large gap", seq: 0x80, delivered: true, gaps: 2, lost: 125, dups: 2},
+		{name: "gap to 0xfe", seq: 0xfe, delivered: true, gaps: 3, lost: 250, dups: 2},
+		{name: "gap across wrap", seq: 0x02, delivered: true, gaps: 4, lost: 253, dups: 2},
+	} {
+		if delivered := recv(tc.seq); delivered != tc.delivered {
+			t.Errorf("%s: got delivered=%v, want %v", tc.name, delivered, tc.delivered)
+		}
+		if st := d.Stats(); st.RxSeqGaps != tc.gaps || st.RxSeqLost != tc.lost || st.RxSeqDuplicates != tc.dups {
+			t.Errorf("%s: got gaps=%d lost=%d dups=%d, want %d %d %d", tc.name,
+				st.RxSeqGaps, st.RxSeqLost, st.RxSeqDuplicates, tc.gaps, tc.lost, tc.dups)
+		}
+	}
+
+	// The chip restarts its sequence numbers after a reset.
+	d.reset_state()
+	d.state = linkStateUp
+	d.btaddr = 0x19000
+	if !recv(0x80) || d.Stats().RxSeqGaps != 0 {
+		t.Errorf("sequence not resynchronized after reset: %+v", d.Stats())
+	}
+	if !recv(0x81) || d.Stats().RxSeqGaps != 0 {
+		t.Errorf("in order packet after reset not delivered: %+v", d.Stats())
+	}
+}
+
+func TestHCIRingWrite(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	bus.mem = map[uint32]uint32{}
+	const ringBuf = 0x19000 + whd.BTSDIO_OFFSET_HOST_WRITE_BUF
+	// HCI command with 9 parameter bytes: 16 bytes in the ring with its header.
+	cmd := []byte{hciPacketCommand, 0x03, 0x0c, 9, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if HCIRingFootprint(len(cmd)) != 16 {
+		t.Fatal("unexpected footprint", HCIRingFootprint(len(cmd)))
+	}
+	write := func(ptr, out uint32) error {
+		d.h2bWritePtr = ptr
+		bus.regs[d.btaddr+whd.BTSDIO_OFFSET_HOST2BT_OUT] = out
+		_, err := d.WriteHCI(cmd)
+		return err
+	}
+
+	// The packet wraps past the end of the ring.
+	if err := write(HCIRingSize-8, HCIRingSize-8); err != nil {
+		t.Fatal(err)
+	}
+	hdr := _busOrder.Uint32([]byte{12, 0, 0, hciPacketCommand})
+	if bus.mem[ringBuf+HCIRingSize-8] != hdr || bus.mem[ringBuf+HCIRingSize-4] != _busOrder.Uint32(cmd[1:5]) ||
+		bus.mem[ringBuf] != _busOrder.Uint32(cmd[5:9]) || bus.mem[ringBuf+4] != _busOrder.Uint32(cmd[9:13]) {
+		t.Errorf("packet not wrapped around the ring end: % x", []uint32{bus.mem[ringBuf+HCIRingSize-8],
+			bus.mem[ringBuf+HCIRingSize-4], bus.mem[ringBuf], bus.mem[ringBuf+4]})
+	}
+	if d.h2bWritePtr != 8 || bus.mem[d.btaddr+whd.BTSDIO_OFFSET_HOST2BT_IN] != 8 {
+		t.Errorf("got write pointer %d, want 8", d.h2bWritePtr)
+	}
+
+	// The packet fills the ring exactly, one word is kept free to tell a
+	// full ring from an empty one.
+	if err := write(HCIRingSize-20, 0); err != nil {
+		t.Fatal(err)
+	}
+	if free, err := d.HCIRingFree(); err != nil || free != 0 {
+		t.Errorf("got %d free bytes, want full ring: %v", free, err)
+	} else if d.h2bWritePtr != HCIRingSize-4 {
+		t.Errorf("got write pointer %d, want %d", d.h2bWritePtr, HCIRingSize-4)
+	}
+	if _, err := d.WriteHCI(cmd); err != ErrHCIWouldBlock {
+		t.Errorf("got %v writing to a full ring, want %v", err, ErrHCIWouldBlock)
+	}
+	// One word short of room.
+	if err := write(HCIRingSize-16, 0); err != ErrHCIWouldBlock {
+		t.Errorf("got %v, want %v", err, ErrHCIWouldBlock)
+	}
+}
+
+func TestResetClose(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	var power []bool
+	d.pwr = func(on bool) { power = append(power, on) }
+	d.RecvEthHandle(func(pkt []byte) error { return nil })
+	// dirty leaves driver state as after a join and some traffic.
+	dirty := func() {
+		d.initialized = true
+		d.sdpcmSeq, d.sdpcmSeqMax = 10, 0x50
+		d.rxSeq, d.rxSeqValid = 7, true
+		d.ioctlID = 3
+		d.state = linkStateUp
+		d.apUp, d.apIface = true, whd.IF_AP
+		d.creds = joinCreds{ssid: "home", hasPMK: true, pmk: [32]byte{1}}
+		d.lease = Lease{IP: netip.MustParseAddr("192.168.1.2")}
+		d.stats.RxSeqGaps = 1
+		bus.pkt[4] = d.rxSeq
+	}
+	cleared := func(op string) {
+		if d.initialized || d.rxSeqValid || d.rxSeq != 0 || d.sdpcmSeq != 0 || d.ioctlID != 0 ||
+			d.state != linkStateDown || d.apUp || d.creds != (joinCreds{}) || d.lease.IP.IsValid() ||
+			d.stats != (Stats{}) {
+			t.Errorf("%s: state not cleared", op)
+		}
+		if d.rcvEth == nil {
+			t.Errorf("%s: receive handler not preserved", op)
+		}
+	}
+
+	dirty()
+	d.Reset()
+	cleared("Reset")
+	if len(power) != 2 || power[0] || !power[1] {
+		t.Errorf("Reset: got power %v, want off then on", power)
+	}
+
+	dirty()
+	power = power[:0]
+	bus.ioctls = bus.ioctls[:0]
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cleared("Close")
+	if !d.closed || len(power) != 1 || power[0] {
+		t.Errorf("Close: got closed=%v power %v, want chip powered down", d.closed, power)
+	}
+	var cmds []whd.SDPCMCommand
+	for _, io := range bus.ioctls {
+		cmds = append(cmds, io.cmd)
+	}
+	if _, ok := bus.findIoctl(whd.WLC_DISASSOC); !ok || cmds[len(cmds)-1] != whd.WLC_DOWN {
+		t.Errorf("Close: got IOCTLs %v, want disassociation and WLC_DOWN last", cmds)
+	}
+	if v, ok := bus.findIovar("bss"); !ok || _busOrder.Uint32(v) != 1 || _busOrder.Uint32(v[4:]) != 0 {
+		t.Errorf("Close: got bss % x, want AP bsscfg down", v)
+	}
+
+	// The closed device may not be used again.
+	power = power[:0]
+	if err := d.Close(); err != errDeviceClosed {
+		t.Errorf("got %v closing twice, want %v", err, errDeviceClosed)
+	}
+	if err := d.Init(Config{}); err != errDeviceClosed {
+		t.Errorf("got %v from Init, want %v", err, errDeviceClosed)
+	}
+	d.Reset()
+	if len(power) != 0 {
+		t.Errorf("closed chip powered up by Reset: %v", power)
+	}
+	if _, err := d.WLCommand("up", nil); err != errDeviceNotInit {
+		t.Errorf("got %v, want %v", err, errDeviceNotInit)
+	}
+}
+
+func TestDisassociate(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	d.eventmask.Enable(whd.EvLINK)
+	d.eventmask.Enable(whd.EvJOIN)
+	d.eventmask.Enable(whd.EvDEAUTH)
+	if err := d.Disassociate(); err != nil {
+		t.Fatal(err)
+	}
+	io, ok := bus.findIoctl(whd.WLC_DISASSOC)
+	if !ok || io.kind != whd.SDPCM_SET || io.iface != whd.IF_STA || !bytes.Equal(io.data, []byte{0, 0, 0, 0}) {
+		t.Errorf("got IOCTL %+v, want WLC_DISASSOC on the station", io)
+	}
+	if d.IsLinkUp() {
+		t.Error("link up after disassociating")
+	}
+	// Link events are no longer tracked so no reconnection is attempted.
+	if d.eventmask.IsEnabled(whd.EvLINK) || d.eventmask.IsEnabled(whd.EvJOIN) || !d.eventmask.IsEnabled(whd.EvDEAUTH) {
+		t.Error("link events still tracked")
+	}
+
+	// The link is reported down even if the firmware fails the request.
+	d.state = linkStateUp
+	bus.ioctlResp = func(fakeIoctl) ([]byte, uint32) { return nil, 1 }
+	if err := d.Disassociate(); err == nil {
+		t.Error("firmware error not returned")
+	} else if d.IsLinkUp() {
+		t.Error("link up after failed disassociation")
+	}
+}
+
+func TestTSF(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if name, _ := io.iovar(); io.cmd != whd.WLC_GET_VAR || name != "tsf" || io.iface != whd.IF_STA {
+			return nil, 1
+		}
+		// Low word followed by high word, written over the request.
+		resp := make([]byte, len(io.data))
+		copy(resp, []byte{0x44, 0x33, 0x22, 0x11, 0x02, 0x01, 0, 0})
+		return resp, 0
+	}
+	tsf, err := d.TSF()
+	if err != nil {
+		t.Fatal(err)
+	} else if tsf != 0x0102_1122_3344 {
+		t.Errorf("got TSF %#x, want 0x010211223344", tsf)
+	}
+	if io := bus.ioctls[len(bus.ioctls)-1]; len(io.data) < 8 {
+		t.Errorf("got %d byte request, want room for the 8 byte TSF", len(io.data))
+	}
+}
+
+func TestSetSSIDDirected(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	if err := d.setSSIDDirected("hidden"); err != nil {
+		t.Fatal(err)
+	}
+	if d.state != linkStateDown {
+		t.Errorf("got link state %v, want down while joining", d.state)
+	}
+	v, ok := bus.findIovar("join")
+	if !ok {
+		t.Fatal("join iovar not set")
+	} else if len(v) != 72 {
+		t.Fatalf("got %d byte join parameters, want 72", len(v))
+	}
+	// wlc_ssid_t.
+	if n := binary.LittleEndian.Uint32(v[0:4]); n != 6 || string(v[4:10]) != "hidden" || !bytes.Equal(v[10:36], make([]byte, 26)) {
+		t.Errorf("got SSID % x, want length 6 and %q", v[0:36], "hidden")
+	}
+	// wl_join_scan_params_t: active scan with firmware default times.
+	if v[36] != whd.SCAN_TYPE_ACTIVE {
+		t.Errorf("got scan type %d, want active", v[36])
+	}
+	for i := 40; i < 56; i += 4 {
+		if got := binary.LittleEndian.Uint32(v[i:]); got != 0xffff_ffff {
+			t.Errorf("got scan parameter %d = %#x, want firmware default", (i-40)/4, got)
+		}
+	}
+	// wl_join_assoc_params_t: any BSSID.
+	if !bytes.Equal(v[56:62], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("got BSSID % x, want broadcast", v[56:62])
+	}
+
+	if err := d.setSSIDDirected(strings.Repeat("x", 33)); err != errSSIDTooLong {
+		t.Errorf("got %v, want %v", err, errSSIDTooLong)
+	}
+}
+
+func TestJoinHidden(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.SetClock(&fakeClock{t: time.Unix(1, 0)})
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		if name, _ := io.iovar(); io.cmd == whd.WLC_SET_VAR && name == "join" {
+			d.state = linkStateUp
+		} else if io.cmd == whd.WLC_SET_SSID {
+			t.Error("hidden network joined with WLC_SET_SSID")
+		} else if io.kind == whd.SDPCM_GET {
+			return io.data, 0
+		}
+		return nil, 0
+	}
+	if err := d.JoinWithOptions("IEEE", "password", JoinOptions{Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := bus.findIovar("join"); !ok || string(v[4:8]) != "IEEE" {
+		t.Errorf("got join parameters % x, want directed join of IEEE", v)
+	}
+	if !d.creds.hidden {
+		t.Error("hidden network not recorded in credentials")
+	} else if d.joinPol.hidden {
+		t.Error("join policy left hidden after join")
+	}
+	var buf bytes.Buffer
+	if err := d.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	state := buf.Bytes()
+	if state[5]&stateHidden == 0 {
+		t.Errorf("got state flags %#x, want hidden", state[5])
+	}
+
+	// With no saved BSSID the restored join is also directed.
+	bus.ioctls = bus.ioctls[:0]
+	d.state = linkStateDown
+	d.creds = joinCreds{}
+	if err := d.RestoreState(bytes.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bus.findIovar("join"); !ok {
+		t.Error("restored hidden network not joined with the join iovar")
+	}
+	if !d.creds.hidden || d.creds.ssid != "IEEE" {
+		t.Errorf("got restored credentials %+v, want hidden IEEE", d.creds)
+	}
+}
@@ -0,0 +1,30 @@
+// Package cyw43439 is a driver for the Infineon CYW43439 WLAN and Bluetooth
+// combo chip found on the Raspberry Pi Pico W.
+//
+// # Memory usage
+//
+// The driver is designed to run without heap allocations after a Device is
+// created so that GC pauses do not cause packet loss under load:
+//
+//   - New and NewPicoWDevice allocate the Device, which holds all buffers
+//     used to communicate with the chip (roughly 7kB).
+//   - The packet path does not allocate: SendEth, SendEthIface, SendEthWithHeadroom, PollOne,
+//     TryPoll, Poll, WriteHCI, ReadHCI, ReadHCIPacket, BufferedHCI and the
+//     receive handlers called by them. Neither do the accessors MTU, LinkMTU, MaxFrameSize, HardwareAddr6, NetFlags,
+//     IsLinkUp, Stats, ResetStats and TSF. This is verified on host builds by
+//     TestHotPathAllocs.
+//   - Configuration methods such as Init, Reset, Close, JoinWPA2, JoinWithOptions,
+//     StartAP, Scan, EnableBluetooth and the Set* methods are meant to be called
+//     rarely. They do not retain memory but may allocate error values on failure.
+//   - Enabling logging at Debug level or lower allocates on every packet.
+//
+// Packets passed to receive handlers reference driver buffers and are only valid
+// for the duration of the call; handlers must copy data they wish to retain.
+//
+// # Multiple devices
+//
+// The package holds no mutable global state: all buffers and driver state
+// live in the Device. Several chips on separate buses may be driven
+// concurrently, each by its own Device created with New. This is verified by
+// TestMultipleDevices.
+package cyw43439
@@ -0,0 +1,100 @@
+package cyw43439
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errEntropyRepetition = errors.New("RF measurements repeated, entropy source failed health test")
+
+const (
+	// entropySamplesPerBit is the amount of RF measurements per bit of
+	// entropy credited. The noise floor is reported in whole dBm and only
+	// updated by the firmware now and then, so consecutive measurements are
+	// assumed to hold no more than 1/8 bit of min-entropy.
+	entropySamplesPerBit = 8
+	// entropyBlockLen is the amount of bytes output per entropySamples
+	// measurements conditioned with SHA-256.
+	entropyBlockLen = 16
+	entropySamples  = entropyBlockLen * 8 * entropySamplesPerBit
+	// entropyRepeatCutoff is the cutoff of the repetition count health test
+	// of NIST SP 800-90B section 4.4.1 for a false positive probability of
+	// 2^-20 at the min-entropy assumed: 1 + 20*entropySamplesPerBit.
+	entropyRepeatCutoff = 1 + 20*entropySamplesPerBit
+)
+
+// EntropyReader returns a reader of random bytes harvested from RF
+// measurements: the PHY noise floor and the RSSI while joined, along with the
+// timing jitter of the bus transactions reading them, conditioned with SHA-256.
+// Many TinyGo targets lack a strong random number generator, so the reader is
+// meant to supplement the seed of the random source used by TLS stacks and
+// other crypto/rand consumers. It is not a CSPRNG nor a sufficient seed by
+// itself: an attacker nearby may observe or influence the RF environment.
+// Entropy is credited conservatively, 1 bit per 8 measurements, so reads are
+// slow, taking 1024 measurements per 16 bytes. Reads fail if the measurements
+// fail the repetition count health test of NIST SP 800-90B, i.e: the same
+// measurement is read 161 times in a row. Init must be called first.
+func (d *Device) EntropyReader() io.Reader {
+	return entropyReader{d: d}
+}
+
+type entropyReader struct {
+	d *Device
+}
+
+func (r entropyReader) Read(p []byte) (n int, err error) {
+	var block [sha256.Size]byte
+	for n < len(p) {
+		err = r.d.read_entropy(&block)
+		if err != nil {
+			break
+		}
+		n += copy(p[n:], block[:entropyBlockLen])
+	}
+	clear(block[:])
+	return n, err
+}
+
+// read_entropy fills block with entropy, of which the first entropyBlockLen
+// bytes are credited, taking the lock per block so long reads do not starve
+// other users of the device.
+func (d *Device) read_entropy(block *[sha256.Size]byte) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	h := sha256.New()
+	var sample, last [16]byte
+	repeats := 0
+	for i := 0; i < entropySamples; i++ {
+		start := d.now()
+		clear(sample[:8])
+		_, err := d.doIoctlGet(whd.WLC_GET_PHY_NOISE, whd.IF_STA, sample[0:4])
+		if err != nil {
+			return err
+		}
+		if d.state == linkStateUp {
+			// Fails between joins, in which case the noise floor is used alone.
+			d.doIoctlGet(whd.WLC_GET_RSSI, whd.IF_STA, sample[4:8])
+		}
+		binary.LittleEndian.PutUint64(sample[8:16], uint64(d.since(start)))
+		h.Write(sample[:])
+		// Only RF measurements are health tested, bus timing may be too regular.
+		if i > 0 && [8]byte(sample[:8]) == [8]byte(last[:8]) {
+			repeats++
+			if repeats >= entropyRepeatCutoff-1 {
+				return errEntropyRepetition
+			}
+		} else {
+			repeats = 0
+		}
+		last = sample
+	}
+	h.Sum(block[:0])
+	return nil
+}
@@ -0,0 +1,311 @@
+// Package eth provides Ethernet helpers for applications sending raw frames
+// with the CYW43439 without a network stack, such as UDP-only telemetry, and
+// for network stacks running on top of the driver.
+//
+// ARP resolves the MAC addresses of IPv4 next hops and answers ARP requests
+// for the host's address so peers can reach it:
+//
+//	arp, err := eth.NewARP(dev, eth.ARPConfig{IP: netip.MustParseAddr("192.168.1.2")})
+//	gwMAC, err := arp.Resolve(gateway)
+//
+// Received ARP packets are processed as the device is polled. Replies to ARP
+// requests can not be sent while the device is polled so they are sent by
+// Resolve or by calling SendPending after polling.
+//
+// The chip does not offload checksums: SetChecksums and VerifyChecksums
+// compute them for whole frames and Checksum for arbitrary data.
+// DecodeTCPOptions and AppendTCPOptions handle the TCP options, such as the
+// MSS, which fixed size TCP header decoders skip. IGMP joins multicast groups
+// so they are forwarded by switches with IGMP snooping. AppendUDPBroadcast
+// builds a UDP broadcast frame, such as a discovery announcement.
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/cyw43439"
+)
+
+const (
+	arpHTypeEthernet = 1
+	arpOpRequest     = 1
+	arpOpReply       = 2
+	// arpFrameLen is the length of an Ethernet frame with an ARP packet,
+	// padded to the minimum Ethernet frame length.
+	arpFrameLen  = 60
+	ethHeaderLen = 14
+	arpLen       = 28
+	maxPending   = 4
+
+	defaultEntries = 8
+	defaultTTL     = 5 * time.Minute
+	defaultTimeout = time.Second
+	// requestsPerResolve is the amount of ARP requests sent during Resolve's timeout.
+	requestsPerResolve = 3
+)
+
+var (
+	errARPTimeout  = errors.New("eth: ARP resolve timeout")
+	errNotIPv4     = errors.New("eth: address not IPv4")
+	errShortARP    = errors.New("eth: short ARP packet")
+	errUnsupported = errors.New("eth: unsupported ARP packet")
+)
+
+// ARPConfig configures the ARP resolver.
+type ARPConfig struct {
+	// IP is the IPv4 address of the host. ARP requests for it are answered
+	// and it is sent as sender address of requests.
+	IP netip.Addr
+	// Entries is the size of the ARP cache. Defaults to 8.
+	Entries int
+	// TTL is the time a resolved address is cached. Defaults to 5 minutes.
+	TTL time.Duration
+	// Timeout is the time Resolve waits for a reply. Defaults to 1 second.
+	Timeout time.Duration
+}
+
+type arpEntry struct {
+	ip      [4]byte
+	mac     [6]byte
+	expires time.Time
+	// static entries added with Put never expire.
+	static bool
+}
+
+// ARP is an ARP cache and resolver for a Device, see NewARP.
+type ARP struct {
+	dev *cyw43439.Device
+	mac [6]byte
+	ip  [4]byte
+	cfg ARPConfig
+	id  cyw43439.RecvHandlerID
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries []arpEntry
+	// pending are the addresses requests for the host's address came from,
+	// to be replied to by SendPending.
+	pending  [maxPending]arpEntry
+	npending int
+	txbuf    [arpFrameLen]byte
+}
+
+// NewARP returns an ARP resolver registered to receive the ARP packets of dev.
+// The device must be initialized so that its MAC address is known.
+func NewARP(dev *cyw43439.Device, cfg ARPConfig) (*ARP, error) {
+	if !cfg.IP.Is4() {
+		return nil, errNotIPv4
+	}
+	mac, err := dev.HardwareAddr6()
+	if err != nil {
+		return nil, err
+	}
+	a := newARP(cfg, mac)
+	a.dev = dev
+	a.id, err = dev.AddRecvHandler(cyw43439.EtherTypeARP, a.handle)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newARP(cfg ARPConfig, mac [6]byte) *ARP {
+	if cfg.Entries <= 0 {
+		cfg.Entries = defaultEntries
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return &ARP{
+		mac:     mac,
+		ip:      cfg.IP.As4(),
+		cfg:     cfg,
+		now:     time.Now,
+		entries: make([]arpEntry, 0, cfg.Entries),
+	}
+}
+
+// Close unregisters the resolver from the device.
+func (a *ARP) Close() error {
+	return a.dev.RemoveRecvHandler(a.id)
+}
+
+// Lookup returns the cached MAC address of ip without sending requests.
+func (a *ARP) Lookup(ip netip.Addr) (mac [6]byte, ok bool) {
+	if !ip.Is4() {
+		return mac, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := a.find(ip.As4())
+	if e == nil {
+		return mac, false
+	}
+	return e.mac, true
+}
+
+// Put adds a static entry to the cache which does not expire, i.e: for a
+// gateway whose address is known beforehand.
+func (a *ARP) Put(ip netip.Addr, mac [6]byte) error {
+	if !ip.Is4() {
+		return errNotIPv4
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.learn(ip.As4(), mac, true)
+	return nil
+}
+
+// Resolve returns the MAC address of ip, sending ARP requests and polling the
+// device until a reply is received if it is not cached. ip must be on the
+// local network; the address of the gateway is resolved for other destinations.
+func (a *ARP) Resolve(ip netip.Addr) (mac [6]byte, err error) {
+	if mac, ok := a.Lookup(ip); ok {
+		return mac, nil
+	} else if !ip.Is4() {
+		return mac, errNotIPv4
+	}
+	retry := a.cfg.Timeout / requestsPerResolve
+	start := a.now()
+	var lastReq time.Time
+	for a.now().Sub(start) < a.cfg.Timeout {
+		if lastReq.IsZero() || a.now().Sub(lastReq) >= retry {
+			err = a.request(ip.As4())
+			if err != nil {
+				return mac, err
+			}
+			lastReq = a.now()
+		}
+		_, _, err = a.dev.Poll(cyw43439.PollBudget{MaxFrames: 4})
+		if err != nil {
+			return mac, err
+		}
+		err = a.SendPending()
+		if err != nil {
+			return mac, err
+		}
+		if mac, ok := a.Lookup(ip); ok {
+			return mac, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return mac, errARPTimeout
+}
+
+// SendPending sends the replies to ARP requests for the host's address
+// received since the last call. Call it after polling the device.
+func (a *ARP) SendPending() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.npending > 0 {
+		a.npending--
+		p := &a.pending[a.npending]
+		a.put(arpOpReply, p.mac, p.ip)
+		err := a.dev.SendEth(a.txbuf[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends an ARP request for ip.
+func (a *ARP) request(ip [4]byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.put(arpOpRequest, [6]byte{}, ip)
+	return a.dev.SendEth(a.txbuf[:])
+}
+
+// put writes an ARP packet of operation op to txbuf.
+func (a *ARP) put(op uint16, targetMAC [6]byte, targetIP [4]byte) {
+	b := a.txbuf[:]
+	clear(b)
+	if op == arpOpRequest {
+		copy(b[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	} else {
+		copy(b[0:6], targetMAC[:])
+	}
+	copy(b[6:12], a.mac[:])
+	binary.BigEndian.PutUint16(b[12:], cyw43439.EtherTypeARP)
+	arp := b[ethHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:], arpHTypeEthernet)
+	binary.BigEndian.PutUint16(arp[2:], cyw43439.EtherTypeIPv4)
+	arp[4], arp[5] = 6, 4 // Hardware and protocol address lengths.
+	binary.BigEndian.PutUint16(arp[6:], op)
+	copy(arp[8:14], a.mac[:])
+	copy(arp[14:18], a.ip[:])
+	copy(arp[18:24], targetMAC[:])
+	copy(arp[24:28], targetIP[:])
+}
+
+// handle processes a received ARP packet following RFC 826: the sender of
+// packets addressed to the host, or already cached, is learned.
+func (a *ARP) handle(pkt []byte) error {
+	if len(pkt) < ethHeaderLen+arpLen {
+		return errShortARP
+	}
+	arp := pkt[ethHeaderLen:]
+	if binary.BigEndian.Uint16(arp[0:]) != arpHTypeEthernet || binary.BigEndian.Uint16(arp[2:]) != cyw43439.EtherTypeIPv4 ||
+		arp[4] != 6 || arp[5] != 4 {
+		return errUnsupported
+	}
+	op := binary.BigEndian.Uint16(arp[6:])
+	senderMAC := [6]byte(arp[8:14])
+	senderIP := [4]byte(arp[14:18])
+	targetIP := [4]byte(arp[24:28])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	toUs := targetIP == a.ip
+	if e := a.find(senderIP); e != nil && !e.static {
+		e.mac = senderMAC
+		e.expires = a.now().Add(a.cfg.TTL)
+	} else if toUs && senderIP != [4]byte{} {
+		a.learn(senderIP, senderMAC, false)
+	}
+	if toUs && op == arpOpRequest && a.npending < maxPending {
+		a.pending[a.npending] = arpEntry{ip: senderIP, mac: senderMAC}
+		a.npending++
+	}
+	return nil
+}
+
+// find returns the unexpired entry of ip, nil if there is none.
+func (a *ARP) find(ip [4]byte) *arpEntry {
+	now := a.now()
+	for i := range a.entries {
+		e := &a.entries[i]
+		if e.ip == ip && (e.static || now.Before(e.expires)) {
+			return e
+		}
+	}
+	return nil
+}
+
+// learn caches mac as the address of ip, replacing the entry of ip, an
+// expired entry or the one closest to expiring if the cache is full.
+func (a *ARP) learn(ip [4]byte, mac [6]byte, static bool) {
+	entry := arpEntry{ip: ip, mac: mac, expires: a.now().Add(a.cfg.TTL), static: static}
+	victim := -1
+	for i := range a.entries {
+		e := &a.entries[i]
+		if e.ip == ip {
+			victim = i
+			break
+		} else if !e.static && (victim < 0 || e.expires.Before(a.entries[victim].expires)) {
+			victim = i
+		}
+	}
+	if victim >= 0 && (a.entries[victim].ip == ip || len(a.entries) == cap(a.entries)) {
+		a.entries[victim] = entry
+	} else if len(a.entries) < cap(a.entries) {
+		a.entries = append(a.entries, entry)
+	}
+}
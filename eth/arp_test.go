@@ -0,0 +1,63 @@
+package eth
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func arpPacket(op uint16, senderMAC [6]byte, senderIP, targetIP [4]byte) []byte {
+	a := newARP(ARPConfig{IP: netip.AddrFrom4(senderIP)}, senderMAC)
+	a.put(op, [6]byte{}, targetIP)
+	return append([]byte(nil), a.txbuf[:]...)
+}
+
+func TestARPCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	host := [4]byte{192, 168, 1, 2}
+	a := newARP(ARPConfig{IP: netip.AddrFrom4(host), Entries: 2, TTL: time.Minute}, [6]byte{2})
+	a.now = func() time.Time { return now }
+
+	peer, peerIP := [6]byte{0xaa, 1}, [4]byte{192, 168, 1, 10}
+	err := a.handle(arpPacket(arpOpRequest, peer, peerIP, host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac, ok := a.Lookup(netip.AddrFrom4(peerIP)); !ok || mac != peer {
+		t.Errorf("requester not learned: %x %v", mac, ok)
+	}
+	if a.npending != 1 || a.pending[0].mac != peer {
+		t.Errorf("reply not queued: %d", a.npending)
+	}
+	a.put(arpOpReply, a.pending[0].mac, a.pending[0].ip)
+	if [6]byte(a.txbuf[0:6]) != peer || binary.BigEndian.Uint16(a.txbuf[ethHeaderLen+6:]) != arpOpReply ||
+		[4]byte(a.txbuf[ethHeaderLen+14:ethHeaderLen+18]) != host {
+		t.Errorf("bad reply % x", a.txbuf[:ethHeaderLen+arpLen])
+	}
+
+	// Requests for other hosts are not learned nor replied.
+	other := [4]byte{192, 168, 1, 11}
+	a.handle(arpPacket(arpOpRequest, [6]byte{0xbb}, other, [4]byte{192, 168, 1, 1}))
+	if _, ok := a.Lookup(netip.AddrFrom4(other)); ok || a.npending != 1 {
+		t.Error("request for another host learned or replied")
+	}
+
+	gw := netip.AddrFrom4([4]byte{192, 168, 1, 1})
+	a.Put(gw, [6]byte{0xcc})
+	now = now.Add(2 * time.Minute)
+	if _, ok := a.Lookup(netip.AddrFrom4(peerIP)); ok {
+		t.Error("entry did not expire")
+	}
+	if _, ok := a.Lookup(gw); !ok {
+		t.Error("static entry expired")
+	}
+	// The expired entry is replaced when the cache is full.
+	a.handle(arpPacket(arpOpReply, [6]byte{0xdd}, other, host))
+	if mac, ok := a.Lookup(netip.AddrFrom4(other)); !ok || mac != [6]byte{0xdd} || len(a.entries) != 2 {
+		t.Errorf("reply not learned: %x %v %d", mac, ok, len(a.entries))
+	}
+	if err := a.handle(make([]byte, 20)); err != errShortARP {
+		t.Errorf("got %v for short packet", err)
+	}
+}
@@ -0,0 +1,163 @@
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439"
+)
+
+// IP protocol numbers.
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
+
+const (
+	ipv4MinHeaderLen = 20
+	udpHeaderLen     = 8
+	tcpMinHeaderLen  = 20
+	// Offsets of the checksum field in the IPv4, UDP and TCP headers.
+	ipv4ChecksumOff = 10
+	udpChecksumOff  = 6
+	tcpChecksumOff  = 16
+)
+
+var (
+	errShortFrame  = errors.New("eth: short frame")
+	errBadIPv4     = errors.New("eth: malformed IPv4 header")
+	errBadChecksum = errors.New("eth: bad checksum")
+)
+
+// Checksum returns the Internet checksum (RFC 1071) of b with the partial sum
+// initial added, i.e: the sum of a pseudo header, see PseudoHeaderSum.
+// The data is summed a 32 bit word at a time, halving the additions of the
+// usual 16 bit loop, which matters on cores such as the Cortex-M0+ where
+// checksums are a top CPU consumer at high throughput.
+func Checksum(b []byte, initial uint32) uint16 {
+	return ^fold(sum(uint64(initial), b))
+}
+
+// PseudoHeaderSum returns the partial sum of the IPv4 pseudo header of a TCP
+// or UDP segment of length bytes, to be passed to Checksum.
+func PseudoHeaderSum(src, dst [4]byte, proto uint8, length uint16) uint32 {
+	s := uint64(binary.BigEndian.Uint32(src[:])) + uint64(binary.BigEndian.Uint32(dst[:])) +
+		uint64(proto) + uint64(length)
+	return uint32(fold(s))
+}
+
+// sum adds b to the one's complement sum acc. Summing 32 bit words and
+// folding later is equivalent to summing 16 bit words since 2^16 = 1 modulo 0xffff.
+func sum(acc uint64, b []byte) uint64 {
+	for len(b) >= 16 {
+		acc += uint64(binary.BigEndian.Uint32(b[0:])) + uint64(binary.BigEndian.Uint32(b[4:])) +
+			uint64(binary.BigEndian.Uint32(b[8:])) + uint64(binary.BigEndian.Uint32(b[12:]))
+		b = b[16:]
+	}
+	for len(b) >= 4 {
+		acc += uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		acc += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		acc += uint64(b[0]) << 8 // Padded with a zero byte.
+	}
+	return acc
+}
+
+// fold folds the sum acc to 16 bits.
+func fold(acc uint64) uint16 {
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return uint16(acc)
+}
+
+// SetChecksums emulates checksum offload for an Ethernet frame about to be
+// sent: the IPv4 header checksum and the TCP or UDP checksum are computed and
+// written to the frame. Frames which are not IPv4 are left untouched, as are
+// the transport headers of fragmented datagrams.
+func SetChecksums(frame []byte) error {
+	ip, l4, proto, err := splitIPv4(frame)
+	if err != nil || ip == nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(ip[ipv4ChecksumOff:], 0)
+	binary.BigEndian.PutUint16(ip[ipv4ChecksumOff:], Checksum(ip, 0))
+	off := l4ChecksumOffset(proto, l4)
+	if off < 0 {
+		return nil
+	}
+	binary.BigEndian.PutUint16(l4[off:], 0)
+	csum := Checksum(l4, pseudoHeader(ip, proto, l4))
+	if proto == ProtoUDP && csum == 0 {
+		csum = 0xffff // Zero means no checksum in UDP.
+	}
+	binary.BigEndian.PutUint16(l4[off:], csum)
+	return nil
+}
+
+// VerifyChecksums checks the IPv4 header checksum and the TCP or UDP
+// checksum of a received Ethernet frame. Frames which are not IPv4 and UDP
+// datagrams sent without checksum are accepted.
+func VerifyChecksums(frame []byte) error {
+	ip, l4, proto, err := splitIPv4(frame)
+	if err != nil || ip == nil {
+		return err
+	}
+	if Checksum(ip, 0) != 0 {
+		return errBadChecksum
+	}
+	off := l4ChecksumOffset(proto, l4)
+	if off < 0 || (proto == ProtoUDP && binary.BigEndian.Uint16(l4[off:]) == 0) {
+		return nil
+	}
+	if Checksum(l4, pseudoHeader(ip, proto, l4)) != 0 {
+		return errBadChecksum
+	}
+	return nil
+}
+
+// splitIPv4 returns the IPv4 header and payload of frame, nil if frame is
+// not IPv4. The payload is nil for fragments.
+func splitIPv4(frame []byte) (ip, l4 []byte, proto uint8, err error) {
+	if len(frame) < ethHeaderLen {
+		return nil, nil, 0, errShortFrame
+	} else if binary.BigEndian.Uint16(frame[12:]) != cyw43439.EtherTypeIPv4 {
+		return nil, nil, 0, nil
+	}
+	pkt := frame[ethHeaderLen:]
+	if len(pkt) < ipv4MinHeaderLen || pkt[0]>>4 != 4 {
+		return nil, nil, 0, errBadIPv4
+	}
+	hdrLen := int(pkt[0]&0xf) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:]))
+	if hdrLen < ipv4MinHeaderLen || totalLen < hdrLen || totalLen > len(pkt) {
+		return nil, nil, 0, errBadIPv4
+	}
+	ip = pkt[:hdrLen]
+	if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+		// Fragment: the transport checksum covers the whole datagram.
+		return ip, nil, ip[9], nil
+	}
+	return ip, pkt[hdrLen:totalLen], ip[9], nil
+}
+
+// l4ChecksumOffset returns the offset of the checksum field in the TCP or
+// UDP segment l4, -1 if l4 is neither or too short.
+func l4ChecksumOffset(proto uint8, l4 []byte) int {
+	switch {
+	case proto == ProtoTCP && len(l4) >= tcpMinHeaderLen:
+		return tcpChecksumOff
+	case proto == ProtoUDP && len(l4) >= udpHeaderLen:
+		return udpChecksumOff
+	}
+	return -1
+}
+
+func pseudoHeader(ip []byte, proto uint8, l4 []byte) uint32 {
+	return PseudoHeaderSum([4]byte(ip[12:16]), [4]byte(ip[16:20]), proto, uint16(len(l4)))
+}
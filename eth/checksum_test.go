@@ -0,0 +1,86 @@
+package eth
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// checksum16 is the reference RFC 1071 implementation summing 16 bit words.
+func checksum16(b []byte, initial uint32) uint16 {
+	s := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func TestChecksum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1600)
+	for n := 0; n < len(buf); n += 1 + n/8 {
+		rng.Read(buf[:n])
+		initial := rng.Uint32() & 0x1ffff
+		if got, want := Checksum(buf[:n], initial), checksum16(buf[:n], initial); got != want {
+			t.Errorf("len %d: got %#x, want %#x", n, got, want)
+		}
+	}
+	// IPv4 header with checksum 0xb861 zeroed.
+	hdr := []byte{0x45, 0, 0, 0x73, 0, 0, 0x40, 0, 0x40, 0x11, 0, 0, 0xc0, 0xa8, 0, 1, 0xc0, 0xa8, 0, 0xc7}
+	if got := Checksum(hdr, 0); got != 0xb861 {
+		t.Errorf("got IPv4 header checksum %#x", got)
+	}
+}
+
+func TestSetChecksums(t *testing.T) {
+	for _, proto := range []uint8{ProtoUDP, ProtoTCP} {
+		payload := 13
+		l4len := udpHeaderLen + payload
+		if proto == ProtoTCP {
+			l4len = tcpMinHeaderLen + payload
+		}
+		frame := make([]byte, ethHeaderLen+ipv4MinHeaderLen+l4len)
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip := frame[ethHeaderLen:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(ipv4MinHeaderLen+l4len))
+		ip[8], ip[9] = 64, proto
+		copy(ip[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+		for i := ipv4MinHeaderLen; i < len(ip); i++ {
+			ip[i] = byte(i * 7)
+		}
+		if proto == ProtoUDP {
+			binary.BigEndian.PutUint16(ip[ipv4MinHeaderLen+4:], uint16(l4len))
+		}
+		err := SetChecksums(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = VerifyChecksums(frame); err != nil {
+			t.Errorf("proto %d: %v", proto, err)
+		}
+		frame[len(frame)-1]++
+		if err = VerifyChecksums(frame); err != errBadChecksum {
+			t.Errorf("proto %d: corrupted frame got %v", proto, err)
+		}
+	}
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:], 0x0806)
+	if SetChecksums(arp) != nil || VerifyChecksums(arp) != nil {
+		t.Error("non IPv4 frame not ignored")
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	buf := make([]byte, 1460)
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		Checksum(buf, 0)
+	}
+}
@@ -0,0 +1,255 @@
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+
+	"github.com/soypat/cyw43439"
+)
+
+// IGMP message types.
+const (
+	igmpQuery    = 0x11
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+	protoIGMP    = 2
+	// IGMPv3 group record types.
+	igmpModeIsExclude   = 2
+	igmpChangeToInclude = 3
+	igmpChangeToExclude = 4
+	maxIGMPGroups       = 8
+	// igmpHeaderLen is the length of the IPv4 header with the router alert option.
+	igmpHeaderLen = ipv4MinHeaderLen + 4
+	// igmpFrameLen is the length of the largest frame sent, a v3 report of maxIGMPGroups records.
+	igmpFrameLen = ethHeaderLen + igmpHeaderLen + 8 + 8*maxIGMPGroups
+)
+
+var (
+	igmpAllRouters   = [4]byte{224, 0, 0, 2}
+	igmpV3Routers    = [4]byte{224, 0, 0, 22}
+	errNotMulticast  = errors.New("eth: not an IPv4 multicast group")
+	errIGMPFull      = errors.New("eth: too many IGMP groups")
+	errIGMPNotJoined = errors.New("eth: IGMP group not joined")
+	errIGMPVersion   = errors.New("eth: IGMP version not 2 or 3")
+)
+
+// IGMPConfig configures the IGMP helper.
+type IGMPConfig struct {
+	// IP is the IPv4 address of the host, sent as source of reports.
+	IP netip.Addr
+	// Version is the IGMP version of reports, 2 or 3. Defaults to 3.
+	Version uint8
+}
+
+// IGMP manages IPv4 multicast group memberships of a Device: joining a group
+// programs the chip's multicast filter and sends an IGMP membership report
+// so that switches with IGMP snooping forward the group's traffic to the
+// device. Queries from the network's querier are answered so memberships do
+// not time out; the reports are sent by SendPending, see ARP.
+type IGMP struct {
+	dev     *cyw43439.Device
+	mac     [6]byte
+	ip      [4]byte
+	version uint8
+	id      cyw43439.RecvHandlerID
+
+	mu      sync.Mutex
+	groups  [maxIGMPGroups][4]byte
+	ngroups int
+	// reportAll is set by a general query, reportGroup by a group specific query.
+	reportAll   bool
+	reportGroup [4]byte
+	txbuf       [igmpFrameLen]byte
+}
+
+// NewIGMP returns an IGMP helper registered to receive the IGMP queries of dev.
+// The device must be initialized so that its MAC address is known.
+func NewIGMP(dev *cyw43439.Device, cfg IGMPConfig) (*IGMP, error) {
+	if !cfg.IP.Is4() {
+		return nil, errNotIPv4
+	} else if cfg.Version == 0 {
+		cfg.Version = 3
+	} else if cfg.Version != 2 && cfg.Version != 3 {
+		return nil, errIGMPVersion
+	}
+	mac, err := dev.HardwareAddr6()
+	if err != nil {
+		return nil, err
+	}
+	m := &IGMP{dev: dev, mac: mac, ip: cfg.IP.As4(), version: cfg.Version}
+	m.id, err = dev.AddRecvHandler(cyw43439.EtherTypeIPv4, m.handle)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close unregisters the helper from the device. Joined groups are not left.
+func (m *IGMP) Close() error {
+	return m.dev.RemoveRecvHandler(m.id)
+}
+
+// MulticastMAC returns the Ethernet address IPv4 multicast group frames are sent to.
+func MulticastMAC(group netip.Addr) (mac [6]byte, ok bool) {
+	if !group.Is4() || !group.IsMulticast() {
+		return mac, false
+	}
+	g := group.As4()
+	return [6]byte{0x01, 0x00, 0x5e, g[1] & 0x7f, g[2], g[3]}, true
+}
+
+// Join joins the IPv4 multicast group: its address is added to the chip's
+// multicast filter with JoinMulticastGroup and a membership report is sent.
+func (m *IGMP) Join(group netip.Addr) error {
+	mac, ok := MulticastMAC(group)
+	if !ok {
+		return errNotMulticast
+	}
+	g := group.As4()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.find(g) >= 0 {
+		return nil
+	} else if m.ngroups == maxIGMPGroups {
+		return errIGMPFull
+	}
+	err := m.dev.JoinMulticastGroup(mac)
+	if err != nil {
+		return err
+	}
+	m.groups[m.ngroups] = g
+	m.ngroups++
+	if m.version == 2 {
+		return m.send(igmpV2Report, g, g)
+	}
+	return m.sendV3(igmpChangeToExclude, g)
+}
+
+// Leave leaves a group joined with Join, sending a leave message so
+// switches stop forwarding its traffic.
+func (m *IGMP) Leave(group netip.Addr) error {
+	mac, ok := MulticastMAC(group)
+	if !ok {
+		return errNotMulticast
+	}
+	g := group.As4()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(g)
+	if i < 0 {
+		return errIGMPNotJoined
+	}
+	m.ngroups--
+	m.groups[i] = m.groups[m.ngroups]
+	var err error
+	if m.version == 2 {
+		err = m.send(igmpV2Leave, igmpAllRouters, g)
+	} else {
+		err = m.sendV3(igmpChangeToInclude, g)
+	}
+	if err != nil {
+		return err
+	}
+	return m.dev.LeaveMulticastGroup(mac)
+}
+
+// SendPending sends the membership reports requested by queries received
+// since the last call. Call it after polling the device.
+func (m *IGMP) SendPending() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all, group := m.reportAll, m.reportGroup
+	m.reportAll, m.reportGroup = false, [4]byte{}
+	if m.version == 3 && (all || group != [4]byte{}) {
+		return m.sendV3(igmpModeIsExclude, group)
+	}
+	for _, g := range m.groups[:m.ngroups] {
+		if all || g == group {
+			err := m.send(igmpV2Report, g, g)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handle processes IPv4 frames, flagging the reports to send for IGMP queries.
+func (m *IGMP) handle(pkt []byte) error {
+	ip, l4, proto, err := splitIPv4(pkt)
+	if err != nil || ip == nil || proto != protoIGMP || len(l4) < 8 || l4[0] != igmpQuery {
+		return err
+	}
+	group := [4]byte(l4[4:8])
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if group == [4]byte{} {
+		m.reportAll = true
+	} else if m.find(group) >= 0 {
+		m.reportGroup = group
+	}
+	return nil
+}
+
+func (m *IGMP) find(group [4]byte) int {
+	for i, g := range m.groups[:m.ngroups] {
+		if g == group {
+			return i
+		}
+	}
+	return -1
+}
+
+// send sends an IGMPv2 message of type typ for group to the IPv4 address dst.
+func (m *IGMP) send(typ uint8, dst, group [4]byte) error {
+	msg := m.putHeader(dst, 8)
+	msg[0], msg[1] = typ, 0
+	copy(msg[4:8], group[:])
+	binary.BigEndian.PutUint16(msg[2:], Checksum(msg, 0))
+	return m.dev.SendEth(m.txbuf[:ethHeaderLen+igmpHeaderLen+len(msg)])
+}
+
+// sendV3 sends an IGMPv3 report with a record of type rtype for group, or
+// for every joined group if group is zero.
+func (m *IGMP) sendV3(rtype uint8, group [4]byte) error {
+	groups := m.groups[:m.ngroups]
+	one := [1][4]byte{group}
+	if group != [4]byte{} {
+		groups = one[:]
+	}
+	msg := m.putHeader(igmpV3Routers, 8+8*len(groups))
+	msg[0], msg[1] = igmpV3Report, 0
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(groups)))
+	for i, g := range groups {
+		rec := msg[8+8*i:]
+		rec[0], rec[1] = rtype, 0
+		binary.BigEndian.PutUint16(rec[2:], 0) // No sources.
+		copy(rec[4:8], g[:])
+	}
+	binary.BigEndian.PutUint16(msg[2:], Checksum(msg, 0))
+	return m.dev.SendEth(m.txbuf[:ethHeaderLen+igmpHeaderLen+len(msg)])
+}
+
+// putHeader writes the Ethernet and IPv4 headers of an IGMP message of
+// msgLen bytes sent to dst and returns the zeroed message.
+func (m *IGMP) putHeader(dst [4]byte, msgLen int) []byte {
+	b := m.txbuf[:ethHeaderLen+igmpHeaderLen+msgLen]
+	clear(b)
+	dstMAC, _ := MulticastMAC(netip.AddrFrom4(dst))
+	copy(b[0:6], dstMAC[:])
+	copy(b[6:12], m.mac[:])
+	binary.BigEndian.PutUint16(b[12:], cyw43439.EtherTypeIPv4)
+	ip := b[ethHeaderLen : ethHeaderLen+igmpHeaderLen]
+	ip[0] = 0x40 | igmpHeaderLen/4
+	ip[1] = 0xc0 // Internetwork control.
+	binary.BigEndian.PutUint16(ip[2:], uint16(igmpHeaderLen+msgLen))
+	ip[8], ip[9] = 1, protoIGMP // TTL of 1: reports are not routed.
+	copy(ip[12:16], m.ip[:])
+	copy(ip[16:20], dst[:])
+	ip[20], ip[21] = 0x94, 0x04 // Router alert option.
+	binary.BigEndian.PutUint16(ip[ipv4ChecksumOff:], Checksum(ip, 0))
+	return b[ethHeaderLen+igmpHeaderLen:]
+}
@@ -0,0 +1,45 @@
+package eth
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func TestIGMP(t *testing.T) {
+	group := netip.MustParseAddr("239.129.2.3")
+	mac, ok := MulticastMAC(group)
+	if !ok || mac != [6]byte{0x01, 0x00, 0x5e, 0x01, 2, 3} {
+		t.Errorf("got multicast MAC %x %v", mac, ok)
+	}
+	if _, ok = MulticastMAC(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Error("unicast address mapped to multicast MAC")
+	}
+
+	m := &IGMP{ip: [4]byte{10, 0, 0, 2}, version: 2}
+	m.groups[0], m.ngroups = group.As4(), 1
+	msg := m.putHeader(group.As4(), 8)
+	frame := m.txbuf[:ethHeaderLen+igmpHeaderLen+len(msg)]
+	if err := VerifyChecksums(frame); err != nil {
+		t.Error(err)
+	}
+	if frame[ethHeaderLen+8] != 1 || [6]byte(frame[0:6]) != mac {
+		t.Errorf("bad report header % x", frame[:ethHeaderLen+igmpHeaderLen])
+	}
+
+	// A query for another group is ignored, a general query reports all groups.
+	query := make([]byte, len(frame))
+	copy(query, frame)
+	q := query[ethHeaderLen+igmpHeaderLen:]
+	q[0] = igmpQuery
+	copy(q[4:8], []byte{239, 0, 0, 9})
+	m.handle(query)
+	if m.reportAll || m.reportGroup != [4]byte{} {
+		t.Error("query for other group flagged a report")
+	}
+	binary.BigEndian.PutUint32(q[4:], 0)
+	m.handle(query)
+	if !m.reportAll {
+		t.Error("general query did not flag a report")
+	}
+}
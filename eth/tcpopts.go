@@ -0,0 +1,114 @@
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// TCP option kinds.
+const (
+	tcpOptEnd           = 0
+	tcpOptNop           = 1
+	tcpOptMSS           = 2
+	tcpOptWindowScale   = 3
+	tcpOptSACKPermitted = 4
+	tcpOptTimestamps    = 8
+	// maxTCPOptionsLen is the length of the largest options field, limited by the 4 bit data offset.
+	maxTCPOptionsLen = 40
+)
+
+var (
+	errShortTCP      = errors.New("eth: short TCP header")
+	errBadTCPOptions = errors.New("eth: malformed TCP options")
+)
+
+// TCPOptions are the TCP options negotiated on connection setup and the
+// timestamps option, see DecodeTCPOptions and AppendTCPOptions.
+type TCPOptions struct {
+	// MSS is the maximum segment size the sender can receive, zero if absent.
+	MSS uint16
+	// WindowScale is the shift count of the sender's window, valid if
+	// HasWindowScale is set.
+	WindowScale    uint8
+	HasWindowScale bool
+	// SACKPermitted is set if the sender supports selective acknowledgements.
+	SACKPermitted bool
+	// TSVal and TSEcr are the timestamp value and echo reply, valid if
+	// HasTimestamps is set.
+	TSVal         uint32
+	TSEcr         uint32
+	HasTimestamps bool
+}
+
+// DecodeTCPOptions decodes the options of the TCP segment tcp, which starts
+// with the TCP header. Header decoders usually assume the fixed 20 byte
+// header, i.e: DecodeTCPHeader of github.com/soypat/seqs/eth, skipping the
+// options which carry the MSS of SYN segments. Unknown options are ignored.
+func DecodeTCPOptions(tcp []byte) (opts TCPOptions, err error) {
+	if len(tcp) < tcpMinHeaderLen {
+		return opts, errShortTCP
+	}
+	hdrLen := int(tcp[12]>>4) * 4
+	if hdrLen < tcpMinHeaderLen || hdrLen > len(tcp) {
+		return opts, errShortTCP
+	}
+	b := tcp[tcpMinHeaderLen:hdrLen]
+	for len(b) > 0 {
+		kind := b[0]
+		if kind == tcpOptEnd {
+			break
+		} else if kind == tcpOptNop {
+			b = b[1:]
+			continue
+		} else if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return opts, errBadTCPOptions
+		}
+		data := b[2:b[1]]
+		switch {
+		case kind == tcpOptMSS && len(data) == 2:
+			opts.MSS = binary.BigEndian.Uint16(data)
+		case kind == tcpOptWindowScale && len(data) == 1:
+			opts.WindowScale = min(data[0], 14) // RFC 7323 limit.
+			opts.HasWindowScale = true
+		case kind == tcpOptSACKPermitted && len(data) == 0:
+			opts.SACKPermitted = true
+		case kind == tcpOptTimestamps && len(data) == 8:
+			opts.TSVal = binary.BigEndian.Uint32(data)
+			opts.TSEcr = binary.BigEndian.Uint32(data[4:])
+			opts.HasTimestamps = true
+		case kind == tcpOptMSS || kind == tcpOptWindowScale || kind == tcpOptSACKPermitted || kind == tcpOptTimestamps:
+			return opts, errBadTCPOptions // Known option with wrong length.
+		}
+		b = b[b[1]:]
+	}
+	return opts, nil
+}
+
+// AppendTCPOptions appends the encoded opts to dst padded to a multiple of 4
+// bytes, to be written after the 20 byte TCP header. The header's data offset
+// must be set to (20+n)/4 where n is the amount of bytes appended.
+func AppendTCPOptions(dst []byte, opts TCPOptions) []byte {
+	start := len(dst)
+	if opts.MSS != 0 {
+		dst = append(dst, tcpOptMSS, 4)
+		dst = binary.BigEndian.AppendUint16(dst, opts.MSS)
+	}
+	if opts.SACKPermitted {
+		dst = append(dst, tcpOptSACKPermitted, 2)
+	}
+	if opts.HasTimestamps {
+		if !opts.SACKPermitted {
+			dst = append(dst, tcpOptNop, tcpOptNop) // Align timestamps.
+		}
+		dst = append(dst, tcpOptTimestamps, 10)
+		dst = binary.BigEndian.AppendUint32(dst, opts.TSVal)
+		dst = binary.BigEndian.AppendUint32(dst, opts.TSEcr)
+	}
+	if opts.HasWindowScale {
+		dst = append(dst, tcpOptNop, tcpOptWindowScale, 3, opts.WindowScale)
+	}
+	for (len(dst)-start)%4 != 0 {
+		dst = append(dst, tcpOptEnd)
+	}
+	return dst
+}
@@ -0,0 +1,48 @@
+package eth
+
+import (
+	"testing"
+)
+
+func TestTCPOptions(t *testing.T) {
+	want := TCPOptions{
+		MSS:            1460,
+		WindowScale:    7,
+		HasWindowScale: true,
+		SACKPermitted:  true,
+		TSVal:          0x01020304,
+		TSEcr:          0x05060708,
+		HasTimestamps:  true,
+	}
+	seg := make([]byte, tcpMinHeaderLen, tcpMinHeaderLen+maxTCPOptionsLen)
+	seg = AppendTCPOptions(seg, want)
+	if len(seg) != tcpMinHeaderLen+20 {
+		t.Fatalf("got options length %d", len(seg)-tcpMinHeaderLen)
+	}
+	seg[12] = byte(len(seg)/4) << 4
+	seg = append(seg, "payload"...)
+	got, err := DecodeTCPOptions(seg)
+	if err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// MSS only, as sent by minimal stacks, is padded to 4 bytes.
+	seg = AppendTCPOptions(make([]byte, tcpMinHeaderLen), TCPOptions{MSS: 536})
+	seg[12] = byte(len(seg)/4) << 4
+	if got, err = DecodeTCPOptions(seg); err != nil || got != (TCPOptions{MSS: 536}) {
+		t.Errorf("got %+v %v", got, err)
+	}
+
+	// Options running past the header are rejected.
+	seg = append(make([]byte, tcpMinHeaderLen), tcpOptMSS, 8, 0, 0)
+	seg[12] = byte(len(seg)/4) << 4
+	if _, err = DecodeTCPOptions(seg); err != errBadTCPOptions {
+		t.Errorf("got %v for malformed options", err)
+	}
+	seg[12] = 0x60 // Data offset past the segment.
+	if _, err = DecodeTCPOptions(seg[:22]); err != errShortTCP {
+		t.Errorf("got %v for short segment", err)
+	}
+}
@@ -0,0 +1,50 @@
+package eth
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"github.com/soypat/cyw43439"
+)
+
+var errFrameSize = errors.New("eth: UDP broadcast payload exceeds MTU")
+
+// AppendUDPBroadcast appends a complete Ethernet frame carrying payload as a
+// UDP datagram to the limited broadcast address 255.255.255.255 and returns
+// the extended buffer. The result can be sent directly with Device.SendEth.
+// Useful for discovery protocols that announce a device on the local network.
+func AppendUDPBroadcast(dst []byte, srcMAC [6]byte, srcIP netip.Addr, srcPort, dstPort uint16, payload []byte) ([]byte, error) {
+	const hdrLen = ethHeaderLen + ipv4MinHeaderLen + udpHeaderLen
+	if !srcIP.Is4() {
+		return dst, errNotIPv4
+	} else if hdrLen+len(payload) > cyw43439.MaxFrameSize {
+		return dst, errFrameSize
+	}
+	off := len(dst)
+	dst = append(dst, make([]byte, hdrLen)...)
+	b := dst[off:]
+	copy(b[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(b[6:12], srcMAC[:])
+	binary.BigEndian.PutUint16(b[12:], cyw43439.EtherTypeIPv4)
+	ip := b[ethHeaderLen : ethHeaderLen+ipv4MinHeaderLen]
+	ip[0] = 0x40 | ipv4MinHeaderLen/4
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4MinHeaderLen+udpHeaderLen+len(payload)))
+	ip[8], ip[9] = 64, ProtoUDP
+	src := srcIP.As4()
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], []byte{255, 255, 255, 255})
+	binary.BigEndian.PutUint16(ip[ipv4ChecksumOff:], Checksum(ip, 0))
+	udp := b[ethHeaderLen+ipv4MinHeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(payload)))
+	dst = append(dst, payload...)
+	l4 := dst[off+ethHeaderLen+ipv4MinHeaderLen:]
+	csum := Checksum(l4, pseudoHeader(ip, ProtoUDP, l4))
+	if csum == 0 {
+		csum = 0xffff // Zero means no checksum in UDP.
+	}
+	binary.BigEndian.PutUint16(l4[udpChecksumOff:], csum)
+	return dst, nil
+}
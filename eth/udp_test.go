@@ -0,0 +1,50 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/soypat/cyw43439"
+)
+
+func TestAppendUDPBroadcast(t *testing.T) {
+	mac := [6]byte{0x28, 0xcd, 0xc1, 1, 2, 3}
+	ip := netip.MustParseAddr("192.168.1.2")
+	payload := []byte("hello, discovery")
+	prefix := []byte{0xaa, 0xbb}
+	frame, err := AppendUDPBroadcast(prefix, mac, ip, 5000, 6000, payload)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(frame[:2], prefix) {
+		t.Fatal("prefix overwritten")
+	}
+	frame = frame[2:]
+	if err := VerifyChecksums(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) || !bytes.Equal(frame[6:12], mac[:]) {
+		t.Errorf("got Ethernet addresses % x", frame[:12])
+	}
+	ipHdr, l4, proto, err := splitIPv4(frame)
+	if err != nil || ipHdr == nil {
+		t.Fatal("not an IPv4 frame", err)
+	}
+	if proto != ProtoUDP || [4]byte(ipHdr[12:16]) != ip.As4() || [4]byte(ipHdr[16:20]) != [4]byte{255, 255, 255, 255} {
+		t.Errorf("got IPv4 header % x", ipHdr)
+	}
+	if sp, dp := binary.BigEndian.Uint16(l4[0:]), binary.BigEndian.Uint16(l4[2:]); sp != 5000 || dp != 6000 {
+		t.Errorf("got ports %d->%d", sp, dp)
+	}
+	if n := binary.BigEndian.Uint16(l4[4:]); int(n) != udpHeaderLen+len(payload) || !bytes.Equal(l4[udpHeaderLen:], payload) {
+		t.Errorf("got UDP length %d and payload %q", n, l4[udpHeaderLen:])
+	}
+
+	if _, err := AppendUDPBroadcast(nil, mac, netip.MustParseAddr("::1"), 1, 1, payload); err == nil {
+		t.Error("IPv6 source accepted")
+	}
+	if _, err := AppendUDPBroadcast(nil, mac, ip, 1, 1, make([]byte, cyw43439.MaxFrameSize)); err == nil {
+		t.Error("oversized payload accepted")
+	}
+}
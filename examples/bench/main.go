@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"machine"
+	"time"
+
+	"log/slog"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/eth"
+	"github.com/soypat/cyw43439/examples/common"
+)
+
+// On-device benchmarks. Set mode to choose the benchmark:
+//   - benchUDP: sends UDP broadcast packets to port 9000 for the duration.
+//     Run `go run ./cmd/cywbench` on a host in the same network to measure
+//     throughput and loss. Setup Wifi Password and SSID in common/secrets.go.
+//   - benchHCI: puts the Bluetooth controller in local loopback mode and
+//     measures round trip latency and throughput of ACL packets over the bus.
+const (
+	mode     = benchUDP
+	duration = 10 * time.Second
+	udpPort  = 9000
+	// udpPayload is the size of the UDP payload sent.
+	udpPayload = 1400
+	// aclPayload is the size of the ACL data sent in loopback.
+	aclPayload = 200
+)
+
+const (
+	benchUDP = iota
+	benchHCI
+)
+
+func main() {
+	time.Sleep(2 * time.Second)
+	println("starting program")
+	logger := slog.New(slog.NewTextHandler(machine.Serial, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	var dev *cyw43439.Device
+	var err error
+	switch mode {
+	case benchUDP:
+		dev, err = benchmarkUDP(logger)
+	case benchHCI:
+		dev, err = benchmarkHCI(logger)
+	}
+	if err != nil {
+		panic(err)
+	}
+	stats := dev.Stats()
+	logger.Info("driver stats",
+		slog.Uint64("txframes", uint64(stats.TxFrames)),
+		slog.Uint64("txbytes", stats.TxBytes),
+		slog.Uint64("txerrors", uint64(stats.TxErrors)),
+		slog.Uint64("rxframes", uint64(stats.RxFrames)),
+		slog.Uint64("rxbytes", stats.RxBytes),
+		slog.Uint64("rxdropped", uint64(stats.RxDropped)),
+		slog.Uint64("hcitx", uint64(stats.HCITxPackets)),
+		slog.Uint64("hcirx", uint64(stats.HCIRxPackets)),
+	)
+	for {
+		time.Sleep(time.Second)
+	}
+}
+
+func benchmarkUDP(logger *slog.Logger) (*cyw43439.Device, error) {
+	_, stack, dev, err := common.SetupWithDHCP(common.SetupConfig{
+		Hostname: "bench-pico",
+		Logger:   logger,
+		UDPPorts: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dev.SetPerformanceProfile(cyw43439.ProfileThroughput)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := dev.HardwareAddr6()
+	if err != nil {
+		return nil, err
+	}
+	ip := stack.Addr()
+	var payload [udpPayload]byte
+	copy(payload[:], "CYWB")
+	frame := make([]byte, 0, cyw43439.MaxFrameSize)
+	dev.ResetStats()
+	start := time.Now()
+	var seq uint32
+	for time.Since(start) < duration {
+		binary.BigEndian.PutUint32(payload[4:], seq)
+		binary.BigEndian.PutUint32(payload[8:], uint32(time.Since(start).Milliseconds()))
+		frame, err = eth.AppendUDPBroadcast(frame[:0], mac, ip, udpPort, udpPort, payload[:])
+		if err != nil {
+			return dev, err
+		}
+		err = dev.SendEth(frame)
+		if err != nil {
+			logger.Error("send", slog.String("err", err.Error()))
+			continue
+		}
+		seq++
+	}
+	elapsed := time.Since(start)
+	logger.Info("udp blast done", slog.Uint64("packets", uint64(seq)),
+		slog.Float64("mbps", mbps(int(seq)*udpPayload, elapsed)), slog.Duration("elapsed", elapsed))
+	return dev, nil
+}
+
+func benchmarkHCI(logger *slog.Logger) (*cyw43439.Device, error) {
+	dev := cyw43439.NewPicoWDevice()
+	cfg := cyw43439.DefaultBluetoothConfig()
+	cfg.HCIReadTimeout = time.Second
+	err := dev.Init(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var buf [512]byte
+	// HCI Reset then Write Loopback Mode (local loopback).
+	_, err = hciCommand(dev, buf[:], 0x0c03)
+	if err != nil {
+		return dev, err
+	}
+	handle, err := hciCommand(dev, buf[:], 0x1802, 0x01)
+	if err != nil {
+		return dev, err
+	}
+	logger.Info("hci loopback enabled", slog.Int("handle", int(handle)))
+
+	pkt := make([]byte, 5+aclPayload)
+	pkt[0] = 0x02 // ACL.
+	binary.LittleEndian.PutUint16(pkt[1:], handle|0x2000)
+	binary.LittleEndian.PutUint16(pkt[3:], aclPayload)
+	dev.ResetStats()
+	var n int
+	var worst, total time.Duration
+	start := time.Now()
+	for time.Since(start) < duration {
+		t0 := time.Now()
+		_, err = dev.WriteHCI(pkt)
+		if err != nil {
+			return dev, err
+		}
+		// Skip events such as Number Of Completed Packets until the ACL packet comes back.
+		for {
+			_, err = dev.ReadHCI(buf[:])
+			if err != nil {
+				return dev, err
+			} else if buf[0] == 0x02 {
+				break
+			}
+		}
+		rtt := time.Since(t0)
+		total += rtt
+		worst = max(worst, rtt)
+		n++
+	}
+	elapsed := time.Since(start)
+	logger.Info("hci loopback done", slog.Int("packets", n),
+		slog.Duration("avgrtt", total/time.Duration(max(n, 1))), slog.Duration("maxrtt", worst),
+		slog.Float64("mbps", mbps(2*n*aclPayload, elapsed)))
+	return dev, nil
+}
+
+// hciCommand sends an HCI command and waits for its Command Complete event.
+// It returns the connection handle of the last Connection Complete event seen, if any.
+func hciCommand(dev *cyw43439.Device, buf []byte, opcode uint16, params ...byte) (handle uint16, err error) {
+	cmd := append([]byte{0x01, byte(opcode), byte(opcode >> 8), byte(len(params))}, params...)
+	_, err = dev.WriteHCI(cmd)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		n, err := dev.ReadHCI(buf)
+		if err != nil {
+			return 0, err
+		} else if n < 3 || buf[0] != 0x04 {
+			continue
+		}
+		switch buf[1] {
+		case 0x03: // Connection Complete.
+			handle = binary.LittleEndian.Uint16(buf[4:])
+		case 0x0e: // Command Complete.
+			if binary.LittleEndian.Uint16(buf[4:]) == opcode {
+				return handle, nil
+			}
+		}
+	}
+}
+
+func mbps(bytes int, elapsed time.Duration) float64 {
+	return float64(8*bytes) / elapsed.Seconds() / 1e6
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"machine"
+	"time"
+
+	"log/slog"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/bleprov"
+)
+
+// Provision WiFi credentials over BLE: connect with a BLE app (i.e: nRF Connect),
+// write SSID and passphrase characteristics, then write 0x01 to the control characteristic.
+
+func main() {
+	time.Sleep(2 * time.Second)
+	println("starting program")
+	logger := slog.New(slog.NewTextHandler(machine.Serial, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	dev := cyw43439.NewPicoWDevice()
+	err := dev.Init(cyw43439.DefaultBluetoothConfig())
+	if err != nil {
+		panic("init failed:" + err.Error())
+	}
+	prov, err := bleprov.New(dev, bleprov.Config{
+		LocalName: "pico-prov",
+		Logger:    logger,
+	})
+	if err != nil {
+		panic(err)
+	}
+	creds, err := prov.Run(context.Background())
+	if err != nil {
+		panic("provisioning failed:" + err.Error())
+	}
+	logger.Info("provisioned", slog.String("ssid", creds.SSID), slog.Bool("linkup", dev.IsLinkUp()))
+	for {
+		time.Sleep(time.Second)
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/soypat/seqs/stacks"
 )
 
-const mtu = cyw43439.MTU
+const mtu = cyw43439.MaxFrameSize
 
 type SetupConfig struct {
 	// DHCP requested hostname.
@@ -26,6 +26,14 @@ type SetupConfig struct {
 	UDPPorts uint16
 	// Number of TCP ports to open for the stack.
 	TCPPorts uint16
+	// Join configures the network join. If Join.StaticIP is valid DHCP is
+	// skipped entirely and the returned DHCP client is nil: Join.Gateway is
+	// then the router to resolve with ResolveHardwareAddr and Join.DNS the
+	// server used by the resolver returned by NewStaticResolver.
+	Join cyw43439.JoinOptions
+	// Firmware, if set, provides the radio firmware in place of the embedded
+	// firmware, see FetchFirmware.
+	Firmware cyw43439.FirmwareProvider
 }
 
 func SetupWithDHCP(cfg SetupConfig) (*stacks.DHCPClient, *stacks.PortStack, *cyw43439.Device, error) {
@@ -47,6 +55,7 @@ func SetupWithDHCP(cfg SetupConfig) (*stacks.DHCPClient, *stacks.PortStack, *cyw
 
 	dev := cyw43439.NewPicoWDevice()
 	wificfg := cyw43439.DefaultWifiConfig()
+	wificfg.FirmwareProvider = cfg.Firmware
 	// cfg.Logger = logger // Uncomment to see in depth info on wifi device functioning.
 	logger.Info("initializing pico W device...")
 	devInitTime := time.Now()
@@ -62,7 +71,7 @@ func SetupWithDHCP(cfg SetupConfig) (*stacks.DHCPClient, *stacks.PortStack, *cyw
 	}
 	for {
 		// Set ssid/pass in secrets.go
-		err = dev.JoinWPA2(ssid, pass)
+		err = dev.JoinWithOptions(ssid, pass, cfg.Join)
 		if err == nil {
 			break
 		}
@@ -85,6 +94,14 @@ func SetupWithDHCP(cfg SetupConfig) (*stacks.DHCPClient, *stacks.PortStack, *cyw
 	// Begin asynchronous packet handling.
 	go nicLoop(dev, stack)
 
+	if cfg.Join.StaticIP.IsValid() {
+		// ARP offload already programmed by JoinWithOptions.
+		logger.Info("using static IP, skipping DHCP", slog.String("ip", cfg.Join.StaticIP.String()),
+			slog.String("gateway", cfg.Join.Gateway.String()), slog.String("dns", cfg.Join.DNS.String()))
+		stack.SetAddr(cfg.Join.StaticIP)
+		return nil, stack, dev, nil
+	}
+
 	// Perform DHCP request.
 	dhcpClient := stacks.NewDHCPClient(stack, dhcp.DefaultClientPort)
 	err = dhcpClient.BeginRequest(stacks.DHCPRequestConfig{
@@ -130,6 +147,10 @@ func SetupWithDHCP(cfg SetupConfig) (*stacks.DHCPClient, *stacks.PortStack, *cyw
 	)
 
 	stack.SetAddr(ip) // It's important to set the IP address after DHCP completes.
+	err = dev.SetHostIP(ip)
+	if err != nil {
+		logger.Error("ARP offload", slog.String("err", err.Error()))
+	}
 	return dhcpClient, stack, dev, nil
 }
 
@@ -169,16 +190,31 @@ type Resolver struct {
 }
 
 func NewResolver(stack *stacks.PortStack, dhcp *stacks.DHCPClient) (*Resolver, error) {
-	dnsc := stacks.NewDNSClient(stack, dns.ClientPort)
+	if dhcp == nil {
+		return nil, errors.New("no DHCP client, use NewStaticResolver with a static IP")
+	}
 	dnsaddrs := dhcp.DNSServers()
-	if len(dnsaddrs) > 0 && !dnsaddrs[0].IsValid() {
+	if len(dnsaddrs) == 0 || !dnsaddrs[0].IsValid() {
 		return nil, errors.New("dns addr obtained via DHCP not valid")
 	}
+	r, err := NewStaticResolver(stack, dnsaddrs[0])
+	if err != nil {
+		return nil, err
+	}
+	r.dhcp = dhcp
+	return r, nil
+}
+
+// NewStaticResolver returns a resolver which queries the DNS server dnsaddr,
+// i.e: SetupConfig.Join.DNS when using a static IP.
+func NewStaticResolver(stack *stacks.PortStack, dnsaddr netip.Addr) (*Resolver, error) {
+	if !dnsaddr.IsValid() {
+		return nil, errors.New("invalid dns addr")
+	}
 	return &Resolver{
 		stack:   stack,
-		dhcp:    dhcp,
-		dns:     dnsc,
-		dnsaddr: dnsaddrs[0],
+		dns:     stacks.NewDNSClient(stack, dns.ClientPort),
+		dnsaddr: dnsaddr,
 	}, nil
 }
 
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/httpx"
+	"github.com/soypat/seqs/stacks"
+)
+
+var (
+	errHTTPStatus        = errors.New("firmware download: HTTP status not 200 OK")
+	errHTTPContentLength = errors.New("firmware download: missing Content-Length")
+)
+
+const firmwareTimeout = 60 * time.Second
+
+// FetchFirmware downloads a combined firmware image, see cmd/cywfwimage, from
+// an HTTP server at path and stores it with p to be used on the next Init.
+// Only plain HTTP is supported, so image integrity relies on the network: the
+// image structure is validated by cyw43439.UpdateFirmware before it is used.
+// stack must have a free TCP port.
+func FetchFirmware(stack *stacks.PortStack, p cyw43439.FirmwareProvider, server netip.AddrPort, path string) error {
+	hwaddr, err := ResolveHardwareAddr(stack, server.Addr())
+	if err != nil {
+		return err
+	}
+	conn, err := stacks.NewTCPConn(stack, stacks.TCPConnConfig{
+		TxBufSize: 512,
+		RxBufSize: 2030,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	now := time.Now()
+	conn.SetDeadline(now.Add(firmwareTimeout))
+	localPort := uint16(now.UnixNano()%(65535-1024)) + 1024
+	err = conn.OpenDialTCP(localPort, hwaddr, server, seqs.Value(now.UnixNano()))
+	if err != nil {
+		return err
+	}
+	for conn.State() != seqs.StateEstablished {
+		if time.Since(now) > 5*time.Second {
+			return errors.New("firmware download: TCP establish timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var req httpx.RequestHeader
+	req.SetRequestURI(path)
+	req.SetMethod("GET")
+	req.SetHost(server.Addr().String())
+	_, err = conn.Write(req.Header())
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(conn, 512)
+	size, err := readResponseHeader(r)
+	if err != nil {
+		return err
+	}
+	return cyw43439.UpdateFirmware(p, io.LimitReader(r, int64(size)), size)
+}
+
+// readResponseHeader reads an HTTP response header returning the Content-Length
+// of a 200 OK response.
+func readResponseHeader(r *bufio.Reader) (contentLength int, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return 0, err
+	} else if len(line) < 12 || !bytes.HasPrefix(line, []byte("HTTP/1.")) || string(line[9:12]) != "200" {
+		return 0, errHTTPStatus
+	}
+	contentLength = -1
+	for {
+		line, err = r.ReadSlice('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			break // End of header.
+		}
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(key, []byte("Content-Length")) {
+			contentLength, err = strconv.Atoi(string(bytes.TrimSpace(value)))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if contentLength < 0 {
+		return 0, errHTTPContentLength
+	}
+	return contentLength, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"machine"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/soypat/cyw43439/examples/common"
+)
+
+// Set this address to an HTTP server serving a firmware image created with cmd/cywfwimage, i.e:
+//
+//	go run ./cmd/cywfwimage -wlan firmware/43439A0.bin -clm firmware/43439A0_clm.bin -o fw.img && python3 -m http.server
+const serverAddrStr = "192.168.0.44:8000"
+const imagePath = "/fw.img"
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(machine.Serial, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	time.Sleep(2 * time.Second)
+	var fw flashProvider
+	_, stack, _, err := common.SetupWithDHCP(common.SetupConfig{
+		Hostname: "fwupdate",
+		Logger:   logger,
+		TCPPorts: 1,
+		Firmware: &fw, // Falls back to embedded firmware if flash holds no image.
+	})
+	if err != nil {
+		panic("setup DHCP:" + err.Error())
+	}
+	server, err := netip.ParseAddrPort(serverAddrStr)
+	if err != nil {
+		panic(err)
+	}
+	logger.Info("downloading firmware", slog.String("server", serverAddrStr))
+	err = common.FetchFirmware(stack, &fw, server, imagePath)
+	if err != nil {
+		panic("firmware update:" + err.Error())
+	}
+	logger.Info("firmware stored in flash, used from next boot")
+	for {
+		time.Sleep(time.Hour)
+	}
+}
+
+// flashProvider stores a firmware image in the flash data area, after the
+// program. The first erase block holds a header with the image length, which is
+// erased while a new image is written so that an interrupted update falls back
+// to the embedded firmware. The image is read in place through the flash memory map.
+type flashProvider struct{}
+
+const flashMagic = "CYWI"
+
+var errNoImage = errors.New("no firmware image in flash")
+
+func (flashProvider) FirmwareImage() (string, error) {
+	base := machine.FlashDataStart()
+	hdr := unsafe.Slice((*byte)(unsafe.Pointer(base)), 8)
+	size := binary.LittleEndian.Uint32(hdr[4:])
+	if string(hdr[:4]) != flashMagic || int64(size) > machine.Flash.Size()-machine.Flash.EraseBlockSize() {
+		return "", errNoImage
+	}
+	return unsafe.String((*byte)(unsafe.Pointer(base+uintptr(machine.Flash.EraseBlockSize()))), size), nil
+}
+
+func (flashProvider) StoreImage(r io.Reader, size int) error {
+	blockSize := machine.Flash.EraseBlockSize()
+	if int64(size) > machine.Flash.Size()-blockSize {
+		return errors.New("firmware image larger than flash data area")
+	}
+	blocks := 1 + (int64(size)+blockSize-1)/blockSize
+	err := machine.Flash.EraseBlocks(0, blocks)
+	if err != nil {
+		return err
+	}
+	var buf [4096]byte
+	off := blockSize
+	for remaining := size; remaining > 0; {
+		n, err := io.ReadFull(r, buf[:min(remaining, len(buf))])
+		if err != nil {
+			return err
+		}
+		_, err = machine.Flash.WriteAt(buf[:n], off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+		remaining -= n
+	}
+	var hdr [8]byte
+	copy(hdr[:4], flashMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(size))
+	_, err = machine.Flash.WriteAt(hdr[:], 0)
+	return err
+}
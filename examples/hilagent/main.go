@@ -0,0 +1,25 @@
+package main
+
+import (
+	"machine"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/hil"
+)
+
+// Hardware-in-the-loop test agent. Flash this program and run the
+// host side tests in the hil package, see its documentation.
+
+func main() {
+	time.Sleep(2 * time.Second)
+	dev := cyw43439.NewPicoWDevice()
+	cfg := cyw43439.DefaultBluetoothConfig()
+	cfg.HCIReadTimeout = 100 * time.Millisecond
+	err := dev.Init(cfg)
+	if err != nil {
+		panic("init failed:" + err.Error())
+	}
+	err = hil.Serve(machine.Serial, dev)
+	panic("agent stopped:" + err.Error())
+}
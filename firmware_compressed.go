@@ -0,0 +1,24 @@
+//go:build cy43compressed
+
+package cyw43439
+
+import _ "embed"
+
+// Compressed firmware is generated from the raw firmware files, see CompressFirmware.
+//go:generate go run ./cmd/cywfwimage -in firmware/43439A0.bin -compress -o firmware/43439A0.bin.lzss
+//go:generate go run ./cmd/cywfwimage -in firmware/wifibtfw.bin -len 231077 -compress -o firmware/wifibtfw.bin.lzss
+//go:generate go run ./cmd/cywfwimage -in firmware/wifibtfw.bin -off 231424 -len 984 -o firmware/wifibtfw_clm.bin
+
+var (
+	//go:embed firmware/43439A0.bin.lzss
+	wifiFW2 string
+	//go:embed firmware/wifibtfw.bin.lzss
+	wifibtFWCompressed string
+	//go:embed firmware/wifibtfw_clm.bin
+	wifibtCLM string
+)
+
+// wifibtFirmware returns the WLAN firmware supporting Bluetooth coexistence and its CLM.
+func wifibtFirmware() (fw, clm string) {
+	return wifibtFWCompressed, wifibtCLM
+}
@@ -8,14 +8,9 @@ import _ "embed"
 var (
 	//go:embed firmware/43439A0_clm.bin
 	clmFW string
-	//go:embed firmware/43439A0.bin
-	wifiFW2 string
 	// Of raw size 225240.
 	//go:embed firmware/wififw.bin
 	wifiFW string
-	// Of raw size 232408 bytes
-	//go:embed firmware/wifibtfw.bin
-	wifibtFW string
 	// Of raw size 6164 bytes.
 	//go:embed firmware/btfw.bin
 	btFW string
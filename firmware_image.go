@@ -0,0 +1,232 @@
+package cyw43439
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+var (
+	errImageMagic   = errors.New("firmware image: bad magic")
+	errImageVersion = errors.New("firmware image: unsupported version")
+	errImageBounds  = errors.New("firmware image: section out of bounds")
+	errImageNoWLAN  = errors.New("firmware image: missing WLAN firmware section")
+	errImageDup     = errors.New("firmware image: duplicate section")
+	errImageSize    = errors.New("firmware image: size does not match directory")
+)
+
+// Combined firmware image layout, all integers little endian:
+//
+//	[0:4]  magic "CYWF"
+//	[4:6]  version, currently 1
+//	[6:8]  section count N
+//	[8:8+12*N] section directory, each entry is:
+//	       [0:4] section kind, see FirmwareSection
+//	       [4:8] offset of section data from start of image
+//	       [8:12] length of section data
+//	[8+12*N:] section data, each section aligned to 4 bytes.
+const (
+	imageMagic       = "CYWF"
+	imageVersion     = 1
+	imageHeaderLen   = 8
+	imageDirEntryLen = 12
+)
+
+// FirmwareSection identifies a section of a combined firmware image.
+type FirmwareSection uint32
+
+const (
+	SectionWLAN      FirmwareSection = 1 // WLAN firmware, Config.Firmware.
+	SectionCLM       FirmwareSection = 2 // Country locale matrix, Config.CLM.
+	SectionBluetooth FirmwareSection = 3 // Bluetooth controller firmware, Config.BluetoothFirmware.
+	SectionNVRAM     FirmwareSection = 4 // Board NVRAM, Config.NVRAM.
+)
+
+// maxImageSections bounds the section directory read by UpdateFirmware.
+const maxImageSections = 16
+
+// FirmwareProvider stores a combined firmware image outside the program
+// binary, i.e: in a flash partition, so that the radio firmware can be updated
+// in the field with UpdateFirmware. Set Config.FirmwareProvider to use the
+// stored image on Init.
+type FirmwareProvider interface {
+	// FirmwareImage returns the stored image. The returned string is referenced
+	// by the Device after Init so it must remain valid, as is the case for
+	// memory mapped flash. An error is returned if no image is stored.
+	FirmwareImage() (string, error)
+	// StoreImage replaces the stored image with size bytes read from r.
+	// Implementations should keep the current image until the new one is
+	// completely written, i.e: by alternating between two partitions.
+	StoreImage(r io.Reader, size int) error
+}
+
+// ParseFirmwareImage parses a combined firmware image holding the WLAN
+// firmware, CLM and optionally the Bluetooth firmware and returns a Config
+// with the firmware fields referencing image, so no memory is copied.
+// Unknown sections are ignored so that newer images remain loadable.
+// Images are created with AppendFirmwareImage or the cywfwimage tool.
+func ParseFirmwareImage(image string) (cfg Config, err error) {
+	if len(image) < imageHeaderLen || image[:4] != imageMagic {
+		return cfg, errImageMagic
+	} else if leUint32(image[4:8])&0xffff != imageVersion {
+		return cfg, errImageVersion
+	}
+	n := int(leUint32(image[4:8]) >> 16)
+	if imageHeaderLen+n*imageDirEntryLen > len(image) {
+		return cfg, errImageBounds
+	}
+	for i := 0; i < n; i++ {
+		entry := image[imageHeaderLen+i*imageDirEntryLen:]
+		kind := FirmwareSection(leUint32(entry[0:4]))
+		off, length := leUint32(entry[4:8]), leUint32(entry[8:12])
+		if uint64(off)+uint64(length) > uint64(len(image)) {
+			return cfg, errImageBounds
+		}
+		data := image[off : off+length]
+		var dst *string
+		switch kind {
+		case SectionWLAN:
+			dst = &cfg.Firmware
+		case SectionCLM:
+			dst = &cfg.CLM
+		case SectionBluetooth:
+			dst = &cfg.BluetoothFirmware
+		case SectionNVRAM:
+			dst = &cfg.NVRAM
+		default:
+			continue
+		}
+		if *dst != "" {
+			return cfg, errImageDup
+		}
+		*dst = data
+	}
+	if cfg.Firmware == "" {
+		return cfg, errImageNoWLAN
+	}
+	return cfg, nil
+}
+
+// AppendFirmwareImage appends a combined firmware image with the non-empty
+// firmware fields of cfg to dst, see ParseFirmwareImage.
+func AppendFirmwareImage(dst []byte, cfg Config) []byte {
+	sections := [...]struct {
+		kind FirmwareSection
+		data string
+	}{
+		{SectionWLAN, cfg.Firmware},
+		{SectionCLM, cfg.CLM},
+		{SectionBluetooth, cfg.BluetoothFirmware},
+		{SectionNVRAM, cfg.NVRAM},
+	}
+	n := 0
+	for _, s := range sections {
+		if s.data != "" {
+			n++
+		}
+	}
+	start := len(dst)
+	dst = append(dst, imageMagic...)
+	dst = binary.LittleEndian.AppendUint16(dst, imageVersion)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(n))
+	off := uint32(imageHeaderLen + n*imageDirEntryLen)
+	for _, s := range sections {
+		if s.data == "" {
+			continue
+		}
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(s.kind))
+		dst = binary.LittleEndian.AppendUint32(dst, off)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(s.data)))
+		off = align(off+uint32(len(s.data)), 4)
+	}
+	for _, s := range sections {
+		if s.data == "" {
+			continue
+		}
+		dst = append(dst, s.data...)
+		for (len(dst)-start)%4 != 0 {
+			dst = append(dst, 0)
+		}
+	}
+	return dst
+}
+
+// UpdateFirmware stores the size byte combined firmware image read from r,
+// i.e: an HTTP response body, with p. The image header and section directory
+// are validated before any data is passed to p and the stored image is parsed
+// once written. The new image is used on the next Init.
+func UpdateFirmware(p FirmwareProvider, r io.Reader, size int) error {
+	var hdr [imageHeaderLen + maxImageSections*imageDirEntryLen]byte
+	_, err := io.ReadFull(r, hdr[:imageHeaderLen])
+	if err != nil {
+		return err
+	} else if string(hdr[:4]) != imageMagic {
+		return errImageMagic
+	} else if binary.LittleEndian.Uint16(hdr[4:]) != imageVersion {
+		return errImageVersion
+	}
+	n := int(binary.LittleEndian.Uint16(hdr[6:]))
+	dirEnd := imageHeaderLen + n*imageDirEntryLen
+	if n > maxImageSections || dirEnd > size {
+		return errImageBounds
+	}
+	_, err = io.ReadFull(r, hdr[imageHeaderLen:dirEnd])
+	if err != nil {
+		return err
+	}
+	// AppendFirmwareImage places sections back to back, the last one ends the image.
+	end := uint64(dirEnd)
+	for i := 0; i < n; i++ {
+		entry := hdr[imageHeaderLen+i*imageDirEntryLen:]
+		off, length := binary.LittleEndian.Uint32(entry[4:]), binary.LittleEndian.Uint32(entry[8:])
+		end = max(end, uint64(off)+uint64(length))
+	}
+	if end > uint64(size) || align(end, 4) < uint64(size) {
+		return errImageSize
+	}
+	err = p.StoreImage(io.MultiReader(bytes.NewReader(hdr[:dirEnd]), r), size)
+	if err != nil {
+		return err
+	}
+	image, err := p.FirmwareImage()
+	if err != nil {
+		return err
+	}
+	_, err = ParseFirmwareImage(image)
+	return err
+}
+
+// apply_firmware_image returns cfg with its firmware replaced by the sections
+// of the image held by cfg.FirmwareProvider, or cfg unchanged if there is no valid image.
+func (d *Device) apply_firmware_image(cfg Config) Config {
+	image, err := cfg.FirmwareProvider.FirmwareImage()
+	var img Config
+	if err == nil {
+		img, err = ParseFirmwareImage(image)
+	}
+	if err != nil {
+		d.warn("Init:using embedded firmware", slog.String("err", err.Error()))
+		return cfg
+	}
+	d.info("Init:using provided firmware", slog.Int("len", len(image)))
+	cfg.Firmware = img.Firmware
+	if img.CLM != "" {
+		cfg.CLM = img.CLM
+	}
+	if img.NVRAM != "" {
+		cfg.NVRAM = img.NVRAM
+	}
+	if cfg.BluetoothFirmware != "" && img.BluetoothFirmware != "" {
+		cfg.BluetoothFirmware = img.BluetoothFirmware // Bluetooth is only brought up if requested.
+	}
+	return cfg
+}
+
+// leUint32 decodes a little endian uint32 from a string without allocating.
+func leUint32(s string) uint32 {
+	_ = s[3]
+	return uint32(s[0]) | uint32(s[1])<<8 | uint32(s[2])<<16 | uint32(s[3])<<24
+}
@@ -0,0 +1,20 @@
+//go:build !cy43compressed
+
+package cyw43439
+
+import _ "embed"
+
+var (
+	//go:embed firmware/43439A0.bin
+	wifiFW2 string
+	// Of raw size 232408 bytes
+	//go:embed firmware/wifibtfw.bin
+	wifibtFW string
+)
+
+// wifibtFirmware returns the WLAN firmware supporting Bluetooth coexistence and its CLM,
+// which follows the firmware in the same file.
+func wifibtFirmware() (fw, clm string) {
+	const clmOffset = (wifibtFWLen + 511) &^ 511
+	return wifibtFW[:wifibtFWLen], wifibtFW[clmOffset : clmOffset+clmLen]
+}
@@ -0,0 +1,177 @@
+package cyw43439
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// Flight recorder ring sizes.
+const (
+	flightEvents = 16
+	flightNotes  = 32
+)
+
+// Shared memory flags set by the firmware on failure.
+const (
+	sharedFlagAssert = 0x0200
+	sharedFlagTrap   = 0x0400
+)
+
+// FailureKind is the kind of failure captured by the flight recorder, see LastFailure.
+type FailureKind uint8
+
+const (
+	// FailureIoctlTimeout is a firmware that stopped responding to ioctls
+	// or returning bus credit.
+	FailureIoctlTimeout FailureKind = iota + 1
+	// FailureFirmwareTrap is an ioctl timeout caused by a firmware trap or assert.
+	FailureFirmwareTrap
+	// FailureHCIDesync is an HCI ring buffer pointer out of range, see ResetHCI.
+	FailureHCIDesync
+	// FailureRecvHandler is a receive handler error halting reception, see RecvErrorHalt.
+	FailureRecvHandler
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailureIoctlTimeout:
+		return "ioctl timeout"
+	case FailureFirmwareTrap:
+		return "firmware trap"
+	case FailureHCIDesync:
+		return "HCI desync"
+	case FailureRecvHandler:
+		return "receive handler"
+	}
+	return "unknown"
+}
+
+// FailureEvent is an async event received before a failure.
+type FailureEvent struct {
+	At     time.Time
+	Event  whd.AsyncEventType
+	Status uint32
+	Reason uint32
+}
+
+// Failure is a diagnostic snapshot of the driver and chip taken on failure,
+// see LastFailure.
+type Failure struct {
+	Kind FailureKind
+	// Err is the error the failing operation returned.
+	Err error
+	At  time.Time
+	// Events are the last async events received, oldest first.
+	Events []FailureEvent
+	// Trace are the last driver log messages, regardless of the logger's
+	// level and without attributes, oldest first.
+	Trace []string
+	// Status is the bus status register and BusTest the bus test register,
+	// which reads 0xFEEDBEAD while the bus is in sync.
+	Status  Status
+	BusTest uint32
+	// FirmwareFlags, TrapAddr and AssertLine are read from the firmware's
+	// shared memory: a set trap or assert flag means the firmware crashed.
+	FirmwareFlags uint32
+	TrapAddr      uint32
+	AssertLine    uint32
+	// Stats are the driver counters at the time of failure.
+	Stats Stats
+}
+
+// String returns a multi line description of the failure suited to be
+// persisted or sent for analysis.
+func (f *Failure) String() string {
+	s := "failure: " + f.Kind.String()
+	if f.Err != nil {
+		s += ": " + f.Err.Error()
+	}
+	s += "\nat: " + f.At.String() +
+		"\nstatus: " + f.Status.String() +
+		"\nbustest: 0x" + hex32(f.BusTest) +
+		"\nfwflags: 0x" + hex32(f.FirmwareFlags) +
+		" trap: 0x" + hex32(f.TrapAddr) +
+		" assertline: " + strconv.FormatUint(uint64(f.AssertLine), 10)
+	for _, ev := range f.Events {
+		s += "\nevent: " + f.At.Sub(ev.At).Round(time.Millisecond).String() + " before " + ev.Event.String() +
+			" status=" + strconv.FormatUint(uint64(ev.Status), 10) +
+			" reason=" + strconv.FormatUint(uint64(ev.Reason), 10)
+	}
+	for _, msg := range f.Trace {
+		s += "\ntrace: " + msg
+	}
+	return s
+}
+
+// flightRecorder keeps the recent history of the driver in fixed size rings
+// so a failure can be diagnosed after the fact without logging enabled.
+type flightRecorder struct {
+	events    [flightEvents]FailureEvent
+	nevents   int
+	notes     [flightNotes]string
+	nnotes    int
+	failure   Failure
+	failed    bool
+	capturing bool
+}
+
+// note records a log message. Only the message is kept, as it is usually a
+// constant string, so recording does not allocate.
+func (fr *flightRecorder) note(msg string) {
+	fr.notes[fr.nnotes%flightNotes] = msg
+	fr.nnotes++
+}
+
+func (fr *flightRecorder) event(ev FailureEvent) {
+	fr.events[fr.nevents%flightEvents] = ev
+	fr.nevents++
+}
+
+// LastFailure returns a snapshot of the driver and chip taken on the last
+// IOCTL timeout, firmware trap, HCI desync or receive halt. The snapshot
+// survives Reset and Init so it may be retrieved and persisted after
+// recovering the device.
+func (d *Device) LastFailure() (Failure, bool) {
+	d.lock()
+	defer d.unlock()
+	return d.flight.failure, d.flight.failed
+}
+
+// flight_failure snapshots the flight recorder and chip state on failure
+// and returns err.
+func (d *Device) flight_failure(kind FailureKind, err error) error {
+	fr := &d.flight
+	if fr.capturing {
+		return err // Failure while capturing a failure.
+	}
+	fr.capturing = true
+	defer func() { fr.capturing = false }()
+	f := Failure{Kind: kind, Err: err, At: d.now(), Stats: d.stats}
+	for i := max(0, fr.nevents-flightEvents); i < fr.nevents; i++ {
+		f.Events = append(f.Events, fr.events[i%flightEvents])
+	}
+	for i := max(0, fr.nnotes-flightNotes); i < fr.nnotes; i++ {
+		f.Trace = append(f.Trace, fr.notes[i%flightNotes])
+	}
+	// Errors are ignored: registers of a failed chip are read on a best effort basis.
+	status, _ := d.read32(FuncBus, whd.SPI_STATUS_REGISTER)
+	f.Status = Status(status)
+	f.BusTest, _ = d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
+	if d.chip != nil {
+		var shared [32]byte
+		addr, rerr := d.bp_read32(d.chip.ramSize - 4 - d.chip.srmemSize)
+		if rerr == nil && d.bp_read(addr, shared[:]) == nil {
+			smem := decodeSharedMem(_busOrder, shared[:])
+			f.FirmwareFlags, f.TrapAddr, f.AssertLine = smem.flags, smem.trap_addr, smem.assert_line
+			if kind == FailureIoctlTimeout && smem.flags&(sharedFlagTrap|sharedFlagAssert) != 0 {
+				f.Kind = FailureFirmwareTrap
+			}
+		}
+	}
+	fr.failure, fr.failed = f, true
+	d.logerr("flight:failure", slog.String("kind", f.Kind.String()))
+	return err
+}
@@ -0,0 +1,130 @@
+//go:build linux && !baremetal
+
+package gspi
+
+import (
+	"os"
+	"unsafe"
+)
+
+// GPIO character device v2 ioctl requests and line flags, see linux/gpio.h.
+const (
+	gpioV2GetLineIoctl       = 0xc250b407
+	gpioV2LineGetValuesIoctl = 0xc010b40e
+	gpioV2LineSetValuesIoctl = 0xc010b40f
+
+	gpioV2LineFlagInput        = 1 << 2
+	gpioV2LineFlagOutput       = 1 << 3
+	gpioV2LineFlagBiasPullUp   = 1 << 8
+	gpioV2LineFlagBiasPullDown = 1 << 9
+)
+
+type gpioV2LineAttribute struct {
+	id    uint32
+	_     uint32
+	value uint64
+}
+
+type gpioV2LineConfigAttribute struct {
+	attr gpioV2LineAttribute
+	mask uint64
+}
+
+type gpioV2LineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	_        [5]uint32
+	attrs    [10]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	offsets         [64]uint32
+	consumer        [32]byte
+	config          gpioV2LineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	_               [5]uint32
+	fd              int32
+}
+
+type gpioV2LineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// Line is a GPIO line requested through the Linux GPIO character device
+// (gpiod), implementing PinOut and PinIn.
+type Line struct {
+	f *os.File
+	// Err holds the first error of Set or Get, which can not return errors.
+	Err error
+}
+
+// LinePull is the bias of an input Line.
+type LinePull uint8
+
+const (
+	LinePullNone LinePull = iota
+	LinePullUp
+	LinePullDown
+)
+
+// OpenOutput requests line offset of a GPIO chip such as /dev/gpiochip0 as an output.
+func OpenOutput(chip string, offset uint32) (*Line, error) {
+	return openLine(chip, offset, gpioV2LineFlagOutput)
+}
+
+// OpenInput requests line offset of a GPIO chip such as /dev/gpiochip0 as an input.
+func OpenInput(chip string, offset uint32, pull LinePull) (*Line, error) {
+	flags := uint64(gpioV2LineFlagInput)
+	switch pull {
+	case LinePullUp:
+		flags |= gpioV2LineFlagBiasPullUp
+	case LinePullDown:
+		flags |= gpioV2LineFlagBiasPullDown
+	}
+	return openLine(chip, offset, flags)
+}
+
+func openLine(chip string, offset uint32, flags uint64) (*Line, error) {
+	c, err := os.OpenFile(chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var req gpioV2LineRequest
+	req.offsets[0] = offset
+	req.numLines = 1
+	req.config.flags = flags
+	copy(req.consumer[:len(req.consumer)-1], "cyw43439")
+	err = ioctl(c.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&req))
+	if err != nil {
+		return nil, err
+	}
+	return &Line{f: os.NewFile(uintptr(req.fd), chip)}, nil
+}
+
+// Set drives the line high or low.
+func (l *Line) Set(high bool) {
+	vals := gpioV2LineValues{mask: 1}
+	if high {
+		vals.bits = 1
+	}
+	l.seterr(ioctl(l.f.Fd(), gpioV2LineSetValuesIoctl, unsafe.Pointer(&vals)))
+}
+
+// Get reads the line level.
+func (l *Line) Get() bool {
+	vals := gpioV2LineValues{mask: 1}
+	l.seterr(ioctl(l.f.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&vals)))
+	return vals.bits&1 != 0
+}
+
+// Close releases the line.
+func (l *Line) Close() error { return l.f.Close() }
+
+func (l *Line) seterr(err error) {
+	if l.Err == nil && err != nil {
+		l.Err = err
+	}
+}
@@ -0,0 +1,152 @@
+// Package gspi defines the hardware the cyw43439 driver depends on as small
+// interfaces and implements the chip's gSPI command bus on top of them, so the
+// driver core runs unmodified on any TinyGo target or host with an SPI peripheral:
+//
+//	bus := gspi.NewSPI(machine.SPI1)
+//	dev := cyw43439.New(wlRegOn.Set, cs.Set, bus)
+//
+// machine.SPI and machine.Pin implement Transferer, PinOut and PinIn. On Linux,
+// SPIDev and Line implement them over spidev and the GPIO character device.
+// On the RP2040 the driver uses the PIO implementation, see NewPicoWPIO,
+// unless built with the cy43nopio tag.
+package gspi
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+var errNoBaudrate = errors.New("gspi: bus does not support setting the baudrate")
+
+// Transferer is a byte oriented SPI bus, i.e: machine.SPI on TinyGo or a spidev
+// connection on Linux. Tx writes w while reading into r; either may be nil.
+type Transferer interface {
+	Tx(w, r []byte) error
+}
+
+// PinOut is a digital output, i.e: the chip's WL_REG_ON power and chip select pins.
+type PinOut interface {
+	Set(high bool)
+}
+
+// PinIn is a digital input, i.e: the chip's host-wake pin.
+type PinIn interface {
+	Get() bool
+}
+
+// CmdBus performs gSPI transactions: a command word followed by data words
+// written to or read from the chip. Chip select is handled by the driver.
+type CmdBus interface {
+	CmdRead(cmd uint32, buf []uint32) error
+	CmdWrite(cmd uint32, buf []uint32) error
+	// LastStatus returns the status word the chip sent after the last transaction.
+	LastStatus() uint32
+}
+
+// CRCBus is a CmdBus which can append and verify the check sequences of the
+// chip's gSPI error checking, see cyw43439.Device.SetBusCRC. None of the
+// buses of this package implement it yet.
+type CRCBus interface {
+	CmdBus
+	// SetCRC enables or disables check sequences on subsequent transactions.
+	SetCRC(enable bool) error
+}
+
+var _ CmdBus = (*SPI)(nil)
+
+// SPI implements CmdBus over a Transferer. gSPI is half duplex: the SPI bus'
+// data lines must both connect to the chip's data line, the host output
+// through a resistor as on the Pico W. Words are sent most significant byte
+// first. SPI does not allocate.
+type SPI struct {
+	bus    Transferer
+	status uint32
+	word   [4]byte
+}
+
+// NewSPI returns a gSPI command bus using bus, which must be configured for
+// SPI mode 0 at up to 50MHz.
+func NewSPI(bus Transferer) *SPI {
+	return &SPI{bus: bus}
+}
+
+// CmdWrite writes the command word followed by buf.
+func (s *SPI) CmdWrite(cmd uint32, buf []uint32) error {
+	err := s.writeWord(cmd)
+	if err == nil && len(buf) > 0 {
+		b := wordBytes(buf)
+		toWire(buf, b)
+		err = s.bus.Tx(b, nil)
+		fromWire(buf, b)
+	}
+	if err == nil {
+		err = s.readStatus()
+	}
+	return err
+}
+
+// CmdRead writes the command word and reads len(buf) words into buf.
+func (s *SPI) CmdRead(cmd uint32, buf []uint32) error {
+	err := s.writeWord(cmd)
+	if err == nil && len(buf) > 0 {
+		b := wordBytes(buf)
+		err = s.bus.Tx(nil, b)
+		fromWire(buf, b)
+	}
+	if err == nil {
+		err = s.readStatus()
+	}
+	return err
+}
+
+// LastStatus returns the status word read after the last transaction.
+func (s *SPI) LastStatus() uint32 { return s.status }
+
+// SetBaudrate sets the clock frequency of the underlying bus if it implements
+// a SetBaudrate(uint32) error method, as SPIDev does.
+func (s *SPI) SetBaudrate(hz uint32) error {
+	if b, ok := s.bus.(interface{ SetBaudrate(uint32) error }); ok {
+		return b.SetBaudrate(hz)
+	}
+	return errNoBaudrate
+}
+
+// Close closes the underlying bus if it implements io.Closer.
+func (s *SPI) Close() error {
+	if c, ok := s.bus.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *SPI) writeWord(w uint32) error {
+	binary.BigEndian.PutUint32(s.word[:], w)
+	return s.bus.Tx(s.word[:], nil)
+}
+
+func (s *SPI) readStatus() error {
+	err := s.bus.Tx(nil, s.word[:])
+	s.status = binary.BigEndian.Uint32(s.word[:])
+	return err
+}
+
+// toWire converts words in buf to wire order in place. b is buf's memory.
+func toWire(buf []uint32, b []byte) {
+	for i, w := range buf {
+		binary.BigEndian.PutUint32(b[4*i:], w)
+	}
+}
+
+// fromWire converts wire order bytes b to words in place. b is buf's memory.
+func fromWire(buf []uint32, b []byte) {
+	for i := range buf {
+		buf[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+}
+
+// wordBytes returns the memory of buf as bytes, used to convert words in place.
+func wordBytes(buf []uint32) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), 4*len(buf))
+}
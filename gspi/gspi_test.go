@@ -0,0 +1,49 @@
+package gspi
+
+import (
+	"bytes"
+	"testing"
+)
+
+// wire records written bytes and returns rx on reads.
+type wire struct {
+	tx bytes.Buffer
+	rx []byte
+}
+
+func (w *wire) Tx(wb, rb []byte) error {
+	w.tx.Write(wb)
+	w.rx = w.rx[copy(rb, w.rx):]
+	return nil
+}
+
+func TestSPI(t *testing.T) {
+	w := &wire{rx: []byte{0, 0, 0, 0x20}}
+	s := NewSPI(w)
+	buf := []uint32{0x01020304, 0x05060708}
+	if err := s.CmdWrite(0xc0ffee00, buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xc0, 0xff, 0xee, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !bytes.Equal(w.tx.Bytes(), want) {
+		t.Errorf("CmdWrite sent %x, want %x", w.tx.Bytes(), want)
+	}
+	if buf[0] != 0x01020304 || buf[1] != 0x05060708 {
+		t.Errorf("CmdWrite modified buffer: %x", buf)
+	}
+	if s.LastStatus() != 0x20 {
+		t.Errorf("status %#x, want 0x20", s.LastStatus())
+	}
+
+	w.tx.Reset()
+	w.rx = []byte{0xfe, 0xed, 0xbe, 0xad, 0, 0, 0, 1}
+	if err := s.CmdRead(0x4000a004, buf[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 0xfeedbead || s.LastStatus() != 1 {
+		t.Errorf("CmdRead got %#x status %#x", buf[0], s.LastStatus())
+	}
+	if allocs := testing.AllocsPerRun(10, func() { s.CmdWrite(0, buf) }); allocs != 0 {
+		t.Errorf("CmdWrite allocates %v times", allocs)
+	}
+}
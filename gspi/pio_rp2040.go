@@ -0,0 +1,41 @@
+//go:build rp2040
+
+package gspi
+
+import (
+	"machine"
+
+	pio "github.com/tinygo-org/pio/rp2-pio"
+	"github.com/tinygo-org/pio/rp2-pio/piolib"
+)
+
+// PIO implements CmdBus with an RP2040 PIO state machine driving the 3-wire
+// gSPI bus, leaving the SPI peripherals free.
+type PIO struct {
+	piolib.SPI3w
+}
+
+// NewPicoWPIO returns a PIO gSPI bus on the Raspberry Pi Pico W pins
+// (data GPIO24, clock GPIO29) running at baud.
+func NewPicoWPIO(baud uint32) (PIO, error) {
+	return NewPIO(machine.GPIO24, machine.GPIO29, baud)
+}
+
+// NewPIO returns a PIO gSPI bus on the given data and clock pins, which may
+// be used for CYW43439 modules wired to other pins than on the Pico W.
+func NewPIO(data, clk machine.Pin, baud uint32) (PIO, error) {
+	sm, err := pio.PIO0.ClaimStateMachine()
+	if err != nil {
+		return PIO{}, err
+	}
+	spi, err := piolib.NewSPI3w(sm, data, clk, baud)
+	if err != nil {
+		return PIO{}, err
+	}
+	spi.EnableStatus(true)
+	err = spi.EnableDMA(true)
+	if err != nil {
+		return PIO{}, err
+	}
+	return PIO{*spi}, nil
+}
@@ -0,0 +1,127 @@
+//go:build linux && !baremetal
+
+package gspi
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var errTxLength = errors.New("spidev: write and read buffers differ in length")
+
+// spidev ioctl requests and mode flags, see linux/spi/spidev.h.
+const (
+	spiIocMessage1     = 0x40206b00 // SPI_IOC_MESSAGE(1)
+	spiIocWrMode       = 0x40016b01
+	spiIocWrBitsPerWrd = 0x40016b03
+	spiIocWrMaxSpeedHz = 0x40046b04
+
+	spiMode0  = 0x00
+	spi3Wire  = 0x10
+	spiNoCS   = 0x40
+	wordWidth = 8
+)
+
+// spiIocTransfer is struct spi_ioc_transfer.
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	_           uint8
+}
+
+// SPIDev is a Linux spidev device implementing Transferer, for running the
+// driver with mainstream Go on a Raspberry Pi or similar board. Chip select
+// is left to the driver so it must be wired to a GPIO, see OpenLine.
+type SPIDev struct {
+	f  *os.File
+	hz uint32
+}
+
+// OpenSPIDev opens a spidev device such as /dev/spidev0.0 in SPI mode 0 at hz.
+// threeWire selects half duplex operation on a single data line (SPI_3WIRE)
+// for controllers which support it, otherwise MOSI and MISO must both connect
+// to the chip's data line, MOSI through a resistor.
+func OpenSPIDev(path string, hz uint32, threeWire bool) (*SPIDev, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &SPIDev{f: f, hz: hz}
+	mode := uint8(spiMode0 | spiNoCS)
+	if threeWire {
+		mode |= spi3Wire
+	}
+	bits := uint8(wordWidth)
+	err = s.ioctl(spiIocWrMode, unsafe.Pointer(&mode))
+	if err == nil {
+		err = s.ioctl(spiIocWrBitsPerWrd, unsafe.Pointer(&bits))
+	}
+	if err == nil {
+		err = s.SetBaudrate(hz)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Tx writes w while reading into r. Either may be nil, otherwise their lengths must match.
+func (s *SPIDev) Tx(w, r []byte) error {
+	if w != nil && r != nil && len(w) != len(r) {
+		return errTxLength
+	}
+	tr := spiIocTransfer{
+		len:         uint32(max(len(w), len(r))),
+		speedHz:     s.hz,
+		bitsPerWord: wordWidth,
+	}
+	if tr.len == 0 {
+		return nil
+	}
+	if len(w) > 0 {
+		tr.txBuf = uint64(uintptr(unsafe.Pointer(&w[0])))
+	}
+	if len(r) > 0 {
+		tr.rxBuf = uint64(uintptr(unsafe.Pointer(&r[0])))
+	}
+	err := s.ioctl(spiIocMessage1, unsafe.Pointer(&tr))
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(r)
+	return err
+}
+
+// SetBaudrate sets the SPI clock frequency.
+func (s *SPIDev) SetBaudrate(hz uint32) error {
+	err := s.ioctl(spiIocWrMaxSpeedHz, unsafe.Pointer(&hz))
+	if err == nil {
+		s.hz = hz
+	}
+	return err
+}
+
+// Close closes the spidev device.
+func (s *SPIDev) Close() error { return s.f.Close() }
+
+func (s *SPIDev) ioctl(req uintptr, arg unsafe.Pointer) error {
+	return ioctl(s.f.Fd(), req, arg)
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+// btsnoop file format constants. See RFC 1761 and the btsnoop format description
+// at https://fte.com/webhelpii/hsu/Content/Technical_Information/BT_Snoop_File_Format.htm
+const (
+	btsnoopDatalinkH4 = 1002
+	btsnoopFlagRecv   = 1 << 0
+	btsnoopFlagCmdEvt = 1 << 1
+	// btsnoopEpochDelta is the amount of microseconds between 0000-01-01 and the Unix epoch.
+	btsnoopEpochDelta = 0x00dcddb30f2f8000
+	btsnoopRecordLen  = 24
+)
+
+// hciSnoop writes HCI packets to a writer in btsnoop format.
+type hciSnoop struct {
+	w   io.Writer
+	hdr [btsnoopRecordLen]byte
+}
+
+// AttachHCISnoop logs all HCI packets written with WriteHCI and read with
+// ReadHCI to w in btsnoop format (H4 datalink) which can be opened by Wireshark.
+// The btsnoop file header is written immediately. Passing a nil writer detaches the snoop.
+// Errors writing packet records are logged and otherwise ignored.
+func (d *Device) AttachHCISnoop(w io.Writer) error {
+	d.lock_as(SubsystemBluetooth)
+	defer d.unlock()
+	d.snoop.w = nil
+	if w == nil {
+		return nil
+	}
+	hdr := d.snoop.hdr[:16]
+	copy(hdr, "btsnoop\x00")
+	binary.BigEndian.PutUint32(hdr[8:], 1) // Version.
+	binary.BigEndian.PutUint32(hdr[12:], btsnoopDatalinkH4)
+	_, err := w.Write(hdr)
+	if err != nil {
+		return err
+	}
+	d.snoop.w = w
+	return nil
+}
+
+// hci_snoop writes an H4 format HCI packet record to the attached snoop writer, if any.
+func (d *Device) hci_snoop(pkt []byte, received bool) {
+	if d.snoop.w == nil || len(pkt) == 0 {
+		return
+	}
+	var flags uint32
+	if received {
+		flags |= btsnoopFlagRecv
+	}
+	if pkt[0] == hciPacketCommand || pkt[0] == hciPacketEvent {
+		flags |= btsnoopFlagCmdEvt
+	}
+	hdr := d.snoop.hdr[:]
+	binary.BigEndian.PutUint32(hdr[0:], uint32(len(pkt))) // Original length.
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(pkt))) // Included length.
+	binary.BigEndian.PutUint32(hdr[8:], flags)
+	binary.BigEndian.PutUint32(hdr[12:], 0) // Cumulative drops.
+	binary.BigEndian.PutUint64(hdr[16:], uint64(d.now().UnixMicro()+btsnoopEpochDelta))
+	_, err := d.snoop.w.Write(hdr)
+	if err == nil {
+		_, err = d.snoop.w.Write(pkt)
+	}
+	if err != nil {
+		d.logerr("hci:snoop", slog.String("err", err.Error()))
+	}
+}
@@ -0,0 +1,65 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errHealthMagic     = errors.New("health: bad firmware ioctl magic")
+	errHealthBusTest   = errors.New("health: bus test register mismatch")
+	errHealthBusStatus = errors.New("health: bus status reports error")
+)
+
+// Health is the result of a health check, see Device.Healthcheck.
+type Health struct {
+	// Latency is the round trip time of the IOCTL sent to the firmware.
+	Latency time.Duration
+	// Status is the bus status register read after the round trip.
+	Status Status
+}
+
+// Healthcheck checks the device is responsive by performing a cheap IOCTL
+// round trip to the firmware and validating the bus test and status registers.
+// A non-nil error means the device is unhealthy: the application may then
+// recover it by calling Reset followed by Init. The returned Health is valid
+// up to the first failed check.
+func (d *Device) Healthcheck() (Health, error) {
+	d.lock()
+	defer d.unlock()
+	var h Health
+	if !d.initialized {
+		return h, errDeviceNotInit
+	}
+	var magic [4]byte
+	start := d.now()
+	_, err := d.doIoctlGet(whd.WLC_GET_MAGIC, whd.IF_STA, magic[:])
+	h.Latency = d.since(start)
+	if err != nil {
+		return h, err
+	} else if got := _busOrder.Uint32(magic[:]); got != whd.WLC_IOCTL_MAGIC {
+		d.logerr("Healthcheck:magic", slog.Uint64("got", uint64(got)))
+		return h, errHealthMagic
+	}
+	got, err := d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
+	if err != nil {
+		return h, err
+	} else if got != whd.TEST_PATTERN {
+		d.logerr("Healthcheck:bustest", slog.Uint64("got", uint64(got)))
+		return h, errHealthBusTest
+	}
+	got, err = d.read32(FuncBus, whd.SPI_STATUS_REGISTER)
+	if err != nil {
+		return h, err
+	}
+	h.Status = Status(got)
+	if h.Status.IsOverflow() || h.Status.IsUnderflow() || h.Status.HostCommandDataError() {
+		d.logerr("Healthcheck:status", slog.String("status", h.Status.String()))
+		return h, errHealthBusStatus
+	}
+	d.debug("Healthcheck", slog.Duration("latency", h.Latency))
+	return h, nil
+}
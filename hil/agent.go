@@ -0,0 +1,163 @@
+package hil
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// Serve runs the device side agent reading commands from rw and executing them
+// on dev until reading from rw fails. dev must be initialized. The HCI echo
+// command requires Bluetooth to be enabled.
+//
+// Reads returning no data and no error are retried after a short sleep, as
+// is the case for TinyGo's machine.Serial.
+func Serve(rw io.ReadWriter, dev *cyw43439.Device) error {
+	a := agent{rw: rw, dev: dev}
+	for {
+		line, err := a.readLine()
+		if err == errLineTooLong {
+			a.replyErr(err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			a.replyErr(err)
+			continue
+		} else if len(args) == 0 {
+			continue
+		}
+		err = a.exec(args[0], args[1:])
+		if err != nil {
+			a.replyErr(err)
+		}
+	}
+}
+
+type agent struct {
+	rw   io.ReadWriter
+	dev  *cyw43439.Device
+	line [maxLineLen]byte
+	out  []byte
+	hci  [260]byte
+}
+
+func (a *agent) readLine() (string, error) {
+	n := 0
+	tooLong := false
+	for {
+		nr, err := a.rw.Read(a.line[n : n+1])
+		if err != nil {
+			return "", err
+		} else if nr == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		c := a.line[n]
+		switch {
+		case c == '\n':
+			if tooLong {
+				return "", errLineTooLong
+			}
+			return string(a.line[:n]), nil
+		case c == '\r':
+		case n == len(a.line)-1:
+			tooLong = true // Discard until end of line.
+		default:
+			n++
+		}
+	}
+}
+
+func (a *agent) exec(cmd string, args []string) error {
+	switch cmd {
+	case CmdPing:
+		return a.replyOK()
+	case CmdJoin:
+		if len(args) != 2 {
+			return errBadArgs
+		}
+		err := a.dev.JoinWPA2(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return a.replyOK()
+	case CmdScan:
+		err := a.dev.Scan(cyw43439.ScanConfig{}, func(bss *whd.BSSInfo) {
+			a.out = append(a.out[:0], replyData...)
+			a.out = append(a.out, ' ')
+			a.out = strconv.AppendQuote(a.out, string(bss.SSIDBytes()))
+			a.out = append(a.out, ' ')
+			a.out = strconv.AppendInt(a.out, int64(bss.RSSI), 10)
+			a.out = append(a.out, ' ')
+			a.out = strconv.AppendUint(a.out, uint64(bss.Channel()), 10)
+			a.out = append(a.out, '\n')
+			a.rw.Write(a.out)
+		})
+		if err != nil {
+			return err
+		}
+		return a.replyOK()
+	case CmdHCIEcho:
+		return a.hciEcho()
+	case CmdStats:
+		s := a.dev.Stats()
+		return a.replyOK(
+			strconv.FormatUint(uint64(s.TxFrames), 10), strconv.FormatUint(uint64(s.RxFrames), 10),
+			strconv.FormatUint(uint64(s.HCITxPackets), 10), strconv.FormatUint(uint64(s.HCIRxPackets), 10),
+		)
+	}
+	return errUnknownCommand
+}
+
+// hciEcho sends an HCI Reset command and waits for its Command Complete
+// event, replying with the round trip time in microseconds.
+func (a *agent) hciEcho() error {
+	const opReset = 0x0c03
+	start := time.Now()
+	_, err := a.dev.WriteHCI([]byte{0x01, opReset & 0xff, opReset >> 8, 0})
+	if err != nil {
+		return err
+	}
+	for time.Since(start) < time.Second {
+		n, err := a.dev.ReadHCI(a.hci[:])
+		if err == cyw43439.ErrDataNotAvailable {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// Command Complete: type, code, len, ncmd, opcode(2), status.
+		if n >= 7 && a.hci[0] == 0x04 && a.hci[1] == 0x0e &&
+			uint16(a.hci[4])|uint16(a.hci[5])<<8 == opReset {
+			if a.hci[6] != 0 {
+				return errUnexpectedReply
+			}
+			return a.replyOK(strconv.FormatInt(time.Since(start).Microseconds(), 10))
+		}
+	}
+	return cyw43439.ErrDataNotAvailable
+}
+
+func (a *agent) replyOK(fields ...string) error {
+	a.out = append(a.out[:0], replyOK...)
+	for _, f := range fields {
+		a.out = append(a.out, ' ')
+		a.out = append(a.out, f...)
+	}
+	a.out = append(a.out, '\n')
+	_, err := a.rw.Write(a.out)
+	return err
+}
+
+func (a *agent) replyErr(err error) {
+	a.out = append(a.out[:0], replyErr...)
+	a.out = append(a.out, ' ')
+	a.out = strconv.AppendQuote(a.out, err.Error())
+	a.out = append(a.out, '\n')
+	a.rw.Write(a.out)
+}
@@ -0,0 +1,133 @@
+package hil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soypat/cyw43439"
+)
+
+// Client drives an agent from the host side.
+type Client struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// NewClient returns a client communicating with an agent over rw.
+func NewClient(rw io.ReadWriter) *Client {
+	return &Client{w: rw, r: bufio.NewReaderSize(rw, maxLineLen)}
+}
+
+// BSS is a network found by a scan.
+type BSS struct {
+	SSID    string
+	RSSI    int
+	Channel int
+}
+
+// Ping checks the agent is responsive.
+func (c *Client) Ping() error {
+	_, _, err := c.do(CmdPing)
+	return err
+}
+
+// Join joins the device to a WPA2 network.
+func (c *Client) Join(ssid, pass string) error {
+	_, _, err := c.do(CmdJoin, strconv.Quote(ssid), strconv.Quote(pass))
+	return err
+}
+
+// Scan scans for networks from the device.
+func (c *Client) Scan() ([]BSS, error) {
+	data, _, err := c.do(CmdScan)
+	if err != nil {
+		return nil, err
+	}
+	bsss := make([]BSS, 0, len(data))
+	for _, fields := range data {
+		if len(fields) != 3 {
+			return bsss, errUnexpectedReply
+		}
+		rssi, err1 := strconv.Atoi(fields[1])
+		ch, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			return bsss, errUnexpectedReply
+		}
+		bsss = append(bsss, BSS{SSID: fields[0], RSSI: rssi, Channel: ch})
+	}
+	return bsss, nil
+}
+
+// HCIEcho performs an HCI command round trip on the device, which must have
+// Bluetooth enabled, and returns the round trip time measured by the device.
+func (c *Client) HCIEcho() (time.Duration, error) {
+	_, ok, err := c.do(CmdHCIEcho)
+	if err != nil {
+		return 0, err
+	} else if len(ok) != 1 {
+		return 0, errUnexpectedReply
+	}
+	us, err := strconv.ParseInt(ok[0], 10, 64)
+	return time.Duration(us) * time.Microsecond, err
+}
+
+// Stats returns the device's driver counters. Only frame and HCI packet counts are reported.
+func (c *Client) Stats() (s cyw43439.Stats, err error) {
+	_, ok, err := c.do(CmdStats)
+	if err != nil {
+		return s, err
+	} else if len(ok) != 4 {
+		return s, errUnexpectedReply
+	}
+	var v [4]uint64
+	for i := range v {
+		v[i], err = strconv.ParseUint(ok[i], 10, 32)
+		if err != nil {
+			return s, errUnexpectedReply
+		}
+	}
+	s.TxFrames, s.RxFrames = uint32(v[0]), uint32(v[1])
+	s.HCITxPackets, s.HCIRxPackets = uint32(v[2]), uint32(v[3])
+	return s, nil
+}
+
+// do sends a command and reads the reply. Data lines are returned split in
+// fields along with the fields following the ok status. An err status is returned as an error.
+func (c *Client) do(cmd string, args ...string) (data [][]string, ok []string, err error) {
+	line := cmd
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	_, err = io.WriteString(c.w, line+"\n")
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return data, nil, err
+		}
+		fields, err := splitArgs(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			return data, nil, err
+		} else if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case replyData:
+			data = append(data, fields[1:])
+		case replyOK:
+			return data, fields[1:], nil
+		case replyErr:
+			if len(fields) != 2 {
+				return data, nil, errUnexpectedReply
+			}
+			return data, nil, errors.New(fields[1])
+		}
+		// Ignore other lines such as device logs sharing the serial port.
+	}
+}
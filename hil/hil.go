@@ -0,0 +1,83 @@
+// Package hil implements hardware-in-the-loop testing of the cyw43439 driver.
+//
+// An agent running on the device (see Serve and examples/hilagent) exposes
+// driver operations over a serial link, usually the Pico W USB serial port.
+// Host-side Go tests drive scenarios such as joining a network, scanning and
+// exchanging HCI packets through a Client and assert on the results.
+//
+// The protocol is line based text. The host sends a command followed by its
+// arguments, separated by spaces, strings are Go quoted:
+//
+//	join "my network" "password"
+//
+// The agent replies with zero or more data lines followed by a status line:
+//
+//	data "my network" -52 6
+//	ok
+//
+// or on failure:
+//
+//	err "join failed"
+//
+// To run the hardware tests flash examples/hilagent and run on the host:
+//
+//	CYW43439_HIL_PORT=/dev/ttyACM0 CYW43439_HIL_SSID=ssid CYW43439_HIL_PASS=pass go test ./hil
+package hil
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Commands understood by the agent.
+const (
+	CmdPing    = "ping"
+	CmdJoin    = "join"
+	CmdScan    = "scan"
+	CmdHCIEcho = "hciecho"
+	CmdStats   = "stats"
+)
+
+// Reply line prefixes.
+const (
+	replyData = "data"
+	replyOK   = "ok"
+	replyErr  = "err"
+)
+
+// maxLineLen is the maximum length of a protocol line.
+const maxLineLen = 256
+
+var (
+	errLineTooLong     = errors.New("hil: line too long")
+	errUnknownCommand  = errors.New("hil: unknown command")
+	errBadArgs         = errors.New("hil: bad arguments")
+	errUnexpectedReply = errors.New("hil: unexpected reply")
+)
+
+// splitArgs splits a protocol line into its space separated fields, unquoting Go quoted strings.
+func splitArgs(line string) (args []string, err error) {
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args, nil
+		}
+		var arg string
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, errBadArgs
+			}
+			arg, _ = strconv.Unquote(quoted)
+			line = line[len(quoted):]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			arg, line = line[:end], line[end:]
+		}
+		args = append(args, arg)
+	}
+}
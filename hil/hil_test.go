@@ -0,0 +1,112 @@
+package hil
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`join "my \"net\"" pass  7`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"join", `my "net"`, "pass", "7"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", args, want)
+	}
+	_, err = splitArgs(`join "unterminated`)
+	if err != errBadArgs {
+		t.Errorf("got %v, want %v", err, errBadArgs)
+	}
+}
+
+func TestClientReplies(t *testing.T) {
+	host, dev := net.Pipe()
+	defer host.Close()
+	go func() {
+		defer dev.Close()
+		replies := []string{
+			"some device log line\nok\n",
+			"data \"net one\" -40 1\ndata \"\" -80 11\nok\n",
+			"err \"join failed\"\n",
+		}
+		buf := make([]byte, maxLineLen)
+		for _, reply := range replies {
+			if _, err := dev.Read(buf); err != nil {
+				return
+			}
+			dev.Write([]byte(reply))
+		}
+	}()
+	c := NewClient(host)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	bsss, err := c.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bsss) != 2 || bsss[0] != (BSS{SSID: "net one", RSSI: -40, Channel: 1}) {
+		t.Errorf("unexpected scan result %+v", bsss)
+	}
+	err = c.Join("net one", "pass")
+	if err == nil || err.Error() != "join failed" {
+		t.Errorf("got %v, want join failed", err)
+	}
+}
+
+// TestHardware runs scenarios against a device running examples/hilagent.
+// It is skipped unless CYW43439_HIL_PORT is set.
+func TestHardware(t *testing.T) {
+	port := os.Getenv("CYW43439_HIL_PORT")
+	if port == "" {
+		t.Skip("CYW43439_HIL_PORT not set")
+	}
+	f, err := os.OpenFile(port, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c := NewClient(f)
+	if err := c.Ping(); err != nil {
+		t.Fatal("ping:", err)
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		bsss, err := c.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, bss := range bsss {
+			if bss.Channel < 1 || bss.Channel > 14 {
+				t.Errorf("%q: invalid channel %d", bss.SSID, bss.Channel)
+			}
+		}
+		t.Logf("found %d networks", len(bsss))
+	})
+	t.Run("hciecho", func(t *testing.T) {
+		rtt, err := c.HCIEcho()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := c.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.HCITxPackets == 0 || stats.HCIRxPackets == 0 {
+			t.Errorf("HCI packets not counted: %+v", stats)
+		}
+		t.Log("HCI round trip", rtt)
+	})
+	t.Run("join", func(t *testing.T) {
+		ssid := os.Getenv("CYW43439_HIL_SSID")
+		if ssid == "" {
+			t.Skip("CYW43439_HIL_SSID not set")
+		}
+		if err := c.Join(ssid, os.Getenv("CYW43439_HIL_PASS")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errHostAsleep    = errors.New("host sleep already armed")
+	errHostNotAsleep = errors.New("host sleep not armed")
+	errHostNoWake    = errors.New("host sleep requires at least one wake filter")
+	errHostBusy      = errors.New("packets still pending, poll before host sleep")
+
+	errHostWakePull     = errors.New("invalid host-wake pull")
+	errHostWakeNoConfig = errors.New("host-wake pull requires Configure")
+	errHostWakeAsserted = errors.New("host-wake pull holds the line asserted, pull must oppose polarity")
+)
+
+// Pull is a pull resistor configuration of the host pin wired to host-wake.
+type Pull uint8
+
+const (
+	PullNone Pull = iota
+	PullUp
+	PullDown
+)
+
+// HostWakeConfig describes how the chip's host-wake interrupt output
+// (WL_HOST_WAKE) is wired to the host. The zero value matches the Pico W,
+// where host-wake shares the gSPI data line and is active high.
+type HostWakeConfig struct {
+	// Get reads the level of the host pin wired to host-wake, see
+	// Device.HostWakePending. Nil if host-wake is not wired or not used.
+	Get func() bool
+	// Configure, if set, is called by Init to configure the host pin as an
+	// input with the pull resistor in Pull.
+	Configure func(pull Pull) error
+	// ActiveLow sets the host-wake polarity to active low.
+	ActiveLow bool
+	// Pull is the host pin pull resistor. It must keep the line deasserted
+	// while the chip is powered down: a pull-down for active high host-wake,
+	// a pull-up for active low.
+	Pull Pull
+}
+
+// validate checks the pull configuration against the polarity.
+func (c *HostWakeConfig) validate() error {
+	switch {
+	case c.Pull > PullDown:
+		return errHostWakePull
+	case c.Pull != PullNone && c.Configure == nil:
+		return errHostWakeNoConfig
+	case (c.Pull == PullUp && !c.ActiveLow) || (c.Pull == PullDown && c.ActiveLow):
+		return errHostWakeAsserted
+	}
+	return nil
+}
+
+// HostWakePending reports whether host-wake is asserted, i.e: the chip has
+// packets pending, reading the pin set in Config.HostWake. Polling loops may
+// use it to skip bus transactions. Always true if no pin was configured.
+// Note host-wake is only meaningful while the gSPI bus is idle.
+func (d *Device) HostWakePending() bool {
+	d.lock()
+	defer d.unlock()
+	if d.hostWake.Get == nil {
+		return true
+	}
+	return d.hostWake.Get() != d.hostWake.ActiveLow
+}
+
+// hostSleepDrain bounds the packets processed by HostSleep before arming.
+const hostSleepDrain = 16
+
+// WakeFilter is a set of events which wake a sleeping host, see Device.HostSleep.
+type WakeFilter uint32
+
+const (
+	WakeMagicPacket WakeFilter = whd.WL_WOWL_MAGIC
+	WakeDisassoc    WakeFilter = whd.WL_WOWL_DIS
+	WakeBeaconLoss  WakeFilter = whd.WL_WOWL_BCN
+	WakeGTKFailure  WakeFilter = whd.WL_WOWL_GTK_FAILURE
+	WakeBroadcast   WakeFilter = whd.WL_WOWL_BCAST
+	WakeLinkDown    WakeFilter = whd.WL_WOWL_LINKDOWN
+	// WakeConnection wakes the host on any loss of the connection to the AP.
+	WakeConnection = WakeDisassoc | WakeBeaconLoss | WakeLinkDown
+)
+
+// HostSleepConfig configures how the firmware wakes a sleeping host.
+type HostSleepConfig struct {
+	// Wake selects the events which assert the host-wake interrupt. Firmware
+	// offloads such as ARP replies and keepalives keep running while the host sleeps.
+	Wake WakeFilter
+}
+
+// HostSleep tells the firmware the host is about to sleep: pending packets are
+// processed, the firmware is armed to assert the host-wake interrupt, see
+// Config.HostWake, on the events in cfg.Wake and the bus is put to
+// sleep if the save/restore engine is enabled. After waking, and before any
+// other call, the host must call HostWake to rearm normal operation. Packets
+// received while the host sleeps are buffered by the chip until then.
+func (d *Device) HostSleep(cfg HostSleepConfig) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if d.hostAsleep {
+		return errHostAsleep
+	} else if cfg.Wake == 0 {
+		return errHostNoWake
+	}
+	d.info("HostSleep", slog.Uint64("wake", uint64(cfg.Wake)))
+	// The host-wake line would be asserted right away with packets pending.
+	for i := 0; ; i++ {
+		_, _, err := d.tryPoll(d._rxBuf[:])
+		if err == errNoF2Avail {
+			break
+		} else if err != nil {
+			return err
+		} else if i == hostSleepDrain {
+			return errHostBusy
+		}
+	}
+	err := d.set_iovar("wowl_clear", whd.IF_STA, 0)
+	if err != nil {
+		return err
+	}
+	err = d.set_iovar("wowl", whd.IF_STA, uint32(cfg.Wake))
+	if err != nil {
+		return err
+	}
+	err = d.set_iovar("wowl_activate", whd.IF_STA, 1)
+	if err != nil {
+		return err
+	}
+	d.hostAsleep = true
+	if d.srEnabled && !d.busAsleep {
+		err = d.kso_set(false)
+		d.busAsleep = err == nil
+	}
+	return err
+}
+
+// HostWake rearms normal operation after HostSleep and returns the events which
+// woke the host, zero if the host woke for another reason.
+// Frames which woke the host are pending and are received with the next poll.
+func (d *Device) HostWake() (WakeFilter, error) {
+	d.lock()
+	defer d.unlock()
+	if !d.hostAsleep {
+		return 0, errHostNotAsleep
+	}
+	// The first ioctl wakes the bus, see bus_awake.
+	var ind [8]byte // wl_wowl_wakeind_t: pci_wakeind, ucode_wakeind.
+	_, err := d.get_iovar_n("wowl_wakeind", whd.IF_STA, ind[:])
+	if err != nil {
+		return 0, err
+	}
+	err = d.set_iovar("wowl_activate", whd.IF_STA, 0)
+	if err != nil {
+		return 0, err
+	}
+	d.hostAsleep = false
+	woke := WakeFilter(_busOrder.Uint32(ind[4:]))
+	d.info("HostWake", slog.Uint64("wakeind", uint64(woke)))
+	return woke, d.set_iovar("wowl_clear", whd.IF_STA, 0)
+}
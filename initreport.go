@@ -0,0 +1,128 @@
+package cyw43439
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// InitPhase is a step of Device.Init, see InitReport.
+type InitPhase uint8
+
+const (
+	InitPhaseBus       InitPhase = iota // Power cycle and gSPI bus configuration.
+	InitPhaseALPClock                   // Wait for the backplane ALP clock.
+	InitPhaseFirmware                   // WLAN firmware and NVRAM upload.
+	InitPhaseCore                       // WLAN ARM core start.
+	InitPhaseHTClock                    // Wait for the chip HT clock.
+	InitPhaseWLANReady                  // Wait for firmware to signal F2 ready.
+	InitPhaseBluetooth                  // Bluetooth firmware upload and bring up.
+	InitPhaseControl                    // CLM upload and firmware configuration.
+	numInitPhases
+)
+
+var initPhaseNames = [numInitPhases]string{
+	InitPhaseBus:       "bus",
+	InitPhaseALPClock:  "alp-clock",
+	InitPhaseFirmware:  "firmware",
+	InitPhaseCore:      "core",
+	InitPhaseHTClock:   "ht-clock",
+	InitPhaseWLANReady: "wlan-ready",
+	InitPhaseBluetooth: "bluetooth",
+	InitPhaseControl:   "control",
+}
+
+func (p InitPhase) String() string {
+	if p >= numInitPhases {
+		return "InitPhase(" + strconv.Itoa(int(p)) + ")"
+	}
+	return initPhaseNames[p]
+}
+
+// InitReport describes how far Device.Init got before failing. Init returns
+// a *InitReport wrapping the underlying error, retrieve it with errors.As and
+// include it in bug reports:
+//
+//	var report *cyw43439.InitReport
+//	if errors.As(err, &report) {
+//		println(report.String())
+//	}
+//
+// Registers are read after the failure and are zero if they could not be read.
+type InitReport struct {
+	// Phase is the phase Init failed in.
+	Phase InitPhase
+	// Err is the error returned by the failed phase.
+	Err error
+	// Elapsed is the time since Init started.
+	Elapsed time.Duration
+	// PhaseTimes holds how long each phase took, including the failed one.
+	// Phases that were skipped or not reached are zero.
+	PhaseTimes [numInitPhases]time.Duration
+	// ChipID is read from the backplane after the ALP clock is available.
+	ChipID uint16
+	// Status is the gSPI status register.
+	Status Status
+	// TestRegister is the gSPI test register, whd.TEST_PATTERN on a healthy bus.
+	TestRegister uint32
+	// ChipClockCSR is the backplane chip clock control and status register.
+	// Bit 0x40 is set when the ALP clock is available and 0x80 for the HT clock.
+	ChipClockCSR uint8
+	// ColdResets is the amount of extended power cycles done because the
+	// chip was still running after the initial power cycle, see Init.
+	ColdResets int
+
+	phaseStart time.Time
+}
+
+// Error implements the error interface.
+func (r *InitReport) Error() string {
+	return "init failed in " + r.Phase.String() + " phase: " + r.Err.Error()
+}
+
+// Unwrap returns the error of the failed phase.
+func (r *InitReport) Unwrap() error { return r.Err }
+
+// String returns a single line with the report's fields for bug reports.
+func (r *InitReport) String() string {
+	s := r.Error() + " elapsed=" + r.Elapsed.String()
+	for p := InitPhase(0); p < numInitPhases; p++ {
+		if r.PhaseTimes[p] != 0 {
+			s += " " + p.String() + "=" + r.PhaseTimes[p].String()
+		}
+	}
+	if r.ColdResets != 0 {
+		s += " coldresets=" + strconv.Itoa(r.ColdResets)
+	}
+	return s + " chipid=" + hex32(uint32(r.ChipID)) + " status=" + hex32(uint32(r.Status)) +
+		" test=" + hex32(r.TestRegister) + " clkcsr=" + hex32(uint32(r.ChipClockCSR))
+}
+
+// init_phase records the time taken by the current phase and starts phase p.
+func (d *Device) init_phase(r *InitReport, p InitPhase) {
+	now := d.now()
+	r.PhaseTimes[r.Phase] += now.Sub(r.phaseStart)
+	r.Phase = p
+	r.phaseStart = now
+}
+
+// init_fail completes r with the error of the failed phase and a snapshot of
+// the registers useful to diagnose it.
+func (d *Device) init_fail(r *InitReport, err error, start time.Time) *InitReport {
+	d.init_phase(r, r.Phase)
+	r.Err = err
+	r.Elapsed = d.since(start)
+	if r.Phase == InitPhaseBus {
+		// Bus may not be configured for 32 bit words yet.
+		r.TestRegister = d.read32_as(d.wordOrder, whd.SPI_READ_TEST_REGISTER)
+	} else {
+		r.TestRegister, _ = d.read32(FuncBus, whd.SPI_READ_TEST_REGISTER)
+		r.ChipClockCSR, _ = d.read8(FuncBackplane, whd.SDIO_CHIP_CLOCK_CSR)
+	}
+	got, _ := d.read32(FuncBus, whd.SPI_STATUS_REGISTER)
+	r.Status = Status(got)
+	d.logerr("Init:failed", slog.String("report", r.String()))
+	return r
+}
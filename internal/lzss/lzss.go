@@ -0,0 +1,142 @@
+// Package lzss implements a small LZSS compression format meant to be
+// decompressed on microcontrollers with a fixed 2kB window and no allocations.
+//
+// The stream is a sequence of groups, each starting with a flag byte whose bits,
+// least significant first, describe the following 8 items. A set bit is a literal
+// byte. A cleared bit is a 2 byte big endian back-reference: the top 11 bits
+// are the distance minus one and the bottom 5 bits the length minus MinMatch.
+package lzss
+
+import "errors"
+
+const (
+	// WindowSize is the size of the window back-references are made into.
+	WindowSize = 1 << 11
+	// MinMatch is the shortest back-reference.
+	MinMatch = 3
+	// MaxMatch is the longest back-reference.
+	MaxMatch = MinMatch + 31
+
+	hashBits  = 12
+	maxChain  = 64
+	lenBits   = 5
+	lenMask   = 1<<lenBits - 1
+	emptyHead = -1
+)
+
+var (
+	errCorrupt    = errors.New("lzss: corrupt stream")
+	errWindowSize = errors.New("lzss: window must be WindowSize long")
+)
+
+// Encode appends the compressed form of src to dst and returns the extended buffer.
+func Encode(dst, src []byte) []byte {
+	var head [1 << hashBits]int32
+	for i := range head {
+		head[i] = emptyHead
+	}
+	prev := make([]int32, len(src))
+	insert := func(i int) {
+		if i+MinMatch <= len(src) {
+			h := hash(src[i:])
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	flagIdx, bit := 0, 8
+	for i := 0; i < len(src); bit++ {
+		if bit == 8 {
+			flagIdx, bit = len(dst), 0
+			dst = append(dst, 0)
+		}
+		bestLen, bestDist := 0, 0
+		if i+MinMatch <= len(src) {
+			end := min(i+MaxMatch, len(src))
+			j := int(head[hash(src[i:])])
+			for n := 0; j >= 0 && i-j <= WindowSize && n < maxChain; n++ {
+				l := matchLen(src[j:], src[i:end])
+				if l > bestLen {
+					bestLen, bestDist = l, i-j
+					if i+l == end {
+						break
+					}
+				}
+				j = int(prev[j])
+			}
+		}
+		if bestLen < MinMatch {
+			dst[flagIdx] |= 1 << bit
+			dst = append(dst, src[i])
+			insert(i)
+			i++
+			continue
+		}
+		v := uint16(bestDist-1)<<lenBits | uint16(bestLen-MinMatch)
+		dst = append(dst, byte(v>>8), byte(v))
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+	return dst
+}
+
+// Decode decompresses src using window, which must be WindowSize long, as
+// history buffer. emit is called with the decompressed data every time the
+// window fills up and once at the end with the remaining data. The data passed
+// to emit is only valid during the call. Decode returns the decompressed length.
+func Decode(src string, window []byte, emit func([]byte) error) (n int, err error) {
+	if len(window) != WindowSize {
+		return 0, errWindowSize
+	}
+	const mask = WindowSize - 1
+	for len(src) > 0 {
+		flags := src[0]
+		src = src[1:]
+		for bit := 0; bit < 8 && len(src) > 0; bit++ {
+			length, dist := 1, 0
+			if flags&(1<<bit) != 0 {
+				window[n&mask] = src[0]
+				src = src[1:]
+			} else {
+				if len(src) < 2 {
+					return n, errCorrupt
+				}
+				v := int(src[0])<<8 | int(src[1])
+				src = src[2:]
+				dist, length = v>>lenBits+1, v&lenMask+MinMatch
+				if dist > n {
+					return n, errCorrupt
+				}
+			}
+			for k := 0; k < length; k++ {
+				if dist != 0 {
+					window[n&mask] = window[(n-dist)&mask]
+				}
+				n++
+				if n&mask == 0 {
+					err = emit(window)
+					if err != nil {
+						return n, err
+					}
+				}
+			}
+		}
+	}
+	if n&mask != 0 {
+		err = emit(window[:n&mask])
+	}
+	return n, err
+}
+
+func hash(b []byte) uint32 {
+	return (uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])) * 2654435761 >> (32 - hashBits)
+}
+
+func matchLen(a, b []byte) int {
+	n := 0
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
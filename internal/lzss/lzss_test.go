@@ -0,0 +1,36 @@
+package lzss
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*WindowSize+7)
+	rng.Read(random)
+	repetitive := bytes.Repeat([]byte("firmware\x00\x01\x02"), 1000)
+	for _, src := range [][]byte{nil, []byte("ab"), random, repetitive, append(repetitive, random...)} {
+		compressed := Encode(nil, src)
+		var got []byte
+		window := make([]byte, WindowSize)
+		n, err := Decode(string(compressed), window, func(b []byte) error {
+			got = append(got, b...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if n != len(src) || !bytes.Equal(got, src) {
+			t.Fatalf("round trip of %d bytes mismatch, got %d bytes", len(src), n)
+		}
+	}
+	if len(Encode(nil, repetitive)) > len(repetitive)/8 {
+		t.Error("repetitive data not compressed")
+	}
+	// Back-references before the start of the stream must be rejected.
+	_, err := Decode("\x00\x00\x00", make([]byte, WindowSize), func([]byte) error { return nil })
+	if err != errCorrupt {
+		t.Errorf("got %v, want %v", err, errCorrupt)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !cy43noslog
+
+// Package slog is the logging API used by the driver. By default it is
+// log/slog. Builds with the cy43noslog tag replace it with a minimal leveled
+// key-value logger which saves the code size log/slog adds on TinyGo.
+package slog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type (
+	Logger  = slog.Logger
+	Handler = slog.Handler
+	Level   = slog.Level
+	Attr    = slog.Attr
+	Value   = slog.Value
+	Kind    = slog.Kind
+)
+
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+
+	KindString = slog.KindString
+)
+
+func String(key, v string) Attr                 { return slog.String(key, v) }
+func Int(key string, v int) Attr                { return slog.Int(key, v) }
+func Uint64(key string, v uint64) Attr          { return slog.Uint64(key, v) }
+func Bool(key string, v bool) Attr              { return slog.Bool(key, v) }
+func Duration(key string, v time.Duration) Attr { return slog.Duration(key, v) }
+
+// Enabled reports whether l logs records of the given level.
+func Enabled(l *Logger, level Level) bool {
+	return l.Handler().Enabled(context.Background(), level)
+}
+
+// Log logs a record with the given level, message and attributes.
+func Log(l *Logger, level Level, msg string, attrs ...Attr) {
+	l.LogAttrs(context.Background(), level, msg, attrs...)
+}
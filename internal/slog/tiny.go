@@ -0,0 +1,144 @@
+//go:build cy43noslog
+
+package slog
+
+import (
+	"strconv"
+	"time"
+)
+
+// Level is the importance of a log record. Levels match those of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG" + offset(l-LevelDebug)
+	case l < LevelWarn:
+		return "INFO" + offset(l-LevelInfo)
+	case l < LevelError:
+		return "WARN" + offset(l-LevelWarn)
+	}
+	return "ERROR" + offset(l-LevelError)
+}
+
+func offset(l Level) string {
+	if l == 0 {
+		return ""
+	} else if l > 0 {
+		return "+" + strconv.Itoa(int(l))
+	}
+	return strconv.Itoa(int(l))
+}
+
+// Kind is the kind of a Value.
+type Kind int
+
+const (
+	KindBool Kind = iota
+	KindDuration
+	KindInt64
+	KindString
+	KindUint64
+)
+
+// Value is the value of an attribute.
+type Value struct {
+	kind Kind
+	s    string
+	n    uint64
+}
+
+func (v Value) Kind() Kind              { return v.kind }
+func (v Value) Int64() int64            { return int64(v.n) }
+func (v Value) Uint64() uint64          { return v.n }
+func (v Value) Bool() bool              { return v.n != 0 }
+func (v Value) Duration() time.Duration { return time.Duration(v.n) }
+
+// String returns the value formatted as text.
+func (v Value) String() string {
+	switch v.kind {
+	case KindString:
+		return v.s
+	case KindBool:
+		return strconv.FormatBool(v.Bool())
+	case KindDuration:
+		return v.Duration().String()
+	case KindInt64:
+		return strconv.FormatInt(v.Int64(), 10)
+	}
+	return strconv.FormatUint(v.n, 10)
+}
+
+// Attr is a key-value pair.
+type Attr struct {
+	Key   string
+	Value Value
+}
+
+func String(key, v string) Attr        { return Attr{key, Value{kind: KindString, s: v}} }
+func Int(key string, v int) Attr       { return Attr{key, Value{kind: KindInt64, n: uint64(v)}} }
+func Uint64(key string, v uint64) Attr { return Attr{key, Value{kind: KindUint64, n: v}} }
+func Duration(key string, v time.Duration) Attr {
+	return Attr{key, Value{kind: KindDuration, n: uint64(v)}}
+}
+func Bool(key string, v bool) Attr {
+	var n uint64
+	if v {
+		n = 1
+	}
+	return Attr{key, Value{kind: KindBool, n: n}}
+}
+
+// Handler handles the log records of a Logger.
+type Handler interface {
+	// Enabled reports whether records of the given level are handled.
+	Enabled(level Level) bool
+	// Handle handles a record. attrs must not be retained.
+	Handle(level Level, msg string, attrs []Attr)
+}
+
+// Logger logs records to its Handler.
+type Logger struct {
+	h Handler
+}
+
+// New returns a logger which logs to h.
+func New(h Handler) *Logger { return &Logger{h: h} }
+
+// Handler returns the logger's handler.
+func (l *Logger) Handler() Handler { return l.h }
+
+// Enabled reports whether l logs records of the given level.
+func Enabled(l *Logger, level Level) bool { return l.h.Enabled(level) }
+
+// Log logs a record with the given level, message and attributes if the
+// level is enabled, as log/slog does.
+func Log(l *Logger, level Level, msg string, attrs ...Attr) {
+	if l.h.Enabled(level) {
+		l.h.Handle(level, msg, attrs)
+	}
+}
+
+// PrintHandler returns a handler printing records of the given level and
+// above with the print builtin, as "LEVEL msg key=value ...".
+func PrintHandler(level Level) Handler { return printHandler(level) }
+
+type printHandler Level
+
+func (h printHandler) Enabled(level Level) bool { return level >= Level(h) }
+
+func (h printHandler) Handle(level Level, msg string, attrs []Attr) {
+	print(level.String(), " ", msg)
+	for _, a := range attrs {
+		print(" ", a.Key, "=", a.Value.String())
+	}
+	println()
+}
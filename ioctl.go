@@ -8,14 +8,15 @@ import (
 	"errors"
 	"io"
 	"time"
+	"unsafe"
 
-	"log/slog"
-
+	"github.com/soypat/cyw43439/internal/slog"
 	"github.com/soypat/cyw43439/whd"
 )
 
 var (
 	errTxPacketTooLarge      = errors.New("tx packet too large")
+	errTxHeadroom            = errors.New("tx buffer shorter than headroom")
 	errLinkDown              = errors.New("link down")
 	errIOVarTooLarge         = errors.New("iovar too large")
 	errInvalidIoctlIface     = errors.New("invalid ioctl iface")
@@ -88,24 +89,46 @@ func (d *Device) has_credit() bool {
 
 // 2 is padding necessary in the SDPCM header.
 const mtuPrefix = 2 + whd.SDPCM_HEADER_LEN + whd.BDC_HEADER_LEN
+
+// MTU is the largest payload of a single bus transfer.
+//
+// Deprecated: MTU is not the link MTU; use LinkMTU for the largest IP packet
+// and MaxFrameSize for the largest Ethernet frame sent with SendEth.
 const MTU = 2048 - mtuPrefix
 
-// tx transmits a SDPCM+BDC data packet to the device.
-func (d *Device) tx(packet []byte) (err error) {
-	if !d.IsLinkUp() {
+const (
+	// LinkMTU is the largest IP packet carried in a frame, the link MTU.
+	LinkMTU = 1500
+	// MaxFrameSize is the largest Ethernet frame accepted by SendEth and
+	// SendEthIface: the header, an optional 802.1Q tag and a LinkMTU payload.
+	// The frame check sequence is added by the chip.
+	MaxFrameSize = ethHeaderLen + 4 + LinkMTU
+	// TxHeadroom is the length of the SDPCM and BDC bus headers the driver
+	// places before each frame in its transmit buffer, which holds
+	// MaxFrameSize+TxHeadroom bytes. SendEth copies frames to it, so callers
+	// need not reserve headroom, while SendEthWithHeadroom writes the headers
+	// to headroom reserved by the caller to avoid the copy.
+	TxHeadroom = mtuPrefix
+)
+
+// isIfaceUp reports whether data frames can be sent over iface.
+func (d *Device) isIfaceUp(iface whd.IoctlInterface) bool {
+	return (d.apUp && iface == d.apIface) || (iface == whd.IF_STA && d.state == linkStateUp)
+}
+
+// tx transmits a SDPCM+BDC data packet to the device over iface.
+func (d *Device) tx(iface whd.IoctlInterface, prio uint8, packet []byte) (err error) {
+	if !d.isIfaceUp(iface) {
 		return errLinkDown
 	}
 	// reference: https://github.com/embassy-rs/embassy/blob/6babd5752e439b234151104d8d20bae32e41d714/cyw43/src/runner.rs#L247
-	d.debug("tx", slog.Int("len", len(packet)))
+	if d.logenabled(slog.LevelDebug) {
+		d.debug("tx", slog.Int("len", len(packet)))
+	}
 	buf := d._sendIoctlBuf[:]
 	buf8 := u32AsU8(buf)
-
-	// There MUST be 2 bytes of padding between the SDPCM and BDC headers (only for data packets). See reference.
-	// "¯\_(ツ)_/¯"
-
-	const PADDING_SIZE = 2
 	totalLen := mtuPrefix + len(packet)
-	if totalLen > len(buf8) {
+	if len(packet) > MaxFrameSize || totalLen > len(buf8) {
 		return errTxPacketTooLarge
 	}
 	d.log_read()
@@ -114,7 +137,44 @@ func (d *Device) tx(packet []byte) (err error) {
 	if err != nil {
 		return err
 	}
+	copy(buf8[mtuPrefix:], packet)
+	return d.tx_write(iface, prio, buf, len(packet))
+}
+
+// tx_inplace transmits the packet following TxHeadroom bytes of headroom in
+// buf like tx, writing the bus headers to the headroom to avoid copying the
+// packet. Falls back to tx if buf is not suitably aligned.
+func (d *Device) tx_inplace(iface whd.IoctlInterface, prio uint8, buf []byte) (err error) {
+	packet := buf[TxHeadroom:]
+	words := int(align(uint32(len(buf)), 4) / 4)
+	ptr := unsafe.Pointer(unsafe.SliceData(buf))
+	if uintptr(ptr)%4 != 0 || cap(buf) < 4*words {
+		return d.tx(iface, prio, packet)
+	} else if !d.isIfaceUp(iface) {
+		return errLinkDown
+	} else if len(packet) > MaxFrameSize {
+		return errTxPacketTooLarge
+	}
+	if d.logenabled(slog.LevelDebug) {
+		d.debug("tx_inplace", slog.Int("len", len(packet)))
+	}
+	d.log_read()
+	err = d.waitForCredit(d._sendIoctlBuf[:])
+	if err != nil {
+		return err
+	}
+	return d.tx_write(iface, prio, unsafe.Slice((*uint32)(ptr), words), len(packet))
+}
+
+// tx_write fills in the bus headers before the packet of length n at offset
+// TxHeadroom of buf and writes it to the bus. Callers must wait for credit.
+func (d *Device) tx_write(iface whd.IoctlInterface, prio uint8, buf []uint32, n int) (err error) {
+	buf8 := u32AsU8(buf)
+	// There MUST be 2 bytes of padding between the SDPCM and BDC headers (only for data packets). See reference.
+	// "¯\_(ツ)_/¯"
 
+	const PADDING_SIZE = 2
+	totalLen := mtuPrefix + n
 	seq := d.sdpcmSeq
 	d.sdpcmSeq++ // Go wraps around on overflow by default.
 
@@ -126,15 +186,23 @@ func (d *Device) tx(packet []byte) (err error) {
 		HeaderLength: whd.SDPCM_HEADER_LEN + PADDING_SIZE,
 	}
 	d.lastSDPCMHeader.Put(_busOrder, buf8[:whd.SDPCM_HEADER_LEN])
+	buf8[whd.SDPCM_HEADER_LEN], buf8[whd.SDPCM_HEADER_LEN+1] = 0, 0
 
 	d.auxBDCHeader = whd.BDCHeader{
-		Flags: 2 << 4, // BDC version.
+		Flags:    2 << 4,       // BDC version.
+		Priority: prio & 7,     // 802.1D priority, mapped to a WMM access category.
+		Flags2:   uint8(iface), // Interface index.
 	}
 	d.auxBDCHeader.Put(buf8[whd.SDPCM_HEADER_LEN+PADDING_SIZE:])
 
-	copy(buf8[whd.SDPCM_HEADER_LEN+PADDING_SIZE+whd.BDC_HEADER_LEN:], packet)
-
-	return d.wlan_write(buf[:align(uint32(totalLen), 4)/4], uint32(totalLen))
+	err = d.wlan_write(buf[:align(uint32(totalLen), 4)/4], uint32(totalLen))
+	if err != nil {
+		d.stats.TxErrors++
+		return err
+	}
+	d.stats.TxFrames++
+	d.stats.TxBytes += uint64(n)
+	return nil
 }
 
 func (d *Device) get_iovar(VAR string, iface whd.IoctlInterface) (_ uint32, err error) {
@@ -207,6 +275,10 @@ func (d *Device) doIoctlGet(cmd whd.SDPCMCommand, iface whd.IoctlInterface, data
 	if err != nil {
 		return 0, err
 	}
+	if strictMode {
+		d.strict_check(len(packet) >= len(data), "ioctl response shorter than request",
+			slog.String("cmd", cmd.String()), slog.Int("len", len(packet)), slog.Int("want", len(data)))
+	}
 
 	n = copy(data[:], packet)
 	return n, nil
@@ -317,7 +389,7 @@ func (d *Device) irqPoll() {
 		d.unlock()
 		// Avoid busy waiting on idle.  Trade off here is time sleeping
 		// is time added to receive latency.
-		time.Sleep(10 * time.Millisecond)
+		d.sleep(10 * time.Millisecond)
 	}
 }
 
@@ -333,6 +405,9 @@ func (d *Device) f2PacketAvail() (bool, uint16) {
 	// If that didn't work, get the interurpt status, which updates cached
 	// status
 	irq := d.getInterrupts()
+	if irq&Interrupts(irqF1_INTR) != 0 {
+		d.hci_invalidate() // Bluetooth controller interrupt, see BufferedHCI.
+	}
 	if irq.IsF2Available() {
 		status = d.spi.Status()
 		if status.F2PacketAvailable() {
@@ -359,9 +434,9 @@ func (d *Device) waitForCredit(buf []uint32) error {
 		} else if d.has_credit() {
 			return nil
 		}
-		time.Sleep(10 * time.Millisecond)
+		d.sleep(10 * time.Millisecond)
 	}
-	return errWaitForCreditTimeout
+	return d.flight_failure(FailureIoctlTimeout, errWaitForCreditTimeout)
 }
 
 // pollForIoctl polls until a control/ioctl/cdc packet is received.
@@ -374,9 +449,9 @@ func (d *Device) pollForIoctl(buf []uint32) ([]byte, error) {
 		} else if hdr == whd.CONTROL_HEADER {
 			return buf8, nil
 		}
-		time.Sleep(10 * time.Millisecond)
+		d.sleep(10 * time.Millisecond)
 	}
-	return nil, errors.New("pollForIoctl timeout")
+	return nil, d.flight_failure(FailureIoctlTimeout, errIoctlPollTimeout)
 }
 
 // check_status handles F2 events while status register is set.
@@ -406,6 +481,8 @@ func (d *Device) tryPoll(buf []uint32) ([]byte, whd.SDPCMHeaderType, error) {
 	if err != nil {
 		return nil, whd.UNKNOWN_HEADER, err
 	}
+	d.busIdlePolls = 0
+	d.rxTime = d.now() // Timestamp as close to bus read as possible.
 	buf8 := u32AsU8(buf[:])
 	offset, plen, hdrType, err := d.rx(buf8[:length])
 
@@ -417,8 +494,11 @@ func (d *Device) tryPoll(buf []uint32) ([]byte, whd.SDPCMHeaderType, error) {
 			d.debug("tryPoll:ignore_spurious", slog.String("err", err.Error()))
 		}
 		err = nil
-	} else if err != nil && d.logenabled(slog.LevelError) {
-		d.logerr("tryPoll:rx", slog.Uint64("plen", uint64(plen)), slog.String("err", err.Error()))
+	} else if err != nil {
+		d.stats.RxErrors++
+		if d.logenabled(slog.LevelError) {
+			d.logerr("tryPoll:rx", slog.Uint64("plen", uint64(plen)), slog.String("err", err.Error()))
+		}
 	}
 	return buf8[offset : offset+plen], hdrType, err
 }
@@ -432,16 +512,26 @@ func (d *Device) rx(packet []byte) (offset, plen uint16, _ whd.SDPCMHeaderType,
 
 	d.lastSDPCMHeader = whd.DecodeSDPCMHeader(_busOrder, packet)
 	hdrType := d.lastSDPCMHeader.Type()
-	d.debug("rx", slog.Int("len", len(packet)), slog.String("hdr", hdrType.String()))
+	if d.logenabled(slog.LevelDebug) {
+		d.debug("rx", slog.Int("len", len(packet)), slog.String("hdr", hdrType.String()))
+	}
 	payload, err := d.lastSDPCMHeader.Parse(packet)
 	if err != nil {
 		return 0, 0, noPacket, err
 	}
 	d.update_credit(&d.lastSDPCMHeader)
+	if !d.rx_check_seq(d.lastSDPCMHeader.Seq) {
+		return 0, 0, noPacket, nil // Duplicate or stale packet, already processed.
+	}
 
 	// Other Rx methods received the payload without SDPCM header.
 	switch hdrType {
 	case whd.CONTROL_HEADER:
+		if d.async_response(payload) {
+			return 0, 0, noPacket, nil // Not the response sync ioctls wait for.
+		} else if d.stale_response(payload) {
+			return 0, 0, noPacket, nil
+		}
 		offset, plen, err = d.rxControl(payload)
 	case whd.ASYNCEVENT_HEADER:
 		err = d.rxEvent(payload)
@@ -453,6 +543,51 @@ func (d *Device) rx(packet []byte) (offset, plen uint16, _ whd.SDPCMHeaderType,
 	return offset, plen, hdrType, err
 }
 
+// rx_check_seq checks the sequence number of a received SDPCM packet against the
+// expected one. Gaps are counted and resynchronized to so that processing
+// continues after lost packets. Returns false for duplicate or stale packets,
+// which must not be processed again.
+func (d *Device) rx_check_seq(seq uint8) bool {
+	expect := d.rxSeq
+	d.rxSeq = seq + 1
+	if !d.rxSeqValid {
+		d.rxSeqValid = true
+		return true
+	}
+	switch diff := seq - expect; {
+	case diff == 0:
+		return true
+	case diff < 0x80:
+		d.stats.RxSeqGaps++
+		d.stats.RxSeqLost += uint32(diff)
+		d.warn("rx:seq_gap", slog.Int("expect", int(expect)), slog.Int("got", int(seq)))
+		return true
+	default:
+		// Sequence went backwards: a repeated read of a packet already processed.
+		// Keep expecting the sequence number following the last processed packet.
+		d.rxSeq = expect
+		d.stats.RxSeqDuplicates++
+		d.warn("rx:seq_dup", slog.Int("expect", int(expect)), slog.Int("got", int(seq)))
+		return false
+	}
+}
+
+// stale_response returns true if the control packet payload is the late
+// response of an ioctl which timed out, i.e: its ID is not the one of the
+// last ioctl sent. Stale responses are dropped so they are not taken as
+// the response of the ioctl being waited for.
+func (d *Device) stale_response(payload []byte) bool {
+	if len(payload) < whd.CDC_HEADER_LEN {
+		return false
+	}
+	id := whd.DecodeCDCHeader(_busOrder, payload).ID
+	if id == d.ioctlID {
+		return false
+	}
+	d.warn("rx:stale_ioctl", slog.Int("id", int(id)), slog.Int("want", int(d.ioctlID)))
+	return true
+}
+
 func (d *Device) rxControl(packet []byte) (offset, plen uint16, err error) {
 	d.auxCDCHeader = whd.DecodeCDCHeader(_busOrder, packet)
 	if d.isTraceEnabled() {
@@ -468,10 +603,19 @@ func (d *Device) rxControl(packet []byte) (offset, plen uint16, err error) {
 		d.logerr("rxControl:ioctlerror", slog.Uint64("status", uint64(d.auxCDCHeader.Status)))
 		return 0, 0, errRxIoctlStatus
 	}
+	if strictMode {
+		d.strict_check(len(packet) >= whd.CDC_HEADER_LEN, "CDC header exceeds packet", slog.Int("len", len(packet)))
+		d.strict_check(uint32(len(packet)-whd.CDC_HEADER_LEN) >= d.auxCDCHeader.Length, "CDC length exceeds packet",
+			slog.Int("len", len(packet)), slog.Uint64("cdc.Len", uint64(d.auxCDCHeader.Length)))
+		d.strict_check(d.auxCDCHeader.ID == d.ioctlID, "ioctl response ID mismatch",
+			slog.Int("id", int(d.auxCDCHeader.ID)), slog.Int("want", int(d.ioctlID)))
+	}
 	offset = uint16(d.lastSDPCMHeader.HeaderLength + whd.CDC_HEADER_LEN)
 	// NB: losing some precision here (uint16(uint32)).
 	plen = uint16(d.auxCDCHeader.Length)
-	d.trace("rxControl:success", slog.Int("plen", int(plen)))
+	if d.isTraceEnabled() {
+		d.trace("rxControl:success", slog.Int("plen", int(plen)))
+	}
 	return offset, plen, nil
 }
 
@@ -501,6 +645,14 @@ func (d *Device) rxEvent(packet []byte) (err error) {
 	if err != nil {
 		return err
 	}
+	d.stats.RxEvents++
+	d.flight.event(FailureEvent{At: d.rxTime, Event: aePacket.Message.EventType,
+		Status: aePacket.Message.Status, Reason: aePacket.Message.Reason})
+	if strictMode {
+		d.strict_check(len(bdcPacket) >= whd.EVENT_PACKET_LEN &&
+			uint32(len(bdcPacket)-whd.EVENT_PACKET_LEN) >= aePacket.Message.DataLen, "event data exceeds packet",
+			slog.Int("len", len(bdcPacket)), slog.Uint64("datalen", uint64(aePacket.Message.DataLen)))
+	}
 	if d.isTraceEnabled() {
 		d.trace("rxEvent",
 			slog.Int("plen", len(packet)),
@@ -511,6 +663,10 @@ func (d *Device) rxEvent(packet []byte) (err error) {
 		)
 	}
 	ev := aePacket.Message.EventType
+	if d.joinTrace != nil {
+		d.jointrace_event(&aePacket.Message)
+	}
+	d.blacklist_event(&aePacket.Message)
 	if !d.eventmask.IsEnabled(ev) {
 		return nil
 	}
@@ -537,6 +693,16 @@ func (d *Device) rxEvent(packet []byte) (err error) {
 		}
 	case whd.EvDEAUTH, whd.EvDISASSOC:
 		d.state = linkStateDown
+	case whd.EvESCAN_RESULT:
+		if len(bdcPacket) >= whd.EVENT_PACKET_LEN {
+			d.rxScanResult(aePacket.Message.Status, bdcPacket[whd.EVENT_PACKET_LEN:])
+		}
+		return nil // Don't log each scan result.
+	case whd.EvPROBREQ_MSG_RX:
+		if len(bdcPacket) >= whd.EVENT_PACKET_LEN {
+			d.rxProbeRequest(bdcPacket[whd.EVENT_PACKET_LEN:])
+		}
+		return nil
 	}
 	if d.logenabled(slog.LevelInfo) {
 		d.info("rxEvent",
@@ -552,14 +718,53 @@ func (d *Device) rxEvent(packet []byte) (err error) {
 
 func (d *Device) rxData(packet []byte) (err error) {
 	d.trace("rxData:start")
-	if d.rcvEth != nil {
-		bdcHdr := whd.DecodeBDCHeader(packet)
-		packetStart := whd.BDC_HEADER_LEN + 4*int(bdcHdr.DataOffset)
-		if packetStart > len(packet) {
-			return errInvalidRxBDCHeaderLen
+	if len(packet) < whd.BDC_HEADER_LEN {
+		return errPacketSmol
+	}
+	bdcHdr := whd.DecodeBDCHeader(packet)
+	iface := bdcHdr.Interface()
+	packetStart := whd.BDC_HEADER_LEN + 4*int(bdcHdr.DataOffset)
+	if packetStart > len(packet) {
+		return errInvalidRxBDCHeaderLen
+	}
+	payload := packet[packetStart:]
+	d.stats.RxFrames++
+	d.stats.RxBytes += uint64(len(payload))
+	if d.bridge != nil && d.bridge_rx(iface, payload) {
+		return nil
+	}
+	if !d.rxfilter_pass(iface, payload) {
+		d.stats.RxFiltered++
+		return nil
+	} else if d.rxLimit.rate != 0 && len(payload) > 0 && payload[0]&1 != 0 && !d.rxLimit.allow(d.rxTime) {
+		d.stats.RxRateLimited++
+		return nil
+	}
+	if d.joinTrace != nil {
+		d.jointrace_eapol(payload)
+	}
+	if d.rcvHalted {
+		d.stats.RxDropped++
+		return nil
+	}
+	demuxed := d.recv_demux(payload)
+	if d.rcvHalted {
+		return errRecvHalted // Halted by a handler registered with AddRecvHandler.
+	}
+	hasIfaceHandler := iface.IsValid() && d.rcvEthIface[iface] != nil
+	if !hasIfaceHandler && d.rcvEthTS == nil && d.rcvEth == nil {
+		if demuxed == 0 {
+			d.stats.RxDropped++
 		}
-		payload := packet[packetStart:]
-		return d.rcvEth(payload)
+		return nil
 	}
-	return nil
+	switch {
+	case hasIfaceHandler:
+		err = d.recv_call(d.rcvEthIface[iface], payload)
+	case d.rcvEthTS != nil:
+		err = d.recv_call_ts(payload)
+	default:
+		err = d.recv_call(d.rcvEth, payload)
+	}
+	return d.recv_error(err)
 }
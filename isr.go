@@ -0,0 +1,45 @@
+package cyw43439
+
+import "errors"
+
+var errLockInterrupt = errors.New("device method called from interrupt context, use ISRNotify")
+
+// ISRNotify records that the chip asserted host-wake, signalling packets are
+// pending. It is the only Device method safe to call from interrupt context:
+// it sets an atomic flag and never takes the device lock, allocates, logs or
+// touches the bus. Calling any other method from an interrupt handler
+// corrupts the gSPI transaction in progress or deadlocks on the device lock,
+// which panics on TinyGo. The main loop services the notification with
+// PollNotified.
+//
+// On the Pico W host-wake shares GPIO24 with the gSPI data line so the
+// interrupt also fires during bus transactions; the spurious notifications
+// only cost an empty poll. Integration with the RP2040 GPIO interrupts:
+//
+//	machine.GPIO24.SetInterrupt(machine.PinRising, func(machine.Pin) {
+//		dev.ISRNotify()
+//	})
+//	for {
+//		_, _, err := dev.PollNotified(cyw43439.PollBudget{MaxFrames: 4})
+//		if err != nil {
+//			println(err.Error())
+//		}
+//		// Sleep or run other tasks until the next interrupt.
+//	}
+func (d *Device) ISRNotify() {
+	d.isrPending.Store(true)
+}
+
+// PollNotified polls the device as Poll does if ISRNotify was called since the
+// last call, returning immediately otherwise. If the budget is exhausted the
+// notification is kept so the next call polls again.
+func (d *Device) PollNotified(budget PollBudget) (frames, hci int, err error) {
+	if !d.isrPending.Swap(false) {
+		return 0, 0, nil
+	}
+	frames, hci, err = d.Poll(budget)
+	if err != nil || frames >= max(budget.MaxFrames, 1) || (budget.MaxHCI > 0 && hci >= budget.MaxHCI) {
+		d.isrPending.Store(true) // More work may be pending.
+	}
+	return frames, hci, err
+}
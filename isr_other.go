@@ -0,0 +1,6 @@
+//go:build !tinygo
+
+package cyw43439
+
+// inInterrupt reports whether the caller runs in interrupt context.
+func inInterrupt() bool { return false }
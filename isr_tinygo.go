@@ -0,0 +1,8 @@
+//go:build tinygo
+
+package cyw43439
+
+import "runtime/interrupt"
+
+// inInterrupt reports whether the caller runs in interrupt context.
+func inInterrupt() bool { return interrupt.In() }
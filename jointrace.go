@@ -0,0 +1,375 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// maxJoinSteps bounds the steps recorded by a join trace.
+const maxJoinSteps = 32
+
+// EAPOL-Key frame layout after the Ethernet header, see IEEE 802.11 12.7.2.
+const (
+	eapolTypeKey     = 3
+	eapolKeyInfo     = 5 // Offset of key information in the EAPOL frame.
+	eapolKeyInfoLen  = 7
+	eapolKeyInstall  = 1 << 6
+	eapolKeyAck      = 1 << 7
+	eapolKeyMIC      = 1 << 8
+	eapolKeySecure   = 1 << 9
+	eapolKeyPairwise = 1 << 3
+)
+
+// 802.11 reason codes of interest, reported in deauthentication and disassociation events.
+const (
+	reasonPrevAuthInvalid = 2
+	reasonFourWayTimeout  = 15
+	reasonGroupKeyTimeout = 16
+	reason8021XFailed     = 23
+)
+
+// Prune reasons reported by PRUNE events when the firmware discards a candidate AP.
+const (
+	pruneEncrMismatch  = 1
+	pruneMACDeny       = 3
+	pruneRSNMismatch   = 8
+	pruneNoCommonRates = 9
+	pruneCipherNA      = 12
+)
+
+// JoinStep is an event observed during a join, see JoinReport.
+type JoinStep struct {
+	// At is the time since the join started.
+	At time.Duration
+	// Event is the firmware event, zero for EAPOL frames.
+	Event whd.AsyncEventType
+	// Status and Reason are the event's status and reason codes. Reason is
+	// the 802.11 reason or status code for most events.
+	Status uint32
+	Reason uint32
+	// Addr is the peer address of the event, usually the AP's BSSID.
+	Addr [6]byte
+	// EAPOLKey is the 4-way handshake message number (1-4) of an EAPOL-Key
+	// frame seen on the data path. EAPOL frames are usually consumed by the
+	// firmware supplicant and only reach the host with some firmwares.
+	EAPOLKey uint8
+}
+
+// String returns a human readable description of the step.
+func (s JoinStep) String() string {
+	str := "+" + s.At.Round(time.Millisecond).String() + " "
+	if s.EAPOLKey != 0 {
+		return str + "EAPOL-Key message " + strconv.Itoa(int(s.EAPOLKey)) + " of 4"
+	}
+	str += s.Event.String()
+	switch s.Event {
+	case whd.EvPSK_SUP:
+		str += " state=" + supStateName(s.Status)
+	default:
+		str += " status=" + eventStatusName(s.Status)
+	}
+	if s.Reason != 0 {
+		str += " reason=" + strconv.Itoa(int(s.Reason))
+		if s.Event == whd.EvPRUNE {
+			str += pruneReasonText(s.Reason)
+		} else {
+			str += reasonText(s.Reason)
+		}
+	}
+	return str
+}
+
+// JoinReport is returned, wrapping the join error, by a failed JoinWPA2 or
+// JoinWithOptions while join tracing is enabled, see SetJoinTrace. It lists
+// the authentication, association and handshake events of the attempt and a
+// diagnosis of where it failed. Retrieve it with errors.As:
+//
+//	var report *cyw43439.JoinReport
+//	if errors.As(err, &report) {
+//		println(report.String())
+//	}
+type JoinReport struct {
+	SSID string
+	// Err is the error the join failed with.
+	Err error
+	// Elapsed is the time the join took.
+	Elapsed time.Duration
+	// Steps are the events observed in order. Events past the first 32 are dropped.
+	Steps []JoinStep
+
+	start time.Time
+}
+
+// Error implements the error interface.
+func (r *JoinReport) Error() string {
+	return "join " + strconv.Quote(r.SSID) + " failed: " + r.Diagnosis() + ": " + r.Err.Error()
+}
+
+// Unwrap returns the join error.
+func (r *JoinReport) Unwrap() error { return r.Err }
+
+// String returns the diagnosis followed by one line per step.
+func (r *JoinReport) String() string {
+	s := r.Error() + " elapsed=" + r.Elapsed.String()
+	for _, step := range r.Steps {
+		s += "\n\t" + step.String()
+	}
+	return s
+}
+
+// Diagnosis returns a short human readable explanation of where the join failed.
+func (r *JoinReport) Diagnosis() string {
+	var authOK, assocOK bool
+	var eapolMsgs uint8
+	for _, s := range r.Steps {
+		if s.EAPOLKey != 0 {
+			eapolMsgs |= 1 << (s.EAPOLKey - 1)
+			continue
+		}
+		switch s.Event {
+		case whd.EvSET_SSID:
+			if s.Status == whd.CYW43_STATUS_NO_NETWORKS {
+				return "network not found, check the SSID and that the AP uses the 2.4GHz band"
+			}
+		case whd.EvPRUNE:
+			switch s.Reason {
+			case pruneEncrMismatch, pruneRSNMismatch, pruneCipherNA:
+				return "AP security does not match, the driver joins WPA2-PSK (AES) networks"
+			case pruneMACDeny:
+				return "AP MAC address filter rejected the device"
+			case pruneNoCommonRates:
+				return "AP rates not supported, 2.4GHz b/g/n rates required"
+			}
+		case whd.EvAUTH:
+			if s.Status == whd.CYW43_STATUS_TIMEOUT || s.Status == whd.CYW43_STATUS_NO_ACK {
+				return "AP did not answer authentication, it may be out of range"
+			} else if s.Status != whd.CYW43_STATUS_SUCCESS {
+				return "AP rejected authentication with status code " + strconv.Itoa(int(s.Reason))
+			}
+			authOK = true
+		case whd.EvASSOC, whd.EvREASSOC:
+			if s.Status == whd.CYW43_STATUS_TIMEOUT || s.Status == whd.CYW43_STATUS_NO_ACK {
+				return "AP did not answer association, it may be out of range"
+			} else if s.Status != whd.CYW43_STATUS_SUCCESS {
+				return "AP rejected association with status code " + strconv.Itoa(int(s.Reason)) + ", it may be full"
+			}
+			assocOK = true
+		case whd.EvDEAUTH_IND, whd.EvDISASSOC_IND, whd.EvDEAUTH, whd.EvDISASSOC:
+			switch s.Reason {
+			case reasonFourWayTimeout, reasonPrevAuthInvalid, reason8021XFailed:
+				if assocOK {
+					return "AP dropped the connection during the 4-way handshake, most likely a wrong passphrase"
+				}
+			case reasonGroupKeyTimeout:
+				return "group key handshake timed out"
+			}
+			if assocOK {
+				return "AP disconnected the device after association" + reasonText(s.Reason)
+			}
+		case whd.EvPSK_SUP:
+			if s.Status != whd.CYW43_SUP_KEYED && s.Status != whd.CYW43_SUP_DISCONNECTED {
+				return "4-way handshake failed in state " + supStateName(s.Status) + ", most likely a wrong passphrase"
+			}
+		}
+	}
+	switch {
+	case eapolMsgs&1 != 0 && eapolMsgs&4 == 0:
+		return "AP did not continue the 4-way handshake, most likely a wrong passphrase"
+	case assocOK:
+		return "associated but the handshake did not complete"
+	case authOK:
+		return "authenticated but association did not complete"
+	case len(r.Steps) == 0:
+		return "no response from firmware, the network may be out of range"
+	}
+	return "join did not complete"
+}
+
+// SetJoinTrace enables or disables join tracing. While enabled joins record
+// the firmware's authentication, association and handshake events and EAPOL
+// frames, and failed joins return a *JoinReport explaining where the join
+// failed. Intended for troubleshooting connection problems.
+func (d *Device) SetJoinTrace(enable bool) {
+	d.lock()
+	defer d.unlock()
+	if !enable {
+		d.joinTrace = nil
+	} else if d.joinTrace == nil {
+		d.joinTrace = &joinTrace{}
+	}
+}
+
+// joinTrace is the join trace state, recording while active is set.
+type joinTrace struct {
+	report JoinReport
+	steps  [maxJoinSteps]JoinStep
+	active bool
+}
+
+// jointrace_start starts recording a join to ssid if tracing is enabled.
+func (d *Device) jointrace_start(ssid string) {
+	if d.joinTrace == nil {
+		return
+	}
+	d.joinTrace.report = JoinReport{SSID: ssid, Steps: d.joinTrace.steps[:0], start: d.now()}
+	d.joinTrace.active = true
+}
+
+// jointrace_end stops recording and, if err is not nil and tracing is enabled,
+// returns a *JoinReport wrapping err.
+func (d *Device) jointrace_end(err error) error {
+	if d.joinTrace == nil || !d.joinTrace.active {
+		return err
+	}
+	d.joinTrace.active = false
+	if err == nil {
+		return nil
+	}
+	report := d.joinTrace.report
+	report.Err = err
+	report.Elapsed = d.since(report.start)
+	report.Steps = append([]JoinStep(nil), report.Steps...)
+	d.info("join:report", slog.String("report", report.String()))
+	return &report
+}
+
+// jointrace_event records join related firmware events.
+func (d *Device) jointrace_event(msg *whd.EventMessage) {
+	switch msg.EventType {
+	case whd.EvSET_SSID, whd.EvJOIN, whd.EvJOIN_START, whd.EvAUTH, whd.EvASSOC_START,
+		whd.EvASSOC, whd.EvREASSOC, whd.EvDEAUTH, whd.EvDEAUTH_IND, whd.EvDISASSOC,
+		whd.EvDISASSOC_IND, whd.EvLINK, whd.EvPSK_SUP, whd.EvPRUNE:
+		d.jointrace_add(JoinStep{Event: msg.EventType, Status: msg.Status, Reason: msg.Reason, Addr: msg.Addr})
+	}
+}
+
+// jointrace_eapol records EAPOL-Key frames of the 4-way handshake.
+func (d *Device) jointrace_eapol(pkt []byte) {
+	if len(pkt) < ethHeaderLen+eapolKeyInfoLen || binary.BigEndian.Uint16(pkt[12:14]) != EtherTypeEAPOL ||
+		pkt[ethHeaderLen+1] != eapolTypeKey {
+		return
+	}
+	info := binary.BigEndian.Uint16(pkt[ethHeaderLen+eapolKeyInfo:])
+	var msg uint8
+	switch {
+	case info&eapolKeyPairwise == 0:
+		return // Group key handshake.
+	case info&eapolKeyAck != 0 && info&eapolKeyMIC == 0:
+		msg = 1
+	case info&eapolKeyAck != 0:
+		msg = 3
+	case info&eapolKeySecure == 0:
+		msg = 2
+	default:
+		msg = 4
+	}
+	var addr [6]byte
+	copy(addr[:], pkt[6:12])
+	d.jointrace_add(JoinStep{EAPOLKey: msg, Addr: addr})
+}
+
+func (d *Device) jointrace_add(step JoinStep) {
+	r := &d.joinTrace.report
+	if !d.joinTrace.active || len(r.Steps) == cap(r.Steps) {
+		return
+	}
+	step.At = d.since(r.start)
+	r.Steps = append(r.Steps, step)
+}
+
+var eventStatusNames = [...]string{
+	whd.CYW43_STATUS_SUCCESS:     "success",
+	whd.CYW43_STATUS_FAIL:        "fail",
+	whd.CYW43_STATUS_TIMEOUT:     "timeout",
+	whd.CYW43_STATUS_NO_NETWORKS: "no-networks",
+	whd.CYW43_STATUS_ABORT:       "abort",
+	whd.CYW43_STATUS_NO_ACK:      "no-ack",
+	whd.CYW43_STATUS_UNSOLICITED: "unsolicited",
+	whd.CYW43_STATUS_ATTEMPT:     "attempt",
+	whd.CYW43_STATUS_PARTIAL:     "partial",
+	whd.CYW43_STATUS_NEWSCAN:     "newscan",
+	whd.CYW43_STATUS_NEWASSOC:    "newassoc",
+}
+
+func eventStatusName(status uint32) string {
+	if status < uint32(len(eventStatusNames)) {
+		return eventStatusNames[status]
+	}
+	return strconv.Itoa(int(status))
+}
+
+var supStateNames = [...]string{
+	whd.CYW43_SUP_DISCONNECTED:       "disconnected",
+	whd.CYW43_SUP_CONNECTING:         "connecting",
+	whd.CYW43_SUP_IDREQUIRED:         "id-required",
+	whd.CYW43_SUP_AUTHENTICATING:     "authenticating",
+	whd.CYW43_SUP_KEYXCHANGE_WAIT_M1: "wait-M1",
+	whd.CYW43_SUP_KEYXCHANGE_PREP_M2: "prep-M2",
+	whd.CYW43_SUP_KEYED:              "keyed",
+	whd.CYW43_SUP_TIMEOUT:            "timeout",
+	whd.CYW43_SUP_KEYXCHANGE_WAIT_M3: "wait-M3",
+	whd.CYW43_SUP_KEYXCHANGE_PREP_M4: "prep-M4",
+	whd.CYW43_SUP_KEYXCHANGE_WAIT_G1: "wait-G1",
+	whd.CYW43_SUP_KEYXCHANGE_PREP_G2: "prep-G2",
+}
+
+func supStateName(state uint32) string {
+	if state < uint32(len(supStateNames)) {
+		return supStateNames[state]
+	}
+	return strconv.Itoa(int(state))
+}
+
+// reasonText describes common 802.11 reason codes.
+func reasonText(reason uint32) string {
+	switch reason {
+	case 1:
+		return " (unspecified)"
+	case reasonPrevAuthInvalid:
+		return " (previous authentication no longer valid)"
+	case 3:
+		return " (AP is leaving)"
+	case 4:
+		return " (inactivity)"
+	case 5:
+		return " (AP is full)"
+	case 8:
+		return " (AP disassociated leaving)"
+	case 14:
+		return " (MIC failure)"
+	case reasonFourWayTimeout:
+		return " (4-way handshake timeout)"
+	case reasonGroupKeyTimeout:
+		return " (group key handshake timeout)"
+	case 17:
+		return " (IE mismatch)"
+	case 18, 19:
+		return " (invalid cipher)"
+	case 20:
+		return " (invalid AKMP)"
+	case reason8021XFailed:
+		return " (802.1X authentication failed)"
+	}
+	return ""
+}
+
+// pruneReasonText describes the reasons the firmware prunes an AP from the join candidates.
+func pruneReasonText(reason uint32) string {
+	switch reason {
+	case pruneEncrMismatch:
+		return " (encryption mismatch)"
+	case pruneMACDeny:
+		return " (MAC address denied)"
+	case pruneRSNMismatch:
+		return " (RSN mismatch)"
+	case pruneNoCommonRates:
+		return " (no common rates)"
+	case pruneCipherNA:
+		return " (cipher not supported)"
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package cyw43439
+
+import (
+	"net"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// Beacon RSSI range reported while associated. The firmware reports 0 when
+// no beacons are being received.
+const (
+	linkMinRSSI = -110
+	linkMaxRSSI = 0
+)
+
+// linkCheck is the schedule of the link state verification, see SetLinkCheck.
+type linkCheck struct {
+	interval time.Duration
+	last     time.Time
+}
+
+// SetLinkCheck enables a periodic verification of the station link for
+// setups where async events are unreliable, i.e: when the event mask is
+// reprogrammed by the application or events are lost to bus errors. Every
+// interval PollOne, TryPoll and Poll check with two IOCTLs that the device
+// is still associated to a BSSID and that the beacon RSSI is sane. If not,
+// the link is taken down as if a disassociation event was received, so a
+// lost link is detected within interval even if its events never arrive.
+// Links taken down are counted in Stats.LinkCheckDown. IOCTL errors are
+// logged and the check retried on the next interval.
+// A zero interval disables the check, which is the default.
+func (d *Device) SetLinkCheck(interval time.Duration) {
+	d.lock()
+	defer d.unlock()
+	d.info("SetLinkCheck", slog.Duration("interval", interval))
+	d.linkCheck = linkCheck{interval: max(interval, 0), last: d.now()}
+}
+
+// linkcheck_tick verifies the station link when due.
+func (d *Device) linkcheck_tick() {
+	lc := &d.linkCheck
+	if lc.interval == 0 || d.state != linkStateUp || d.since(lc.last) < lc.interval {
+		return
+	}
+	lc.last = d.now()
+	var bssid [6]byte
+	var rssi [4]byte
+	_, err := d.doIoctlGet(whd.WLC_GET_BSSID, whd.IF_STA, bssid[:])
+	if err == nil {
+		_, err = d.doIoctlGet(whd.WLC_GET_RSSI, whd.IF_STA, rssi[:])
+	}
+	if err != nil {
+		d.debug("linkcheck_tick", slog.String("err", err.Error()))
+		return
+	}
+	r := int32(_busOrder.Uint32(rssi[:]))
+	if linkSane(bssid, r) || d.state != linkStateUp {
+		return // State may have changed processing packets during the IOCTLs.
+	}
+	d.info("linkcheck_tick:down", slog.String("bssid", net.HardwareAddr(bssid[:]).String()), slog.Int("rssi", int(r)))
+	d.stats.LinkCheckDown++
+	d.state = linkStateDown
+}
+
+// linkSane returns true if bssid and rssi, as read from the firmware, show
+// the station is associated and receiving beacons.
+func linkSane(bssid [6]byte, rssi int32) bool {
+	return bssid != [6]byte{} && rssi >= linkMinRSSI && rssi < linkMaxRSSI
+}
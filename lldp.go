@@ -0,0 +1,159 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errLLDPNoMAC   = errors.New("LLDP requires the hardware address, call Init first")
+	errLLDPField   = errors.New("LLDP string fields must be at most 255 bytes")
+	errLLDPStopped = errors.New("LLDP not started")
+)
+
+const (
+	lldpDefaultInterval = 30 * time.Second
+	// lldpHoldMultiplier is the default TTL in intervals, see IEEE 802.1AB.
+	lldpHoldMultiplier = 4
+
+	lldpTLVEnd         = 0
+	lldpTLVChassisID   = 1
+	lldpTLVPortID      = 2
+	lldpTLVTTL         = 3
+	lldpTLVPortDesc    = 4
+	lldpTLVSystemName  = 5
+	lldpTLVSystemDesc  = 6
+	lldpTLVSystemCaps  = 7
+	lldpChassisIDMAC   = 4
+	lldpPortIDMAC      = 3
+	lldpCapStationOnly = 0x80
+)
+
+// lldpMulticast is the nearest bridge group address LLDP frames are sent to.
+var lldpMulticast = [6]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// LLDPConfig configures the LLDP announcements sent by the device, see StartLLDP.
+type LLDPConfig struct {
+	// SystemName is the device name shown in neighbor tables, i.e: its hostname.
+	SystemName string
+	// SystemDescription optionally describes the device, i.e: firmware and version.
+	SystemDescription string
+	// PortDescription describes the interface. Defaults to "wlan0".
+	PortDescription string
+	// Interval between announcements. Defaults to 30 seconds.
+	Interval time.Duration
+	// TTL is how long neighbors keep the announced information. Defaults to
+	// four times Interval and is capped to 65535 seconds.
+	TTL time.Duration
+}
+
+// lldpState holds the frame built by StartLLDP and its schedule.
+type lldpState struct {
+	frame    []byte
+	interval time.Duration
+	next     time.Time
+}
+
+// StartLLDP periodically announces the device with LLDP (IEEE 802.1AB) on the
+// station interface so network administrators see it in the neighbor tables
+// of switches and access points. The chassis and port IDs are the device's
+// MAC address. Announcements are sent from PollOne, TryPoll and Poll while the
+// link is up, the first one on the next poll. Calling StartLLDP again
+// replaces the configuration.
+func (d *Device) StartLLDP(cfg LLDPConfig) error {
+	if len(cfg.SystemName) > 255 || len(cfg.SystemDescription) > 255 || len(cfg.PortDescription) > 255 {
+		return errLLDPField
+	}
+	if cfg.PortDescription == "" {
+		cfg.PortDescription = "wlan0"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = lldpDefaultInterval
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = lldpHoldMultiplier * cfg.Interval
+	}
+	d.lock()
+	defer d.unlock()
+	if d.mac == [6]byte{} {
+		return errLLDPNoMAC
+	}
+	ttl := min(cfg.TTL/time.Second, 0xffff)
+	d.lldp = &lldpState{
+		frame:    appendLLDP(nil, d.mac, uint16(ttl), cfg),
+		interval: cfg.Interval,
+		next:     d.now(),
+	}
+	d.info("StartLLDP", slog.Int("len", len(d.lldp.frame)))
+	return nil
+}
+
+// StopLLDP stops LLDP announcements. If the link is up a shutdown
+// announcement with a zero TTL is sent so neighbors forget the device.
+func (d *Device) StopLLDP() error {
+	d.lock()
+	defer d.unlock()
+	if d.lldp == nil {
+		return errLLDPStopped
+	}
+	frame := d.lldp.frame
+	d.lldp = nil
+	if !d.isIfaceUp(whd.IF_STA) {
+		return nil
+	}
+	binary.BigEndian.PutUint16(frame[lldpTTLOffset:], 0)
+	return d.tx(whd.IF_STA, 0, frame)
+}
+
+// lldp_tick sends the LLDP announcement when due.
+func (d *Device) lldp_tick() {
+	if d.lldp == nil || d.since(d.lldp.next) < 0 || !d.isIfaceUp(whd.IF_STA) {
+		return
+	}
+	d.lldp.next = d.now().Add(d.lldp.interval)
+	err := d.tx(whd.IF_STA, 0, d.lldp.frame)
+	if err != nil {
+		d.debug("lldp_tick", slog.String("err", err.Error()))
+	}
+}
+
+// lldpTTLOffset is the offset of the TTL value in frames built by appendLLDP.
+const lldpTTLOffset = ethHeaderLen + 2 + 7 + 2 + 7 + 2
+
+// appendLLDP appends an LLDP Ethernet frame announcing mac to dst.
+func appendLLDP(dst []byte, mac [6]byte, ttl uint16, cfg LLDPConfig) []byte {
+	dst = append(dst, lldpMulticast[:]...)
+	dst = append(dst, mac[:]...)
+	dst = binary.BigEndian.AppendUint16(dst, EtherTypeLLDP)
+	dst = appendTLV(dst, lldpTLVChassisID, lldpChassisIDMAC, mac[:])
+	dst = appendTLV(dst, lldpTLVPortID, lldpPortIDMAC, mac[:])
+	dst = binary.BigEndian.AppendUint16(dst, lldpTLVTTL<<9|2)
+	dst = binary.BigEndian.AppendUint16(dst, ttl)
+	dst = appendTLV(dst, lldpTLVPortDesc, -1, []byte(cfg.PortDescription))
+	if cfg.SystemName != "" {
+		dst = appendTLV(dst, lldpTLVSystemName, -1, []byte(cfg.SystemName))
+	}
+	if cfg.SystemDescription != "" {
+		dst = appendTLV(dst, lldpTLVSystemDesc, -1, []byte(cfg.SystemDescription))
+	}
+	// Station only capability, supported and enabled.
+	dst = appendTLV(dst, lldpTLVSystemCaps, -1, []byte{0, lldpCapStationOnly, 0, lldpCapStationOnly})
+	return binary.BigEndian.AppendUint16(dst, lldpTLVEnd)
+}
+
+// appendTLV appends an LLDP TLV with a subtype byte if subtype is not negative.
+func appendTLV(dst []byte, typ uint16, subtype int, value []byte) []byte {
+	n := len(value)
+	if subtype >= 0 {
+		n++
+	}
+	dst = binary.BigEndian.AppendUint16(dst, typ<<9|uint16(n))
+	if subtype >= 0 {
+		dst = append(dst, byte(subtype))
+	}
+	return append(dst, value...)
+}
@@ -0,0 +1,150 @@
+package cyw43439
+
+import (
+	"time"
+)
+
+// Subsystem is a user of the device, see Device.LockStats.
+type Subsystem uint8
+
+const (
+	// SubsystemWiFi covers WLAN traffic and control, including Poll.
+	SubsystemWiFi Subsystem = iota
+	// SubsystemBluetooth covers HCI transport calls such as WriteHCI and ReadHCI.
+	SubsystemBluetooth
+	numSubsystems
+)
+
+func (s Subsystem) String() string {
+	switch s {
+	case SubsystemWiFi:
+		return "wifi"
+	case SubsystemBluetooth:
+		return "bluetooth"
+	}
+	return "Subsystem(" + hex32(uint32(s)) + ")"
+}
+
+// lockBuckets is the amount of power of two microsecond hold time buckets.
+const lockBuckets = 24
+
+// LockStats describes how long a subsystem held the device lock, during
+// which it has exclusive use of the bus and other subsystems wait.
+type LockStats struct {
+	// Acquisitions is the amount of times the lock was taken.
+	Acquisitions uint32
+	// HoldTotal, HoldMax and Hold95 are the total, maximum and 95th
+	// percentile time the lock was held. Hold95 is rounded up to a power of
+	// two microseconds.
+	HoldTotal time.Duration
+	HoldMax   time.Duration
+	Hold95    time.Duration
+	// WaitMax is the longest time spent waiting for the lock to be released
+	// by another subsystem or goroutine.
+	WaitMax time.Duration
+}
+
+// lockMetrics holds the lock hold time histograms of all subsystems.
+type lockMetrics struct {
+	enabled bool
+	// held is set if the current lock acquisition is measured.
+	held  bool
+	owner Subsystem
+	start time.Time
+	sub   [numSubsystems]subsystemLock
+}
+
+// subsystemLock holds a subsystem's lock metrics and hold time histogram.
+type subsystemLock struct {
+	LockStats
+	// hist[i] counts holds shorter than 1<<i microseconds and longer than half that.
+	hist [lockBuckets]uint32
+}
+
+// EnableLockMetrics enables or disables measuring the time each subsystem
+// holds the device lock, see LockStats. Applications running Bluetooth
+// alongside WiFi traffic can use them to find which subsystem starves the
+// other. Measuring adds two clock reads per call to the device.
+func (d *Device) EnableLockMetrics(enable bool) {
+	d.lock()
+	defer d.unlock()
+	d.lockm.enabled = enable
+}
+
+// LockStats returns the lock metrics of subsystem s, see EnableLockMetrics.
+func (d *Device) LockStats(s Subsystem) LockStats {
+	d.lock()
+	defer d.unlock()
+	if s >= numSubsystems {
+		return LockStats{}
+	}
+	m := &d.lockm.sub[s]
+	stats := m.LockStats
+	// 95th percentile from the histogram.
+	var n uint32
+	for i, count := range m.hist {
+		n += count
+		if n*100 >= stats.Acquisitions*95 && count > 0 {
+			stats.Hold95 = min(time.Duration(1<<i)*time.Microsecond, stats.HoldMax)
+			break
+		}
+	}
+	return stats
+}
+
+// ResetLockStats zeroes the lock metrics of all subsystems.
+func (d *Device) ResetLockStats() {
+	d.lock()
+	defer d.unlock()
+	d.lockm.sub = [numSubsystems]subsystemLock{}
+}
+
+func (d *Device) lock() { d.lock_as(SubsystemWiFi) }
+
+// unlock_sleep releases the device lock while sleeping so other goroutines,
+// i.e: a BLE stack polling HCI, are serviced during long waits. The caller
+// must not rely on device state read before the call.
+func (d *Device) unlock_sleep(dur time.Duration) {
+	s := d.lockm.owner
+	d.unlock()
+	d.sleep(dur)
+	d.lock_as(s)
+}
+
+// lock_as takes the device lock on behalf of subsystem s.
+func (d *Device) lock_as(s Subsystem) {
+	if inInterrupt() {
+		panic(errLockInterrupt) // See ISRNotify.
+	}
+	mu := d.mutex()
+	if !d.lockOn.Load() {
+		mu.Lock()
+		return
+	}
+	start := d.now()
+	mu.Lock()
+	m := &d.lockm
+	m.start = d.now()
+	m.owner = s
+	m.held = true
+	m.sub[s].WaitMax = max(m.sub[s].WaitMax, m.start.Sub(start))
+}
+
+func (d *Device) unlock() {
+	m := &d.lockm
+	if m.held {
+		m.held = false
+		held := d.since(m.start)
+		sub := &m.sub[m.owner]
+		sub.Acquisitions++
+		sub.HoldTotal += held
+		sub.HoldMax = max(sub.HoldMax, held)
+		bucket := 0
+		for us := held / time.Microsecond; us > 0 && bucket < lockBuckets-1; us >>= 1 {
+			bucket++
+		}
+		sub.hist[bucket]++
+	}
+	d.lockOn.Store(m.enabled)
+	d.mutex().Unlock()
+}
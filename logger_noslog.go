@@ -0,0 +1,29 @@
+//go:build cy43noslog
+
+package cyw43439
+
+import "github.com/soypat/cyw43439/internal/slog"
+
+// Builds with the cy43noslog tag log through a minimal leveled key-value
+// logger in place of log/slog, which adds noticeable code size on TinyGo.
+// Loggers passed to SetLogger and Config are then created with NewLogger.
+type (
+	LogLevel   = slog.Level
+	LogAttr    = slog.Attr
+	LogHandler = slog.Handler
+)
+
+// Log levels, matching those of log/slog.
+const (
+	LogLevelDebug = slog.LevelDebug
+	LogLevelInfo  = slog.LevelInfo
+	LogLevelWarn  = slog.LevelWarn
+	LogLevelError = slog.LevelError
+)
+
+// NewLogger returns a logger which logs to h.
+func NewLogger(h LogHandler) *slog.Logger { return slog.New(h) }
+
+// NewPrintLogHandler returns a handler printing records of the given level
+// and above with the print builtin.
+func NewPrintLogHandler(level LogLevel) LogHandler { return slog.PrintHandler(level) }
@@ -0,0 +1,45 @@
+//go:build cy43noslog
+
+package cyw43439
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+// recordHandler keeps the records logged at the info level and above.
+type recordHandler struct{ records []string }
+
+func (h *recordHandler) Enabled(level LogLevel) bool { return level >= LogLevelInfo }
+
+func (h *recordHandler) Handle(level LogLevel, msg string, attrs []LogAttr) {
+	rec := level.String() + " " + msg
+	for _, a := range attrs {
+		rec += " " + a.Key + "=" + a.Value.String()
+	}
+	h.records = append(h.records, rec)
+}
+
+// newDiscardLogger returns a logger enabled at the info level which discards records.
+func newDiscardLogger() *slog.Logger {
+	return NewLogger(&recordHandler{})
+}
+
+func TestNoSlogLogger(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	var h recordHandler
+	d.SetLogger(NewLogger(&h))
+	d.debug("hidden")
+	d.SetLinkCheck(2 * time.Second)
+	if len(h.records) != 1 || !strings.HasPrefix(h.records[0], "INFO SetLinkCheck interval=2s") {
+		t.Errorf("got records %q", h.records)
+	}
+	d.SetLogger(nil)
+	d.SetLinkCheck(0)
+	if len(h.records) != 1 {
+		t.Error("logged with logger removed")
+	}
+}
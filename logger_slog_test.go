@@ -0,0 +1,13 @@
+//go:build !cy43noslog
+
+package cyw43439
+
+import (
+	"io"
+	"log/slog"
+)
+
+// newDiscardLogger returns a logger enabled at the info level which discards records.
+func newDiscardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
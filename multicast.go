@@ -0,0 +1,95 @@
+package cyw43439
+
+import (
+	"errors"
+	"net"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errMcastNotGroup  = errors.New("not a multicast MAC address")
+	errMcastFull      = errors.New("multicast group table full")
+	errMcastNotMember = errors.New("multicast group not joined")
+)
+
+// mcastGroup is a multicast MAC address registered with the firmware. The
+// address is shared by up to 32 IPv4 groups so it is reference counted.
+type mcastGroup struct {
+	mac  [6]byte
+	refs uint8
+}
+
+// JoinMulticastGroup adds the multicast MAC address mac to the firmware's
+// multicast filter so frames sent to it are passed to the host when broadcast
+// reception is disabled, see SetBroadcastRX. Up to 10 addresses may be joined;
+// joining an address already joined increments its reference count.
+// Switches with IGMP snooping only forward a multicast stream to ports an IGMP
+// membership report was received on, see the IGMP helper of the eth package.
+func (d *Device) JoinMulticastGroup(mac [6]byte) error {
+	if mac[0]&1 == 0 {
+		return errMcastNotGroup
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	free := -1
+	for i := range d.mcast {
+		g := &d.mcast[i]
+		if g.refs > 0 && g.mac == mac {
+			g.refs++
+			return nil
+		} else if g.refs == 0 && free < 0 {
+			free = i
+		}
+	}
+	if free < 0 {
+		return errMcastFull
+	}
+	d.info("JoinMulticastGroup", slog.String("mac", net.HardwareAddr(mac[:]).String()))
+	d.mcast[free] = mcastGroup{mac: mac, refs: 1}
+	err := d.set_mcast_list()
+	if err != nil {
+		d.mcast[free] = mcastGroup{}
+	}
+	return err
+}
+
+// LeaveMulticastGroup decrements the reference count of the multicast MAC
+// address mac joined with JoinMulticastGroup, removing it from the firmware's
+// multicast filter when it reaches zero.
+func (d *Device) LeaveMulticastGroup(mac [6]byte) error {
+	d.lock()
+	defer d.unlock()
+	for i := range d.mcast {
+		g := &d.mcast[i]
+		if g.refs == 0 || g.mac != mac {
+			continue
+		}
+		g.refs--
+		if g.refs > 0 {
+			return nil
+		}
+		return d.set_mcast_list()
+	}
+	return errMcastNotMember
+}
+
+// set_mcast_list programs the firmware multicast filter with the joined groups.
+//
+//	reference: wl_mcast_list
+func (d *Device) set_mcast_list() error {
+	var buf [4 + 6*whd.MAX_MULTICAST_REGISTERED_ADDRESS]byte
+	n := 0
+	for _, g := range d.mcast {
+		if g.refs > 0 {
+			copy(buf[4+6*n:], g.mac[:])
+			n++
+		}
+	}
+	_busOrder.PutUint32(buf[:4], uint32(n))
+	return d.set_iovar_n("mcast_list", whd.IF_STA, buf[:])
+}
@@ -3,14 +3,32 @@ package cyw43439
 import (
 	"errors"
 	"net"
+	"time"
 
 	"github.com/soypat/cyw43439/whd"
 )
 
 // MTU (maximum transmission unit) returns the maximum amount
 // of bytes that can be sent in a single ethernet frame in a call to SendEth.
+//
+// Deprecated: this method returns the MTU constant, the largest payload of a
+// single bus transfer. Use the LinkMTU method for the largest IP packet and the
+// MaxFrameSize method for the largest Ethernet frame accepted by SendEth.
 func (d *Device) MTU() int { return MTU }
 
+// LinkMTU returns the link MTU, the largest IP packet that can be sent in a
+// single Ethernet frame, which is the LinkMTU constant. Frame buffers must
+// hold MaxFrameSize bytes.
+func (d *Device) LinkMTU() int { return LinkMTU }
+
+// MaxFrameSize returns the largest Ethernet frame, header included, that can
+// be sent in a call to SendEth, which is the MaxFrameSize constant.
+func (d *Device) MaxFrameSize() int { return MaxFrameSize }
+
+// TxHeadroom returns the length of the bus headers prepended to sent frames,
+// which is the TxHeadroom constant.
+func (d *Device) TxHeadroom() int { return TxHeadroom }
+
 // HardwareAddr6 returns the device's 6-byte [MAC address].
 //
 // [MAC address]: https://en.wikipedia.org/wiki/MAC_address
@@ -28,26 +46,231 @@ func (d *Device) HardwareAddr6() ([6]byte, error) {
 func (d *Device) PollOne() (bool, error) {
 	d.lock()
 	defer d.unlock()
+	d.poll_tasks()
 	_, cmd, err := d.tryPoll(d._rxBuf[:])
 	if err == errNoF2Avail {
+		d.bus_idle()
 		return false, nil
 	}
 	return cmd == whd.CONTROL_HEADER && err == nil, err
 }
 
+// TryPoll services the device without blocking, for integration with
+// cooperative schedulers and control loops. It processes at most one packet
+// pending in the device, be it an Ethernet frame, an async event or an ioctl
+// response. didWork reports whether a packet was processed, in which case more
+// may be pending and TryPoll may be called again right away. didWork is false
+// if err is not nil, even if the failed packet was consumed.
+//
+// The chip buffers only a handful of received frames so under traffic TryPoll
+// should be called every few milliseconds to avoid frame drops. When idle, calling
+// it every 100ms suffices for link events such as disconnection to be noticed.
+func (d *Device) TryPoll() (didWork bool, err error) {
+	d.lock()
+	defer d.unlock()
+	d.poll_tasks()
+	_, _, err = d.tryPoll(d._rxBuf[:])
+	if err == errNoF2Avail {
+		d.bus_idle()
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// poll_tasks runs the periodic work done on every poll.
+func (d *Device) poll_tasks() {
+	d.txq_flush()
+	d.txpend_flush()
+	d.lldp_tick()
+	d.linkcheck_tick()
+}
+
+// PollBudget bounds the work done by a single call to Poll so that real-time
+// applications can bound the time spent servicing the driver per loop iteration.
+type PollBudget struct {
+	// MaxFrames is the maximum amount of WLAN packets processed, including
+	// Ethernet frames, async events and ioctl responses. Zero processes a single packet.
+	MaxFrames int
+	// MaxHCI is the maximum amount of HCI packets drained to the handler set
+	// with RecvHCIHandle. Zero drains no HCI packets.
+	MaxHCI int
+	// Coalesce, if non-zero, is the minimum time between bus accesses after a
+	// Poll call found no pending work. Calls within the period return
+	// immediately, letting packets accumulate to be processed in a batch.
+	Coalesce time.Duration
+	// HCIInterleave, if non-zero, gives HCI priority over WLAN packets: HCI
+	// packets are serviced first and again after every HCIInterleave WLAN
+	// packets. Otherwise HCI is serviced once WLAN packets are exhausted or
+	// MaxFrames are processed, so large transfers delay time-critical BLE
+	// connection events by up to a whole batch, risking supervision timeouts.
+	HCIInterleave int
+}
+
+// Poll services the device processing pending WLAN and HCI packets within the
+// given budget without blocking. It returns the amount of WLAN and HCI
+// packets processed. If the budget is exhausted more work may be pending.
+// With firmware power save enabled, consecutive polls which find no work put
+// the chip to deep sleep until the next transaction, see Stats.BusWakeups.
+func (d *Device) Poll(budget PollBudget) (frames, hci int, err error) {
+	d.lock()
+	defer d.unlock()
+	if budget.Coalesce > 0 && d.since(d.lastIdlePoll) < budget.Coalesce {
+		return 0, 0, nil
+	}
+	d.poll_tasks()
+	maxFrames := max(budget.MaxFrames, 1)
+	for {
+		if budget.HCIInterleave > 0 {
+			n, err := d.poll_hci(budget.MaxHCI - hci)
+			hci += n
+			if err != nil {
+				return frames, hci, err
+			}
+		}
+		batch := maxFrames - frames
+		if budget.HCIInterleave > 0 {
+			batch = min(batch, budget.HCIInterleave)
+		}
+		n, err := d.poll_wlan(batch)
+		frames += n
+		if err != nil {
+			return frames, hci, err
+		} else if budget.HCIInterleave == 0 || n < batch || frames == maxFrames {
+			break
+		}
+	}
+	n, err := d.poll_hci(budget.MaxHCI - hci)
+	hci += n
+	if err != nil {
+		return frames, hci, err
+	}
+	if frames == 0 && hci == 0 {
+		d.lastIdlePoll = d.now()
+		d.bus_idle()
+	}
+	return frames, hci, nil
+}
+
+// poll_wlan processes up to limit WLAN packets, returning the amount processed.
+func (d *Device) poll_wlan(limit int) (n int, err error) {
+	for n < limit {
+		_, _, err = d.tryPoll(d._rxBuf[:])
+		if err == errNoF2Avail {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// poll_hci drains up to limit HCI packets to the HCI handler, returning the
+// amount drained. Packets are left pending while a partial ReadHCI is in progress.
+func (d *Device) poll_hci(limit int) (n int, err error) {
+	for d.rcvHCI != nil && d.btaddr != 0 && d.hciReadOff == 0 && n < limit {
+		pkt, next, err := d.hci_peek()
+		if err == ErrDataNotAvailable {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		d.hci_received(pkt)
+		herr := d.recv_call(d.rcvHCI, pkt)
+		// Consume the packet even if the handler failed so it is not redelivered.
+		err = d.hci_consume(next)
+		if err != nil {
+			return n, err
+		}
+		n++
+		if err = d.recv_error(herr); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 // RecvEthHandle sets handler for receiving Ethernet pkt
-// If set to nil then incoming packets are ignored.
+// If set to nil then incoming packets are ignored. Errors returned by
+// handler are handled as set with SetRecvErrorPolicy.
+// Packets received on an interface with a handler registered via
+// RecvEthHandleIface are not passed to handler.
 func (d *Device) RecvEthHandle(handler func(pkt []byte) error) {
 	d.lock()
 	defer d.unlock()
 	d.rcvEth = handler
 }
 
+// RecvEthHandleIface sets the handler for Ethernet packets received on iface.
+// This allows separating AP-side and STA-side traffic in concurrent AP+STA mode.
+// If set to nil packets received on iface are passed to the handler set by RecvEthHandle.
+func (d *Device) RecvEthHandleIface(iface whd.IoctlInterface, handler func(pkt []byte) error) error {
+	if !iface.IsValid() {
+		return errInvalidIoctlIface
+	}
+	d.lock()
+	defer d.unlock()
+	d.rcvEthIface[iface] = handler
+	return nil
+}
+
+// RecvEthHandleTimestamped sets handler for receiving Ethernet packets along
+// with the time they were read from the chip, captured right after the bus
+// transfer. The time carries a monotonic clock reading so it is suitable for
+// latency and jitter measurements. It takes precedence over the handler set
+// with RecvEthHandle. Handlers set with RecvEthHandleIface take precedence over both.
+func (d *Device) RecvEthHandleTimestamped(handler func(pkt []byte, rx time.Time) error) {
+	d.lock()
+	defer d.unlock()
+	d.rcvEthTS = handler
+}
+
 // SendEth sends an Ethernet packet over the current interface.
+// When a SoftAP is running without a station interface the packet is sent over the AP.
 func (d *Device) SendEth(pkt []byte) error {
 	d.lock()
 	defer d.unlock()
-	return d.tx(pkt)
+	return d.send(whd.IF_STA, d.tx_priority(pkt), pkt)
+}
+
+// SendEthWithHeadroom sends the Ethernet packet following TxHeadroom bytes of
+// headroom in buf over the station interface like SendEth. The driver writes
+// the bus headers to the headroom and sends the frame from buf, saving the
+// copy SendEth makes of every frame. buf must be 4 byte aligned, as buffers
+// from make are, with its capacity extending its length to a multiple of 4;
+// otherwise, or if the TX queue is enabled, the frame is copied as in SendEth.
+// The headroom is overwritten and the frame is left unmodified. The buffer
+// may be reused once SendEthWithHeadroom returns unless a TX done handler is
+// set, see SetTxDoneHandler.
+func (d *Device) SendEthWithHeadroom(buf []byte) error {
+	if len(buf) < TxHeadroom {
+		return errTxHeadroom
+	}
+	d.lock()
+	defer d.unlock()
+	prio := d.tx_priority(buf[TxHeadroom:])
+	if d.txq != nil {
+		err := d.send(whd.IF_STA, prio, buf[TxHeadroom:])
+		if err == nil && d.txDone != nil {
+			d.txDone(buf, nil) // Copied to the TX queue.
+		}
+		return err
+	} else if d.txDone != nil {
+		return d.txpend_send(prio, buf)
+	}
+	return d.tx_inplace(whd.IF_STA, prio, buf)
+}
+
+// SendEthIface sends an Ethernet packet over the given interface. It is used
+// in concurrent AP+STA mode to route frames to the AP (whd.IF_AP) or
+// station (whd.IF_STA) side. See [APConfig].
+func (d *Device) SendEthIface(iface whd.IoctlInterface, pkt []byte) error {
+	if iface != whd.IF_STA && iface != whd.IF_AP {
+		return errInvalidIoctlIface
+	}
+	d.lock()
+	defer d.unlock()
+	return d.send(iface, d.tx_priority(pkt), pkt)
 }
 
 // NetFlags returns the current network flags for the device.
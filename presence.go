@@ -0,0 +1,73 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errProbeNoAP = errors.New("probe request reporting requires a running SoftAP")
+
+// Layout of PROBREQ_MSG_RX event data: wl_event_rx_frame_data_t followed by the 802.11 frame.
+const (
+	rxFrameDataLen  = 16
+	dot11HeaderLen  = 24
+	dot11SourceAddr = 10 // Offset of transmitter address (addr2) in 802.11 header.
+	dot11FCProbeReq = 0x40
+	dot11FCTypeMask = 0xfc
+)
+
+// ProbeRequest is a probe request frame received by the SoftAP. Devices with
+// WiFi enabled send probe requests periodically while looking for networks,
+// which makes them useful for presence detection.
+type ProbeRequest struct {
+	// Source is the MAC address of the sender. Note that many devices
+	// randomize their MAC address while scanning.
+	Source [6]byte
+	// RSSI is the received signal strength in dBm.
+	RSSI int8
+	// Channel the probe request was received on.
+	Channel uint8
+}
+
+// HandleProbeRequests sets fn to be called for every probe request received
+// while a SoftAP is running, see StartAP. Probe requests are delivered during
+// PollOne. Passing a nil fn disables probe request reporting.
+func (d *Device) HandleProbeRequests(fn func(ProbeRequest)) error {
+	d.lock()
+	defer d.unlock()
+	if fn != nil && !d.apUp {
+		return errProbeNoAP
+	}
+	bsscfg := uint32(0)
+	if d.apIface == whd.IF_AP {
+		bsscfg = 1
+	}
+	if fn != nil {
+		d.fwevents.Enable(whd.EvPROBREQ_MSG_RX)
+		d.eventmask.Enable(whd.EvPROBREQ_MSG_RX)
+	} else {
+		d.fwevents.Disable(whd.EvPROBREQ_MSG_RX)
+		d.eventmask.Disable(whd.EvPROBREQ_MSG_RX)
+	}
+	d.probeFn = fn
+	return d.set_fw_events(bsscfg)
+}
+
+// rxProbeRequest handles PROBREQ_MSG_RX event data.
+func (d *Device) rxProbeRequest(data []byte) {
+	if d.probeFn == nil || len(data) < rxFrameDataLen+dot11HeaderLen {
+		return
+	}
+	frame := data[rxFrameDataLen:]
+	if frame[0]&dot11FCTypeMask != dot11FCProbeReq {
+		return
+	}
+	// Frame data header fields are in network order.
+	var req ProbeRequest
+	req.Channel = uint8(binary.BigEndian.Uint16(data[2:]) & whd.CHANSPEC_CHAN_MASK)
+	req.RSSI = int8(int32(binary.BigEndian.Uint32(data[4:])))
+	copy(req.Source[:], frame[dot11SourceAddr:dot11SourceAddr+6])
+	d.probeFn(req)
+}
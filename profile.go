@@ -0,0 +1,123 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+var errInvalidProfile = errors.New("invalid performance profile")
+
+const (
+	// defaultAMPDUWsize is the AMPDU block ack window size used unless changed by a profile.
+	defaultAMPDUWsize = 8
+	// defaultBusClock is the bus clock frequency NewPicoWDevice configures.
+	defaultBusClock = 25000_000 - 1
+)
+
+// PerformanceProfile is a set of driver and firmware settings tuned for a use case.
+// See [Device.SetPerformanceProfile].
+type PerformanceProfile uint8
+
+const (
+	// ProfileBalanced is the configuration after Init: firmware power save
+	// with moderate aggregation.
+	ProfileBalanced PerformanceProfile = iota
+	// ProfileThroughput disables power save, enlarges AMPDU aggregation and
+	// raises the bus clock. Sustained rates above 5Mbps require this profile.
+	ProfileThroughput
+	// ProfileLowPower uses aggressive firmware power save and minimal aggregation
+	// at the cost of throughput and latency.
+	ProfileLowPower
+)
+
+func (p PerformanceProfile) IsValid() bool { return p <= ProfileLowPower }
+
+func (p PerformanceProfile) String() string {
+	switch p {
+	case ProfileBalanced:
+		return "Balanced"
+	case ProfileThroughput:
+		return "Throughput"
+	case ProfileLowPower:
+		return "LowPower"
+	}
+	return "unknown"
+}
+
+// PollBudget returns the Poll budget suited to the profile. Throughput profile
+// drains frames in large batches, interleaving HCI so BLE connections are not
+// starved, while low power profile coalesces polls so the host may sleep
+// between bus accesses.
+func (p PerformanceProfile) PollBudget() PollBudget {
+	switch p {
+	case ProfileThroughput:
+		return PollBudget{MaxFrames: 16, MaxHCI: 8, HCIInterleave: 4}
+	case ProfileLowPower:
+		return PollBudget{MaxFrames: 2, MaxHCI: 2, Coalesce: 50 * time.Millisecond}
+	}
+	return PollBudget{MaxFrames: 4, MaxHCI: 4}
+}
+
+func (p PerformanceProfile) pm() powerManagementMode {
+	switch p {
+	case ProfileThroughput:
+		return None
+	case ProfileLowPower:
+		return Aggressive
+	}
+	return PowerSave
+}
+
+// ampdu returns the aggregation configuration of the profile.
+func (p PerformanceProfile) ampdu() AMPDUConfig {
+	switch p {
+	case ProfileThroughput:
+		return AMPDUConfig{RxWindow: 16, TxMPDUs: 8}
+	case ProfileLowPower:
+		return AMPDUConfig{RxWindow: 4, TxMPDUs: 2}
+	}
+	return AMPDUConfig{RxWindow: defaultAMPDUWsize, TxMPDUs: defaultAMPDUMPDU}
+}
+
+func (p PerformanceProfile) busClock() uint32 {
+	if p == ProfileThroughput {
+		return 50000_000 - 1 // Maximum gSPI clock.
+	}
+	return defaultBusClock
+}
+
+// busClockSetter is implemented by buses which can change their clock frequency.
+type busClockSetter interface {
+	SetBaudrate(hz uint32) error
+}
+
+// SetPerformanceProfile configures AMPDU aggregation, firmware power save and the
+// bus clock together for the given profile. The bus clock is only changed if the
+// bus implements a SetBaudrate(uint32) error method. Aggregation settings take
+// effect on the next join. Use the profile's PollBudget method to poll the device
+// with the matching strategy.
+func (d *Device) SetPerformanceProfile(p PerformanceProfile) error {
+	d.lock()
+	defer d.unlock()
+	if !p.IsValid() {
+		return errInvalidProfile
+	} else if !d.initialized {
+		return errDeviceNotInit
+	}
+	d.info("SetPerformanceProfile", slog.String("profile", p.String()))
+	err := d.set_ampdu(p.ampdu())
+	if err != nil {
+		return err
+	}
+	err = d.set_power_management(p.pm())
+	if err != nil {
+		return err
+	}
+	d.profile = p
+	if bus, ok := any(d.spi.spi).(busClockSetter); ok {
+		err = bus.SetBaudrate(p.busClock())
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+)
+
+var (
+	errRecvHandlerNil  = errors.New("nil receive handler")
+	errRecvHandlerFull = errors.New("too many receive handlers")
+	errRecvHandlerID   = errors.New("receive handler not registered")
+	errRecvPanic       = errors.New("receive handler panicked")
+	errRecvHalted      = errors.New("receive halted by handler error")
+)
+
+// RecvErrorPolicy selects what happens when a receive handler returns an
+// error or panics, see SetRecvErrorPolicy. Errors and panics are always
+// counted in Stats.RxHandlerErrors and Stats.RxHandlerPanics.
+type RecvErrorPolicy uint8
+
+const (
+	// RecvErrorDrop drops the frame and continues receiving. This is the default.
+	RecvErrorDrop RecvErrorPolicy = iota
+	// RecvErrorReturn returns the handler's error from the device operation
+	// that received the frame, i.e: Poll. Packets still queued in the chip
+	// are received by the next operation.
+	RecvErrorReturn
+	// RecvErrorHalt stops passing frames to handlers after the first error,
+	// records a Failure of kind FailureRecvHandler, see LastFailure, and
+	// returns an error from the operation that received the frame. Frames
+	// received while halted are counted in Stats.RxDropped. Control packets
+	// and events are still processed so the device remains usable.
+	RecvErrorHalt
+)
+
+// maxRecvHandlers is the amount of handlers AddRecvHandler can register.
+const maxRecvHandlers = 8
+
+// EtherTypes commonly registered with AddRecvHandler.
+const (
+	// EtherTypeAny matches frames of any EtherType, i.e: for a pcap tap.
+	EtherTypeAny   uint16 = 0
+	EtherTypeIPv4  uint16 = 0x0800
+	EtherTypeARP   uint16 = 0x0806
+	EtherTypeIPv6  uint16 = 0x86dd
+	EtherTypeEAPOL uint16 = 0x888e
+	EtherTypeLLDP  uint16 = 0x88cc
+)
+
+// RecvHandlerID identifies a handler registered with AddRecvHandler.
+type RecvHandlerID uint8
+
+type recvHandler struct {
+	etherType uint16
+	fn        func(pkt []byte) error
+}
+
+// AddRecvHandler registers handler to receive Ethernet frames of etherType
+// on any interface, or all frames if etherType is EtherTypeAny. VLAN tagged
+// frames match the VLAN EtherType 0x8100. Any number of handlers up to 8
+// may be registered, each frame is passed to every matching handler in
+// registration order so a network stack, an EAPOL supplicant and a capture
+// tap can consume traffic without chaining callbacks. An error returned by a
+// handler is counted in Stats.RxHandlerErrors and does not affect other
+// handlers nor the poll that received the frame, unless reception is halted
+// with RecvErrorHalt, see SetRecvErrorPolicy.
+// Handlers must not modify or retain pkt. Registered handlers receive frames
+// in addition to the handlers set with RecvEthHandle and friends.
+func (d *Device) AddRecvHandler(etherType uint16, handler func(pkt []byte) error) (RecvHandlerID, error) {
+	if handler == nil {
+		return 0, errRecvHandlerNil
+	}
+	d.lock()
+	defer d.unlock()
+	for i := range d.rcvMux {
+		if d.rcvMux[i].fn == nil {
+			d.rcvMux[i] = recvHandler{etherType: etherType, fn: handler}
+			return RecvHandlerID(i), nil
+		}
+	}
+	return 0, errRecvHandlerFull
+}
+
+// RemoveRecvHandler unregisters a handler registered with AddRecvHandler.
+func (d *Device) RemoveRecvHandler(id RecvHandlerID) error {
+	d.lock()
+	defer d.unlock()
+	if int(id) >= len(d.rcvMux) || d.rcvMux[id].fn == nil {
+		return errRecvHandlerID
+	}
+	d.rcvMux[id] = recvHandler{}
+	return nil
+}
+
+// recv_demux passes pkt to the matching registered handlers and returns the amount called.
+func (d *Device) recv_demux(pkt []byte) (n int) {
+	etherType := EtherTypeAny
+	if len(pkt) >= 14 {
+		etherType = binary.BigEndian.Uint16(pkt[12:14])
+	}
+	for i := range d.rcvMux {
+		h := &d.rcvMux[i]
+		if h.fn == nil || (h.etherType != EtherTypeAny && h.etherType != etherType) {
+			continue
+		}
+		n++
+		if err := d.recv_call(h.fn, pkt); err != nil {
+			if d.logenabled(slog.LevelDebug) {
+				d.debug("recv_demux:handler", slog.Int("id", i), slog.String("err", err.Error()))
+			}
+			if d.rcvPolicy == RecvErrorHalt {
+				d.recv_halt(err)
+				return n
+			}
+		}
+	}
+	return n
+}
+
+// SetRecvErrorPolicy sets what happens when a receive handler set with
+// RecvEthHandle and friends returns an error or panics. Handlers registered
+// with AddRecvHandler never affect the poll that received the frame but do
+// halt reception under RecvErrorHalt. Setting the policy resumes reception
+// halted by RecvErrorHalt. Panics are only recovered on targets whose runtime
+// supports recover.
+func (d *Device) SetRecvErrorPolicy(policy RecvErrorPolicy) {
+	d.lock()
+	defer d.unlock()
+	d.rcvPolicy = policy
+	d.rcvHalted = false
+}
+
+// recv_call calls a receive handler, counting its error and converting a
+// panic into errRecvPanic.
+func (d *Device) recv_call(fn func([]byte) error, pkt []byte) (err error) {
+	defer d.recv_recover(&err)
+	return fn(pkt)
+}
+
+// recv_call_ts is recv_call for the handler set with RecvEthHandleTimestamped.
+func (d *Device) recv_call_ts(pkt []byte) (err error) {
+	defer d.recv_recover(&err)
+	return d.rcvEthTS(pkt, d.rxTime)
+}
+
+func (d *Device) recv_recover(err *error) {
+	if r := recover(); r != nil {
+		d.stats.RxHandlerPanics++
+		*err = errRecvPanic
+	}
+	if *err != nil {
+		d.stats.RxHandlerErrors++
+	}
+}
+
+// recv_error applies the receive error policy to the error returned by a
+// handler set with RecvEthHandle and friends.
+func (d *Device) recv_error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch d.rcvPolicy {
+	case RecvErrorReturn:
+		return err
+	case RecvErrorHalt:
+		d.recv_halt(err)
+		return errRecvHalted
+	}
+	if d.logenabled(slog.LevelDebug) {
+		d.debug("recv:drop", slog.String("err", err.Error()))
+	}
+	return nil
+}
+
+// recv_halt stops passing frames to handlers and records a Failure.
+func (d *Device) recv_halt(err error) {
+	if d.rcvHalted {
+		return
+	}
+	d.rcvHalted = true
+	d.flight_failure(FailureRecvHandler, err)
+}
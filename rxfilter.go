@@ -0,0 +1,120 @@
+package cyw43439
+
+import (
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+// RxFilterMode selects the frames dropped by the host-side destination
+// address filter, see SetRxFilter.
+type RxFilterMode uint8
+
+const (
+	// RxFilterOff passes all frames received from the chip to handlers. This is the default.
+	RxFilterOff RxFilterMode = iota
+	// RxFilterUnicast drops unicast frames not addressed to the device.
+	// Broadcast and multicast frames are passed.
+	RxFilterUnicast
+	// RxFilterStrict drops frames not addressed to the device, broadcast, or
+	// a multicast address joined with JoinMulticastGroup. Note IPv6 neighbor
+	// discovery requires joining the solicited-node multicast address.
+	RxFilterStrict
+)
+
+// SetRxFilter sets the host-side filter applied to received frames before
+// they are passed to receive handlers. Dropped frames are counted in
+// Stats.RxFiltered. The filter is a stopgap for when the firmware's own
+// filtering is not in effect, i.e: with promiscuous reception enabled for
+// diagnostics or while running a SoftAP, and costs a comparison per frame.
+// Frames received on the SoftAP interface of a concurrent AP are matched
+// against the AP's MAC address. Frames forwarded by the bridge, see
+// StartBridge, are not filtered.
+func (d *Device) SetRxFilter(mode RxFilterMode) error {
+	d.lock()
+	defer d.unlock()
+	d.info("SetRxFilter", slog.Int("mode", int(mode)))
+	d.rxFilter = mode
+	if mode == RxFilterOff {
+		return nil
+	}
+	return d.rxfilter_update()
+}
+
+// rxfilter_update reads the MAC address of the concurrent SoftAP interface.
+func (d *Device) rxfilter_update() error {
+	d.rxFilterAP = [6]byte{}
+	if !d.apUp || d.apIface == whd.IF_STA {
+		return nil
+	}
+	_, err := d.get_iovar_n("cur_etheraddr", d.apIface, d.rxFilterAP[:])
+	return err
+}
+
+// rxfilter_pass returns true if the frame received on iface passes the filter.
+func (d *Device) rxfilter_pass(iface whd.IoctlInterface, pkt []byte) bool {
+	if d.rxFilter == RxFilterOff || len(pkt) < 6 {
+		return true
+	}
+	dst := [6]byte(pkt[:6])
+	if dst[0]&1 == 0 {
+		ours := d.mac
+		if iface != whd.IF_STA && iface == d.apIface && d.rxFilterAP != [6]byte{} {
+			ours = d.rxFilterAP
+		}
+		return dst == ours
+	} else if d.rxFilter == RxFilterUnicast || dst == [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		return true
+	}
+	for i := range d.mcast {
+		if d.mcast[i].refs > 0 && d.mcast[i].mac == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// groupLimiter is a token bucket limiting the rate of received broadcast and
+// multicast frames, see SetRxGroupLimit.
+type groupLimiter struct {
+	rate   uint32 // Frames per second, zero disables the limiter.
+	burst  uint32
+	tokens uint32
+	last   time.Time
+}
+
+// SetRxGroupLimit limits received broadcast and multicast frames to rate
+// frames per second, allowing bursts of up to burst frames. Excess frames are
+// dropped before receive handlers are called and counted in
+// Stats.RxRateLimited, protecting the application from broadcast storms of
+// busy networks, i.e: ARP and mDNS floods. Unicast frames are not limited.
+// A zero rate disables the limiter. A zero burst allows bursts of rate frames.
+func (d *Device) SetRxGroupLimit(rate, burst uint16) {
+	d.lock()
+	defer d.unlock()
+	if burst == 0 {
+		burst = rate
+	}
+	d.info("SetRxGroupLimit", slog.Int("rate", int(rate)), slog.Int("burst", int(burst)))
+	d.rxLimit = groupLimiter{rate: uint32(rate), burst: uint32(burst), tokens: uint32(burst), last: d.now()}
+}
+
+// allow takes a token for a frame received at now, returning false if none is left.
+func (l *groupLimiter) allow(now time.Time) bool {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		full := time.Duration(l.burst) * time.Second / time.Duration(l.rate)
+		if elapsed >= full {
+			l.tokens, l.last = l.burst, now
+		} else if add := uint64(elapsed) * uint64(l.rate) / uint64(time.Second); add > 0 {
+			l.tokens = uint32(min(uint64(l.tokens)+add, uint64(l.burst)))
+			// Advance by the time the tokens took to accrue so fractions are not lost.
+			l.last = l.last.Add(time.Duration(add * uint64(time.Second) / uint64(l.rate)))
+		}
+	}
+	if l.tokens == 0 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,184 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errScanSSIDTooLong  = errors.New("scan SSID too long")
+	errScanTimeout      = errors.New("scan timeout")
+	errScanFailed       = errors.New("scan failed")
+	errScanInProgress   = errors.New("scan already in progress")
+	errScanNilCallback  = errors.New("nil scan callback")
+	errScanManyChannels = errors.New("too many scan channels")
+)
+
+const (
+	// scanTimeout is the maximum time a scan is waited on.
+	scanTimeout = 10 * time.Second
+	// maxScanChannels is the amount of channels of all bands.
+	maxScanChannels = len(channels2G4) + len(channels5G)
+)
+
+// ScanConfig configures a WiFi scan.
+type ScanConfig struct {
+	// SSID restricts the scan to a single network. Empty scans all networks.
+	// SSIDs are arbitrary octet strings, see SSIDFromBytes. Active scans for
+	// an SSID send probe requests carrying it, which also find hidden networks.
+	SSID string
+	// HomeTime is the time spent on the channel of the joined network
+	// between scanned channels. Scanning while joined does not drop the
+	// association: the firmware returns to the home channel to exchange
+	// buffered traffic. Zero selects the firmware default.
+	HomeTime time.Duration
+	// Passive selects passive scanning: no probe requests are sent and
+	// networks are found by their beacons only. Required on channels where
+	// regulations forbid transmitting before detecting an AP.
+	Passive bool
+	// Channels to scan, see SupportedChannels. Unsupported channels return a
+	// *ChannelError. Empty scans all channels allowed by the country setting.
+	// Scanning only the channel the network is known to be on is much faster.
+	Channels []uint8
+	// Dwell is the time spent listening on each channel. Zero selects the
+	// firmware default. Passive scans need a dwell longer than the beacon interval (~100ms).
+	Dwell time.Duration
+}
+
+// Scan scans for WiFi networks calling fn for every BSS found. Scan blocks until
+// the scan completes. A BSS may be reported more than once. fn must not retain
+// bss since it references driver buffers. The security and PHY capabilities of
+// a BSS are obtained with bss.Capabilities.
+// Scanning is supported while joined to a network, see ScanConfig.HomeTime.
+func (d *Device) Scan(cfg ScanConfig, fn func(bss *whd.BSSInfo)) error {
+	d.lock()
+	defer d.unlock()
+	return d.scan(cfg, fn)
+}
+
+func (d *Device) scan(cfg ScanConfig, fn func(bss *whd.BSSInfo)) error {
+	err := d.scan_start(cfg, fn)
+	if err != nil {
+		return err
+	}
+	defer d.scan_finish()
+	// Poll for async scan results.
+	deadline := d.now().Add(scanTimeout)
+	for !d.scanDone {
+		if d.since(deadline) > 0 {
+			return errScanTimeout
+		}
+		d.sleep(10 * time.Millisecond)
+		err = d.check_status(d._sendIoctlBuf[:])
+		if err != nil {
+			return err
+		}
+	}
+	return d.scan_result()
+}
+
+// scan_start starts a scan whose results are passed to fn as events are processed.
+func (d *Device) scan_start(cfg ScanConfig, fn func(bss *whd.BSSInfo)) error {
+	if fn == nil {
+		return errScanNilCallback
+	} else if len(cfg.SSID) > 32 {
+		return errScanSSIDTooLong
+	} else if d.scanFn != nil {
+		return errScanInProgress
+	} else if d.joining {
+		return errJoinBusy
+	}
+	d.info("Scan", ssidAttr(cfg.SSID), slog.Bool("joined", d.state == linkStateUp),
+		slog.Bool("passive", cfg.Passive), slog.Int("channels", len(cfg.Channels)))
+	params := whd.EscanParams{
+		Version:     whd.ESCAN_VERSION,
+		Action:      whd.ESCAN_ACTION_START,
+		SyncID:      0x1234,
+		SSIDLength:  uint32(len(cfg.SSID)),
+		BSSID:       [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		BSSType:     whd.DOT11_BSSTYPE_ANY,
+		ScanType:    whd.SCAN_TYPE_ACTIVE,
+		NProbes:     -1,
+		ActiveTime:  -1,
+		PassiveTime: -1,
+		HomeTime:    -1,
+	}
+	copy(params.SSID[:], cfg.SSID)
+	if cfg.HomeTime > 0 {
+		params.HomeTime = int32(cfg.HomeTime.Milliseconds())
+	}
+	if cfg.Passive {
+		params.ScanType = whd.SCAN_TYPE_PASSIVE
+	}
+	if cfg.Dwell > 0 {
+		dwell := int32(cfg.Dwell.Milliseconds())
+		if cfg.Passive {
+			params.PassiveTime = dwell
+		} else {
+			params.ActiveTime = dwell
+		}
+	}
+	if len(cfg.Channels) > maxScanChannels {
+		return errScanManyChannels
+	}
+	var chanspecs [maxScanChannels]uint16
+	for i, ch := range cfg.Channels {
+		if err := d.check_channel(ch); err != nil {
+			return err
+		}
+		chanspecs[i] = chanspec20(ch)
+	}
+	params.Channels = chanspecs[:len(cfg.Channels)]
+	var buf [whd.ESCAN_PARAMS_LEN + 2*maxScanChannels]byte
+	n := params.Put(_busOrder, buf[:])
+
+	d.scanFn = fn
+	d.scanDone = false
+	d.eventmask.Enable(whd.EvESCAN_RESULT)
+	err := d.set_iovar_n("escan", whd.IF_STA, buf[:n])
+	if err != nil {
+		d.scan_finish()
+	}
+	return err
+}
+
+// scan_finish stops passing scan results to the scan callback.
+func (d *Device) scan_finish() {
+	d.scanFn = nil
+	d.scanAsync = false
+	d.eventmask.Disable(whd.EvESCAN_RESULT)
+}
+
+// scan_result returns the result of the completed scan.
+func (d *Device) scan_result() error {
+	if d.scanStatus != whd.CYW43_STATUS_SUCCESS {
+		d.logerr("Scan:failed", slog.Uint64("status", uint64(d.scanStatus)))
+		return errScanFailed
+	}
+	return nil
+}
+
+// rxScanResult handles ESCAN_RESULT event data.
+func (d *Device) rxScanResult(status uint32, data []byte) {
+	if d.scanFn == nil {
+		return
+	}
+	if status != whd.CYW43_STATUS_PARTIAL {
+		d.scanDone = true
+		d.scanStatus = status
+		if d.scanAsync {
+			d.scan_finish() // Nobody waits on it, see StartScan.
+		}
+		return
+	}
+	bss, err := whd.DecodeEscanResult(_busOrder, data)
+	if err != nil {
+		d.logerr("rxScanResult", slog.String("err", err.Error()))
+		return
+	}
+	d.scancache_add(&bss)
+	d.scanFn(&bss)
+}
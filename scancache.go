@@ -0,0 +1,93 @@
+package cyw43439
+
+import (
+	"time"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+const (
+	// scanCacheLen is the amount of BSSs kept by the scan result cache.
+	scanCacheLen = 16
+	// scanCacheFresh is the age below which JoinAuto restricts its scan to
+	// the channels the network was last seen on.
+	scanCacheFresh = 30 * time.Second
+)
+
+// ScanResult is a BSS found by a recent scan, see LastScanResults.
+type ScanResult struct {
+	// BSS is the last report of the BSS. IEs is nil since the information
+	// elements are not kept, their parsed form is in Capabilities.
+	BSS          whd.BSSInfo
+	Capabilities whd.Capabilities
+	// Age is the time since the BSS was last reported by a scan.
+	Age time.Duration
+}
+
+// scanEntry is a BSS kept by the scan result cache.
+type scanEntry struct {
+	bss  whd.BSSInfo
+	caps whd.Capabilities
+	seen time.Time
+}
+
+// LastScanResults appends the BSSs found by recent scans to dst, so UIs can
+// list networks without rescanning. Results of all scans are kept, including
+// those done by joins, up to the 16 most recently seen BSSs. A BSS reported
+// more than once keeps its last report. The cache is cleared by Reset.
+func (d *Device) LastScanResults(dst []ScanResult) []ScanResult {
+	d.lock()
+	defer d.unlock()
+	for i := range d.scanCache {
+		e := &d.scanCache[i]
+		if e.seen.IsZero() {
+			continue
+		}
+		dst = append(dst, ScanResult{BSS: e.bss, Capabilities: e.caps, Age: d.since(e.seen)})
+	}
+	return dst
+}
+
+// scancache_add stores a scan result, replacing the entry of the same BSSID
+// or else the least recently seen one.
+func (d *Device) scancache_add(bss *whd.BSSInfo) {
+	slot := -1
+	for i := range d.scanCache {
+		if e := &d.scanCache[i]; !e.seen.IsZero() && e.bss.BSSID == bss.BSSID {
+			slot = i
+			break
+		}
+	}
+	if slot < 0 {
+		slot = 0 // Empty entries have the zero time, which is the oldest.
+		for i := range d.scanCache {
+			if d.scanCache[i].seen.Before(d.scanCache[slot].seen) {
+				slot = i
+			}
+		}
+	}
+	caps, _ := bss.Capabilities()
+	e := &d.scanCache[slot]
+	*e = scanEntry{bss: *bss, caps: caps, seen: d.rxTime}
+	e.bss.IEs = nil
+}
+
+// scancache_channels appends to dst the channels ssid was seen on within
+// scanCacheFresh.
+func (d *Device) scancache_channels(dst []uint8, ssid string) []uint8 {
+	for i := range d.scanCache {
+		e := &d.scanCache[i]
+		if e.seen.IsZero() || d.since(e.seen) > scanCacheFresh || string(e.bss.SSIDBytes()) != ssid {
+			continue
+		}
+		ch := e.bss.Channel()
+		found := false
+		for _, c := range dst {
+			found = found || c == ch
+		}
+		if !found {
+			dst = append(dst, ch)
+		}
+	}
+	return dst
+}
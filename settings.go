@@ -0,0 +1,347 @@
+package cyw43439
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errSettingsMagic   = errors.New("settings: bad magic")
+	errSettingsVersion = errors.New("settings: unsupported version")
+	errSettingsBounds  = errors.New("settings: entry out of bounds")
+	errSettingsCRC     = errors.New("settings: checksum mismatch")
+	errSettingsNone    = errors.New("settings: no valid record stored")
+	errSettingsSize    = errors.New("settings: record larger than bank")
+	errBadCountry      = errors.New("country code must be two uppercase letters")
+	errBadMAC          = errors.New("MAC address must be unicast and non-zero")
+)
+
+// Settings record layout, all integers little endian:
+//
+//	[0:4]  magic "CYWC"
+//	[4:6]  version, currently 1
+//	[6:8]  length L of the entries
+//	[8:8+L] entries, each is:
+//	       [0]   tag, see settingsTag
+//	       [1:3] length N of the value
+//	       [3:3+N] value
+//	[8+L:12+L] CRC-32 (IEEE) of bytes [0:8+L]
+//
+// Unknown tags are skipped so records written by newer versions of the
+// driver remain readable. The version only changes if existing entries change
+// meaning.
+const (
+	settingsMagic     = "CYWC"
+	settingsVersion   = 1
+	settingsHeaderLen = 8
+	settingsEntryLen  = 3
+)
+
+// settingsTag identifies an entry of a settings record.
+type settingsTag uint8
+
+const (
+	settingsCountry settingsTag = 1 // Country code and revision.
+	settingsMAC     settingsTag = 2 // MAC address override.
+	settingsProfile settingsTag = 3 // Performance profile.
+	settingsState   settingsTag = 4 // Join state, see SaveState.
+)
+
+// Settings are the radio settings an application persists across resets and
+// application updates, see StoreSettings and LoadSettings. Zero fields are
+// not applied by ApplySettings, leaving the setting as after Init.
+type Settings struct {
+	// Country is the ISO 3166 alpha-2 code of the regulatory domain, see SetCountry.
+	Country    string
+	CountryRev uint8
+	// MAC overrides the chip's MAC address, see SetMAC.
+	MAC [6]byte
+	// Profile is the performance profile, see SetPerformanceProfile.
+	Profile PerformanceProfile
+	// State is the join state written by SaveState.
+	State []byte
+}
+
+// AppendSettings appends the versioned serialization of s to dst.
+func AppendSettings(dst []byte, s *Settings) []byte {
+	start := len(dst)
+	dst = append(dst, settingsMagic...)
+	dst = binary.LittleEndian.AppendUint16(dst, settingsVersion)
+	dst = append(dst, 0, 0) // Entries length, set below.
+	if s.Country != "" {
+		dst = appendSettingsEntry(dst, settingsCountry, s.Country[:min(len(s.Country), 2)], s.CountryRev)
+	}
+	if s.MAC != [6]byte{} {
+		dst = appendSettingsEntry(dst, settingsMAC, string(s.MAC[:]))
+	}
+	if s.Profile != ProfileBalanced {
+		dst = appendSettingsEntry(dst, settingsProfile, "", byte(s.Profile))
+	}
+	if len(s.State) > 0 {
+		dst = appendSettingsEntry(dst, settingsState, string(s.State))
+	}
+	binary.LittleEndian.PutUint16(dst[start+6:], uint16(len(dst)-start-settingsHeaderLen))
+	return binary.LittleEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+func appendSettingsEntry(dst []byte, tag settingsTag, value string, extra ...byte) []byte {
+	dst = append(dst, byte(tag))
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(value)+len(extra)))
+	dst = append(dst, value...)
+	return append(dst, extra...)
+}
+
+// ParseSettings parses a record written by AppendSettings. State references b.
+func ParseSettings(b []byte) (s Settings, err error) {
+	if len(b) < settingsHeaderLen+4 || string(b[:4]) != settingsMagic {
+		return s, errSettingsMagic
+	} else if binary.LittleEndian.Uint16(b[4:6]) != settingsVersion {
+		return s, errSettingsVersion
+	}
+	end := settingsHeaderLen + int(binary.LittleEndian.Uint16(b[6:8]))
+	if end+4 > len(b) {
+		return s, errSettingsBounds
+	} else if crc32.ChecksumIEEE(b[:end]) != binary.LittleEndian.Uint32(b[end:]) {
+		return s, errSettingsCRC
+	}
+	entries := b[settingsHeaderLen:end]
+	for len(entries) > 0 {
+		if len(entries) < settingsEntryLen {
+			return s, errSettingsBounds
+		}
+		n := settingsEntryLen + int(binary.LittleEndian.Uint16(entries[1:3]))
+		if n > len(entries) {
+			return s, errSettingsBounds
+		}
+		value := entries[settingsEntryLen:n]
+		switch settingsTag(entries[0]) {
+		case settingsCountry:
+			if len(value) == 3 {
+				s.Country, s.CountryRev = string(value[:2]), value[2]
+			}
+		case settingsMAC:
+			if len(value) == 6 {
+				s.MAC = [6]byte(value)
+			}
+		case settingsProfile:
+			if len(value) == 1 {
+				s.Profile = PerformanceProfile(value[0])
+			}
+		case settingsState:
+			s.State = value
+		}
+		entries = entries[n:]
+	}
+	return s, nil
+}
+
+// SettingsStore persists a settings record outside the program binary, i.e:
+// in a flash region the application's OTA updates leave untouched.
+type SettingsStore interface {
+	// LoadSettings returns the stored record, an error if none is stored.
+	LoadSettings() ([]byte, error)
+	// StoreSettings replaces the stored record. Implementations should keep
+	// the previous record until the new one is completely written, see DualBankStore.
+	StoreSettings(record []byte) error
+}
+
+// SettingsBank is a region of non-volatile memory, i.e: a flash sector,
+// holding one copy of the settings record of a DualBankStore.
+type SettingsBank interface {
+	io.ReaderAt
+	io.WriterAt
+	// Erase prepares the bank to be written. Memories that need no erasure
+	// may implement it as a no-op.
+	Erase() error
+}
+
+// DualBankStore is a SettingsStore which alternates between two banks so a
+// write interrupted by a power loss or reset leaves the previous record
+// readable. Each bank holds a sequence number followed by the record, the
+// newest valid record is loaded.
+type DualBankStore struct {
+	Banks [2]SettingsBank
+	// Size is the size of each bank in bytes.
+	Size int
+}
+
+// LoadSettings returns the newest valid record.
+func (s *DualBankStore) LoadSettings() ([]byte, error) {
+	record, _, bank := s.newest()
+	if bank < 0 {
+		return nil, errSettingsNone
+	}
+	return record, nil
+}
+
+// StoreSettings writes record to the bank not holding the newest record.
+func (s *DualBankStore) StoreSettings(record []byte) error {
+	if 4+len(record) > s.Size {
+		return errSettingsSize
+	}
+	_, seq, bank := s.newest()
+	bank = (bank + 1) % 2 // Bank 0 if none is valid.
+	buf := make([]byte, 4+len(record))
+	binary.LittleEndian.PutUint32(buf, seq+1)
+	copy(buf[4:], record)
+	err := s.Banks[bank].Erase()
+	if err != nil {
+		return err
+	}
+	_, err = s.Banks[bank].WriteAt(buf, 0)
+	return err
+}
+
+// newest returns the newest valid record, its sequence number and bank, -1 if none is valid.
+func (s *DualBankStore) newest() (record []byte, seq uint32, bank int) {
+	bank = -1
+	for i := range s.Banks {
+		buf := make([]byte, s.Size)
+		n, _ := s.Banks[i].ReadAt(buf, 0)
+		if n < 4 {
+			continue
+		} else if _, err := ParseSettings(buf[4:n]); err != nil {
+			continue
+		}
+		bseq := binary.LittleEndian.Uint32(buf)
+		if bank < 0 || int32(bseq-seq) > 0 {
+			end := 4 + settingsHeaderLen + int(binary.LittleEndian.Uint16(buf[10:12])) + 4
+			record, seq, bank = buf[4:end], bseq, i
+		}
+	}
+	return record, seq, bank
+}
+
+// SetCountry sets the regulatory domain the radio operates in, which selects
+// the allowed channels and transmit power. code is an ISO 3166 alpha-2
+// country code such as "US", see whd.CountryInfo. Init sets the worldwide
+// domain "XX". Must be set before joining a network or starting an AP.
+func (d *Device) SetCountry(code string, rev uint8) error {
+	info := whd.CountryInfo(code, rev)
+	if info[0] == 0 {
+		return errBadCountry
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	d.info("SetCountry", slog.String("code", code), slog.Int("rev", int(rev)))
+	err := d.set_iovar_n("country", whd.IF_STA, info[:])
+	if err != nil {
+		return err
+	}
+	d.country, d.countryRev = [2]byte(info[:2]), rev
+	// set country takes some time, next ioctls fail if we don't wait.
+	d.sleep(100 * time.Millisecond)
+	return nil
+}
+
+// SetMAC overrides the MAC address of the station interface until the
+// device is reset. The interface is brought down to change the address so
+// the network joined, if any, is left.
+func (d *Device) SetMAC(mac [6]byte) error {
+	if mac[0]&1 != 0 || mac == [6]byte{} {
+		return errBadMAC
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	d.info("SetMAC", slog.String("mac", net.HardwareAddr(mac[:]).String()))
+	if err := d.doIoctlSet(whd.WLC_DOWN, whd.IF_STA, nil); err != nil {
+		return err
+	}
+	d.state = linkStateDown
+	if err := d.set_iovar_n("cur_etheraddr", whd.IF_STA, mac[:]); err != nil {
+		return err
+	}
+	if err := d.doIoctlSet(whd.WLC_UP, whd.IF_STA, nil); err != nil {
+		return err
+	}
+	d.mac, d.macOverride = mac, true
+	return nil
+}
+
+// Settings returns the current radio settings: the country, MAC override and
+// performance profile set since Init and the join state if a network is
+// joined, see SaveState.
+func (d *Device) Settings() (Settings, error) {
+	var state bytes.Buffer
+	err := d.SaveState(&state)
+	if err != nil && err != errStateNoJoin {
+		return Settings{}, err
+	}
+	d.lock()
+	defer d.unlock()
+	s := Settings{CountryRev: d.countryRev, Profile: d.profile, State: state.Bytes()}
+	if d.country != [2]byte{} {
+		s.Country = string(d.country[:])
+	}
+	if d.macOverride {
+		s.MAC = d.mac
+	}
+	return s, nil
+}
+
+// ApplySettings applies the non-zero fields of s: the country, MAC address and
+// performance profile, and finally restores the join state. Init must be called first.
+func (d *Device) ApplySettings(s Settings) error {
+	if s.Country != "" {
+		if err := d.SetCountry(s.Country, s.CountryRev); err != nil {
+			return err
+		}
+	}
+	if s.MAC != [6]byte{} {
+		if err := d.SetMAC(s.MAC); err != nil {
+			return err
+		}
+	}
+	if s.Profile != ProfileBalanced {
+		if err := d.SetPerformanceProfile(s.Profile); err != nil {
+			return err
+		}
+	}
+	if len(s.State) > 0 {
+		return d.RestoreState(bytes.NewReader(s.State))
+	}
+	return nil
+}
+
+// StoreSettings writes the current settings to st, see Settings. The record
+// holds the PMK of the joined network so st should be as secure as the
+// passphrase, see SaveState.
+func (d *Device) StoreSettings(st SettingsStore) error {
+	s, err := d.Settings()
+	if err != nil {
+		return err
+	}
+	record := AppendSettings(nil, &s)
+	err = st.StoreSettings(record)
+	clear(record)
+	clear(s.State)
+	return err
+}
+
+// LoadSettings reads the settings stored in st and applies them, see ApplySettings.
+func (d *Device) LoadSettings(st SettingsStore) error {
+	record, err := st.LoadSettings()
+	if err != nil {
+		return err
+	}
+	defer clear(record)
+	s, err := ParseSettings(record)
+	if err != nil {
+		return err
+	}
+	return d.ApplySettings(s)
+}
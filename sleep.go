@@ -0,0 +1,129 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errKSOTimeout = errors.New("timeout setting KSO (keep SDIO on)")
+
+const (
+	// busSleepIdlePolls is the amount of consecutive idle polls after which the bus is put to sleep.
+	busSleepIdlePolls = 8
+	// ksoRetries bounds the KSO bit readback loop, see kso_set.
+	ksoRetries = 64
+)
+
+// SaveRestoreEnabled reports whether Init enabled the chip's save/restore
+// engine. If enabled the chip enters deep sleep between transactions while
+// firmware power save is on, see Device.Poll.
+func (d *Device) SaveRestoreEnabled() bool {
+	d.lock()
+	defer d.unlock()
+	return d.srEnabled
+}
+
+// sr_init enables the host side of the save/restore (SR) engine if the
+// firmware initialized it. With SR the chip saves firmware state before deep
+// sleep and restores it on wakeup, so the bus may be put to sleep with KSO
+// (keep SDIO on) between transactions. The device is left awake.
+//
+//	reference: whd_enable_save_restore, brcmf_sdio_sr_init
+func (d *Device) sr_init() (enabled bool, err error) {
+	sr, err := d.bp_read32(whd.CHIPCOMMON_SR_CONTROL1)
+	if err != nil || sr == 0 {
+		return false, err // Firmware did not configure the SR engine.
+	}
+	// Request the HT clock after the SDIO core is powered on by a wakeup.
+	wctrl, err := d.read8(FuncBackplane, whd.SDIO_WAKEUP_CTRL)
+	if err != nil {
+		return false, err
+	}
+	d.write8(FuncBackplane, whd.SDIO_WAKEUP_CTRL, wctrl|whd.SBSDIO_WCTRL_WAKE_TILL_HT_AVAIL)
+	// Have sdiod_aos wake the device on any command line activity without decoding it.
+	d.write8(FuncBus, whd.SDIOD_CCCR_BRCM_CARDCAP, whd.SDIOD_CCCR_BRCM_CARDCAP_CMD_NODEC)
+	d.clkBase = whd.SBSDIO_FORCE_HT
+	err = d.clock_update()
+	if err != nil {
+		return false, err
+	}
+	slp, err := d.read8(FuncBackplane, whd.SDIO_SLEEP_CSR)
+	if err != nil {
+		return false, err
+	}
+	if slp&whd.SBSDIO_SLPCSR_KEEP_SDIO_ON == 0 {
+		err = d.kso_set(true)
+	}
+	d.debug("sr_init", slog.Uint64("sr_control1", uint64(sr)))
+	return err == nil, err
+}
+
+// kso_set sets or clears the KSO bit. Clearing it lets the WLAN core enter
+// deep sleep; setting it wakes the device and waits until it reports being on.
+//
+//	reference: cyw43_kso_set
+func (d *Device) kso_set(on bool) error {
+	var val, mask, want uint8 = 0, whd.SBSDIO_SLPCSR_KEEP_SDIO_ON, 0
+	if on {
+		// Wake: both KSO and device on status bits must read back set.
+		val = whd.SBSDIO_SLPCSR_KEEP_SDIO_ON
+		mask = whd.SBSDIO_SLPCSR_KEEP_SDIO_ON | whd.SBSDIO_SLPCSR_DEVICE_ON
+		want = mask
+	}
+	// Sleep register writes are synchronized to the 32kHz PMU clock so a
+	// single write may be missed, write twice and read back until it sticks.
+	d.write8(FuncBackplane, whd.SDIO_SLEEP_CSR, val)
+	d.write8(FuncBackplane, whd.SDIO_SLEEP_CSR, val)
+	for i := 0; i < ksoRetries; i++ {
+		got, err := d.read8(FuncBackplane, whd.SDIO_SLEEP_CSR)
+		if err == nil && got != 0xff && got&mask == want {
+			return nil
+		}
+		d.sleep(time.Millisecond)
+		d.write8(FuncBackplane, whd.SDIO_SLEEP_CSR, val)
+	}
+	return errKSOTimeout
+}
+
+// bus_awake wakes the bus if it was put to sleep by bus_sleep. It is called
+// before all WLAN and backplane transactions, bus function registers remain
+// accessible while asleep.
+func (d *Device) bus_awake() error {
+	if !d.busAsleep {
+		return nil
+	}
+	d.busAsleep = false // kso_set accesses the backplane.
+	d.busIdlePolls = 0
+	err := d.kso_set(true)
+	if err != nil {
+		d.busAsleep = true
+		d.logerr("bus_awake", slog.String("err", err.Error()))
+		return err
+	}
+	d.stats.BusWakeups++
+	return nil
+}
+
+// bus_idle is called when a poll finds no pending work. After enough idle polls
+// the bus is put to sleep if the save/restore engine and firmware power save
+// are enabled and no clock is requested. Bluetooth keeps the bus awake since
+// its ring buffers are polled over the backplane.
+func (d *Device) bus_idle() {
+	if d.busAsleep || !d.srEnabled || d.pmMode.mode() == 0 || d.btaddr != 0 ||
+		d.clkRefs != [numClocks]uint8{} {
+		return
+	}
+	d.busIdlePolls++
+	if d.busIdlePolls < busSleepIdlePolls {
+		return
+	}
+	err := d.kso_set(false)
+	if err != nil {
+		d.logerr("bus_idle:sleep", slog.String("err", err.Error()))
+		return
+	}
+	d.busAsleep = true
+}
@@ -0,0 +1,203 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errStateNoJoin  = errors.New("no network joined to save")
+	errStateInvalid = errors.New("invalid device state")
+	errLeaseIP      = errors.New("lease requires IPv4 addresses")
+)
+
+const (
+	stateMagic   = "CYWS"
+	stateVersion = 1
+	// stateLen is the length of the encoded device state, see SaveState.
+	stateLen = 99
+
+	stateHasPMK   = 1 << 0
+	stateHasLease = 1 << 1
+	stateHidden   = 1 << 2
+)
+
+// Lease is an IPv4 address lease, usually obtained via DHCP. The driver does
+// not run DHCP itself: the lease is handed to it with SetLease so that it is
+// persisted with SaveState and can be reused after RestoreState.
+type Lease struct {
+	IP        netip.Addr
+	PrefixLen uint8
+	Gateway   netip.Addr
+	DNS       netip.Addr
+	// Server is the DHCP server which granted the lease.
+	Server netip.Addr
+	// Expiry is the time the lease expires.
+	Expiry time.Time
+}
+
+// joinCreds are the credentials of the last successful join, kept for SaveState.
+// Only the PMK of secured networks is kept, never the passphrase, see pskCreds.
+type joinCreds struct {
+	ssid   string
+	pmk    [32]byte
+	hasPMK bool
+	// hidden is set if the network does not broadcast its SSID, see JoinOptions.Hidden.
+	hidden bool
+}
+
+// SetLease sets the IPv4 address lease of the station interface and programs
+// the firmware ARP offload with its address, see SetHostIP.
+// A zero Lease clears the lease and disables ARP offload.
+func (d *Device) SetLease(lease Lease) error {
+	if lease.IP.IsValid() && !lease.IP.Is4() {
+		return errLeaseIP
+	}
+	d.lock()
+	defer d.unlock()
+	d.lease = lease
+	return d.set_host_ip(lease.IP)
+}
+
+// Lease returns the lease set with SetLease or restored by RestoreState.
+// ok is false if there is no lease or it has expired.
+func (d *Device) Lease() (lease Lease, ok bool) {
+	d.lock()
+	defer d.unlock()
+	return d.lease, d.lease.IP.IsValid() && d.since(d.lease.Expiry) < 0
+}
+
+// SaveState writes the state needed to reconnect to the current network to w:
+// the SSID, the pairwise master key, the BSSID and channel of the AP and the
+// lease set with SetLease. Passing the state to RestoreState after
+// a reset reconnects to the same AP skipping the network scan and the PMK
+// derivation, which takes the firmware a considerable part of a WPA2 join.
+// The passphrase is not saved, but the PMK suffices to join the network so
+// the state should be stored as securely as the passphrase.
+func (d *Device) SaveState(w io.Writer) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if d.state != linkStateUp || d.creds.ssid == "" {
+		return errStateNoJoin
+	}
+	var bssid [6]byte
+	_, err := d.doIoctlGet(whd.WLC_GET_BSSID, whd.IF_STA, bssid[:])
+	if err != nil {
+		return err
+	}
+	chanspec, err := d.get_iovar("chanspec", whd.IF_STA)
+	if err != nil {
+		return err
+	}
+	c := &d.creds
+	var buf [stateLen]byte
+	copy(buf[0:4], stateMagic)
+	buf[4] = stateVersion
+	buf[6] = uint8(copy(buf[7:39], c.ssid))
+	if c.hasPMK {
+		buf[5] |= stateHasPMK
+		copy(buf[39:71], c.pmk[:])
+	}
+	if c.hidden {
+		buf[5] |= stateHidden
+	}
+	copy(buf[71:77], bssid[:])
+	buf[77] = uint8(chanspec & whd.CHANSPEC_CHAN_MASK)
+	if remaining := -d.since(d.lease.Expiry); d.lease.IP.IsValid() && remaining > 0 {
+		buf[5] |= stateHasLease
+		putAddr4(buf[78:82], d.lease.IP)
+		buf[82] = d.lease.PrefixLen
+		putAddr4(buf[83:87], d.lease.Gateway)
+		putAddr4(buf[87:91], d.lease.DNS)
+		putAddr4(buf[91:95], d.lease.Server)
+		binary.BigEndian.PutUint32(buf[95:99], uint32(min(remaining/time.Second, 1<<32-1)))
+	}
+	_, err = w.Write(buf[:])
+	clear(buf[:])
+	return err
+}
+
+// RestoreState reads a state written by SaveState from r and joins the saved
+// AP on its channel using the saved PMK, falling back to a regular join of
+// the network if the AP is not found. Init must be called first. If the saved
+// lease has not expired it is restored and its address programmed, see Lease,
+// so the network stack may skip DHCP or just renew the lease.
+func (d *Device) RestoreState(r io.Reader) error {
+	var buf [stateLen]byte
+	defer clear(buf[:])
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return err
+	}
+	flags := buf[5]
+	if string(buf[0:4]) != stateMagic || buf[4] != stateVersion || buf[6] == 0 || buf[6] > 32 {
+		return errStateInvalid
+	}
+	creds := joinCreds{
+		ssid:   string(buf[7 : 7+buf[6]]),
+		hasPMK: flags&stateHasPMK != 0,
+		hidden: flags&stateHidden != 0,
+	}
+	copy(creds.pmk[:], buf[39:71])
+	clear(buf[39:71])
+	var target *joinTarget
+	if bssid := [6]byte(buf[71:77]); bssid != [6]byte{} {
+		target = &joinTarget{bssid: bssid, channel: buf[77]}
+	}
+
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if d.joining {
+		return errJoinBusy
+	}
+	d.joinPol.hidden = creds.hidden
+	defer func() { d.joinPol = joinPolicy{} }()
+	err = d.join_creds(&creds, target)
+	if err != nil && target != nil {
+		// The AP may have moved to another channel or be gone.
+		d.info("RestoreState:retry", slog.String("err", err.Error()))
+		err = d.join_creds(&creds, nil)
+	}
+	if err != nil {
+		clear(creds.pmk[:])
+		return err
+	}
+	d.creds = creds
+	if flags&stateHasLease == 0 {
+		return nil
+	}
+	d.lease = Lease{
+		IP:        netip.AddrFrom4([4]byte(buf[78:82])),
+		PrefixLen: buf[82],
+		Gateway:   netip.AddrFrom4([4]byte(buf[83:87])),
+		DNS:       netip.AddrFrom4([4]byte(buf[87:91])),
+		Server:    netip.AddrFrom4([4]byte(buf[91:95])),
+		Expiry:    d.now().Add(time.Duration(binary.BigEndian.Uint32(buf[95:99])) * time.Second),
+	}
+	return d.set_host_ip(d.lease.IP)
+}
+
+// join_creds joins the network of c, with its PMK if it has one.
+func (d *Device) join_creds(c *joinCreds, target *joinTarget) error {
+	if c.hasPMK {
+		return d.join_wpa2(c.ssid, "", &c.pmk, target)
+	}
+	return d.join_open(c.ssid, target)
+}
+
+func putAddr4(b []byte, addr netip.Addr) {
+	if addr.Is4() {
+		a := addr.As4()
+		copy(b, a[:])
+	}
+}
@@ -0,0 +1,85 @@
+package cyw43439
+
+// Stats holds counters of the traffic handled by the driver since Init or the
+// last call to ResetStats. Counters are updated in the packet path so that
+// throughput and latency can be measured on the device without instrumentation.
+type Stats struct {
+	// Ethernet frames and their bytes sent to the chip.
+	TxFrames uint32
+	TxBytes  uint64
+	// TxErrors counts frames which failed to be sent.
+	TxErrors uint32
+	// TxQueueDepth is the amount of frames in the TX queue, see SetTxQueue.
+	TxQueueDepth uint32
+	// TxQueueAged counts queued frames dropped for exceeding their age limit
+	// and TxQueueDropped frames dropped for lack of room in the queue or
+	// failing to be sent.
+	TxQueueAged    uint32
+	TxQueueDropped uint32
+	// Ethernet frames and their bytes received from the chip, including frames
+	// dropped for lack of a receive handler.
+	RxFrames uint32
+	RxBytes  uint64
+	// RxDropped counts received frames for which no handler was set.
+	RxDropped uint32
+	// RxFiltered counts received frames dropped by the host-side destination
+	// address filter, see SetRxFilter.
+	RxFiltered uint32
+	// RxRateLimited counts received broadcast and multicast frames dropped by
+	// the rate limiter, see SetRxGroupLimit.
+	RxRateLimited uint32
+	// RxHandlerErrors counts errors returned by receive handlers, including
+	// panics, which are also counted in RxHandlerPanics. See SetRecvErrorPolicy.
+	RxHandlerErrors uint32
+	RxHandlerPanics uint32
+	// RxEvents counts async events received from the firmware.
+	RxEvents uint32
+	// RxErrors counts SDPCM packets read from the bus which failed to be processed.
+	RxErrors uint32
+	// RxSeqGaps counts discontinuities in received SDPCM sequence numbers and
+	// RxSeqLost the amount of packets skipped by them. Gaps are a sign of bus
+	// level corruption or packets dropped by the chip.
+	RxSeqGaps uint32
+	RxSeqLost uint32
+	// RxSeqDuplicates counts received SDPCM packets discarded for having a
+	// sequence number already processed.
+	RxSeqDuplicates uint32
+	// BridgeForwarded and BridgeDropped count frames forwarded and dropped
+	// between the SoftAP and station interfaces, see StartBridge.
+	BridgeForwarded uint32
+	BridgeDropped   uint32
+	// HCI packets and their bytes written to and read from the Bluetooth controller.
+	HCITxPackets uint32
+	HCITxBytes   uint64
+	HCIRxPackets uint32
+	HCIRxBytes   uint64
+	// BusWakeups counts wakeups of the bus from KSO sleep, which is entered
+	// when idle with firmware power save enabled.
+	BusWakeups uint32
+	// BusCRCErrors counts bus transactions the chip flagged with a command or
+	// data error, which it detects with error checking enabled, see SetBusCRC.
+	BusCRCErrors uint32
+	// LinkCheckDown counts links found lost by the periodic link
+	// verification without an event reporting it, see SetLinkCheck.
+	LinkCheckDown uint32
+}
+
+// Stats returns the driver traffic counters.
+func (d *Device) Stats() Stats {
+	d.lock()
+	defer d.unlock()
+	stats := d.stats
+	if d.txq != nil {
+		stats.TxQueueDepth = uint32(d.txq.n)
+	}
+	stats.BusCRCErrors = d.spi.errs
+	return stats
+}
+
+// ResetStats zeroes the driver traffic counters.
+func (d *Device) ResetStats() {
+	d.lock()
+	defer d.unlock()
+	d.stats = Stats{}
+	d.spi.errs = 0
+}
@@ -0,0 +1,7 @@
+//go:build !cy43strict
+
+package cyw43439
+
+// strictMode enables validation of firmware responses, see strict_check.
+// Build with the cy43strict tag to enable, i.e: go test -tags cy43strict.
+const strictMode = false
@@ -0,0 +1,6 @@
+//go:build cy43strict
+
+package cyw43439
+
+// strictMode enables validation of firmware responses, see strict_check.
+const strictMode = true
@@ -0,0 +1,49 @@
+//go:build cy43strict
+
+package cyw43439
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+// strictPanic returns the strict mode violation raised by fn, if any.
+func strictPanic(fn func()) (what string) {
+	defer func() {
+		if r := recover(); r != nil {
+			what, _ = r.(string)
+		}
+	}()
+	fn()
+	return ""
+}
+
+func TestStrictShortIoctlResponse(t *testing.T) {
+	d, bus := newFakeDevice(t)
+	d.initialized = true
+	d.sdpcmSeqMax = d.sdpcmSeq + 0x40
+	bus.ioctlResp = func(io fakeIoctl) ([]byte, uint32) {
+		return []byte{1, 2, 3, 4}, 0 // Shorter than the request.
+	}
+	what := strictPanic(func() { d.get_iovar("chanspec", whd.IF_STA) })
+	if !strings.Contains(what, "ioctl response shorter than request") {
+		t.Errorf("got %q, want short response violation", what)
+	}
+	// Well formed responses pass.
+	bus.ioctlResp = nil
+	bus.resps = nil
+	bus.pkt[4] = d.rxSeq
+	if what := strictPanic(func() { d.get_iovar("chanspec", whd.IF_STA) }); what != "" {
+		t.Errorf("valid response flagged: %q", what)
+	}
+}
+
+func TestStrictRingWrite(t *testing.T) {
+	d, _ := newFakeDevice(t)
+	what := strictPanic(func() { d.bt_ring_write(HCIRingSize+4, make([]byte, 4)) })
+	if !strings.Contains(what, "invalid host-to-controller ring write") {
+		t.Errorf("got %q, want ring write violation", what)
+	}
+}
@@ -0,0 +1,90 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errTxPendingFull = errors.New("too many frames pending transmission")
+
+// maxTxPending is the amount of frames SendEthWithHeadroom holds while
+// waiting for bus credit with a TX done handler set.
+const maxTxPending = 8
+
+// txPending is a ring of caller buffers waiting for bus credit, sent in place.
+type txPending struct {
+	bufs [maxTxPending][]byte
+	prio [maxTxPending]uint8
+	head int // Index of the oldest buffer.
+	n    int
+}
+
+// SetTxDoneHandler sets the handler called when the driver is done with a
+// buffer passed to SendEthWithHeadroom, after which the buffer may be reused,
+// enabling copy-free TX pipelines over a static pool of frame buffers.
+// err is nil if the frame was sent and non-nil if it was dropped.
+//
+// With a handler set SendEthWithHeadroom does not wait for bus credit: if
+// the frame can't be sent right away the buffer is held, up to 8 buffers, and
+// sent in place from later calls and PollOne, TryPoll and Poll. The handler
+// is called exactly once for each buffer SendEthWithHeadroom returns nil for,
+// which may be before it returns; on error the buffer is not held. The
+// handler is called with the device locked and must not call Device methods.
+// Setting a new handler, or nil, drops held buffers, passing them to the
+// previous handler.
+func (d *Device) SetTxDoneHandler(handler func(buf []byte, err error)) {
+	d.lock()
+	defer d.unlock()
+	d.txpend_drop(errLinkDown)
+	d.txDone = handler
+}
+
+// txpend_send sends buf in place right away if possible, else holds it.
+func (d *Device) txpend_send(prio uint8, buf []byte) error {
+	d.txpend_flush()
+	p := &d.txPend
+	if p.n == 0 && d.has_credit() {
+		err := d.tx_inplace(whd.IF_STA, prio, buf)
+		if err == nil {
+			d.txDone(buf, nil)
+		}
+		return err
+	} else if !d.isIfaceUp(whd.IF_STA) {
+		return errLinkDown
+	} else if len(buf)-TxHeadroom > MaxFrameSize {
+		return errTxPacketTooLarge
+	} else if p.n == len(p.bufs) {
+		return errTxPendingFull
+	}
+	i := (p.head + p.n) % len(p.bufs)
+	p.bufs[i], p.prio[i] = buf, prio
+	p.n++
+	return nil
+}
+
+// txpend_flush sends held buffers while there is credit.
+func (d *Device) txpend_flush() {
+	p := &d.txPend
+	for p.n > 0 && d.has_credit() {
+		buf := p.bufs[p.head]
+		err := d.tx_inplace(whd.IF_STA, p.prio[p.head], buf)
+		p.bufs[p.head] = nil
+		p.head = (p.head + 1) % len(p.bufs)
+		p.n--
+		d.txDone(buf, err)
+	}
+}
+
+// txpend_drop returns held buffers to the TX done handler with err.
+func (d *Device) txpend_drop(err error) {
+	p := &d.txPend
+	for p.n > 0 {
+		buf := p.bufs[p.head]
+		p.bufs[p.head] = nil
+		p.head = (p.head + 1) % len(p.bufs)
+		p.n--
+		d.txDone(buf, err)
+	}
+	p.head = 0
+}
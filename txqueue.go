@@ -0,0 +1,139 @@
+package cyw43439
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errTxQueueDepth = errors.New("invalid TX queue depth")
+	errTxQueueOff   = errors.New("TX queue not enabled")
+)
+
+// maxTxQueueDepth bounds TxQueueConfig.Depth.
+const maxTxQueueDepth = 64
+
+// TxQueueConfig configures the TX queue, see SetTxQueue.
+type TxQueueConfig struct {
+	// Depth is the amount of frames the queue holds, up to 64. Zero disables the queue.
+	Depth int
+	// MaxAge is the age limit of frames sent with SendEth and SendEthIface.
+	// Frames older than their age limit are dropped instead of sent.
+	// Zero keeps frames until they are sent or the queue overflows.
+	MaxAge time.Duration
+}
+
+// txQueue is a ring of frames waiting for bus credit.
+type txQueue struct {
+	frames []txFrame
+	head   int // Index of the oldest frame.
+	n      int
+	maxAge time.Duration
+}
+
+type txFrame struct {
+	buf      []byte
+	iface    whd.IoctlInterface
+	prio     uint8
+	deadline time.Time // Zero if the frame does not age.
+}
+
+// SetTxQueue enables the TX queue with cfg, or disables it if cfg.Depth is
+// zero. Without a queue SendEth blocks while the chip has no buffer credit,
+// i.e: after a congestion stall, and frames are sent however late. With a
+// queue frames which can't be sent right away are queued and sent as credit
+// becomes available, from the send calls and PollOne, TryPoll and Poll.
+// Frames exceeding their age limit are dropped, so superseded data such as
+// sensor readings is not sent late, and when the queue is full the oldest
+// frame is dropped. Drops and queue depth are reported in Stats.
+// Frames queued when the queue is disabled or reconfigured are dropped.
+func (d *Device) SetTxQueue(cfg TxQueueConfig) error {
+	if cfg.Depth < 0 || cfg.Depth > maxTxQueueDepth {
+		return errTxQueueDepth
+	}
+	d.lock()
+	defer d.unlock()
+	if d.txq != nil {
+		d.stats.TxQueueDropped += uint32(d.txq.n)
+	}
+	if cfg.Depth == 0 {
+		d.txq = nil
+		return nil
+	}
+	d.txq = &txQueue{frames: make([]txFrame, cfg.Depth), maxAge: cfg.MaxAge}
+	return nil
+}
+
+// SendEthWithin sends an Ethernet packet over the station interface like
+// SendEth with an age limit of maxAge, overriding TxQueueConfig.MaxAge.
+// Requires the TX queue, see SetTxQueue.
+func (d *Device) SendEthWithin(pkt []byte, maxAge time.Duration) error {
+	d.lock()
+	defer d.unlock()
+	if d.txq == nil {
+		return errTxQueueOff
+	}
+	return d.txq_send(whd.IF_STA, d.tx_priority(pkt), pkt, maxAge)
+}
+
+// send sends pkt over iface with 802.1D priority prio, through the TX queue if enabled.
+func (d *Device) send(iface whd.IoctlInterface, prio uint8, pkt []byte) error {
+	if d.txq == nil {
+		return d.tx(iface, prio, pkt)
+	}
+	return d.txq_send(iface, prio, pkt, d.txq.maxAge)
+}
+
+// txq_send sends pkt right away if nothing is queued and there is credit, else queues it.
+func (d *Device) txq_send(iface whd.IoctlInterface, prio uint8, pkt []byte, maxAge time.Duration) error {
+	if !d.isIfaceUp(iface) {
+		return errLinkDown
+	} else if len(pkt) > MaxFrameSize {
+		return errTxPacketTooLarge
+	}
+	d.txq_flush()
+	q := d.txq
+	if q.n == 0 && d.has_credit() {
+		return d.tx(iface, prio, pkt)
+	}
+	if q.n == len(q.frames) {
+		// Drop the oldest frame to make room.
+		q.head = (q.head + 1) % len(q.frames)
+		q.n--
+		d.stats.TxQueueDropped++
+	}
+	f := &q.frames[(q.head+q.n)%len(q.frames)]
+	f.buf = append(f.buf[:0], pkt...)
+	f.iface = iface
+	f.prio = prio
+	f.deadline = time.Time{}
+	if maxAge > 0 {
+		f.deadline = d.now().Add(maxAge)
+	}
+	q.n++
+	return nil
+}
+
+// txq_flush drops frames past their age limit and sends queued frames while there is credit.
+func (d *Device) txq_flush() {
+	q := d.txq
+	if q == nil {
+		return
+	}
+	for q.n > 0 {
+		f := &q.frames[q.head]
+		if !f.deadline.IsZero() && d.since(f.deadline) > 0 {
+			d.stats.TxQueueAged++
+		} else if !d.has_credit() {
+			return
+		} else if err := d.tx(f.iface, f.prio, f.buf); err != nil {
+			d.debug("txq_flush", slog.String("err", err.Error()))
+			d.stats.TxQueueDropped++
+		}
+		q.head = (q.head + 1) % len(q.frames)
+		q.n--
+	}
+}
@@ -0,0 +1,83 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errVendorIETooLong  = errors.New("vendor IE data too long")
+	errVendorIEBadFlags = errors.New("vendor IE frames must be all AP or all station frames")
+	errVendorIENoAP     = errors.New("vendor IE in AP frames requires a running SoftAP")
+)
+
+// maxVendorIEData is the maximum length of vendor IE data following the OUI.
+const maxVendorIEData = 255 - 3
+
+// VendorIEFrames selects the transmitted frames a vendor IE is added to.
+type VendorIEFrames uint32
+
+const (
+	// AP frames.
+	VendorIEBeacon        VendorIEFrames = whd.VNDR_IE_BEACON_FLAG
+	VendorIEProbeResponse VendorIEFrames = whd.VNDR_IE_PRBRSP_FLAG
+	VendorIEAssocResponse VendorIEFrames = whd.VNDR_IE_ASSOCRSP_FLAG
+	// Station frames.
+	VendorIEProbeRequest VendorIEFrames = whd.VNDR_IE_PRBREQ_FLAG
+	VendorIEAssocRequest VendorIEFrames = whd.VNDR_IE_ASSOCREQ_FLAG
+
+	vendorIEAPFrames  = VendorIEBeacon | VendorIEProbeResponse | VendorIEAssocResponse
+	vendorIESTAFrames = VendorIEProbeRequest | VendorIEAssocRequest
+)
+
+// AddVendorIE adds a vendor specific information element with the given OUI
+// and data to the selected transmitted frames. Devices running the same
+// application can use vendor IEs in probe requests and beacons to discover
+// each other before associating, see whd.FindVendorIE to find them in scan results.
+// Frames must be either all AP frames, which require a running SoftAP, or all
+// station frames. Vendor IEs are cleared when the device is reset.
+func (d *Device) AddVendorIE(frames VendorIEFrames, oui [3]byte, data []byte) error {
+	d.lock()
+	defer d.unlock()
+	return d.set_vndr_ie("add", frames, oui, data)
+}
+
+// RemoveVendorIE removes a vendor specific information element previously
+// added with AddVendorIE. Arguments must match the ones passed to AddVendorIE.
+func (d *Device) RemoveVendorIE(frames VendorIEFrames, oui [3]byte, data []byte) error {
+	d.lock()
+	defer d.unlock()
+	return d.set_vndr_ie("del", frames, oui, data)
+}
+
+// set_vndr_ie encodes a wl_vndr_ie_setbuf_t with a single IE and sets it with the "vndr_ie" iovar.
+func (d *Device) set_vndr_ie(cmd string, frames VendorIEFrames, oui [3]byte, data []byte) error {
+	if !d.initialized {
+		return errDeviceNotInit
+	} else if len(data) > maxVendorIEData {
+		return errVendorIETooLong
+	}
+	iface := whd.IF_STA
+	switch {
+	case frames == 0 || frames&^(vendorIEAPFrames|vendorIESTAFrames) != 0 ||
+		(frames&vendorIEAPFrames != 0 && frames&vendorIESTAFrames != 0):
+		return errVendorIEBadFlags
+	case frames&vendorIEAPFrames != 0:
+		if !d.apUp {
+			return errVendorIENoAP
+		}
+		iface = d.apIface
+	}
+	d.info("set_vndr_ie", slog.String("cmd", cmd), slog.Uint64("frames", uint64(frames)), slog.Int("len", len(data)))
+	var buf [4 + 4 + 4 + 2 + 3 + maxVendorIEData]byte
+	copy(buf[:4], cmd)              // NUL terminated.
+	_busOrder.PutUint32(buf[4:], 1) // IE count.
+	_busOrder.PutUint32(buf[8:], uint32(frames))
+	buf[12] = whd.DOT11_IE_ID_VENDOR_SPECIFIC
+	buf[13] = uint8(3 + len(data))
+	copy(buf[14:17], oui[:])
+	n := 17 + copy(buf[17:], data)
+	return d.set_iovar_n("vndr_ie", iface, buf[:n])
+}
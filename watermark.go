@@ -0,0 +1,56 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errWatermarkRange    = errors.New("F2 watermark out of range 1..127")
+	errWatermarkNoAccess = errors.New("F2 watermark readback failed: backplane access not working, check bus wiring and clock")
+	errWatermarkMismatch = errors.New("F2 watermark readback mismatch: chip did not accept value")
+)
+
+// maxF2Watermark is the largest value accepted by the 7 bit watermark register.
+const maxF2Watermark = 0x7f
+
+// SetF2Watermark sets the F2 FIFO watermark in bytes: the amount of data the
+// chip buffers before raising the F2 packet available interrupt and starting
+// DMA. Lower values reduce WLAN and HCI latency at the expense of more frequent
+// interrupts and bus transactions; higher values batch data into fewer, larger
+// transfers. The default is 32 bytes, see Config.F2Watermark.
+func (d *Device) SetF2Watermark(watermark uint8) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	return d.set_f2_watermark(watermark)
+}
+
+// set_f2_watermark writes the F2 watermark register and verifies it reads back.
+func (d *Device) set_f2_watermark(watermark uint8) error {
+	if watermark == 0 || watermark > maxF2Watermark {
+		return errWatermarkRange
+	}
+	err := d.write8(FuncBackplane, whd.SDIO_FUNCTION2_WATERMARK, watermark)
+	if err != nil {
+		return err
+	}
+	got, err := d.read8(FuncBackplane, whd.SDIO_FUNCTION2_WATERMARK)
+	if err != nil {
+		return err
+	} else if got == watermark {
+		d.debug("set_f2_watermark", slog.Int("watermark", int(watermark)))
+		d.f2Watermark = watermark
+		return nil
+	}
+	// All ones or zeros usually means the backplane is not responding at all.
+	d.logerr("set_f2_watermark:readback", slog.Int("want", int(watermark)), slog.Int("got", int(got)))
+	if got == 0 || got == 0xff {
+		return errWatermarkNoAccess
+	}
+	return errWatermarkMismatch
+}
@@ -0,0 +1,275 @@
+package whd
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errIETruncated  = errors.New("IE length exceeds buffer")
+	errRSNTruncated = errors.New("RSN IE truncated")
+)
+
+// CipherSuites is a set of cipher suites advertised in RSN and WPA IEs.
+type CipherSuites uint8
+
+const (
+	CipherWEP40 CipherSuites = 1 << iota
+	CipherWEP104
+	CipherTKIP
+	CipherCCMP
+	CipherGCMP
+	CipherCCMP256
+	CipherGCMP256
+)
+
+// AKMSuites is a set of authentication and key management suites advertised in RSN and WPA IEs.
+type AKMSuites uint16
+
+const (
+	AKM8021X AKMSuites = 1 << iota
+	AKMPSK
+	AKMFT8021X
+	AKMFTPSK
+	AKM8021XSHA256
+	AKMPSKSHA256
+	AKMSAE // WPA3 personal.
+	AKMFTSAE
+	AKMOWE // Opportunistic wireless encryption (enhanced open).
+)
+
+// Capabilities is the capability information advertised by a BSS in the
+// information elements of its beacons and probe responses.
+type Capabilities struct {
+	// Privacy is set if the BSS requires encryption. A BSS with Privacy set
+	// and neither WPA nor RSN uses WEP.
+	Privacy bool
+	HT      bool // 802.11n.
+	VHT     bool // 802.11ac.
+	HE      bool // 802.11ax.
+	WMM     bool // Wi-Fi Multimedia QoS.
+	WPS     bool // Wi-Fi Protected Setup.
+	// WPA is set if the BSS advertises a WPA (version 1) vendor IE.
+	WPA bool
+	// RSN is set if the BSS advertises an RSN IE (WPA2/WPA3).
+	RSN bool
+	// GroupCipher is the cipher used for broadcast traffic. RSN takes precedence over WPA.
+	GroupCipher CipherSuites
+	// PairwiseCiphers is the union of WPA and RSN pairwise ciphers.
+	PairwiseCiphers CipherSuites
+	// AKMs is the union of WPA and RSN key management suites.
+	AKMs AKMSuites
+	// MFPCapable and MFPRequired are the 802.11w management frame protection RSN capabilities.
+	MFPCapable  bool
+	MFPRequired bool
+	// VendorIEs is the amount of vendor specific IEs, see FindVendorIE.
+	VendorIEs uint8
+}
+
+// Capabilities parses the information elements of the BSS.
+func (b *BSSInfo) Capabilities() (Capabilities, error) {
+	caps, err := ParseCapabilities(b.IEs)
+	caps.Privacy = b.Capability&DOT11_CAP_PRIVACY != 0
+	return caps, err
+}
+
+// Auth returns the CYW43_AUTH_* security to join the BSS with. ok is false if the
+// BSS requires security not supported by the driver, such as WEP or 802.1X.
+func (c *Capabilities) Auth() (auth uint32, ok bool) {
+	wpa3 := c.RSN && c.AKMs&AKMSAE != 0 && c.PairwiseCiphers&CipherCCMP != 0
+	wpa2 := c.RSN && c.AKMs&AKMPSK != 0 && c.PairwiseCiphers&CipherCCMP != 0
+	wpa := c.WPA && c.AKMs&AKMPSK != 0 && c.PairwiseCiphers&CipherTKIP != 0
+	switch {
+	case !c.Privacy:
+		return CYW43_AUTH_OPEN, true
+	case wpa2 && wpa:
+		// Legacy WPA clients are allowed, join without SAE for compatibility.
+		return CYW43_AUTH_WPA2_MIXED_PSK, true
+	case wpa3 && wpa2:
+		return CYW43_AUTH_WPA3_WPA2_AES_PSK, true
+	case wpa3:
+		return CYW43_AUTH_WPA3_SAE_AES_PSK, true
+	case wpa2:
+		return CYW43_AUTH_WPA2_AES_PSK, true
+	case wpa:
+		return CYW43_AUTH_WPA_TKIP_PSK, true
+	}
+	return 0, false
+}
+
+// ParseCapabilities parses a beacon or probe response's information elements.
+// Capabilities found before a malformed IE are returned along with the error.
+func ParseCapabilities(ies []byte) (caps Capabilities, err error) {
+	for len(ies) > 0 {
+		var id uint8
+		var data []byte
+		id, data, ies, err = NextIE(ies)
+		if err != nil {
+			return caps, err
+		}
+		switch id {
+		case DOT11_IE_ID_HT_CAP:
+			caps.HT = true
+		case DOT11_IE_ID_VHT_CAP:
+			caps.VHT = true
+		case DOT11_IE_ID_EXTENSION:
+			caps.HE = caps.HE || (len(data) > 0 && data[0] == DOT11_IE_EXT_ID_HE_CAP)
+		case DOT11_IE_ID_RSN:
+			caps.RSN = true
+			err = caps.parseSuites(data, RSN_OUI)
+			// RSN capabilities follow the suite lists, they are optional.
+			if rsncap, ok := rsnCapabilities(data); ok && err == nil {
+				caps.MFPCapable = rsncap&DOT11_RSN_CAP_MFPC != 0
+				caps.MFPRequired = rsncap&DOT11_RSN_CAP_MFPR != 0
+			}
+		case DOT11_IE_ID_VENDOR_SPECIFIC:
+			caps.VendorIEs++
+			if len(data) < 4 {
+				break
+			}
+			switch string(data[:4]) {
+			case WPA_OUI_TYPE1:
+				caps.WPA = true
+				group := caps.GroupCipher
+				err = caps.parseSuites(data[4:], WPA_OUI_TYPE1[:3])
+				if caps.RSN {
+					caps.GroupCipher = group
+				}
+			case WMM_OUI_TYPE2:
+				caps.WMM = true
+			case WPS_OUI_TYPE4:
+				caps.WPS = true
+			}
+		}
+		if err != nil {
+			return caps, err
+		}
+	}
+	return caps, nil
+}
+
+// NextIE splits the first information element off ies returning its ID,
+// its data and the remaining IEs.
+func NextIE(ies []byte) (id uint8, data, rest []byte, err error) {
+	if len(ies) < 2 || len(ies) < 2+int(ies[1]) {
+		return 0, nil, nil, errIETruncated
+	}
+	end := 2 + int(ies[1])
+	return ies[0], ies[2:end], ies[end:], nil
+}
+
+// FindVendorIE returns the data of the first vendor specific IE whose data
+// starts with ouiType, i.e: WPS_OUI_TYPE4. The returned data excludes ouiType.
+func FindVendorIE(ies []byte, ouiType string) (data []byte, ok bool) {
+	for len(ies) > 0 {
+		var id uint8
+		var err error
+		id, data, ies, err = NextIE(ies)
+		if err != nil {
+			return nil, false
+		}
+		if id == DOT11_IE_ID_VENDOR_SPECIFIC && len(data) >= len(ouiType) && string(data[:len(ouiType)]) == ouiType {
+			return data[len(ouiType):], true
+		}
+	}
+	return nil, false
+}
+
+// parseSuites parses the version, group cipher, pairwise cipher list and AKM list
+// shared by RSN and WPA IEs. All fields after the version are optional. 802.11 fields are little endian.
+func (caps *Capabilities) parseSuites(data []byte, oui string) error {
+	if len(data) < 2 {
+		return errRSNTruncated
+	}
+	data = data[2:] // Version.
+	if len(data) < 4 {
+		return nil
+	}
+	caps.GroupCipher |= cipherSuite(data[:4], oui)
+	data = data[4:]
+	for _, akm := range [2]bool{false, true} {
+		if len(data) < 2 {
+			return nil
+		}
+		n := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < 4*n {
+			return errRSNTruncated
+		}
+		for i := 0; i < n; i++ {
+			suite := data[4*i : 4*i+4]
+			if akm {
+				caps.AKMs |= akmSuite(suite, oui)
+			} else {
+				caps.PairwiseCiphers |= cipherSuite(suite, oui)
+			}
+		}
+		data = data[4*n:]
+	}
+	return nil
+}
+
+// rsnCapabilities returns the RSN capabilities field of an RSN IE's data.
+func rsnCapabilities(data []byte) (uint16, bool) {
+	off := 2 + 4 // Version and group cipher.
+	for i := 0; i < 2; i++ {
+		if len(data) < off+2 {
+			return 0, false
+		}
+		off += 2 + 4*int(binary.LittleEndian.Uint16(data[off:]))
+	}
+	if len(data) < off+2 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(data[off:]), true
+}
+
+func cipherSuite(suite []byte, oui string) CipherSuites {
+	if string(suite[:3]) != oui {
+		return 0
+	}
+	switch suite[3] {
+	case 1:
+		return CipherWEP40
+	case 2:
+		return CipherTKIP
+	case 4:
+		return CipherCCMP
+	case 5:
+		return CipherWEP104
+	case 8:
+		return CipherGCMP
+	case 9:
+		return CipherGCMP256
+	case 10:
+		return CipherCCMP256
+	}
+	return 0
+}
+
+func akmSuite(suite []byte, oui string) AKMSuites {
+	if string(suite[:3]) != oui {
+		return 0
+	}
+	switch suite[3] {
+	case 1:
+		return AKM8021X
+	case 2:
+		return AKMPSK
+	case 3:
+		return AKMFT8021X
+	case 4:
+		return AKMFTPSK
+	case 5:
+		return AKM8021XSHA256
+	case 6:
+		return AKMPSKSHA256
+	case 8:
+		return AKMSAE
+	case 9:
+		return AKMFTSAE
+	case 18:
+		return AKMOWE
+	}
+	return 0
+}
@@ -134,11 +134,16 @@ func (cdc *CDCHeader) Parse(packet []byte) (payload []byte, err error) {
 type BDCHeader struct {
 	Flags      uint8
 	Priority   uint8 // 802.1d Priority (low 3 bits)
-	Flags2     uint8
+	Flags2     uint8 // Interface index in the low 4 bits.
 	DataOffset uint8 // Offset from end of BDC header to packet data, in
 	// 4-uint8_t words. Leaves room for optional headers.
 }
 
+// Interface returns the interface index the packet was received on or is destined to.
+func (bdc BDCHeader) Interface() IoctlInterface {
+	return IoctlInterface(bdc.Flags2 & BDC_FLAG2_IF_MASK)
+}
+
 func (bdc *BDCHeader) Put(b []byte) {
 	_ = b[3]
 	b[0] = bdc.Flags
@@ -285,6 +290,108 @@ type ScanOptions struct {
 	ChannelList [1]uint16
 }
 
+// EscanParams are the parameters of the "escan" iovar (wl_escan_params_t).
+// A value of -1 in the int32 fields selects the firmware default.
+type EscanParams struct {
+	Version uint32
+	Action  uint16
+	SyncID  uint16
+	// SSID to scan for. Zero length scans all networks.
+	SSIDLength uint32
+	SSID       [32]byte
+	BSSID      [6]byte
+	BSSType    int8
+	// Scan type. See SCAN_TYPE_*.
+	ScanType    uint8
+	NProbes     int32
+	ActiveTime  int32 // Dwell time per channel in active scan in ms.
+	PassiveTime int32 // Dwell time per channel in passive scan in ms.
+	HomeTime    int32 // Time spent on home channel between channels in ms.
+	// Channels to scan. Empty scans all channels.
+	Channels []uint16
+}
+
+// Put encodes the escan parameters into b and returns the amount of bytes written.
+// b must be at least ESCAN_PARAMS_LEN+2*len(Channels) long. c-ref:LittleEndian
+func (p *EscanParams) Put(order binary.ByteOrder, b []byte) int {
+	n := ESCAN_PARAMS_LEN + 2*len(p.Channels)
+	_ = b[n-1]
+	order.PutUint32(b[0:], p.Version)
+	order.PutUint16(b[4:], p.Action)
+	order.PutUint16(b[6:], p.SyncID)
+	order.PutUint32(b[8:], p.SSIDLength)
+	copy(b[12:44], p.SSID[:])
+	copy(b[44:50], p.BSSID[:])
+	b[50] = byte(p.BSSType)
+	b[51] = p.ScanType
+	order.PutUint32(b[52:], uint32(p.NProbes))
+	order.PutUint32(b[56:], uint32(p.ActiveTime))
+	order.PutUint32(b[60:], uint32(p.PassiveTime))
+	order.PutUint32(b[64:], uint32(p.HomeTime))
+	// Low 16 bits are the channel count, high 16 bits the SSID count.
+	order.PutUint32(b[68:], uint32(len(p.Channels)))
+	for i, ch := range p.Channels {
+		order.PutUint16(b[ESCAN_PARAMS_LEN+2*i:], ch)
+	}
+	return n
+}
+
+// BSSInfo is a decoded wl_bss_info_t as found in escan results.
+type BSSInfo struct {
+	BSSID        [6]byte
+	BeaconPeriod uint16
+	Capability   uint16
+	SSIDLength   uint8
+	SSID         [32]byte
+	ChanSpec     uint16
+	RSSI         int16
+	PHYNoise     int8
+	SNR          int16
+	// IEs are the information elements of the beacon or probe response.
+	// It aliases the buffer the BSSInfo was decoded from.
+	IEs []byte
+}
+
+// Channel returns the control channel of the BSS.
+func (b *BSSInfo) Channel() uint8 { return uint8(b.ChanSpec & CHANSPEC_CHAN_MASK) }
+
+// SSIDBytes returns the SSID of the BSS. SSIDs are arbitrary bytes and need
+// not be valid UTF-8 nor free of NUL bytes.
+func (b *BSSInfo) SSIDBytes() []byte { return b.SSID[:min(b.SSIDLength, 32)] }
+
+// DecodeEscanResult decodes the BSS info in the data of an ESCAN_RESULT event
+// with partial status. c-ref:LittleEndian
+func DecodeEscanResult(order binary.ByteOrder, buf []byte) (bss BSSInfo, err error) {
+	if len(buf) < ESCAN_RESULT_HEADER_LEN+BSS_INFO_LEN {
+		return bss, io.ErrShortBuffer
+	}
+	return DecodeBSSInfo(order, buf[ESCAN_RESULT_HEADER_LEN:])
+}
+
+// DecodeBSSInfo decodes a wl_bss_info_t. c-ref:LittleEndian
+func DecodeBSSInfo(order binary.ByteOrder, buf []byte) (bss BSSInfo, err error) {
+	if len(buf) < BSS_INFO_LEN {
+		return bss, io.ErrShortBuffer
+	}
+	length := order.Uint32(buf[4:])
+	copy(bss.BSSID[:], buf[8:14])
+	bss.BeaconPeriod = order.Uint16(buf[14:])
+	bss.Capability = order.Uint16(buf[16:])
+	bss.SSIDLength = min(buf[18], 32)
+	copy(bss.SSID[:], buf[19:51])
+	bss.ChanSpec = order.Uint16(buf[72:])
+	bss.RSSI = int16(order.Uint16(buf[78:]))
+	bss.PHYNoise = int8(buf[80])
+	ieOffset := uint32(order.Uint16(buf[116:]))
+	ieLength := order.Uint32(buf[120:])
+	bss.SNR = int16(order.Uint16(buf[124:]))
+	if ieOffset+ieLength > length || int(ieOffset+ieLength) > len(buf) {
+		return bss, errIEEndExceedsBSS
+	}
+	bss.IEs = buf[ieOffset : ieOffset+ieLength]
+	return bss, nil
+}
+
 type DownloadHeader struct {
 	Flags uint16 // VER=0x1000, NO_CRC=0x1, BEGIN=0x2, END=0x4
 	Type  uint16 // Download type.
@@ -8,57 +8,89 @@ func _() {
 	// An "invalid array index" compiler error signifies that the constant values have changed.
 	// Re-run the stringer command to generate them again.
 	var x [1]struct{}
+	_ = x[WLC_GET_MAGIC-0]
 	_ = x[WLC_UP-2]
 	_ = x[WLC_DOWN-3]
+	_ = x[WLC_GET_RATE-12]
+	_ = x[WLC_GET_INFRA-19]
 	_ = x[WLC_SET_INFRA-20]
+	_ = x[WLC_GET_AUTH-21]
 	_ = x[WLC_SET_AUTH-22]
 	_ = x[WLC_GET_BSSID-23]
 	_ = x[WLC_GET_SSID-25]
 	_ = x[WLC_SET_SSID-26]
+	_ = x[WLC_GET_CHANNEL-29]
 	_ = x[WLC_SET_CHANNEL-30]
 	_ = x[WLC_DISASSOC-52]
 	_ = x[WLC_GET_ANTDIV-63]
 	_ = x[WLC_SET_ANTDIV-64]
+	_ = x[WLC_GET_BCNPRD-75]
+	_ = x[WLC_SET_BCNPRD-76]
+	_ = x[WLC_GET_DTIMPRD-77]
 	_ = x[WLC_SET_DTIMPRD-78]
 	_ = x[WLC_GET_PM-85]
 	_ = x[WLC_SET_PM-86]
+	_ = x[WLC_GET_REVINFO-98]
+	_ = x[WLC_GET_GMODE-109]
 	_ = x[WLC_SET_GMODE-110]
+	_ = x[WLC_GET_AP-117]
 	_ = x[WLC_SET_AP-118]
+	_ = x[WLC_GET_RSSI-127]
+	_ = x[WLC_GET_WSEC-133]
 	_ = x[WLC_SET_WSEC-134]
+	_ = x[WLC_GET_PHY_NOISE-135]
+	_ = x[WLC_GET_BAND-141]
 	_ = x[WLC_SET_BAND-142]
 	_ = x[WLC_GET_ASSOCLIST-159]
+	_ = x[WLC_GET_WPA_AUTH-164]
 	_ = x[WLC_SET_WPA_AUTH-165]
 	_ = x[WLC_SET_VAR-263]
 	_ = x[WLC_GET_VAR-262]
 	_ = x[WLC_SET_WSEC_PMK-268]
 }
 
-const _SDPCMCommand_name = "UPDOWNSET_INFRASET_AUTHGET_BSSIDGET_SSIDSET_SSIDSET_CHANNELDISASSOCGET_ANTDIVSET_ANTDIVSET_DTIMPRDGET_PMSET_PMSET_GMODESET_APSET_WSECSET_BANDGET_ASSOCLISTSET_WPA_AUTHGET_VARSET_VARSET_WSEC_PMK"
+const _SDPCMCommand_name = "GET_MAGICUPDOWNGET_RATEGET_INFRASET_INFRAGET_AUTHSET_AUTHGET_BSSIDGET_SSIDSET_SSIDGET_CHANNELSET_CHANNELDISASSOCGET_ANTDIVSET_ANTDIVGET_BCNPRDSET_BCNPRDGET_DTIMPRDSET_DTIMPRDGET_PMSET_PMGET_REVINFOGET_GMODESET_GMODEGET_APSET_APGET_RSSIGET_WSECSET_WSECGET_PHY_NOISEGET_BANDSET_BANDGET_ASSOCLISTGET_WPA_AUTHSET_WPA_AUTHGET_VARSET_VARSET_WSEC_PMK"
 
 var _SDPCMCommand_map = map[SDPCMCommand]string{
-	2:   _SDPCMCommand_name[0:2],
-	3:   _SDPCMCommand_name[2:6],
-	20:  _SDPCMCommand_name[6:15],
-	22:  _SDPCMCommand_name[15:23],
-	23:  _SDPCMCommand_name[23:32],
-	25:  _SDPCMCommand_name[32:40],
-	26:  _SDPCMCommand_name[40:48],
-	30:  _SDPCMCommand_name[48:59],
-	52:  _SDPCMCommand_name[59:67],
-	63:  _SDPCMCommand_name[67:77],
-	64:  _SDPCMCommand_name[77:87],
-	78:  _SDPCMCommand_name[87:98],
-	85:  _SDPCMCommand_name[98:104],
-	86:  _SDPCMCommand_name[104:110],
-	110: _SDPCMCommand_name[110:119],
-	118: _SDPCMCommand_name[119:125],
-	134: _SDPCMCommand_name[125:133],
-	142: _SDPCMCommand_name[133:141],
-	159: _SDPCMCommand_name[141:154],
-	165: _SDPCMCommand_name[154:166],
-	262: _SDPCMCommand_name[166:173],
-	263: _SDPCMCommand_name[173:180],
-	268: _SDPCMCommand_name[180:192],
+	0:   _SDPCMCommand_name[0:9],
+	2:   _SDPCMCommand_name[9:11],
+	3:   _SDPCMCommand_name[11:15],
+	12:  _SDPCMCommand_name[15:23],
+	19:  _SDPCMCommand_name[23:32],
+	20:  _SDPCMCommand_name[32:41],
+	21:  _SDPCMCommand_name[41:49],
+	22:  _SDPCMCommand_name[49:57],
+	23:  _SDPCMCommand_name[57:66],
+	25:  _SDPCMCommand_name[66:74],
+	26:  _SDPCMCommand_name[74:82],
+	29:  _SDPCMCommand_name[82:93],
+	30:  _SDPCMCommand_name[93:104],
+	52:  _SDPCMCommand_name[104:112],
+	63:  _SDPCMCommand_name[112:122],
+	64:  _SDPCMCommand_name[122:132],
+	75:  _SDPCMCommand_name[132:142],
+	76:  _SDPCMCommand_name[142:152],
+	77:  _SDPCMCommand_name[152:163],
+	78:  _SDPCMCommand_name[163:174],
+	85:  _SDPCMCommand_name[174:180],
+	86:  _SDPCMCommand_name[180:186],
+	98:  _SDPCMCommand_name[186:197],
+	109: _SDPCMCommand_name[197:206],
+	110: _SDPCMCommand_name[206:215],
+	117: _SDPCMCommand_name[215:221],
+	118: _SDPCMCommand_name[221:227],
+	127: _SDPCMCommand_name[227:235],
+	133: _SDPCMCommand_name[235:243],
+	134: _SDPCMCommand_name[243:251],
+	135: _SDPCMCommand_name[251:264],
+	141: _SDPCMCommand_name[264:272],
+	142: _SDPCMCommand_name[272:280],
+	159: _SDPCMCommand_name[280:293],
+	164: _SDPCMCommand_name[293:305],
+	165: _SDPCMCommand_name[305:317],
+	262: _SDPCMCommand_name[317:324],
+	263: _SDPCMCommand_name[324:331],
+	268: _SDPCMCommand_name[331:343],
 }
 
 func (i SDPCMCommand) String() string {
@@ -85,6 +85,16 @@ const (
 	BDC_HEADER_LEN   = 4
 	CDC_HEADER_LEN   = 16
 	DL_HEADER_LEN    = 12 // DownloadHeader size.
+	// EVENT_PACKET_LEN is the length of an EventPacket preceding the event data.
+	EVENT_PACKET_LEN = 14 + 10 + 48
+	// ESCAN_PARAMS_LEN is the length of wl_escan_params_t without channel list.
+	ESCAN_PARAMS_LEN = 8 + 64
+	// ESCAN_RESULT_HEADER_LEN is the length of wl_escan_result_t preceding the BSS info.
+	ESCAN_RESULT_HEADER_LEN = 12
+	// BSS_INFO_LEN is the length of the fixed part of wl_bss_info_t.
+	BSS_INFO_LEN = 128
+
+	BDC_FLAG2_IF_MASK = 0x0f // Interface index bits of BDCHeader.Flags2.
 )
 
 const (
@@ -124,6 +134,41 @@ const (
 	SOCSRAM_BANKX_PDA      = SOCSRAM_BASE_ADDRESS + 0x44
 )
 
+// Bluetooth shared bus (BTSDIO) registers and ring buffer layout.
+// Buffer offsets are relative to the address read from WLAN_RAM_BASE_REG_ADDR.
+const (
+	BTSDIO_REG_DATA_VALID_BITMASK = 1 << 1
+	BTSDIO_REG_BT_AWAKE_BITMASK   = 1 << 8
+	BTSDIO_REG_WAKE_BT_BITMASK    = 1 << 17
+	BTSDIO_REG_SW_RDY_BITMASK     = 1 << 24
+	BTSDIO_REG_FW_RDY_BITMASK     = 1 << 24
+
+	BTSDIO_FWBUF_SIZE            = 0x1000
+	BTSDIO_OFFSET_HOST_WRITE_BUF = 0
+	BTSDIO_OFFSET_HOST_READ_BUF  = BTSDIO_FWBUF_SIZE
+	BTSDIO_OFFSET_HOST2BT_IN     = 0x00002000
+	BTSDIO_OFFSET_HOST2BT_OUT    = 0x00002004
+	BTSDIO_OFFSET_BT2HOST_IN     = 0x00002008
+	BTSDIO_OFFSET_BT2HOST_OUT    = 0x0000200C
+
+	BT_CTRL_REG_ADDR       = 0x18000c7c
+	HOST_CTRL_REG_ADDR     = 0x18000d6c
+	WLAN_RAM_BASE_REG_ADDR = 0x18000d68
+
+	BT2WLAN_PWRUP_WAKE = 3
+	BT2WLAN_PWRUP_ADDR = 0x640894
+	BTFW_MEM_OFFSET    = 0x19000000
+)
+
+// Bluetooth firmware record types.
+const (
+	BTFW_HEX_LINE_TYPE_DATA                     = 0
+	BTFW_HEX_LINE_TYPE_END_OF_DATA              = 1
+	BTFW_HEX_LINE_TYPE_EXTENDED_SEGMENT_ADDRESS = 2
+	BTFW_HEX_LINE_TYPE_EXTENDED_ADDRESS         = 4
+	BTFW_HEX_LINE_TYPE_ABSOLUTE_32BIT_ADDRESS   = 5
+)
+
 // SDIO_CHIP_CLOCK_CSR bits
 const (
 	SBSDIO_ALP_AVAIL           = 0x40
@@ -216,25 +261,41 @@ const (
 type SDPCMCommand uint32
 
 const (
+	WLC_GET_MAGIC     SDPCMCommand = 0
 	WLC_UP            SDPCMCommand = 2
 	WLC_DOWN          SDPCMCommand = 3
+	WLC_GET_RATE      SDPCMCommand = 12
+	WLC_GET_INFRA     SDPCMCommand = 19
 	WLC_SET_INFRA     SDPCMCommand = 20
+	WLC_GET_AUTH      SDPCMCommand = 21
 	WLC_SET_AUTH      SDPCMCommand = 22
 	WLC_GET_BSSID     SDPCMCommand = 23
 	WLC_GET_SSID      SDPCMCommand = 25
 	WLC_SET_SSID      SDPCMCommand = 26
+	WLC_GET_CHANNEL   SDPCMCommand = 29
 	WLC_SET_CHANNEL   SDPCMCommand = 30
 	WLC_DISASSOC      SDPCMCommand = 52
 	WLC_GET_ANTDIV    SDPCMCommand = 63
 	WLC_SET_ANTDIV    SDPCMCommand = 64
+	WLC_GET_BCNPRD    SDPCMCommand = 75
+	WLC_SET_BCNPRD    SDPCMCommand = 76
+	WLC_GET_DTIMPRD   SDPCMCommand = 77
 	WLC_SET_DTIMPRD   SDPCMCommand = 78
 	WLC_GET_PM        SDPCMCommand = 85
 	WLC_SET_PM        SDPCMCommand = 86
+	WLC_GET_REVINFO   SDPCMCommand = 98
+	WLC_GET_GMODE     SDPCMCommand = 109
 	WLC_SET_GMODE     SDPCMCommand = 110
+	WLC_GET_AP        SDPCMCommand = 117
 	WLC_SET_AP        SDPCMCommand = 118
+	WLC_GET_RSSI      SDPCMCommand = 127
+	WLC_GET_WSEC      SDPCMCommand = 133
 	WLC_SET_WSEC      SDPCMCommand = 134
+	WLC_GET_PHY_NOISE SDPCMCommand = 135
+	WLC_GET_BAND      SDPCMCommand = 141
 	WLC_SET_BAND      SDPCMCommand = 142
 	WLC_GET_ASSOCLIST SDPCMCommand = 159
+	WLC_GET_WPA_AUTH  SDPCMCommand = 164
 	WLC_SET_WPA_AUTH  SDPCMCommand = 165
 	WLC_SET_VAR       SDPCMCommand = 263
 	WLC_GET_VAR       SDPCMCommand = 262
@@ -242,12 +303,15 @@ const (
 )
 
 func (cmd SDPCMCommand) IsValid() bool {
-	return cmd == WLC_UP || cmd == WLC_DOWN || cmd == WLC_SET_INFRA || cmd == WLC_SET_AUTH || cmd == WLC_GET_BSSID ||
+	return cmd == WLC_GET_MAGIC || cmd == WLC_UP || cmd == WLC_DOWN || cmd == WLC_SET_INFRA || cmd == WLC_SET_AUTH || cmd == WLC_GET_BSSID ||
 		cmd == WLC_GET_SSID || cmd == WLC_SET_SSID || cmd == WLC_SET_CHANNEL || cmd == WLC_DISASSOC ||
-		cmd == WLC_GET_ANTDIV || cmd == WLC_SET_ANTDIV || cmd == WLC_SET_DTIMPRD || cmd == WLC_GET_PM ||
+		cmd == WLC_GET_ANTDIV || cmd == WLC_SET_ANTDIV || cmd == WLC_SET_BCNPRD || cmd == WLC_SET_DTIMPRD || cmd == WLC_GET_PM ||
 		cmd == WLC_SET_PM || cmd == WLC_SET_GMODE || cmd == WLC_SET_AP || cmd == WLC_SET_WSEC || cmd == WLC_SET_BAND ||
 		cmd == WLC_GET_ASSOCLIST || cmd == WLC_SET_WPA_AUTH || cmd == WLC_SET_VAR || cmd == WLC_GET_VAR ||
-		cmd == WLC_SET_WSEC_PMK
+		cmd == WLC_SET_WSEC_PMK || cmd == WLC_GET_RSSI || cmd == WLC_GET_PHY_NOISE || cmd == WLC_GET_RATE ||
+		cmd == WLC_GET_INFRA || cmd == WLC_GET_AUTH || cmd == WLC_GET_CHANNEL || cmd == WLC_GET_BCNPRD ||
+		cmd == WLC_GET_DTIMPRD || cmd == WLC_GET_REVINFO || cmd == WLC_GET_GMODE || cmd == WLC_GET_AP ||
+		cmd == WLC_GET_WSEC || cmd == WLC_GET_BAND || cmd == WLC_GET_WPA_AUTH
 }
 
 // SDIO bus specifics
@@ -304,9 +368,74 @@ const (
 // For determining security type from a scan
 const (
 	DOT11_CAP_PRIVACY           = 0x0010
+	DOT11_IE_ID_SSID            = 0
+	DOT11_IE_ID_HT_CAP          = 45
 	DOT11_IE_ID_RSN             = 48
+	DOT11_IE_ID_HT_OP           = 61
+	DOT11_IE_ID_VHT_CAP         = 191
+	DOT11_IE_ID_VHT_OP          = 192
 	DOT11_IE_ID_VENDOR_SPECIFIC = 221
+	DOT11_IE_ID_EXTENSION       = 255
+	DOT11_IE_EXT_ID_HE_CAP      = 35 // Element ID extension of HE capabilities.
+	DOT11_RSN_CAP_MFPR          = 1 << 6
+	DOT11_RSN_CAP_MFPC          = 1 << 7
 	WPA_OUI_TYPE1               = "\x00\x50\xF2\x01"
+	WMM_OUI_TYPE2               = "\x00\x50\xF2\x02"
+	WPS_OUI_TYPE4               = "\x00\x50\xF2\x04"
+	RSN_OUI                     = "\x00\x0F\xAC"
+)
+
+// Escan parameters.
+const (
+	ESCAN_VERSION      = 1
+	ESCAN_ACTION_START = 1
+	ESCAN_ACTION_ABORT = 3
+	DOT11_BSSTYPE_ANY  = 2
+	SCAN_TYPE_ACTIVE   = 0
+	SCAN_TYPE_PASSIVE  = 1
+	// Mask of channel number bits in a chanspec.
+	CHANSPEC_CHAN_MASK = 0xff
+	// Chanspec of a 20MHz 2.4GHz channel is channel|CHANSPEC_BAND_2G|CHANSPEC_BW_20.
+	CHANSPEC_BAND_2G = 0x0000
+	CHANSPEC_BAND_5G = 0xc000
+	CHANSPEC_BW_20   = 0x1000
+)
+
+// Frame flags of vendor IEs set with the "vndr_ie" iovar.
+const (
+	VNDR_IE_BEACON_FLAG   = 0x01
+	VNDR_IE_PRBRSP_FLAG   = 0x02
+	VNDR_IE_ASSOCRSP_FLAG = 0x04
+	VNDR_IE_AUTHRSP_FLAG  = 0x08
+	VNDR_IE_PRBREQ_FLAG   = 0x10
+	VNDR_IE_ASSOCREQ_FLAG = 0x20
+)
+
+// ARP offload modes set with the "arp_ol" iovar.
+const (
+	ARP_OL_AGENT           = 0x01 // Enable ARP agent.
+	ARP_OL_SNOOP           = 0x02 // Snoop ARP traffic to fill the peer cache.
+	ARP_OL_HOST_AUTO_REPLY = 0x04 // Reply to ARP requests for the host IP.
+	ARP_OL_PEER_AUTO_REPLY = 0x08 // Reply to ARP requests for peers in the cache.
+)
+
+// Keepalive offload set with the "mkeep_alive" iovar.
+const (
+	WL_MKEEP_ALIVE_VERSION   = 1
+	WL_MKEEP_ALIVE_FIXED_LEN = 11 // Length of wl_mkeep_alive_pkt_t preceding packet data.
+)
+
+// Wake on wireless LAN flags set with the "wowl" iovar and reported by "wowl_wakeind".
+const (
+	WL_WOWL_MAGIC       = 1 << 0  // Wake on magic packet.
+	WL_WOWL_NET         = 1 << 1  // Wake on net pattern match.
+	WL_WOWL_DIS         = 1 << 2  // Wake on disassociation or deauthentication.
+	WL_WOWL_RETR        = 1 << 3  // Wake on retrograde TSF.
+	WL_WOWL_BCN         = 1 << 4  // Wake on loss of beacons.
+	WL_WOWL_GTK_FAILURE = 1 << 10 // Wake on group key rekey failure.
+	WL_WOWL_BCAST       = 1 << 15 // Wake on broadcast frames.
+	WL_WOWL_UNASSOC     = 1 << 24 // Wake on unassociated state.
+	WL_WOWL_LINKDOWN    = 1 << 31 // Wake on link down.
 )
 
 // const SLEEP_MAX (50)
@@ -321,6 +450,9 @@ const MAX_MULTICAST_REGISTERED_ADDRESS = 10
 // Test register value
 const TEST_PATTERN = 0xFEEDBEAD
 
+// WLC_IOCTL_MAGIC is the value returned by the WLC_GET_MAGIC ioctl.
+const WLC_IOCTL_MAGIC = 0x14e46c77
+
 // Register addresses
 const (
 	SPI_BUS_CONTROL               = 0x0000
@@ -541,18 +673,30 @@ const (
 
 // Values used for STA and AP auth settings
 const (
-	CYW43_WPA_AUTH_PSK  = 0x0004
-	CYW43_WPA2_AUTH_PSK = 0x0080
+	CYW43_WPA_AUTH_PSK      = 0x0004
+	CYW43_WPA2_AUTH_PSK     = 0x0080
+	CYW43_WPA3_AUTH_SAE_PSK = 0x40000
+	// WLC_SET_AUTH value selecting SAE authentication.
+	CYW43_AUTH_SAE = 3
+)
+
+// Management frame protection (802.11w) modes set with the "mfp" iovar.
+const (
+	CYW43_MFP_NONE     = 0
+	CYW43_MFP_CAPABLE  = 1
+	CYW43_MFP_REQUIRED = 2
 )
 
 // # Authorization types
 //
 // Used when setting up an access point, or connecting to an access point
 const (
-	CYW43_AUTH_OPEN           = 0          ///< No authorisation required (open)
-	CYW43_AUTH_WPA_TKIP_PSK   = 0x00200002 ///< WPA authorisation
-	CYW43_AUTH_WPA2_AES_PSK   = 0x00400004 ///< WPA2 authorisation (preferred)
-	CYW43_AUTH_WPA2_MIXED_PSK = 0x00400006 ///< WPA2/WPA mixed authorisation
+	CYW43_AUTH_OPEN              = 0          ///< No authorisation required (open)
+	CYW43_AUTH_WPA_TKIP_PSK      = 0x00200002 ///< WPA authorisation
+	CYW43_AUTH_WPA2_AES_PSK      = 0x00400004 ///< WPA2 authorisation (preferred)
+	CYW43_AUTH_WPA2_MIXED_PSK    = 0x00400006 ///< WPA2/WPA mixed authorisation
+	CYW43_AUTH_WPA3_SAE_AES_PSK  = 0x01000004 ///< WPA3 SAE authorisation
+	CYW43_AUTH_WPA3_WPA2_AES_PSK = 0x01400004 ///< WPA3/WPA2 transition mode authorisation
 )
 
 // Passphrase min/max lengths
@@ -27,3 +27,93 @@ func TestParseAsyncEvent(t *testing.T) {
 		t.Error("bad reason")
 	}
 }
+
+func TestDecodeBSSInfo(t *testing.T) {
+	var buf [ESCAN_RESULT_HEADER_LEN + BSS_INFO_LEN + 4]byte
+	bss := buf[ESCAN_RESULT_HEADER_LEN:]
+	order := binary.LittleEndian
+	order.PutUint32(bss[4:], BSS_INFO_LEN+4) // Length.
+	copy(bss[8:], "\x01\x02\x03\x04\x05\x06")
+	bss[18] = 4
+	copy(bss[19:], "home")
+	order.PutUint16(bss[72:], 0x1006) // Chanspec 20MHz channel 6.
+	order.PutUint16(bss[78:], uint16(0xffc4))
+	order.PutUint16(bss[116:], BSS_INFO_LEN) // IE offset.
+	order.PutUint32(bss[120:], 4)            // IE length.
+	copy(bss[BSS_INFO_LEN:], "\x00\x02hi")
+	got, err := DecodeEscanResult(order, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BSSID != [6]byte{1, 2, 3, 4, 5, 6} {
+		t.Errorf("bad BSSID %x", got.BSSID)
+	}
+	if ssid := string(got.SSID[:got.SSIDLength]); ssid != "home" {
+		t.Errorf("bad SSID %q", ssid)
+	}
+	if got.Channel() != 6 {
+		t.Errorf("bad channel %d", got.Channel())
+	}
+	if got.RSSI != -60 {
+		t.Errorf("bad RSSI %d", got.RSSI)
+	}
+	if string(got.IEs) != "\x00\x02hi" {
+		t.Errorf("bad IEs %q", got.IEs)
+	}
+	// IEs past BSS length must be rejected.
+	order.PutUint32(bss[120:], 8)
+	_, err = DecodeEscanResult(order, buf[:])
+	if err == nil {
+		t.Error("expected error for IEs exceeding BSS length")
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	ies := "\x00\x04home" + // SSID.
+		"\x2d\x02\x00\x00" + // HT capabilities.
+		// RSN: version 1, CCMP group, CCMP+TKIP pairwise, PSK+SAE AKM, MFPC.
+		"\x30\x1c\x01\x00\x00\x0f\xac\x04\x02\x00\x00\x0f\xac\x04\x00\x0f\xac\x02\x02\x00\x00\x0f\xac\x02\x00\x0f\xac\x08\x80\x00" +
+		// WPA: version 1, TKIP group, TKIP pairwise, PSK AKM.
+		"\xdd\x16\x00\x50\xf2\x01\x01\x00\x00\x50\xf2\x02\x01\x00\x00\x50\xf2\x02\x01\x00\x00\x50\xf2\x02" +
+		"\xdd\x05\x00\x50\xf2\x04\x10" // WPS.
+	bss := BSSInfo{Capability: DOT11_CAP_PRIVACY, IEs: []byte(ies)}
+	caps, err := bss.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Capabilities{
+		Privacy:         true,
+		HT:              true,
+		WPS:             true,
+		WPA:             true,
+		RSN:             true,
+		GroupCipher:     CipherCCMP,
+		PairwiseCiphers: CipherCCMP | CipherTKIP,
+		AKMs:            AKMPSK | AKMSAE,
+		MFPCapable:      true,
+		VendorIEs:       2,
+	}
+	if caps != want {
+		t.Errorf("got %+v, want %+v", caps, want)
+	}
+	if auth, ok := caps.Auth(); !ok || auth != CYW43_AUTH_WPA2_MIXED_PSK {
+		t.Errorf("bad auth %#x", auth)
+	}
+	// Without legacy WPA the AP is in WPA3 transition mode.
+	caps.WPA, caps.PairwiseCiphers = false, CipherCCMP
+	if auth, ok := caps.Auth(); !ok || auth != CYW43_AUTH_WPA3_WPA2_AES_PSK {
+		t.Errorf("bad transition auth %#x", auth)
+	}
+	caps.AKMs = AKMSAE
+	if auth, ok := caps.Auth(); !ok || auth != CYW43_AUTH_WPA3_SAE_AES_PSK {
+		t.Errorf("bad SAE auth %#x", auth)
+	}
+	if data, ok := FindVendorIE(bss.IEs, WPS_OUI_TYPE4); !ok || string(data) != "\x10" {
+		t.Errorf("bad WPS vendor IE %q", data)
+	}
+	// Truncated IEs must be rejected.
+	_, err = ParseCapabilities([]byte(ies[:len(ies)-1]))
+	if err == nil {
+		t.Error("expected error for truncated IE")
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/netip"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
-	"log/slog"
-
+	"github.com/soypat/cyw43439/internal/slog"
 	"github.com/soypat/cyw43439/whd"
 )
 
@@ -19,6 +21,15 @@ var (
 	errJoinSetSSID  = errors.New("join:SET_SSID failed")
 	errJoinWaitSSID = errors.New("join:wait for ssid")
 	errJoinGeneric  = errors.New("join:failed")
+	errJoinNotFound = errors.New("join:network not found")
+	errJoinSecurity = errors.New("join:unsupported security")
+	errJoinAborted  = errors.New("join:device closed or reset during join")
+	errJoinBusy     = errors.New("join in progress")
+	errSSIDTooLong  = errors.New("SSID longer than 32 bytes")
+	errSSIDEmpty    = errors.New("empty SSID")
+
+	errAPNotUp         = errors.New("AP not started")
+	errAPPassphraseLen = errors.New("Passphrase is too short or too long")
 )
 
 func (d *Device) initControl(clm string) error {
@@ -55,6 +66,7 @@ func (d *Device) initControl(clm string) error {
 		if err != nil {
 			return err
 		}
+		d.report_progress("clm", offset, len(clm))
 	}
 	d.debug("clmload:done")
 	v, err := d.get_iovar("clmload_status", whd.IF_STA)
@@ -67,6 +79,7 @@ func (d *Device) initControl(clm string) error {
 	// a compact mass".
 	d.set_iovar("bus:txglom", whd.IF_STA, 0)
 	d.set_iovar("apsta", whd.IF_STA, 1)
+	d.apsta = true
 
 	// read MAC Address:
 
@@ -77,22 +90,22 @@ func (d *Device) initControl(clm string) error {
 	d.set_iovar_n("country", whd.IF_STA, countryInfo[:])
 
 	// set country takes some time, next ioctls fail if we don't wait.
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
 	// Set Antenna to chip antenna.
 	d.set_ioctl(whd.WLC_SET_ANTDIV, whd.IF_STA, 0)
 
 	d.set_iovar("bus:txglom", whd.IF_STA, 0)
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
-	d.set_iovar("ampdu_ba_wsize", whd.IF_STA, 8)
-	time.Sleep(100 * time.Millisecond)
+	d.set_iovar("ampdu_ba_wsize", whd.IF_STA, defaultAMPDUWsize)
+	d.sleep(100 * time.Millisecond)
 
-	d.set_iovar("ampdu_mpdu", whd.IF_STA, 4)
-	time.Sleep(100 * time.Millisecond)
+	d.set_iovar("ampdu_mpdu", whd.IF_STA, defaultAMPDUMPDU)
+	d.sleep(100 * time.Millisecond)
 
 	// Ignore uninteresting/spammy events.
-	var evts eventMask
+	evts := &d.fwevents
 	for i := range evts.events {
 		evts.events[i] = 0xff
 	}
@@ -102,21 +115,22 @@ func (d *Device) initControl(clm string) error {
 	evts.Disable(whd.EvPROBREQ_MSG_RX)
 	evts.Disable(whd.EvPROBRESP_MSG)
 	evts.Disable(whd.EvROAM)
-	buf := make([]byte, evts.Size())
-	evts.Put(buf)
-	d.set_iovar_n("bsscfg:event_msgs", whd.IF_STA, buf)
+	d.set_fw_events(0)
+
+	// Pass broadcast/multicast frames to host so discovery protocols work.
+	d.set_broadcast_rx(true)
 
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
 	// Set wifi up.
 	d.doIoctlSet(whd.WLC_UP, whd.IF_STA, nil)
 
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
 	d.set_ioctl(whd.WLC_SET_GMODE, whd.IF_STA, 1) // Set GMODE=auto
 	d.set_ioctl(whd.WLC_SET_BAND, whd.IF_STA, 0)  // Set BAND=any
 
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
 	return nil
 }
@@ -132,48 +146,121 @@ func (d *Device) set_power_management(mode powerManagementMode) error {
 	}
 	mode_num := mode.mode()
 	if mode_num == 2 {
+		dtim, listen := mode.dtim_period(), mode.assoc()
+		if d.listen.DTIMSkip != 0 {
+			dtim = d.listen.DTIMSkip
+		}
+		if d.listen.ListenInterval != 0 {
+			listen = d.listen.ListenInterval
+		}
 		d.set_iovar("pm2_sleep_ret", whd.IF_STA, uint32(mode.sleep_ret_ms()))
 		d.set_iovar("bcn_li_bcn", whd.IF_STA, uint32(mode.beacon_period()))
-		d.set_iovar("bcn_li_dtim", whd.IF_STA, uint32(mode.dtim_period()))
-		d.set_iovar("assoc_listen", whd.IF_STA, uint32(mode.assoc()))
+		d.set_iovar("bcn_li_dtim", whd.IF_STA, uint32(dtim))
+		d.set_iovar("assoc_listen", whd.IF_STA, uint32(listen))
+	}
+	err := d.set_ioctl(whd.WLC_SET_PM, whd.IF_STA, uint32(mode_num))
+	if err == nil {
+		d.pmMode = mode
 	}
-	return d.set_ioctl(whd.WLC_SET_PM, whd.IF_STA, uint32(mode_num))
+	return err
+}
+
+// ListenConfig configures how often a power saving station wakes to receive
+// frames buffered by the AP. Zero fields select the power management mode defaults.
+type ListenConfig struct {
+	// ListenInterval is the amount of beacon intervals the station may sleep
+	// between wakeups, which is announced to the AP on association so that it
+	// buffers frames for at least as long. Takes effect on the next join.
+	ListenInterval uint8
+	// DTIMSkip is the amount of DTIM periods between wakeups to receive
+	// broadcast and multicast frames. Values above 1 skip DTIM beacons, saving
+	// power at the cost of missing broadcasts such as ARP requests; the resulting
+	// sleep period should not exceed ListenInterval or the AP may drop buffered frames.
+	DTIMSkip uint8
 }
 
-func (d *Device) join_open(ssid string) error {
-	d.debug("join_open", slog.String("ssid", ssid))
+// SetListenConfig sets the listen interval and DTIM skipping used while in
+// firmware power save, extending battery life beyond what power save alone
+// provides for devices which tolerate higher receive latency. The
+// configuration must be set after Init, which clears it.
+func (d *Device) SetListenConfig(cfg ListenConfig) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	d.info("SetListenConfig", slog.Int("listen", int(cfg.ListenInterval)), slog.Int("dtimskip", int(cfg.DTIMSkip)))
+	d.listen = cfg
+	if cfg.DTIMSkip != 0 {
+		err := d.set_iovar("bcn_li_dtim", whd.IF_STA, uint32(cfg.DTIMSkip))
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.ListenInterval != 0 {
+		return d.set_iovar("assoc_listen", whd.IF_STA, uint32(cfg.ListenInterval))
+	}
+	return nil
+}
+
+func (d *Device) join_open(ssid string, target *joinTarget) error {
+	d.debug("join_open", ssidAttr(ssid))
 	if len(ssid) > 32 {
-		return errors.New("ssid too long")
+		return errSSIDTooLong
 	}
-	d.set_iovar("ampdu_ba_wsize", whd.IF_STA, 8)
+	d.set_iovar("ampdu_ba_wsize", whd.IF_STA, d.ampduWsize)
 	d.set_ioctl(whd.WLC_SET_WSEC, whd.IF_STA, 0)
 	d.set_iovar2("bsscfg:sup_wpa", whd.IF_STA, 0, 0)
 	d.set_ioctl(whd.WLC_SET_INFRA, whd.IF_STA, 1)
 	d.set_ioctl(whd.WLC_SET_AUTH, whd.IF_STA, 0)
 
-	return d.wait_for_join(ssid)
+	return d.wait_for_join(ssid, target)
+}
+
+// joinTarget is a specific AP to join, skipping the scan for the network.
+type joinTarget struct {
+	bssid   [6]byte
+	channel uint8
 }
 
-func (d *Device) wait_for_join(ssid string) (err error) {
+func (d *Device) wait_for_join(ssid string, target *joinTarget) (err error) {
 	d.eventmask.Enable(whd.EvSET_SSID)
 	d.eventmask.Enable(whd.EvAUTH)
 
-	err = d.setSSID(ssid)
+	d.jointrace_start(ssid)
+	defer func() { err = d.jointrace_end(err) }()
+	d.apRejected = [6]byte{}
+	if target != nil {
+		err = d.setSSIDBSSID(ssid, target.bssid, target.channel)
+	} else if bssid, ok := d.blacklist_candidate(ssid); ok {
+		err = d.setSSIDBSSID(ssid, bssid, 0)
+	} else if d.joinPol.hidden {
+		err = d.setSSIDDirected(ssid)
+	} else {
+		err = d.setSSID(ssid)
+	}
 	if err != nil {
 		return err
 	}
 	// Poll for async events.
-	deadline := time.Now().Add(10 * time.Second)
+	policy := d.join_policy()
+	deadline := d.now().Add(policy.assoc)
+	if !policy.deadline.IsZero() && policy.deadline.Before(deadline) {
+		deadline = policy.deadline
+	}
 	keepGoing := true
 	for keepGoing {
-		time.Sleep(270 * time.Millisecond)
+		err = d.join_sleep(270 * time.Millisecond)
+		if err != nil {
+			return err
+		}
 		err = d.check_status(d._sendIoctlBuf[:])
 		if err != nil {
 			return err
 		}
 		// Keep trying until we get a link up/auth failed/timeout.
 		keepGoing = d.state == linkStateDown && d.state != linkStateUpWaitForSSID &&
-			time.Until(deadline) > 0
+			d.since(deadline) < 0
 	}
 	switch d.state {
 	case linkStateUp:
@@ -192,6 +279,9 @@ func (d *Device) wait_for_join(ssid string) (err error) {
 	default:
 		err = errJoinGeneric
 	}
+	if err != nil {
+		d.blacklist_fail(d.apRejected)
+	}
 	return err
 }
 
@@ -207,9 +297,9 @@ func (p *passphraseInfo) Put(order binary.ByteOrder, b []byte) {
 	copy(b[4:68], p.passphrase[:])
 }
 
-func (d *Device) setPassphrase(pass string) error {
+func (d *Device) setPassphrase(pass string, iface whd.IoctlInterface) error {
 	if len(pass) > 64 {
-		return errors.New("ssid too long")
+		return errors.New("passphrase too long")
 	}
 
 	var pfi = passphraseInfo{
@@ -220,8 +310,32 @@ func (d *Device) setPassphrase(pass string) error {
 
 	var buf [68]byte
 	pfi.Put(_busOrder, buf[:])
+	clear(pfi.passphrase[:])
+
+	return d.set_secret(whd.WLC_SET_WSEC_PMK, iface, buf[:])
+}
+
+// SSIDFromBytes returns the SSID b as passed to the string typed SSID
+// parameters of the driver. SSIDs are octet strings of up to 32 bytes which
+// need not be valid UTF-8 and may contain NULs; the driver passes them to the
+// firmware unmodified.
+func SSIDFromBytes(b []byte) (string, error) {
+	if len(b) > 32 {
+		return "", errSSIDTooLong
+	}
+	return string(b), nil
+}
 
-	return d.doIoctlSet(whd.WLC_SET_WSEC_PMK, whd.IF_STA, buf[:])
+// ssidAttr returns ssid as a log attribute, quoted if not printable.
+func ssidAttr(ssid string) slog.Attr {
+	quote := !utf8.ValidString(ssid)
+	for i := 0; i < len(ssid) && !quote; i++ {
+		quote = ssid[i] < 0x20 || ssid[i] == 0x7f
+	}
+	if quote {
+		ssid = strconv.Quote(ssid)
+	}
+	return slog.String("ssid", ssid)
 }
 
 type ssidInfo struct {
@@ -229,6 +343,15 @@ type ssidInfo struct {
 	ssid   [32]byte
 }
 
+func makeSSIDInfo(ssid string) (info ssidInfo, err error) {
+	if len(ssid) > 32 {
+		return info, errSSIDTooLong
+	}
+	info.length = uint32(len(ssid))
+	copy(info.ssid[:], ssid)
+	return info, nil
+}
+
 func (s *ssidInfo) put(order binary.ByteOrder, b []byte) {
 	order.PutUint32(b[0:4], s.length)
 	copy(b[4:36], s.ssid[:])
@@ -237,19 +360,60 @@ func (s *ssidInfo) put(order binary.ByteOrder, b []byte) {
 // setSSID sets the SSID through Ioctl interface. This command
 // also starts the wifi connect procedure.
 func (d *Device) setSSID(ssid string) error {
-	if len(ssid) > 32 {
-		return errors.New("ssid too long")
+	info, err := makeSSIDInfo(ssid)
+	if err != nil {
+		return err
 	}
+	var buf [36]byte
+	info.put(_busOrder, buf[:])
+	d.state = linkStateDown
+	return d.doIoctlSet(whd.WLC_SET_SSID, whd.IF_STA, buf[:])
+}
 
-	var info = ssidInfo{
-		length: uint32(len(ssid)),
+// setSSIDBSSID starts a join to the AP with bssid like setSSID. If channel
+// is not zero the AP is only looked for on channel.
+//
+//	reference: wl_join_params_t
+func (d *Device) setSSIDBSSID(ssid string, bssid [6]byte, channel uint8) error {
+	// wlc_ssid_t followed by wl_assoc_params_t with up to one chanspec.
+	info, err := makeSSIDInfo(ssid)
+	if err != nil {
+		return err
 	}
-	copy(info.ssid[:], ssid)
+	var buf [36 + 12 + 2]byte
+	info.put(_busOrder, buf[:])
+	copy(buf[36:42], bssid[:])
+	n := 36 + 12
+	if channel != 0 {
+		_busOrder.PutUint32(buf[44:48], 1) // chanspec_num.
+		_busOrder.PutUint16(buf[48:50], chanspec20(channel))
+		n += 2
+	}
+	d.state = linkStateDown
+	return d.doIoctlSet(whd.WLC_SET_SSID, whd.IF_STA, buf[:n])
+}
 
-	var buf [36]byte
+// setSSIDDirected starts a join like setSSID but has the firmware look for
+// the network with probe requests carrying ssid, so networks which do not
+// broadcast their SSID in beacons are found.
+//
+//	reference: wl_extjoin_params_t
+func (d *Device) setSSIDDirected(ssid string) error {
+	// wlc_ssid_t, wl_join_scan_params_t and wl_join_assoc_params_t.
+	info, err := makeSSIDInfo(ssid)
+	if err != nil {
+		return err
+	}
+	var buf [36 + 20 + 16]byte
 	info.put(_busOrder, buf[:])
+	buf[36] = whd.SCAN_TYPE_ACTIVE
+	for i := 40; i < 56; i += 4 {
+		// nprobes, active, passive and home time: firmware defaults.
+		_busOrder.PutUint32(buf[i:], 0xffff_ffff)
+	}
+	copy(buf[56:62], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) // Any BSSID.
 	d.state = linkStateDown
-	return d.doIoctlSet(whd.WLC_SET_SSID, whd.IF_STA, buf[:])
+	return d.set_iovar_n("join", whd.IF_STA, buf[:])
 }
 
 type ssidInfoWithIndex struct {
@@ -263,16 +427,11 @@ func (s *ssidInfoWithIndex) Put(order binary.ByteOrder, b []byte) {
 }
 
 func (d *Device) setSSIDWithIndex(ssid string, index uint32) error {
-	if len(ssid) > 32 {
-		return errors.New("ssid too long")
-	}
-
-	var infoIndex = ssidInfoWithIndex{
-		info: ssidInfo{
-			length: uint32(len(ssid)),
-		},
+	info, err := makeSSIDInfo(ssid)
+	if err != nil {
+		return err
 	}
-	copy(infoIndex.info.ssid[:], ssid)
+	var infoIndex = ssidInfoWithIndex{index: index, info: info}
 
 	var buf [40]byte
 	infoIndex.Put(_busOrder, buf[:])
@@ -280,26 +439,400 @@ func (d *Device) setSSIDWithIndex(ssid string, index uint32) error {
 	return d.set_iovar_n("bsscfg:ssid", whd.IF_STA, buf[:])
 }
 
+// set_fw_events programs the firmware event mask for the bsscfg index.
+// Events not enabled in the firmware event mask are never sent to the host.
+func (d *Device) set_fw_events(bsscfg uint32) error {
+	var buf [4 + len(eventMask{}.events)]byte
+	d.fwevents.iface = bsscfg
+	d.fwevents.Put(buf[:])
+	return d.set_iovar_n("bsscfg:event_msgs", whd.IF_STA, buf[:])
+}
+
 // IsLinkUp returns true if the wifi connection is up.
 func (d *Device) IsLinkUp() bool {
 	return d.state == linkStateUp
 }
 
+// JoinOptions configures network layer parameters applied when joining a
+// network with JoinWithOptions. The driver programs firmware offloads from them
+// while the IP configuration is consumed by the network stack glue.
+type JoinOptions struct {
+	// StaticIP is the IPv4 address of the station. If valid DHCP is skipped
+	// by the stack glue and ARP offload is programmed for the address.
+	StaticIP netip.Addr
+	// Gateway is the router used with StaticIP.
+	Gateway netip.Addr
+	// DNS is the DNS server used with StaticIP.
+	DNS netip.Addr
+	// KeepAlivePeriod, if non-zero, has the firmware send null data frames to
+	// the AP periodically so the association is kept while the host is idle.
+	KeepAlivePeriod time.Duration
+
+	// AssocTimeout is the time waited for each join attempt to complete,
+	// network scan, association and handshake included. Defaults to 10 seconds.
+	// Congested environments and enterprise APs may need longer.
+	AssocTimeout time.Duration
+	// HandshakeTimeout is the time the firmware supplicant waits for each
+	// 4-way handshake message from the AP. Defaults to 2.5 seconds.
+	HandshakeTimeout time.Duration
+	// AuthRetries is the amount of times a join failing authentication or
+	// the handshake is retried, i.e: due to a lost handshake message.
+	AuthRetries uint8
+	// ScanRetries is the amount of times a join is retried when the network
+	// is not found or the attempt times out, i.e: due to missed beacons.
+	ScanRetries uint8
+	// Deadline, if non-zero, bounds the time taken by the join including
+	// retries. Battery powered devices may use a short deadline to give up early.
+	Deadline time.Duration
+	// Hidden joins a network which does not broadcast its SSID. The firmware
+	// looks for the network by sending probe requests with the SSID instead of
+	// waiting for its beacons, which do not carry it.
+	Hidden bool
+	// YieldLock releases the device lock while the join waits on the network
+	// so other goroutines, i.e: a BLE stack polling HCI during provisioning,
+	// keep running. Meanwhile calls which would disturb the join, such as
+	// Init, Close, StartAPWithConfig, scans and other joins, fail. Reset
+	// aborts the join.
+	YieldLock bool
+}
+
+// Join defaults, see JoinOptions.
+const (
+	defaultAssocTimeout     = 10 * time.Second
+	defaultHandshakeTimeout = 2500 * time.Millisecond
+	joinRetryDelay          = 500 * time.Millisecond
+)
+
+// joinPolicy holds the timeouts and options of the join in progress.
+type joinPolicy struct {
+	assoc     time.Duration
+	handshake time.Duration
+	hidden    bool
+	yield     bool // Release the device lock while waiting, see JoinOptions.YieldLock.
+	// deadline is the end of the join's overall deadline, zero if unbounded.
+	deadline time.Time
+}
+
+// join_policy returns the timeouts of the join in progress with defaults applied.
+func (d *Device) join_policy() joinPolicy {
+	p := d.joinPol
+	if p.assoc <= 0 {
+		p.assoc = defaultAssocTimeout
+	}
+	if p.handshake <= 0 {
+		p.handshake = defaultHandshakeTimeout
+	}
+	return p
+}
+
+// join_sleep waits dur during a join. The device lock is only released if
+// the join was started with JoinOptions.YieldLock, in which case the join is
+// aborted if the device was closed or reset while the lock was released.
+func (d *Device) join_sleep(dur time.Duration) error {
+	if !d.joinPol.yield {
+		d.sleep(dur)
+		return nil
+	}
+	d.unlock_sleep(dur)
+	if d.closed || !d.initialized {
+		return errJoinAborted
+	}
+	return nil
+}
+
+// JoinWithOptions joins a network like JoinWPA2 with the timeouts and retries
+// configured in opts and then programs the firmware offloads configured in opts.
+func (d *Device) JoinWithOptions(ssid, pass string, opts JoinOptions) error {
+	d.lock()
+	defer d.unlock()
+	err := d.join(ssid, pass, &opts)
+	if err != nil {
+		return err
+	}
+	if opts.StaticIP.IsValid() {
+		err = d.set_host_ip(opts.StaticIP)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.KeepAlivePeriod > 0 {
+		err = d.set_keepalive(opts.KeepAlivePeriod)
+	}
+	return err
+}
+
+// SetHostIP programs the firmware ARP offload so that ARP requests for ip are
+// answered by the firmware. Call with the address obtained via DHCP so that
+// static and dynamic configurations program the firmware the same way.
+// An invalid ip disables ARP offload.
+func (d *Device) SetHostIP(ip netip.Addr) error {
+	d.lock()
+	defer d.unlock()
+	return d.set_host_ip(ip)
+}
+
+func (d *Device) set_host_ip(ip netip.Addr) error {
+	d.info("set_host_ip", slog.String("ip", ip.String()))
+	err := d.set_iovar_n("arp_hostip_clear", whd.IF_STA, nil)
+	if err != nil {
+		return err
+	}
+	if !ip.IsValid() {
+		return d.set_iovar("arpoe", whd.IF_STA, 0)
+	} else if !ip.Is4() {
+		return errors.New("ARP offload requires IPv4 address")
+	}
+	err = d.set_iovar("arp_ol", whd.IF_STA, whd.ARP_OL_AGENT|whd.ARP_OL_SNOOP|whd.ARP_OL_HOST_AUTO_REPLY)
+	if err != nil {
+		return err
+	}
+	err = d.set_iovar("arpoe", whd.IF_STA, 1)
+	if err != nil {
+		return err
+	}
+	addr := ip.As4()
+	return d.set_iovar_n("arp_hostip", whd.IF_STA, addr[:])
+}
+
+// SetBroadcastRX controls whether broadcast and multicast frames are passed
+// up to the host. Broadcast reception is enabled during Init since discovery
+// protocols (DHCP, mDNS, SSDP) depend on it; disabling it reduces host wakeups
+// on busy networks.
+func (d *Device) SetBroadcastRX(enable bool) error {
+	d.lock()
+	defer d.unlock()
+	return d.set_broadcast_rx(enable)
+}
+
+func (d *Device) set_broadcast_rx(enable bool) error {
+	d.debug("set_broadcast_rx", slog.Bool("enable", enable))
+	return d.set_iovar("allmulti", whd.IF_STA, b2u32(enable))
+}
+
+// SetKeepAlive has the firmware send a null data frame to the AP every period
+// while joined, so the association is kept while the host is idle, as with
+// JoinOptions.KeepAlivePeriod. A zero period disables the keep-alive.
+func (d *Device) SetKeepAlive(period time.Duration) error {
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return errDeviceNotInit
+	}
+	return d.set_keepalive(period)
+}
+
+// set_keepalive has the firmware send a null data frame every period.
+func (d *Device) set_keepalive(period time.Duration) error {
+	var buf [whd.WL_MKEEP_ALIVE_FIXED_LEN]byte
+	_busOrder.PutUint16(buf[0:], whd.WL_MKEEP_ALIVE_VERSION)
+	_busOrder.PutUint16(buf[2:], whd.WL_MKEEP_ALIVE_FIXED_LEN)
+	_busOrder.PutUint32(buf[4:], uint32(period.Milliseconds()))
+	// len_bytes=0 sends a null data frame, keep_alive_id=0.
+	return d.set_iovar_n("mkeep_alive", whd.IF_STA, buf[:])
+}
+
+// TSF returns the 802.11 timing synchronization function timer in
+// microseconds. While joined to a network the TSF is synchronized to the AP's
+// beacons, so stations joined to the same AP share a common microsecond clock
+// that may be used to coordinate them, i.e: for synchronized sampling.
+// Note the value is read over the bus so it lags the actual TSF by the bus latency.
+func (d *Device) TSF() (uint64, error) {
+	d.lock()
+	defer d.unlock()
+	var buf [8]byte
+	_, err := d.get_iovar_n("tsf", whd.IF_STA, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	// Firmware returns low word followed by high word.
+	return uint64(_busOrder.Uint32(buf[:])) | uint64(_busOrder.Uint32(buf[4:]))<<32, nil
+}
+
+// Disassociate leaves the network the station is joined to, i.e: before
+// entering deep sleep or switching networks. The link is reported down after
+// the call and the firmware does not attempt to reconnect.
+func (d *Device) Disassociate() error {
+	d.lock()
+	defer d.unlock()
+	return d.disassociate()
+}
+
+func (d *Device) disassociate() error {
+	d.info("disassociate")
+	// Stop tracking link events so the disassociation is not taken as a
+	// temporary link loss awaiting reconnection.
+	d.eventmask.Disable(whd.EvLINK)
+	d.eventmask.Disable(whd.EvJOIN)
+	err := d.set_ioctl(whd.WLC_DISASSOC, whd.IF_STA, 0)
+	d.state = linkStateDown
+	return err
+}
+
+// JoinWPA2 joins the network ssid with WPA2-PSK passphrase pass, or an open
+// network if pass is empty. SSIDs are arbitrary octet strings, see SSIDFromBytes. The passphrase string may not be zeroed, see
+// JoinWPA2Secret for handling credentials under stricter requirements.
+// Once joined only the PMK derived from pass is kept, for SaveState.
 func (d *Device) JoinWPA2(ssid, pass string) error {
 	d.lock()
 	defer d.unlock()
+	return d.join(ssid, pass, &JoinOptions{})
+}
+
+// JoinAuto scans for the network ssid and joins its strongest AP with the
+// security advertised in the AP's beacon: open, WPA, WPA2 or WPA3 SAE, see
+// whd.Capabilities.Auth. If pass is empty only open APs are considered and
+// secured APs otherwise, so an open AP impersonating a secured network is
+// never joined with the credentials. If the network was seen by a scan in the
+// last 30 seconds only its channels are scanned, see LastScanResults.
+// WPA3 only networks are not persisted by SaveState as SAE keys can not be
+// derived ahead of time.
+func (d *Device) JoinAuto(ssid, pass string) error {
+	d.lock()
+	defer d.unlock()
+	if ssid == "" {
+		return errSSIDEmpty
+	} else if d.joining {
+		return errJoinBusy
+	}
+	var (
+		target   joinTarget
+		auth     uint32
+		found    bool
+		secFound bool
+		bestRSSI = int16(-1 << 15)
+	)
+	// Scan only the channels the network was recently seen on, if any,
+	// falling back to all channels if it is not found there.
+	var chbuf [maxScanChannels]uint8
+	cfg := ScanConfig{SSID: ssid, Channels: d.scancache_channels(chbuf[:0], ssid)}
+	scanFn := func(bss *whd.BSSInfo) {
+		if string(bss.SSIDBytes()) != ssid || d.blacklisted(bss.BSSID) || bss.RSSI <= bestRSSI {
+			return
+		}
+		caps, err := bss.Capabilities()
+		if err != nil {
+			return
+		}
+		a, ok := caps.Auth()
+		if !ok || (a == whd.CYW43_AUTH_OPEN) != (pass == "") {
+			secFound = true
+			return
+		}
+		bestRSSI, auth, found = bss.RSSI, a, true
+		target = joinTarget{bssid: bss.BSSID, channel: bss.Channel()}
+	}
+	err := d.scan(cfg, scanFn)
+	if err == nil && !found && len(cfg.Channels) > 0 {
+		cfg.Channels = nil
+		err = d.scan(cfg, scanFn)
+	}
+	if err != nil {
+		return err
+	} else if !found && secFound {
+		return errJoinSecurity
+	} else if !found {
+		return errJoinNotFound
+	}
+	d.info("JoinAuto", ssidAttr(ssid), slog.Uint64("auth", uint64(auth)), slog.Int("rssi", int(bestRSSI)),
+		slog.String("bssid", net.HardwareAddr(target.bssid[:]).String()))
+	if auth == whd.CYW43_AUTH_OPEN {
+		err = d.join_open(ssid, &target)
+	} else {
+		err = d.join_psk(ssid, pass, nil, auth, &target)
+	}
+	if err != nil {
+		return err
+	}
+	d.creds = joinCreds{}
+	if auth != whd.CYW43_AUTH_WPA3_SAE_AES_PSK {
+		d.creds = pskCreds(ssid, pass, false)
+	}
+	return nil
+}
+
+// join joins a WPA2-PSK or open network retrying as configured in opts.
+func (d *Device) join(ssid, pass string, opts *JoinOptions) (err error) {
+	if d.joining {
+		return errJoinBusy
+	}
+	start := d.now()
+	d.joinPol = joinPolicy{assoc: opts.AssocTimeout, handshake: opts.HandshakeTimeout, hidden: opts.Hidden,
+		yield: opts.YieldLock}
+	if opts.Deadline > 0 {
+		d.joinPol.deadline = start.Add(opts.Deadline)
+	}
+	d.joining = opts.YieldLock
+	defer func() { d.joinPol, d.joining = joinPolicy{}, false }()
+	var authFails, scanFails uint8
+	for {
+		if ssid != "" && pass == "" {
+			err = d.join_open(ssid, nil)
+		} else {
+			err = d.join_wpa2(ssid, pass, nil, nil)
+		}
+		if err == nil {
+			d.creds = pskCreds(ssid, pass, opts.Hidden)
+			return nil
+		}
+		if errors.Is(err, errJoinAuth) {
+			authFails++
+			if authFails > opts.AuthRetries {
+				return err
+			}
+		} else if errors.Is(err, errJoinSetSSID) || errors.Is(err, errJoinWaitSSID) || errors.Is(err, errJoinGeneric) {
+			scanFails++
+			if scanFails > opts.ScanRetries {
+				return err
+			}
+		} else {
+			return err // Bus or ioctl error, not worth retrying.
+		}
+		if !d.joinPol.deadline.IsZero() && d.since(d.joinPol.deadline) > -joinRetryDelay {
+			return err
+		}
+		d.info("join:retry", slog.String("err", err.Error()))
+		d.set_ioctl(whd.WLC_DISASSOC, whd.IF_STA, 0) // Stop the firmware's attempt.
+		if err := d.join_sleep(joinRetryDelay); err != nil {
+			return err
+		}
+	}
+}
+
+// join_wpa2 joins a WPA2-PSK network with passphrase pass, or with the
+// pairwise master key pmk if not nil, saving the firmware from deriving it.
+func (d *Device) join_wpa2(ssid, pass string, pmk *[32]byte, target *joinTarget) error {
+	return d.join_psk(ssid, pass, pmk, whd.CYW43_AUTH_WPA2_AES_PSK, target)
+}
 
-	if ssid != "" && pass == "" {
-		return d.join_open(ssid)
+// join_psk joins a network secured with auth, one of the WPA, WPA2 or WPA3
+// CYW43_AUTH_* values. pmk is only used by WPA and WPA2, SAE derives its
+// keys from the passphrase during authentication.
+//
+//	reference: cyw43_ll_wifi_join
+func (d *Device) join_psk(ssid, pass string, pmk *[32]byte, auth uint32, target *joinTarget) error {
+	d.info("joinPSK", ssidAttr(ssid), slog.Int("len(pass)", len(pass)), slog.Bool("pmk", pmk != nil),
+		slog.Uint64("auth", uint64(auth)))
+	var wpaAuth, mfp uint32
+	switch auth {
+	case whd.CYW43_AUTH_WPA_TKIP_PSK:
+		wpaAuth = whd.CYW43_WPA_AUTH_PSK
+	case whd.CYW43_AUTH_WPA2_AES_PSK, whd.CYW43_AUTH_WPA2_MIXED_PSK:
+		wpaAuth = whd.CYW43_WPA2_AUTH_PSK
+	case whd.CYW43_AUTH_WPA3_SAE_AES_PSK:
+		wpaAuth, mfp = whd.CYW43_WPA3_AUTH_SAE_PSK, whd.CYW43_MFP_REQUIRED
+	case whd.CYW43_AUTH_WPA3_WPA2_AES_PSK:
+		wpaAuth, mfp = whd.CYW43_WPA3_AUTH_SAE_PSK|whd.CYW43_WPA2_AUTH_PSK, whd.CYW43_MFP_CAPABLE
+	default:
+		return errJoinSecurity
 	}
-	d.info("joinWpa2", slog.String("ssid", ssid), slog.Int("len(pass)", len(pass)))
+	sae := wpaAuth&whd.CYW43_WPA3_AUTH_SAE_PSK != 0
 
-	if err := d.set_iovar("ampdu_ba_wsize", whd.IF_STA, 8); err != nil {
+	if err := d.set_iovar("ampdu_ba_wsize", whd.IF_STA, d.ampduWsize); err != nil {
 		return err
 	}
 
-	// wsec = wpa2
-	if err := d.set_ioctl(whd.WLC_SET_WSEC, whd.IF_STA, 4); err != nil {
+	// wsec is encoded in the low byte of auth.
+	if err := d.set_ioctl(whd.WLC_SET_WSEC, whd.IF_STA, auth&0xff); err != nil {
 		return err
 	}
 	if err := d.set_iovar2("bsscfg:sup_wpa", whd.IF_STA, 0, 1); err != nil {
@@ -308,101 +841,310 @@ func (d *Device) JoinWPA2(ssid, pass string) error {
 	if err := d.set_iovar2("bsscfg:sup_wpa2_eapver", whd.IF_STA, 0, 0xffff_ffff); err != nil {
 		return err
 	}
-	if err := d.set_iovar2("bsscfg:sup_wpa_tmo", whd.IF_STA, 0, 2500); err != nil {
+	tmo := d.join_policy().handshake
+	if err := d.set_iovar2("bsscfg:sup_wpa_tmo", whd.IF_STA, 0, uint32(tmo.Milliseconds())); err != nil {
 		return err
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	d.sleep(100 * time.Millisecond)
 
-	if err := d.setPassphrase(pass); err != nil {
-		return err
+	if pmk != nil && !sae {
+		if err := d.setPMK(pmk, whd.IF_STA); err != nil {
+			return err
+		}
+	} else if auth != whd.CYW43_AUTH_WPA3_SAE_AES_PSK {
+		if err := d.setPassphrase(pass, whd.IF_STA); err != nil {
+			return err
+		}
+	}
+	if sae {
+		if err := d.setSAEPassword(pass, whd.IF_STA); err != nil {
+			return err
+		}
 	}
 
 	// set_infra = 1
 	if err := d.set_ioctl(whd.WLC_SET_INFRA, whd.IF_STA, 1); err != nil {
 		return err
 	}
-	// set_auth = 0 (open)
-	if err := d.set_ioctl(whd.WLC_SET_AUTH, whd.IF_STA, 0); err != nil {
+	// set_auth = 0 (open), or SAE for WPA3 only networks.
+	authAlg := uint32(0)
+	if auth == whd.CYW43_AUTH_WPA3_SAE_AES_PSK {
+		authAlg = whd.CYW43_AUTH_SAE
+	}
+	if err := d.set_ioctl(whd.WLC_SET_AUTH, whd.IF_STA, authAlg); err != nil {
 		return err
 	}
+	if sae {
+		if err := d.set_iovar("mfp", whd.IF_STA, mfp); err != nil {
+			return err
+		}
+	}
 	// set_wpa_auth
-	if err := d.set_ioctl(whd.WLC_SET_WPA_AUTH, whd.IF_STA, 0x80); err != nil {
+	if err := d.set_ioctl(whd.WLC_SET_WPA_AUTH, whd.IF_STA, wpaAuth); err != nil {
 		return err
 	}
 
-	return d.wait_for_join(ssid)
+	return d.wait_for_join(ssid, target)
+}
+
+// setSAEPassword sets the WPA3 SAE password, which unlike the WPA2
+// passphrase may be up to 128 bytes long.
+func (d *Device) setSAEPassword(pass string, iface whd.IoctlInterface) error {
+	if len(pass) > 128 {
+		return errors.New("SAE password too long")
+	}
+	var buf [2 + 128]byte
+	_busOrder.PutUint16(buf[:2], uint16(len(pass)))
+	copy(buf[2:], pass)
+	return d.set_secret_iovar("sae_password", iface, buf[:])
+}
+
+// APConfig configures the SoftAP started by StartAPWithConfig.
+type APConfig struct {
+	// SSID of the AP, 1 to 32 bytes of any value, see SSIDFromBytes.
+	SSID string
+	// Passphrase for WPA2 security. If empty the AP is open.
+	Passphrase string
+	// Channel of the AP, see SupportedChannels. A channel the chip does not
+	// support returns a *ChannelError.
+	Channel uint8
+	// Hidden stops the SSID from being broadcast in beacons (closed network).
+	// Stations must know the SSID beforehand to join.
+	Hidden bool
+	// MaxClients limits the number of associated stations. Zero keeps the firmware default.
+	MaxClients uint8
+	// BeaconInterval is the beacon period in time units (1TU=1024µs).
+	// Zero keeps the firmware default of 100TU. Longer periods reduce airtime usage
+	// at the cost of slower discovery by stations.
+	BeaconInterval uint16
+	// Concurrent runs the AP on its own interface (bsscfg index 1) alongside the
+	// station interface so the device can stay joined to an upstream network
+	// while serving clients. Frames for the AP are sent with SendEthIface(whd.IF_AP, pkt).
+	// Once the station is associated the radio operates on the upstream AP's
+	// channel, which overrides Channel.
+	Concurrent bool
 }
 
+// StartAP starts an access point with the given SSID, passphrase and channel.
+// If pass is empty the AP is open.
 func (d *Device) StartAP(ssid, pass string, channel uint8) error {
+	return d.StartAPWithConfig(APConfig{
+		SSID:       ssid,
+		Passphrase: pass,
+		Channel:    channel,
+	})
+}
+
+// StartAPWithConfig starts an access point configured by cfg.
+func (d *Device) StartAPWithConfig(cfg APConfig) error {
 	d.lock()
 	defer d.unlock()
+	if d.joining {
+		return errJoinBusy
+	}
+
+	if cfg.SSID == "" {
+		return errSSIDEmpty
+	} else if len(cfg.SSID) > 32 {
+		return errSSIDTooLong
+	}
+	security, err := apSecurity(cfg.Passphrase)
+	if err != nil {
+		return err
+	}
+	if cfg.Channel != 0 || !cfg.Concurrent {
+		if err := d.check_channel(cfg.Channel); err != nil {
+			return err
+		}
+	}
+	if cfg.BeaconInterval != 0 && (cfg.BeaconInterval < 20 || cfg.BeaconInterval > 1000) {
+		return errors.New("beacon interval out of range [20,1000]")
+	}
+	// AP-only mode runs the AP on the primary bsscfg. In concurrent mode
+	// the station keeps bsscfg 0 and the AP gets its own.
+	iface := whd.IF_STA
+	if cfg.Concurrent {
+		iface = whd.IF_AP
+	}
+	bsscfg := uint32(iface)
 
-	security := whd.CYW43_AUTH_OPEN
-	if pass != "" {
-		if len(pass) < whd.CYW43_MIN_PSK_LEN || len(pass) > whd.CYW43_MAX_PSK_LEN {
-			return errors.New("Passphrase is too short or too long")
+	// Changing apsta requires a down/up cycle which would drop the station's
+	// association, so skip it if the firmware is already in the desired mode.
+	if d.apsta != cfg.Concurrent {
+		// Temporarily set wifi down
+		if err := d.doIoctlSet(whd.WLC_DOWN, whd.IF_STA, nil); err != nil {
+			return err
+		}
+		if err := d.set_iovar("apsta", whd.IF_STA, b2u32(cfg.Concurrent)); err != nil {
+			return err
+		}
+		d.apsta = cfg.Concurrent
+		// Set wifi up again
+		if err := d.doIoctlSet(whd.WLC_UP, whd.IF_STA, nil); err != nil {
+			return err
 		}
-		security = whd.CYW43_AUTH_WPA2_AES_PSK
 	}
 
-	// Temporarily set wifi down
-	if err := d.doIoctlSet(whd.WLC_DOWN, whd.IF_STA, nil); err != nil {
-		return err
+	if !cfg.Concurrent {
+		// Turn on AP mode
+		if err := d.set_ioctl(whd.WLC_SET_AP, whd.IF_STA, 1); err != nil {
+			return err
+		}
 	}
 
-	// Turn off APSTA mode
-	if err := d.set_iovar("apsta", whd.IF_STA, 0); err != nil {
+	// Set SSID. In concurrent mode this also creates the AP's bsscfg.
+	if err := d.setSSIDWithIndex(cfg.SSID, bsscfg); err != nil {
 		return err
 	}
+	if cfg.BeaconInterval != 0 {
+		// The AP's BSS is not up yet so the beacon period may still be changed.
+		if err := d.set_ioctl(whd.WLC_SET_BCNPRD, iface, uint32(cfg.BeaconInterval)); err != nil {
+			return err
+		}
+	}
 
-	// Set wifi up again
-	if err := d.doIoctlSet(whd.WLC_UP, whd.IF_STA, nil); err != nil {
+	// Hide SSID from beacons.
+	if err := d.set_iovar2("bsscfg:closednet", whd.IF_STA, bsscfg, b2u32(cfg.Hidden)); err != nil {
 		return err
 	}
 
-	// Turn on AP mode
-	if err := d.set_ioctl(whd.WLC_SET_AP, whd.IF_STA, 1); err != nil {
+	if cfg.MaxClients != 0 && cfg.Concurrent {
+		// maxassoc limits the stations of all BSSs, station's AP included.
+		if err := d.set_iovar2("bsscfg:bss_maxassoc", whd.IF_STA, bsscfg, uint32(cfg.MaxClients)); err != nil {
+			return err
+		}
+	} else if cfg.MaxClients != 0 {
+		if err := d.set_iovar("maxassoc", whd.IF_STA, uint32(cfg.MaxClients)); err != nil {
+			return err
+		}
+	}
+
+	// Set channel number. Without one a concurrent AP follows the station's
+	// channel, which setting it would disturb.
+	if cfg.Channel != 0 {
+		if err := d.set_ioctl(whd.WLC_SET_CHANNEL, iface, uint32(cfg.Channel)); err != nil {
+			return err
+		}
+	}
+
+	if err := d.ap_security(iface, security, cfg.Passphrase); err != nil {
 		return err
 	}
 
-	// Set SSID
-	if err := d.setSSIDWithIndex(ssid, 0); err != nil {
+	// Change mutlicast rate from 1 Mbps to 11 Mbps
+	if err := d.set_iovar("2g_mrate", iface, 11000000/500000); err != nil {
 		return err
 	}
 
-	// Set channel number
-	if err := d.set_ioctl(whd.WLC_SET_CHANNEL, whd.IF_STA, uint32(channel)); err != nil {
+	// Start AP (bss = BSS_UP)
+	if err := d.set_iovar2("bss", whd.IF_STA, bsscfg, 1); err != nil {
 		return err
 	}
+	d.apIface = iface
+	d.apUp = true
+	if d.rxFilter != RxFilterOff {
+		return d.rxfilter_update()
+	}
+	return nil
+}
 
-	// Set security
-	if err := d.set_iovar2("bsscfg:wsec", whd.IF_STA, 0, uint32(security)&0xff); err != nil {
+// APCredentials are the SSID and passphrase of a SoftAP, see UpdateAP.
+type APCredentials struct {
+	SSID string
+	// Passphrase for WPA2 security. If empty the AP is open.
+	Passphrase string
+}
+
+// UpdateAP changes the SSID and passphrase of the running SoftAP from prev,
+// its current credentials, to next, i.e: to rotate temporary credentials per
+// provisioning session. Only the AP's BSS is restarted, which is much quicker
+// than StartAPWithConfig: the radio mode, channel and other AP settings are
+// kept, as is the association of the station interface of a concurrent AP.
+// Stations associated to the AP are disconnected and must join again with
+// the new credentials. If next fails to be set prev is restored and the AP
+// brought back up. The driver keeps no copy of either passphrase.
+func (d *Device) UpdateAP(next, prev APCredentials) error {
+	d.lock()
+	defer d.unlock()
+	if !d.apUp {
+		return errAPNotUp
+	}
+	security, err := apCredentialsSecurity(next)
+	if err != nil {
+		return err
+	}
+	prevSecurity, err := apCredentialsSecurity(prev)
+	if err != nil {
 		return err
 	}
+	d.info("UpdateAP", ssidAttr(next.SSID), slog.Bool("open", security == whd.CYW43_AUTH_OPEN))
+	bsscfg := uint32(d.apIface)
+	if err := d.set_iovar2("bss", whd.IF_STA, bsscfg, 0); err != nil {
+		return err
+	}
+	d.apUp = false // Down until the BSS is brought up again.
+	err = d.ap_credentials(next.SSID, next.Passphrase, security)
+	if err != nil {
+		// Restore the previous credentials so the AP is not left down.
+		d.warn("UpdateAP:restore", slog.String("err", err.Error()))
+		err = errjoin(err, d.ap_credentials(prev.SSID, prev.Passphrase, prevSecurity))
+	}
+	if uperr := d.set_iovar2("bss", whd.IF_STA, bsscfg, 1); uperr != nil {
+		return errjoin(err, uperr)
+	}
+	d.apUp = true
+	return err
+}
 
-	if security != whd.CYW43_AUTH_OPEN {
-		// wpa_auth = WPA2_AUTH_PSK | WPA_AUTH_PSK
-		if err := d.set_iovar2("bsscfg:wpa_auth", whd.IF_STA, 0,
-			whd.CYW43_WPA_AUTH_PSK|whd.CYW43_WPA2_AUTH_PSK); err != nil {
-			return err
-		}
-		time.Sleep(100 * time.Millisecond)
-		// Set passphrase
-		if err := d.setPassphrase(pass); err != nil {
+// apCredentialsSecurity validates c and returns the CYW43_AUTH_* security of an AP using it.
+func apCredentialsSecurity(c APCredentials) (uint32, error) {
+	if c.SSID == "" {
+		return 0, errSSIDEmpty
+	} else if len(c.SSID) > 32 {
+		return 0, errSSIDTooLong
+	}
+	return apSecurity(c.Passphrase)
+}
+
+// ap_credentials sets the SSID and security of the AP while its BSS is down.
+func (d *Device) ap_credentials(ssid, pass string, security uint32) error {
+	bsscfg := uint32(d.apIface)
+	if err := d.setSSIDWithIndex(ssid, bsscfg); err != nil {
+		return err
+	}
+	if security == whd.CYW43_AUTH_OPEN {
+		if err := d.set_iovar2("bsscfg:wpa_auth", whd.IF_STA, bsscfg, 0); err != nil {
 			return err
 		}
 	}
+	return d.ap_security(d.apIface, security, pass)
+}
 
-	// Change mutlicast rate from 1 Mbps to 11 Mbps
-	if err := d.set_iovar("2g_mrate", whd.IF_STA, 11000000/500000); err != nil {
-		return err
+// apSecurity returns the CYW43_AUTH_* security of an AP with passphrase pass.
+func apSecurity(pass string) (uint32, error) {
+	if pass == "" {
+		return whd.CYW43_AUTH_OPEN, nil
+	} else if len(pass) < whd.CYW43_MIN_PSK_LEN || len(pass) > whd.CYW43_MAX_PSK_LEN {
+		return 0, errAPPassphraseLen
 	}
+	return whd.CYW43_AUTH_WPA2_AES_PSK, nil
+}
 
-	// Start AP (bss = BSS_UP)
-	if err := d.set_iovar2("bss", whd.IF_STA, 0, 1); err != nil {
+// ap_security sets the security of the AP on iface.
+func (d *Device) ap_security(iface whd.IoctlInterface, security uint32, pass string) error {
+	bsscfg := uint32(iface)
+	if err := d.set_iovar2("bsscfg:wsec", whd.IF_STA, bsscfg, security&0xff); err != nil {
 		return err
 	}
-
-	return nil
+	if security == whd.CYW43_AUTH_OPEN {
+		return nil
+	}
+	// wpa_auth = WPA2_AUTH_PSK | WPA_AUTH_PSK
+	if err := d.set_iovar2("bsscfg:wpa_auth", whd.IF_STA, bsscfg,
+		whd.CYW43_WPA_AUTH_PSK|whd.CYW43_WPA2_AUTH_PSK); err != nil {
+		return err
+	}
+	d.sleep(100 * time.Millisecond)
+	return d.setPassphrase(pass, iface)
 }
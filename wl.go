@@ -0,0 +1,105 @@
+package cyw43439
+
+import (
+	"errors"
+
+	"github.com/soypat/cyw43439/internal/slog"
+	"github.com/soypat/cyw43439/whd"
+)
+
+var (
+	errWLNoSet = errors.New("wl command can not be set")
+	errWLName  = errors.New("wl command name empty or too long")
+)
+
+const (
+	// wlIovarRespLen is the response length of iovar reads issued by WLCommand.
+	wlIovarRespLen = 512
+	// wlMaxAssoc bounds the stations listed by "assoclist".
+	wlMaxAssoc = 16
+)
+
+// wlIoctl maps a wl utility command to its IOCTLs. Commands without get take
+// no arguments, commands without set can only be read.
+type wlIoctl struct {
+	name    string
+	get     whd.SDPCMCommand
+	set     whd.SDPCMCommand
+	respLen uint8
+}
+
+// wlIoctls are the wl commands implemented with an IOCTL instead of an iovar
+// of the same name.
+var wlIoctls = [...]wlIoctl{
+	{name: "up", set: whd.WLC_UP},
+	{name: "down", set: whd.WLC_DOWN},
+	{name: "disassoc", set: whd.WLC_DISASSOC},
+	{name: "rate", get: whd.WLC_GET_RATE, respLen: 4},
+	{name: "infra", get: whd.WLC_GET_INFRA, set: whd.WLC_SET_INFRA, respLen: 4},
+	{name: "auth", get: whd.WLC_GET_AUTH, set: whd.WLC_SET_AUTH, respLen: 4},
+	{name: "bssid", get: whd.WLC_GET_BSSID, respLen: 6},
+	{name: "ssid", get: whd.WLC_GET_SSID, set: whd.WLC_SET_SSID, respLen: 36},
+	{name: "channel", get: whd.WLC_GET_CHANNEL, set: whd.WLC_SET_CHANNEL, respLen: 12},
+	{name: "antdiv", get: whd.WLC_GET_ANTDIV, set: whd.WLC_SET_ANTDIV, respLen: 4},
+	{name: "bi", get: whd.WLC_GET_BCNPRD, set: whd.WLC_SET_BCNPRD, respLen: 4},
+	{name: "dtim", get: whd.WLC_GET_DTIMPRD, set: whd.WLC_SET_DTIMPRD, respLen: 4},
+	{name: "PM", get: whd.WLC_GET_PM, set: whd.WLC_SET_PM, respLen: 4},
+	{name: "revinfo", get: whd.WLC_GET_REVINFO, respLen: 68},
+	{name: "gmode", get: whd.WLC_GET_GMODE, set: whd.WLC_SET_GMODE, respLen: 4},
+	{name: "ap", get: whd.WLC_GET_AP, set: whd.WLC_SET_AP, respLen: 4},
+	{name: "rssi", get: whd.WLC_GET_RSSI, respLen: 4},
+	{name: "wsec", get: whd.WLC_GET_WSEC, set: whd.WLC_SET_WSEC, respLen: 4},
+	{name: "noise", get: whd.WLC_GET_PHY_NOISE, respLen: 4},
+	{name: "band", get: whd.WLC_GET_BAND, set: whd.WLC_SET_BAND, respLen: 4},
+	{name: "assoclist", get: whd.WLC_GET_ASSOCLIST, respLen: 4 + 6*wlMaxAssoc},
+	{name: "wpa_auth", get: whd.WLC_GET_WPA_AUTH, set: whd.WLC_SET_WPA_AUTH, respLen: 4},
+}
+
+// WLCommand runs a command of Broadcom's wl utility on the station
+// interface, so the wl knowledge found in forums and vendor documentation
+// applies to this driver. As with wl, cmd is read when args is nil and set
+// to args otherwise. args are the command's binary arguments in little
+// endian, i.e: a 4 byte integer for most commands, not wl's textual ones.
+//
+// Commands wl implements with an IOCTL, such as "ssid", "channel", "PM",
+// "up" or "rssi", are mapped to it. Any other command is taken as an iovar of
+// the same name, i.e: "cur_etheraddr", "counters" or "bsscfg:wsec". Iovar
+// reads return 512 bytes as the firmware does not report the value's length;
+// iovars which take parameters when read must be read with StartIoctl.
+// Setting commands the driver manages, such as "PM" or "mpc", may leave the
+// driver's state out of sync with the firmware's.
+func (d *Device) WLCommand(cmd string, args []byte) ([]byte, error) {
+	if cmd == "" || len(cmd) > 64 {
+		return nil, errWLName
+	}
+	d.lock()
+	defer d.unlock()
+	if !d.initialized {
+		return nil, errDeviceNotInit
+	}
+	d.debug("WLCommand", slog.String("cmd", cmd), slog.Int("len(args)", len(args)))
+	for i := range wlIoctls {
+		wl := &wlIoctls[i]
+		if wl.name != cmd {
+			continue
+		}
+		if args != nil {
+			if wl.set == 0 {
+				return nil, errWLNoSet
+			}
+			return nil, d.doIoctlSet(wl.set, whd.IF_STA, args)
+		} else if wl.get == 0 {
+			// Commands like "up" take no arguments.
+			return nil, d.doIoctlSet(wl.set, whd.IF_STA, nil)
+		}
+		resp := make([]byte, wl.respLen)
+		n, err := d.doIoctlGet(wl.get, whd.IF_STA, resp)
+		return resp[:n], err
+	}
+	if args != nil {
+		return nil, d.set_iovar_n(cmd, whd.IF_STA, args)
+	}
+	resp := make([]byte, wlIovarRespLen)
+	n, err := d.get_iovar_n(cmd, whd.IF_STA, resp)
+	return resp[:n], err
+}
@@ -0,0 +1,112 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/soypat/cyw43439/whd"
+)
+
+var errInvalidAC = errors.New("invalid WMM access category")
+
+// AccessCategory is a WMM (802.11e) access category. Frames of higher
+// categories wait less for the medium, getting preferential airtime over
+// other traffic on the network, including other stations'.
+type AccessCategory uint8
+
+const (
+	ACBestEffort AccessCategory = iota // Default category of untagged traffic.
+	ACBackground                       // Bulk transfers which yield to other traffic.
+	ACVideo
+	ACVoice // Lowest latency, for audio and control loops.
+	numAccessCategories
+)
+
+// acPriority maps access categories to the 802.1D priority sent to the firmware.
+var acPriority = [numAccessCategories]uint8{
+	ACBestEffort: 0,
+	ACBackground: 1,
+	ACVideo:      5,
+	ACVoice:      6,
+}
+
+func (ac AccessCategory) String() string {
+	switch ac {
+	case ACBestEffort:
+		return "best-effort"
+	case ACBackground:
+		return "background"
+	case ACVideo:
+		return "video"
+	case ACVoice:
+		return "voice"
+	}
+	return "AccessCategory(" + hex32(uint32(ac)) + ")"
+}
+
+// SendEthAC sends an Ethernet packet over iface like SendEthIface, tagged with
+// access category ac. Frames sent with SendEth and SendEthIface are best effort
+// unless DSCP classification is enabled, see SetDSCPClassification.
+// The AP must have WMM enabled for categories to take effect.
+func (d *Device) SendEthAC(iface whd.IoctlInterface, ac AccessCategory, pkt []byte) error {
+	if iface != whd.IF_STA && iface != whd.IF_AP {
+		return errInvalidIoctlIface
+	} else if ac >= numAccessCategories {
+		return errInvalidAC
+	}
+	d.lock()
+	defer d.unlock()
+	return d.send(iface, acPriority[ac], pkt)
+}
+
+// dscpPriority maps DSCP code points to 802.1D priorities as recommended
+// by RFC 8325 section 4. Code points not listed map to best effort.
+var dscpPriority = [64]uint8{
+	1:  1, // LE, lower effort (RFC 8622).
+	8:  1, // CS1, low-priority data.
+	18: 3, // AF21-AF23, low-latency data.
+	20: 3,
+	22: 3,
+	24: 4, // CS3, broadcast video.
+	26: 4, // AF31-AF33, multimedia streaming.
+	28: 4,
+	30: 4,
+	32: 4, // CS4, real-time interactive.
+	34: 4, // AF41-AF43, multimedia conferencing.
+	36: 4,
+	38: 4,
+	40: 5, // CS5, signaling.
+	44: 6, // VOICE-ADMIT.
+	46: 6, // EF, telephony.
+	48: 7, // CS6, network control.
+	56: 7, // CS7.
+}
+
+// SetDSCPClassification enables or disables tagging frames sent with SendEth
+// and SendEthIface with an access category derived from the DSCP field of
+// IPv4 and IPv6 packets, mapped to 802.1D priority as recommended by RFC 8325.
+// This lets network stacks which mark their sockets' traffic, i.e: expedited
+// forwarding (DSCP 46) for voice, get preferential airtime without driver
+// specific calls. Disabled by default.
+func (d *Device) SetDSCPClassification(enable bool) {
+	d.lock()
+	defer d.unlock()
+	d.dscpClassify = enable
+}
+
+// tx_priority returns the 802.1D priority of frames sent without an explicit access category.
+func (d *Device) tx_priority(pkt []byte) uint8 {
+	if !d.dscpClassify || len(pkt) < ethHeaderLen+2 {
+		return 0
+	}
+	var tos uint8
+	switch binary.BigEndian.Uint16(pkt[12:14]) {
+	case EtherTypeIPv4:
+		tos = pkt[ethHeaderLen+1]
+	case EtherTypeIPv6:
+		tos = uint8(binary.BigEndian.Uint16(pkt[ethHeaderLen:]) >> 4)
+	default:
+		return 0
+	}
+	return dscpPriority[tos>>2] // DSCP, the top 6 bits of the traffic class.
+}